@@ -1,12 +1,290 @@
 package main
 
 import (
+	"database/sql"
+	"flag"
 	"github.com/ricardofandrade/password-hasher/ph"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
-	server := ph.NewPasswordHasherServer(log.New(os.Stderr, "", log.LstdFlags))
+	if len(os.Args) > 1 && (os.Args[1] == "dump" || os.Args[1] == "restore") {
+		runAdminCommand(os.Args[1], os.Args[2:])
+		return
+	}
+	callbackAllow := flag.String("callback-allow", "", "comma-separated hosts callbacks may be sent to (enables callbacks)")
+	callbackSecretFile := flag.String("callback-secret-file", "", "file holding the HMAC-SHA256 key used to sign callbacks (required with -callback-allow)")
+	idStrategy := flag.String("id-strategy", string(ph.RandomIds), "how ids are issued: random, uuidv7, snowflake or sequential")
+	idNode := flag.Int64("id-node", 0, "node id (0-1023) for snowflake ids")
+	tokenKeysFile := flag.String("token-keys-file", "", "file of \"<key id> <secret>\" lines signing retrieval tokens (enables tokens)")
+	tokenTTL := flag.Duration("token-ttl", 24*time.Hour, "how long retrieval tokens stay valid")
+	ttl := flag.Duration("ttl", 0, "how long hashes are kept by default (0 keeps them until a ttl is given per hash)")
+	maxTTL := flag.Duration("max-ttl", 0, "upper bound for the ttl given per hash (0 for none)")
+	expiry := flag.Bool("expiry", false, "enable expiry of hashes (implied by -ttl)")
+	expiryRetention := flag.Duration("expiry-retention", 24*time.Hour, "how long expired ids are remembered as such")
+	expiryInterval := flag.Duration("expiry-interval", time.Minute, "how often expired hashes are removed")
+	maxRecords := flag.Int64("max-records", 0, "most hashes the store may hold (0 for no bound)")
+	maxBytes := flag.Int64("max-bytes", 0, "most (estimated) bytes the store may hold (0 for no bound)")
+	capacityPolicy := flag.String("capacity-policy", string(ph.EvictPolicy), "what a full store does: evict or reject")
+	adminTokenFile := flag.String("admin-token-file", "", "file holding the bearer token for administrative requests")
+	tombstoneWindow := flag.Duration("tombstone-window", 24*time.Hour, "how long deleted ids are remembered as such")
+	logDir := flag.String("log-dir", "", "directory logging hashes so they survive a restart (enables durability)")
+	logSync := flag.String("log-sync", string(ph.SyncAlways), "when the log is flushed to disk: always, interval or never")
+	logSyncInterval := flag.Duration("log-sync-interval", time.Second, "how often the log is flushed with -log-sync interval")
+	snapshotInterval := flag.Duration("snapshot-interval", time.Hour, "how often the store is snapshotted to compact the log (0 for only on demand)")
+	masterKeyFile := flag.String("master-key-file", "", "file holding the hex master key wrapping data keys (enables encryption)")
+	dataKeysFile := flag.String("data-keys-file", "data.keys", "file holding the wrapped data keys, created if missing")
+	shutdownMode := flag.String("shutdown-mode", string(ph.ShutdownWait), "what shutdown does with pending hashes: wait, flush, abandon or spool")
+	shutdownDeadline := flag.Duration("shutdown-deadline", time.Second, "how long -shutdown-mode abandon waits for pending hashes")
+	spoolFile := flag.String("spool-file", "pending.spool", "file pending hashes are spooled to by -shutdown-mode spool, reloaded on start")
+	delay := flag.Duration("delay", 5*time.Second, "how long hashes wait before becoming available")
+	tenantDelays := flag.String("tenant-delays", "", "comma-separated \"<tenant>=<delay>\" pairs overriding -delay per X-Tenant header")
+	delayJitter := flag.Duration("delay-jitter", 0, "random delay of up to this much added to every hash")
+	minRequestDelay := flag.Duration("min-request-delay", 0, "shortest delay a hash may ask for with a \"delay\" field")
+	maxRequestDelay := flag.Duration("max-request-delay", 0, "longest delay a hash may ask for with a \"delay\" field (0 to not allow it)")
+	shards := flag.Int("shards", 1, "independently locked partitions of the store, for read-heavy workloads (ignored with -log-dir)")
+	compactStore := flag.Bool("compact-store", false, "keep hashes as raw digests in preallocated arenas, for many stored hashes")
+	replicationJournal := flag.Int("replication-journal", 0, "latest store mutations kept for followers to catch up from (enables replication)")
+	follow := flag.String("follow", "", "base URL of a primary to follow as a read-only replica, such as http://primary:8090")
+	clusterSelf := flag.String("cluster-self", "", "base URL other nodes reach this one at, such as http://node1:8090 (with -cluster-peers)")
+	clusterPeers := flag.String("cluster-peers", "", "file listing the base URLs of every cluster node, reloaded on SIGHUP (enables clustering)")
+	respAddr := flag.String("resp-addr", "", "address of a Redis-compatible server to keep hashes in, such as localhost:6379")
+	respPasswordFile := flag.String("resp-password-file", "", "file holding the password of the -resp-addr server, if any")
+	respPrefix := flag.String("resp-prefix", "ph:", "prefix of the keys kept in the -resp-addr server")
+	sqlDriver := flag.String("sql-driver", "", "database/sql driver to keep hashes with, which must be linked into the build (with -sql-dsn-file)")
+	sqlDSNFile := flag.String("sql-dsn-file", "", "file holding the data source name of the -sql-driver database")
+	sqlTable := flag.String("sql-table", "password_hashes", "table of the -sql-driver database to keep hashes in")
+	sqlNumberedParams := flag.Bool("sql-numbered-params", false, "write statement parameters as $1, $2... for drivers such as PostgreSQL ones")
+	idempotencyWindow := flag.Duration("idempotency-window", 24*time.Hour, "how long Idempotency-Key headers of hash requests are remembered (0 to ignore them)")
+	idempotencyKeys := flag.Int("idempotency-keys", 100000, "most Idempotency-Key headers remembered at once, the oldest being forgotten first")
+	followRetry := flag.Duration("follow-retry", time.Second, "how long a follower waits before reconnecting to its primary")
+	flag.Parse()
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	strategy, err := ph.ParseIdStrategy(*idStrategy)
+	if err != nil {
+		logger.Fatalf("ERROR: %v", err)
+	}
+	if err := ph.ValidateIdNode(*idNode); err != nil {
+		logger.Fatalf("ERROR: %v", err)
+	}
+	options := []ph.ServerOption{ph.WithIdStrategy(strategy, *idNode), ph.WithTombstoneWindow(*tombstoneWindow), ph.WithShards(*shards)}
+	if *compactStore {
+		options = append(options, ph.WithCompactStore())
+	}
+	tenants, err := ph.ParseTenantDelays(*tenantDelays)
+	if err != nil {
+		logger.Fatalf("ERROR: %v", err)
+	}
+	options = append(options, ph.WithDelay(ph.DelayConfig{
+		Delay:           *delay,
+		Tenants:         tenants,
+		Jitter:          *delayJitter,
+		MinRequestDelay: *minRequestDelay,
+		MaxRequestDelay: *maxRequestDelay,
+	}))
+	if *adminTokenFile != "" {
+		token, err := ioutil.ReadFile(*adminTokenFile)
+		if err != nil {
+			logger.Fatalf("ERROR: %v", err)
+		}
+		options = append(options, ph.WithAdminToken(strings.TrimSpace(string(token))))
+	}
+	if *callbackAllow != "" {
+		if *callbackSecretFile == "" {
+			logger.Fatal("ERROR: -callback-allow requires -callback-secret-file")
+		}
+		secret, err := ioutil.ReadFile(*callbackSecretFile)
+		if err != nil {
+			logger.Fatalf("ERROR: %v", err)
+		}
+		config := ph.CallbackConfig{Allowlist: strings.Split(*callbackAllow, ","), Secret: []byte(strings.TrimSpace(string(secret)))}
+		if len(config.Secret) == 0 {
+			logger.Fatalf("ERROR: no callback secret in %s", *callbackSecretFile)
+		}
+		options = append(options, ph.WithCallbacks(config))
+	}
+	if *tokenKeysFile != "" {
+		data, err := ioutil.ReadFile(*tokenKeysFile)
+		if err != nil {
+			logger.Fatalf("ERROR: %v", err)
+		}
+		keys, err := ph.ParseTokenKeys(data)
+		if err != nil {
+			logger.Fatalf("ERROR: %v", err)
+		}
+		options = append(options, ph.WithRetrievalTokens(ph.TokenConfig{Keys: keys, TTL: *tokenTTL}))
+	}
+
+	if *idempotencyWindow > 0 {
+		options = append(options, ph.WithIdempotency(ph.IdempotencyConfig{Window: *idempotencyWindow, MaxKeys: *idempotencyKeys}))
+	}
+
+	if *expiry || *ttl > 0 {
+		options = append(options, ph.WithExpiry(ph.ExpiryConfig{
+			TTL:       *ttl,
+			MaxTTL:    *maxTTL,
+			Retention: *expiryRetention,
+			Interval:  *expiryInterval,
+		}))
+	}
+	if *maxRecords > 0 || *maxBytes > 0 {
+		policy := ph.CapacityPolicy(*capacityPolicy)
+		if policy != ph.EvictPolicy && policy != ph.RejectPolicy {
+			logger.Fatalf("ERROR: unknown capacity policy %q", *capacityPolicy)
+		}
+		options = append(options, ph.WithCapacity(ph.CapacityConfig{MaxRecords: *maxRecords, MaxBytes: *maxBytes, Policy: policy}))
+	}
+
+	if *follow != "" {
+		if *logDir != "" || *replicationJournal > 0 {
+			logger.Fatalf("ERROR: -follow cannot be used with -log-dir or -replication-journal")
+		}
+		if *adminTokenFile == "" {
+			logger.Fatalf("ERROR: -follow needs -admin-token-file, holding the admin token of the primary")
+		}
+		options = append(options, ph.WithFollower(ph.FollowerConfig{Primary: *follow, Retry: *followRetry}))
+	}
+	if *replicationJournal > 0 {
+		options = append(options, ph.WithReplicationJournal(*replicationJournal))
+	}
+	if *respAddr != "" {
+		if *logDir != "" || *follow != "" || *replicationJournal > 0 {
+			logger.Fatalf("ERROR: -resp-addr cannot be used with -log-dir, -follow or -replication-journal")
+		}
+		config := ph.RespConfig{Addr: *respAddr, Prefix: *respPrefix}
+		if *respPasswordFile != "" {
+			password, err := ioutil.ReadFile(*respPasswordFile)
+			if err != nil {
+				logger.Fatalf("ERROR: %v", err)
+			}
+			config.Password = strings.TrimSpace(string(password))
+		}
+		options = append(options, ph.WithRespStore(config))
+	}
+	if *sqlDriver != "" {
+		if *logDir != "" || *follow != "" || *replicationJournal > 0 || *respAddr != "" {
+			logger.Fatalf("ERROR: -sql-driver cannot be used with -log-dir, -follow, -replication-journal or -resp-addr")
+		}
+		dsn, err := ioutil.ReadFile(*sqlDSNFile)
+		if err != nil {
+			logger.Fatalf("ERROR: %v", err)
+		}
+		db, err := sql.Open(*sqlDriver, strings.TrimSpace(string(dsn)))
+		if err != nil {
+			logger.Fatalf("ERROR: %v", err)
+		}
+		hashDB, err := ph.OpenHashDB(db, ph.SQLConfig{Table: *sqlTable, NumberedParams: *sqlNumberedParams})
+		if err != nil {
+			logger.Fatalf("ERROR: %v", err)
+		}
+		options = append(options, ph.WithHashDB(hashDB))
+	}
+	if *logDir != "" {
+		sync := ph.SyncMode(*logSync)
+		if sync != ph.SyncAlways && sync != ph.SyncInterval && sync != ph.SyncNever {
+			logger.Fatalf("ERROR: unknown log sync mode %q", *logSync)
+		}
+		hashLog, err := ph.OpenHashLog(ph.LogConfig{
+			Dir:              *logDir,
+			Sync:             sync,
+			SyncInterval:     *logSyncInterval,
+			SnapshotInterval: *snapshotInterval,
+		})
+		if err != nil {
+			logger.Fatalf("ERROR: %v", err)
+		}
+		options = append(options, ph.WithHashLog(hashLog))
+	}
+	if *masterKeyFile != "" {
+		data, err := ioutil.ReadFile(*masterKeyFile)
+		if err != nil {
+			logger.Fatalf("ERROR: %v", err)
+		}
+		masterKey, err := ph.ParseMasterKey(data)
+		if err != nil {
+			logger.Fatalf("ERROR: %v", err)
+		}
+		keys, err := ph.OpenKeyRing(*dataKeysFile, masterKey)
+		if err != nil {
+			logger.Fatalf("ERROR: %v", err)
+		}
+		options = append(options, ph.WithEncryption(keys))
+	}
+	mode, err := ph.ParseShutdownMode(*shutdownMode)
+	if err != nil {
+		logger.Fatalf("ERROR: %v", err)
+	}
+	options = append(options, ph.WithShutdown(ph.ShutdownConfig{Mode: mode, Deadline: *shutdownDeadline, SpoolFile: *spoolFile}))
+
+	if *clusterPeers != "" {
+		if err := ph.ValidateClusterIds(strategy); err != nil {
+			logger.Fatalf("ERROR: %v", err)
+		}
+		cluster, err := ph.OpenCluster(ph.ClusterConfig{Self: *clusterSelf, PeersFile: *clusterPeers})
+		if err != nil {
+			logger.Fatalf("ERROR: %v", err)
+		}
+		options = append(options, ph.WithCluster(cluster))
+		go reloadPeersOnHangup(logger, cluster)
+	}
+
+	server := ph.NewPasswordHasherServer(logger, options...)
 	server.Run()
 }
+
+// reloadPeersOnHangup reloads the cluster peers whenever the process gets a SIGHUP.
+func reloadPeersOnHangup(logger *log.Logger, cluster *ph.Cluster) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		if err := cluster.Reload(); err != nil {
+			logger.Printf("ERROR: Failed to reload peers: %v", err)
+		} else {
+			logger.Print("Reloaded peers")
+		}
+	}
+}
+
+// runAdminCommand dumps the store of a running service, or restores a dump into it, through its admin endpoints.
+func runAdminCommand(command string, args []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	url := flags.String("url", "http://localhost:8090", "base URL of the service")
+	adminTokenFile := flags.String("admin-token-file", "", "file holding the bearer token for administrative requests")
+	file := flags.String("file", "-", "file the dump is written to or read from (- for stdout or stdin)")
+	_ = flags.Parse(args)
+
+	logger := log.New(os.Stderr, "", 0)
+	token, err := ioutil.ReadFile(*adminTokenFile)
+	if err != nil {
+		logger.Fatalf("ERROR: %v", err)
+	}
+	if command == "dump" {
+		out := os.Stdout
+		if *file != "-" {
+			if out, err = os.Create(*file); err != nil {
+				logger.Fatalf("ERROR: %v", err)
+			}
+			defer out.Close()
+		}
+		err = ph.DumpHashes(*url, strings.TrimSpace(string(token)), out)
+	} else {
+		in := os.Stdin
+		if *file != "-" {
+			if in, err = os.Open(*file); err != nil {
+				logger.Fatalf("ERROR: %v", err)
+			}
+			defer in.Close()
+		}
+		err = ph.RestoreHashes(*url, strings.TrimSpace(string(token)), in, os.Stdout)
+	}
+	if err != nil {
+		logger.Fatalf("ERROR: %v", err)
+	}
+}
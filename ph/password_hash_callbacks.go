@@ -0,0 +1,234 @@
+package ph
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// passwordHashNotifier is the minimal interface for notifying callers once their hash is stored.
+type passwordHashNotifier interface {
+	allowCallback(callbackURL string) bool
+	registerCallback(id string, callbackURL string)
+	forgetCallback(id string)
+	hashStored(id string, hashed string)
+	callbackStats() *callbackStats
+	waitPendingDeliveries()
+}
+
+// CallbackConfig configures the webhook callbacks sent when a delayed hash becomes available.
+// Allowlist entries are host names, optionally with a port ("hooks.example.com:8443"), or a wildcard
+// for all subdomains ("*.example.com"). Zero values for the retry settings fall back to sensible defaults.
+type CallbackConfig struct {
+	Secret      []byte
+	Allowlist   []string
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	Timeout     time.Duration
+}
+
+const (
+	defaultCallbackAttempts   = 5
+	defaultCallbackBackoff    = time.Second
+	defaultCallbackMaxBackoff = time.Minute
+	defaultCallbackTimeout    = 10 * time.Second
+
+	// callbackSignatureHeader carries the hex-encoded HMAC-SHA256 of the request body.
+	callbackSignatureHeader = "X-Signature-256"
+)
+
+// callbackStats are the delivery results reported by the stats endpoint.
+type callbackStats struct {
+	Delivered int64 `json:"delivered"`
+	Retried   int64 `json:"retried"`
+	Failed    int64 `json:"failed"`
+	Pending   int64 `json:"pending"`
+}
+
+// callbackPayload is the JSON body POST'ed to a callback URL.
+type callbackPayload struct {
+	Id   string `json:"id"`
+	Hash string `json:"hash"`
+}
+
+// webhookNotifier delivers signed HTTP callbacks, retrying failed deliveries with exponential backoff.
+type webhookNotifier struct {
+	config    CallbackConfig
+	client    *http.Client
+	callbacks map[string]string
+	lock      sync.Mutex
+	pending   sync.WaitGroup
+	stats     callbackStats
+	logger    *log.Logger
+}
+
+// newWebhookNotifier creates a new notifier, filling in defaults for any unset retry settings.
+func newWebhookNotifier(logger *log.Logger, config CallbackConfig) *webhookNotifier {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultCallbackAttempts
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = defaultCallbackBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = defaultCallbackMaxBackoff
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultCallbackTimeout
+	}
+	return &webhookNotifier{
+		config:    config,
+		client:    &http.Client{Timeout: config.Timeout, CheckRedirect: refuseRedirect},
+		callbacks: make(map[string]string),
+		logger:    logger,
+	}
+}
+
+// refuseRedirect never follows a redirect, which would send the hash to a host the allowlist was never checked
+// against, so the redirect is taken as the response, failing the delivery.
+func refuseRedirect(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// allowCallback checks the given URL is an absolute http(s) URL whose host is in the allowlist.
+func (notifier *webhookNotifier) allowCallback(callbackURL string) bool {
+	u, err := url.Parse(callbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range notifier.config.Allowlist {
+		allowed = strings.ToLower(allowed)
+		if allowedHost, allowedPort, err := net.SplitHostPort(allowed); err == nil {
+			if u.Port() == allowedPort && matchCallbackHost(host, allowedHost) {
+				return true
+			}
+		} else if matchCallbackHost(host, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchCallbackHost compares a host against a single allowlist pattern, honoring "*." wildcards.
+func matchCallbackHost(host, pattern string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// registerCallback remembers where to deliver the hash for the given id once it gets stored.
+func (notifier *webhookNotifier) registerCallback(id string, callbackURL string) {
+	notifier.lock.Lock()
+	notifier.callbacks[id] = callbackURL
+	notifier.lock.Unlock()
+}
+
+// forgetCallback drops the callback registered for an id that will never be stored.
+func (notifier *webhookNotifier) forgetCallback(id string) {
+	notifier.lock.Lock()
+	delete(notifier.callbacks, id)
+	notifier.lock.Unlock()
+}
+
+// hashStored starts delivering the callback registered for the id, if any.
+// Deliveries run in the background so the store is never held back by a slow receiver.
+func (notifier *webhookNotifier) hashStored(id string, hashed string) {
+	notifier.lock.Lock()
+	callbackURL, ok := notifier.callbacks[id]
+	delete(notifier.callbacks, id)
+	notifier.lock.Unlock()
+	if !ok {
+		return
+	}
+
+	body, err := json.Marshal(&callbackPayload{Id: id, Hash: hashed})
+	if err != nil {
+		notifier.logger.Printf("ERROR: %v", err)
+		return
+	}
+	atomic.AddInt64(&notifier.stats.Pending, 1)
+	notifier.pending.Add(1)
+	go notifier.deliver(id, callbackURL, body)
+}
+
+// deliver POSTs the signed body, retrying with exponential backoff until it succeeds or runs out of attempts.
+func (notifier *webhookNotifier) deliver(id string, callbackURL string, body []byte) {
+	defer notifier.pending.Done()
+	defer atomic.AddInt64(&notifier.stats.Pending, -1)
+
+	backoff := notifier.config.Backoff
+	for attempt := 1; ; attempt++ {
+		err := notifier.post(callbackURL, body)
+		if err == nil {
+			atomic.AddInt64(&notifier.stats.Delivered, 1)
+			notifier.logger.Printf("Callback for %s delivered", id)
+			return
+		}
+		notifier.logger.Printf("Callback for %s failed (attempt %d): %v", id, attempt, err)
+		if attempt >= notifier.config.MaxAttempts {
+			atomic.AddInt64(&notifier.stats.Failed, 1)
+			return
+		}
+		atomic.AddInt64(&notifier.stats.Retried, 1)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > notifier.config.MaxBackoff {
+			backoff = notifier.config.MaxBackoff
+		}
+	}
+}
+
+// post makes a single delivery attempt, treating anything but a 2xx response as a failure.
+func (notifier *webhookNotifier) post(callbackURL string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(callbackSignatureHeader, "sha256="+signCallback(notifier.config.Secret, body))
+	resp, err := notifier.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signCallback returns the hex-encoded HMAC-SHA256 of the body, so receivers can verify its origin.
+func signCallback(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// callbackStats returns a copy of the current delivery results.
+func (notifier *webhookNotifier) callbackStats() *callbackStats {
+	return &callbackStats{
+		Delivered: atomic.LoadInt64(&notifier.stats.Delivered),
+		Retried:   atomic.LoadInt64(&notifier.stats.Retried),
+		Failed:    atomic.LoadInt64(&notifier.stats.Failed),
+		Pending:   atomic.LoadInt64(&notifier.stats.Pending),
+	}
+}
+
+// waitPendingDeliveries blocks until every started delivery has succeeded or given up.
+func (notifier *webhookNotifier) waitPendingDeliveries() {
+	notifier.pending.Wait()
+	notifier.logger.Print("No more pending callbacks")
+}
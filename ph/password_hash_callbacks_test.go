@@ -0,0 +1,175 @@
+package ph
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_newWebhookNotifier(t *testing.T) {
+	notifier := newWebhookNotifier(nil, CallbackConfig{})
+	if notifier.callbacks == nil {
+		t.Error("Callbacks expected to not be nil")
+	}
+	if notifier.config.MaxAttempts != defaultCallbackAttempts {
+		t.Errorf("Unexpected default attempts: %d", notifier.config.MaxAttempts)
+	}
+	if notifier.config.Backoff != defaultCallbackBackoff {
+		t.Errorf("Unexpected default backoff: %v", notifier.config.Backoff)
+	}
+}
+
+func Test_allowCallback(t *testing.T) {
+	notifier := newWebhookNotifier(nil, CallbackConfig{
+		Allowlist: []string{"hooks.example.com", "*.internal.example.com", "localhost:8443"},
+	})
+	cases := map[string]bool{
+		"https://hooks.example.com/done":      true,
+		"http://HOOKS.example.com:9000/done":  true,
+		"https://a.internal.example.com/x":    true,
+		"https://internal.example.com/x":      false,
+		"https://localhost:8443/":             true,
+		"https://localhost/":                  false,
+		"https://evil.example.com/":           false,
+		"https://hooks.example.com.evil.com/": false,
+		"ftp://hooks.example.com/":            false,
+		"https://user:pw@hooks.example.com/":  false,
+		"/relative/path":                      false,
+		"://bogus":                            false,
+	}
+	for callbackURL, expected := range cases {
+		if notifier.allowCallback(callbackURL) != expected {
+			t.Errorf("Expected %s to be allowed=%v", callbackURL, expected)
+		}
+	}
+}
+
+func Test_hashStoredWithoutCallback(t *testing.T) {
+	buf := &bytes.Buffer{}
+	notifier := newWebhookNotifier(log.New(buf, "", 0), CallbackConfig{})
+	notifier.hashStored("1", "test")
+	notifier.waitPendingDeliveries()
+	if buf.String() != "No more pending callbacks\n" {
+		t.Errorf("Expected no deliveries: %s", buf.String())
+	}
+}
+
+func Test_hashStoredDelivers(t *testing.T) {
+	secret := []byte("secret")
+	var received callbackPayload
+	var signature string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		signature = r.Header.Get(callbackSignatureHeader)
+		if signature != "sha256="+signCallback(secret, body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := json.Unmarshal(body, &received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer receiver.Close()
+
+	buf := &bytes.Buffer{}
+	notifier := newWebhookNotifier(log.New(buf, "", 0), CallbackConfig{Secret: secret})
+	notifier.registerCallback("42", receiver.URL)
+	notifier.hashStored("42", "very-hashed")
+	notifier.waitPendingDeliveries()
+
+	if received.Id != "42" || received.Hash != "very-hashed" {
+		t.Errorf("Unexpected payload: %+v", received)
+	}
+	stats := notifier.callbackStats()
+	if stats.Delivered != 1 || stats.Retried != 0 || stats.Failed != 0 || stats.Pending != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if len(notifier.callbacks) != 0 {
+		t.Error("Expected callback to be forgotten once delivered")
+	}
+}
+
+func Test_hashStoredRetries(t *testing.T) {
+	var calls int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer receiver.Close()
+
+	buf := &bytes.Buffer{}
+	notifier := newWebhookNotifier(log.New(buf, "", 0), CallbackConfig{Backoff: time.Millisecond})
+	notifier.registerCallback("1", receiver.URL)
+	notifier.hashStored("1", "test")
+	notifier.waitPendingDeliveries()
+
+	if calls != 3 {
+		t.Errorf("Expected 3 attempts, got %d", calls)
+	}
+	stats := notifier.callbackStats()
+	if stats.Delivered != 1 || stats.Retried != 2 || stats.Failed != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func Test_hashStoredGivesUp(t *testing.T) {
+	var calls int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer receiver.Close()
+
+	buf := &bytes.Buffer{}
+	notifier := newWebhookNotifier(log.New(buf, "", 0), CallbackConfig{MaxAttempts: 2, Backoff: time.Millisecond})
+	notifier.registerCallback("1", receiver.URL)
+	notifier.hashStored("1", "test")
+	notifier.waitPendingDeliveries()
+
+	if calls != 2 {
+		t.Errorf("Expected 2 attempts, got %d", calls)
+	}
+	stats := notifier.callbackStats()
+	if stats.Delivered != 0 || stats.Retried != 1 || stats.Failed != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func Test_hashStoredRefusesRedirects(t *testing.T) {
+	var redirected int32
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&redirected, 1)
+	}))
+	defer internal.Close()
+	receiver := httptest.NewServer(http.RedirectHandler(internal.URL, http.StatusFound))
+	defer receiver.Close()
+
+	buf := &bytes.Buffer{}
+	notifier := newWebhookNotifier(log.New(buf, "", 0), CallbackConfig{MaxAttempts: 1})
+	notifier.registerCallback("1", receiver.URL)
+	notifier.hashStored("1", "test")
+	notifier.waitPendingDeliveries()
+
+	if redirected != 0 {
+		t.Error("Expected the redirect to never be followed")
+	}
+	if stats := notifier.callbackStats(); stats.Delivered != 0 || stats.Failed != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func Test_forgetCallback(t *testing.T) {
+	notifier := newWebhookNotifier(nil, CallbackConfig{})
+	notifier.registerCallback("1", "https://hooks.example.com/")
+	notifier.forgetCallback("1")
+	if len(notifier.callbacks) != 0 {
+		t.Error("Expected callback to be forgotten")
+	}
+}
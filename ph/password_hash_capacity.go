@@ -0,0 +1,166 @@
+package ph
+
+import (
+	"container/list"
+	"errors"
+	"sync/atomic"
+)
+
+// CapacityPolicy tells what a full store does with new hashes.
+type CapacityPolicy string
+
+const (
+	// EvictPolicy makes room for new hashes by removing the least recently retrieved ones.
+	EvictPolicy CapacityPolicy = "evict"
+	// RejectPolicy refuses new hashes until there is room for them, counting pending ones too.
+	RejectPolicy CapacityPolicy = "reject"
+)
+
+// CapacityConfig bounds how much a store may hold, by number of hashes and by (estimated) bytes.
+// Zero means no bound on the respective measure.
+type CapacityConfig struct {
+	MaxRecords int64
+	MaxBytes   int64
+	Policy     CapacityPolicy
+}
+
+// errStoreFull is returned when a store rejects a hash for lack of capacity.
+var errStoreFull = errors.New("store full")
+
+// hashRecordOverhead estimates the bytes used per hash beyond its id and value:
+// the map entry, the LRU list element and its index entry.
+const hashRecordOverhead = 128
+
+// capacityStats are the size and eviction counts reported by the stats endpoint.
+type capacityStats struct {
+	Records  int64 `json:"records"`
+	Bytes    int64 `json:"bytes"`
+	Evicted  int64 `json:"evicted"`
+	Rejected int64 `json:"rejected"`
+}
+
+// hashRecordSize estimates the bytes used by a single stored hash.
+func hashRecordSize(id string, hashed string) int64 {
+	return int64(len(id)+len(hashed)) + hashRecordOverhead
+}
+
+// setCapacity bounds the store, tracking recency of use for eviction. It must be called before any password is stored.
+func (store *passwordHashStore) setCapacity(config CapacityConfig) {
+	if config.Policy == "" {
+		config.Policy = EvictPolicy
+	}
+	store.capacity = &config
+	store.lru = list.New()
+	store.lruIndex = make(map[string]*list.Element)
+}
+
+// reserveCapacity accounts for a hash that is about to be stored, rejecting it if it could not fit.
+// Only the reject policy reserves anything, since evicting always makes room.
+func (store *passwordHashStore) reserveCapacity(id string, hashed string) error {
+	if store.capacity == nil || store.capacity.Policy != RejectPolicy {
+		return nil
+	}
+	defer store.lock.Unlock()
+	store.lock.Lock()
+	return store.reserveCapacityLocked(id, hashed)
+}
+
+// reserveCapacityLocked is reserveCapacity for callers already holding the write lock.
+func (store *passwordHashStore) reserveCapacityLocked(id string, hashed string) error {
+	if store.capacity == nil || store.capacity.Policy != RejectPolicy {
+		return nil
+	}
+	size := hashRecordSize(id, hashed)
+	records := int64(store.hashes.count()) + store.reservedRecords + 1
+	bytes := store.usedBytes + store.reservedBytes + size
+	if store.exceedsCapacity(records, bytes) {
+		atomic.AddInt64(&store.rejectedCount, 1)
+		return errStoreFull
+	}
+	store.reservedRecords++
+	store.reservedBytes += size
+	return nil
+}
+
+// exceedsCapacity tells whether the given totals are over any of the bounds.
+func (store *passwordHashStore) exceedsCapacity(records int64, bytes int64) bool {
+	return (store.capacity.MaxRecords > 0 && records > store.capacity.MaxRecords) ||
+		(store.capacity.MaxBytes > 0 && bytes > store.capacity.MaxBytes)
+}
+
+// trackCapacity accounts for a just stored hash, evicting others if needed. Must be called with the write lock held.
+func (store *passwordHashStore) trackCapacity(id string, hashed string) {
+	if store.capacity == nil {
+		return
+	}
+	store.releaseCapacity(id, hashed)
+	store.usedBytes += hashRecordSize(id, hashed)
+
+	store.lruLock.Lock()
+	store.lruIndex[id] = store.lru.PushFront(id)
+	store.lruLock.Unlock()
+
+	for store.exceedsCapacity(int64(store.hashes.count()), store.usedBytes) {
+		store.lruLock.Lock()
+		oldest := store.lru.Back()
+		store.lruLock.Unlock()
+		if oldest == nil || oldest.Value.(string) == id {
+			break
+		}
+		store.removeHash(oldest.Value.(string))
+		store.noteRemoved(oldest.Value.(string), hashUnknown, store.now())
+		atomic.AddInt64(&store.evictedCount, 1)
+	}
+}
+
+// releaseCapacity gives back what was reserved for a pending hash. Must be called with the write lock held.
+func (store *passwordHashStore) releaseCapacity(id string, hashed string) {
+	if store.capacity == nil || store.capacity.Policy != RejectPolicy {
+		return
+	}
+	store.reservedRecords--
+	store.reservedBytes -= hashRecordSize(id, hashed)
+}
+
+// touchHash marks the hash as the most recently retrieved. Being called with just the read lock held,
+// the LRU list has its own lock, which is always taken after the store's.
+func (store *passwordHashStore) touchHash(id string) {
+	if store.capacity == nil {
+		return
+	}
+	store.lruLock.Lock()
+	if element, ok := store.lruIndex[id]; ok {
+		store.lru.MoveToFront(element)
+	}
+	store.lruLock.Unlock()
+}
+
+// untrackCapacity releases what a removed hash accounted for. Must be called with the write lock held.
+func (store *passwordHashStore) untrackCapacity(id string, hashed string) {
+	if store.capacity == nil {
+		return
+	}
+	store.usedBytes -= hashRecordSize(id, hashed)
+	store.lruLock.Lock()
+	if element, ok := store.lruIndex[id]; ok {
+		store.lru.Remove(element)
+		delete(store.lruIndex, id)
+	}
+	store.lruLock.Unlock()
+}
+
+// capacityStats returns the size and eviction counts, or nil if the store is unbounded.
+func (store *passwordHashStore) capacityStats() *capacityStats {
+	if store.capacity == nil {
+		return nil
+	}
+	store.lock.RLock()
+	records, bytes := int64(store.hashes.count()), store.usedBytes
+	store.lock.RUnlock()
+	return &capacityStats{
+		Records:  records,
+		Bytes:    bytes,
+		Evicted:  atomic.LoadInt64(&store.evictedCount),
+		Rejected: atomic.LoadInt64(&store.rejectedCount),
+	}
+}
@@ -0,0 +1,163 @@
+package ph
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newBoundedStore(buf *bytes.Buffer, config CapacityConfig) *passwordHashStore {
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	store.setCapacity(config)
+	return store
+}
+
+func Test_setCapacity(t *testing.T) {
+	store := newPasswordHashStore(nil)
+	store.setCapacity(CapacityConfig{MaxRecords: 1})
+	if store.capacity.Policy != EvictPolicy {
+		t.Errorf("Expected eviction by default, got %s", store.capacity.Policy)
+	}
+	if store.lru == nil || store.lruIndex == nil {
+		t.Error("Expected LRU to be initialized")
+	}
+}
+
+func Test_evictLeastRecentlyRetrieved(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newBoundedStore(buf, CapacityConfig{MaxRecords: 3})
+	for i := 1; i <= 3; i++ {
+		store.storePassword("test", fmt.Sprint(i), 0, 0)
+		store.waitPendingStores()
+	}
+	// 1 becomes the most recently used, leaving 2 as the least
+	store.retrievePassword("1")
+	store.storePassword("test", "4", 0, 0)
+	store.waitPendingStores()
+
+	if _, state := store.retrievePassword("2"); state != hashUnknown {
+		t.Error("Expected least recently retrieved hash to be evicted")
+	}
+	for _, id := range []string{"1", "3", "4"} {
+		if _, state := store.retrievePassword(id); state != hashAvailable {
+			t.Errorf("Expected %s to be kept", id)
+		}
+	}
+	stats := store.capacityStats()
+	if stats.Records != 3 || stats.Evicted != 1 || stats.Rejected != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if stats.Bytes != 3*hashRecordSize("1", "test") {
+		t.Errorf("Unexpected bytes: %d", stats.Bytes)
+	}
+	if store.lru.Len() != 3 || len(store.lruIndex) != 3 {
+		t.Errorf("Expected LRU to track stored hashes only, got %d", store.lru.Len())
+	}
+}
+
+func Test_evictByBytes(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newBoundedStore(buf, CapacityConfig{MaxBytes: 2 * hashRecordSize("1", "test")})
+	for i := 1; i <= 5; i++ {
+		store.storePassword("test", fmt.Sprint(i), 0, 0)
+		store.waitPendingStores()
+	}
+	stats := store.capacityStats()
+	if stats.Records != 2 || stats.Evicted != 3 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if _, state := store.retrievePassword("5"); state != hashAvailable {
+		t.Error("Expected most recent hash to be kept")
+	}
+}
+
+func Test_rejectWhenFull(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newBoundedStore(buf, CapacityConfig{MaxRecords: 2, Policy: RejectPolicy})
+
+	// pending hashes count too
+	err1 := store.storePassword("test", "1", 0, time.Hour)
+	err2 := store.storePassword("test", "2", 0, time.Hour)
+	if err1 != nil || err2 != nil {
+		t.Fatal("Expected room for two hashes")
+	}
+	if err := store.storePassword("test", "3", 0, time.Hour); err != errStoreFull {
+		t.Errorf("Expected store to be full, got %v", err)
+	}
+	stats := store.capacityStats()
+	if stats.Rejected != 1 || stats.Evicted != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func Test_rejectReleasesReservation(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newBoundedStore(buf, CapacityConfig{MaxRecords: 1, Policy: RejectPolicy})
+	if err := store.storePassword("test", "1", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	store.waitPendingStores()
+	if store.reservedRecords != 0 || store.reservedBytes != 0 {
+		t.Errorf("Expected reservation to be released: %d %d", store.reservedRecords, store.reservedBytes)
+	}
+	if err := store.reserveCapacity("2", "test"); err != errStoreFull {
+		t.Errorf("Expected store to be full, got %v", err)
+	}
+}
+
+func Test_capacityWithExpiry(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newBoundedStore(buf, CapacityConfig{MaxRecords: 1})
+	store.setExpiry(ExpiryConfig{TTL: time.Minute})
+	store.storePassword("test", "1", 0, 0)
+	store.waitPendingStores()
+	store.storePassword("test", "2", 0, 0)
+	store.waitPendingStores()
+
+	// the evicted hash must not be reported as expired later
+	store.expireHashes(time.Now().Add(time.Hour))
+	if _, state := store.retrievePassword("1"); state != hashUnknown {
+		t.Error("Expected evicted hash to be unknown")
+	}
+	if _, state := store.retrievePassword("2"); state != hashExpired {
+		t.Error("Expected remaining hash to expire")
+	}
+	if stats := store.capacityStats(); stats.Records != 0 || stats.Bytes != 0 {
+		t.Errorf("Expected expired hash to release capacity: %+v", stats)
+	}
+}
+
+func Test_capacityConcurrentReads(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newBoundedStore(buf, CapacityConfig{MaxRecords: 50})
+	store.logger = log.New(&bytes.Buffer{}, "", 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				store.storePassword("test", fmt.Sprint(i, "-", j), 0, 0)
+				store.retrievePassword(fmt.Sprint(i, "-", j/2))
+			}
+		}(i)
+	}
+	wg.Wait()
+	store.waitPendingStores()
+	if stats := store.capacityStats(); stats.Records != 50 || stats.Evicted != 750 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if store.lru.Len() != 50 || len(store.lruIndex) != 50 {
+		t.Errorf("Expected LRU to stay consistent, got %d", store.lru.Len())
+	}
+}
+
+func Test_capacityStatsUnbounded(t *testing.T) {
+	store := newPasswordHashStore(nil)
+	if store.capacityStats() != nil {
+		t.Error("Expected no capacity stats when unbounded")
+	}
+}
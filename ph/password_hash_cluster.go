@@ -0,0 +1,279 @@
+package ph
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultVirtualNodes   = 128
+	defaultForwardTimeout = 5 * time.Second
+
+	// clusterForwardedHeader marks requests forwarded by another node, naming it, so they are never forwarded again.
+	clusterForwardedHeader = "X-Cluster-Forwarded-By"
+)
+
+// ClusterConfig configures a node of a cluster: its own base URL, such as "http://node1:8090", the file
+// listing the base URLs of every node, itself included, one per line, and how many points each node has on
+// the ring (128 by default).
+type ClusterConfig struct {
+	Self         string
+	PeersFile    string
+	VirtualNodes int
+}
+
+// Cluster tells which node owns each id, by placing the nodes on a consistent-hash ring. Each node owns
+// the ids hashing between its points and those of the previous ones, so adding or removing a node only
+// moves the ids of its neighbours. The ring is rebuilt whenever the peers file is reloaded.
+type Cluster struct {
+	config ClusterConfig
+	lock   sync.RWMutex
+	ring   *hashRing
+	client *http.Client
+
+	forwarded int64
+	failed    int64
+}
+
+// clusterStats are the cluster state reported by the stats endpoint.
+type clusterStats struct {
+	Self      string `json:"self"`
+	Peers     int    `json:"peers"`
+	Forwarded int64  `json:"forwarded"`
+	Failed    int64  `json:"failed"`
+}
+
+// ValidateClusterIds fails for an id strategy cluster nodes cannot use. Only RandomIds and UUIDv7Ids are
+// unique without any coordination, whichever node issues them, however the ring changes.
+func ValidateClusterIds(strategy IdStrategy) error {
+	switch strategy {
+	case RandomIds, UUIDv7Ids:
+		return nil
+	}
+	return fmt.Errorf("cluster mode requires %s or %s ids, not %s", RandomIds, UUIDv7Ids, strategy)
+}
+
+// OpenCluster loads the peers file, which must list the node itself, and builds the ring.
+func OpenCluster(config ClusterConfig) (*Cluster, error) {
+	if config.VirtualNodes <= 0 {
+		config.VirtualNodes = defaultVirtualNodes
+	}
+	config.Self = strings.TrimSuffix(config.Self, "/")
+	cluster := &Cluster{
+		config: config,
+		client: &http.Client{Timeout: defaultForwardTimeout},
+	}
+	if err := cluster.Reload(); err != nil {
+		return nil, err
+	}
+	return cluster, nil
+}
+
+// Reload reads the peers file again and rebuilds the ring from it. The ring is left as it was if the file
+// cannot be read, or does not list the node itself. Hashes stay on the node they were stored on, so those
+// of ids owned by another node afterwards are not found anymore.
+func (cluster *Cluster) Reload() error {
+	peers, err := readPeers(cluster.config.PeersFile)
+	if err != nil {
+		return err
+	}
+	ring := newHashRing(peers, cluster.config.VirtualNodes)
+	if !ring.has(cluster.config.Self) {
+		return fmt.Errorf("%s does not list %s", cluster.config.PeersFile, cluster.config.Self)
+	}
+	defer cluster.lock.Unlock()
+	cluster.lock.Lock()
+	cluster.ring = ring
+	return nil
+}
+
+// readPeers reads the base URLs of the nodes, one per line, ignoring blank lines and # comments.
+func readPeers(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var peers []string
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		peer := strings.TrimSpace(scanner.Text())
+		if peer == "" || strings.HasPrefix(peer, "#") {
+			continue
+		}
+		if parsed, err := url.Parse(peer); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return nil, fmt.Errorf("%s:%d: invalid peer %q", path, line, peer)
+		}
+		peers = append(peers, strings.TrimSuffix(peer, "/"))
+	}
+	return peers, scanner.Err()
+}
+
+// owner returns the base URL of the node owning the id, and whether it is this node.
+func (cluster *Cluster) owner(id string) (string, bool) {
+	cluster.lock.RLock()
+	owner := cluster.ring.owner(id)
+	cluster.lock.RUnlock()
+	return owner, owner == cluster.config.Self
+}
+
+// owns tells whether this node owns the id.
+func (cluster *Cluster) owns(id string) bool {
+	_, self := cluster.owner(id)
+	return self
+}
+
+// peerCount returns how many nodes are on the ring.
+func (cluster *Cluster) peerCount() int {
+	defer cluster.lock.RUnlock()
+	cluster.lock.RLock()
+	return len(cluster.ring.peers)
+}
+
+// forward sends the request on to the node owning its id, writing back whatever that node answers.
+// It tells whether the node answered, in which case its answer was written back.
+func (cluster *Cluster) forward(logger *log.Logger, w http.ResponseWriter, req *http.Request, owner string) bool {
+	forwarded, err := http.NewRequestWithContext(req.Context(), req.Method, owner+req.URL.RequestURI(), nil)
+	if err != nil {
+		logger.Printf("ERROR: %v", err)
+		return false
+	}
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		forwarded.Header.Set("Authorization", auth)
+	}
+	forwarded.Header.Set(clusterForwardedHeader, cluster.config.Self)
+	resp, err := cluster.client.Do(forwarded)
+	if err == nil {
+		defer resp.Body.Close()
+		body := &bytes.Buffer{}
+		if _, err = io.Copy(body, resp.Body); err == nil {
+			atomic.AddInt64(&cluster.forwarded, 1)
+			if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+				w.Header().Set("Content-Type", contentType)
+			}
+			w.WriteHeader(resp.StatusCode)
+			_, errW := w.Write(body.Bytes())
+			logWriteError(logger, errW)
+			return true
+		}
+	}
+	atomic.AddInt64(&cluster.failed, 1)
+	logger.Printf("ERROR: Failed to forward to %s: %v", owner, err)
+	return false
+}
+
+// stats returns the node, the size of the cluster and how many requests were forwarded, or failed to be.
+func (cluster *Cluster) stats() *clusterStats {
+	return &clusterStats{
+		Self:      cluster.config.Self,
+		Peers:     cluster.peerCount(),
+		Forwarded: atomic.LoadInt64(&cluster.forwarded),
+		Failed:    atomic.LoadInt64(&cluster.failed),
+	}
+}
+
+// hashRing places nodes at several points each on a ring of 64-bit hashes, sorted so owners are found by
+// binary search.
+type hashRing struct {
+	peers  []string
+	points []uint64
+	owners []string
+}
+
+// newHashRing creates a ring with the given number of points per node.
+func newHashRing(peers []string, virtualNodes int) *hashRing {
+	ring := &hashRing{peers: peers}
+	type point struct {
+		at    uint64
+		owner string
+	}
+	points := make([]point, 0, len(peers)*virtualNodes)
+	for _, peer := range peers {
+		for i := 0; i < virtualNodes; i++ {
+			points = append(points, point{ringHash(peer + "#" + strconv.Itoa(i)), peer})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].at == points[j].at {
+			return points[i].owner < points[j].owner
+		}
+		return points[i].at < points[j].at
+	})
+	for _, point := range points {
+		ring.points = append(ring.points, point.at)
+		ring.owners = append(ring.owners, point.owner)
+	}
+	return ring
+}
+
+// owner returns the node at the first point at or after the hash of the id, wrapping around the ring.
+func (ring *hashRing) owner(id string) string {
+	if len(ring.points) == 0 {
+		return ""
+	}
+	at := ringHash(id)
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= at })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.owners[i]
+}
+
+// has tells whether the node is on the ring.
+func (ring *hashRing) has(peer string) bool {
+	for _, candidate := range ring.peers {
+		if candidate == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// ringHash places a string on the ring, mixing its FNV-1a hash so similar strings spread evenly.
+func ringHash(value string) uint64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(value))
+	mixed := hash.Sum64()
+	mixed ^= mixed >> 33
+	mixed *= 0xff51afd7ed558ccd
+	mixed ^= mixed >> 33
+	mixed *= 0xc4ceb9fe1a85ec53
+	mixed ^= mixed >> 33
+	return mixed
+}
+
+// clusterIdGenerator only issues ids owned by this node, skipping those of other nodes, so each node
+// issues ids in its own slice of the ring. With N nodes, it takes N ids of the wrapped generator per id.
+// The wrapped generator must not issue ids in order, as each node would keep a sequence of its own, and
+// one would issue ids another already did once the ring changes.
+type clusterIdGenerator struct {
+	idGenerator
+	cluster *Cluster
+}
+
+// newClusterIdGenerator wraps the generator, keeping only ids owned by this node.
+func newClusterIdGenerator(gen idGenerator, cluster *Cluster) *clusterIdGenerator {
+	return &clusterIdGenerator{idGenerator: gen, cluster: cluster}
+}
+
+// nextId skips ids until one is owned by this node.
+func (gen *clusterIdGenerator) nextId() string {
+	for {
+		if id := gen.idGenerator.nextId(); gen.cluster.owns(id) {
+			return id
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package ph
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writePeers writes a peers file listing the given nodes.
+func writePeers(t *testing.T, path string, peers ...string) {
+	if err := ioutil.WriteFile(path, []byte("# nodes\n"+strings.Join(peers, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_hashRing(t *testing.T) {
+	peers := []string{"http://node1", "http://node2", "http://node3"}
+	ring := newHashRing(peers, defaultVirtualNodes)
+	owned := make(map[string]int)
+	owners := make(map[string]string)
+	for i := 0; i < 30000; i++ {
+		id := strconv.Itoa(i)
+		owners[id] = ring.owner(id)
+		owned[owners[id]]++
+	}
+	for _, peer := range peers {
+		if owned[peer] < 7000 || owned[peer] > 13000 {
+			t.Errorf("Expected ids to spread evenly, got %v", owned)
+		}
+	}
+	if again := newHashRing([]string{"http://node3", "http://node1", "http://node2"}, defaultVirtualNodes); again.owner("42") != owners["42"] {
+		t.Error("Expected owners not to depend on the order of peers")
+	}
+
+	// a fourth node only takes ids from the others, about a quarter of them
+	grown := newHashRing(append(peers, "http://node4"), defaultVirtualNodes)
+	moved := 0
+	for id, owner := range owners {
+		if newOwner := grown.owner(id); newOwner != owner {
+			if newOwner != "http://node4" {
+				t.Fatalf("Expected %s to stay on %s or move to the new node, got %s", id, owner, newOwner)
+			}
+			moved++
+		}
+	}
+	if moved < 4500 || moved > 10500 {
+		t.Errorf("Expected about a quarter of ids to move, got %d", moved)
+	}
+	if newHashRing(nil, defaultVirtualNodes).owner("42") != "" {
+		t.Error("Expected an empty ring to have no owner")
+	}
+}
+
+func Test_clusterReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers")
+	writePeers(t, path, "http://node1/", "http://node2")
+	if _, err := OpenCluster(ClusterConfig{Self: "http://node3", PeersFile: path}); err == nil || !strings.Contains(err.Error(), "does not list http://node3") {
+		t.Errorf("Expected cluster not listing itself to fail, got %v", err)
+	}
+	cluster, err := OpenCluster(ClusterConfig{Self: "http://node1", PeersFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cluster.peerCount() != 2 {
+		t.Errorf("Expected 2 peers, got %d", cluster.peerCount())
+	}
+
+	writePeers(t, path, "http://node1")
+	if err := cluster.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if cluster.peerCount() != 1 || !cluster.owns("42") {
+		t.Errorf("Expected a lone node to own every id, got %d peers", cluster.peerCount())
+	}
+
+	writePeers(t, path, "http://node2", "node3")
+	if err := cluster.Reload(); err == nil || !strings.Contains(err.Error(), `:3: invalid peer "node3"`) {
+		t.Errorf("Expected invalid peer to fail, got %v", err)
+	}
+	writePeers(t, path, "http://node2")
+	if err := cluster.Reload(); err == nil || cluster.peerCount() != 1 {
+		t.Errorf("Expected ring to stay as it was, got %v with %d peers", err, cluster.peerCount())
+	}
+}
+
+func Test_clusterIdGenerator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers")
+	writePeers(t, path, "http://node1", "http://node2", "http://node3")
+	cluster, err := OpenCluster(ClusterConfig{Self: "http://node2", PeersFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := newClusterIdGenerator(newSequentialIdGenerator(), cluster)
+	last := 0
+	for i := 0; i < 100; i++ {
+		id := gen.nextId()
+		if owner, self := cluster.owner(id); !self {
+			t.Fatalf("Expected %s to be owned by this node, got %s", id, owner)
+		}
+		n, _ := strconv.Atoi(id)
+		if n <= last {
+			t.Fatalf("Expected ids to keep increasing, got %d after %d", n, last)
+		}
+		last = n
+	}
+}
+
+func Test_ValidateClusterIds(t *testing.T) {
+	for _, strategy := range []IdStrategy{RandomIds, UUIDv7Ids} {
+		if err := ValidateClusterIds(strategy); err != nil {
+			t.Errorf("Expected %s ids to be allowed: %v", strategy, err)
+		}
+	}
+	for _, strategy := range []IdStrategy{SnowflakeIds, SequentialIds} {
+		if err := ValidateClusterIds(strategy); err == nil {
+			t.Errorf("Expected %s ids to be refused", strategy)
+		}
+	}
+}
+
+func Test_NewPasswordHasherServerWithClusterInOrderIds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers")
+	writePeers(t, path, "http://node1", "http://node2")
+	cluster, err := OpenCluster(ClusterConfig{Self: "http://node1", PeersFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected ids issued in order to panic")
+		}
+	}()
+	NewPasswordHasherServer(log.New(&bytes.Buffer{}, "", 0), WithCluster(cluster), WithIdStrategy(SequentialIds, 0))
+}
+
+func Test_cluster(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := log.New(buf, "", 0)
+	path := filepath.Join(t.TempDir(), "peers")
+	services := make([]*httptest.Server, 3)
+	peers := make([]string, 3)
+	for i := range services {
+		services[i] = httptest.NewUnstartedServer(nil)
+		peers[i] = "http://" + services[i].Listener.Addr().String()
+	}
+	writePeers(t, path, peers...)
+	nodes := make([]*PasswordHasherServer, 3)
+	for i := range nodes {
+		cluster, err := OpenCluster(ClusterConfig{Self: peers[i], PeersFile: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = NewPasswordHasherServer(logger, WithCluster(cluster), WithAdminToken("admin-secret"), WithDelay(DelayConfig{}))
+		nodes[i].phStats.startAccumulating()
+		defer nodes[i].phStats.stopAccumulating()
+		services[i].Config.Handler = nodes[i].http.Handler
+		services[i].Start()
+		defer services[i].Close()
+	}
+
+	get := func(node int, id string) (int, string) {
+		resp, err := http.Get(peers[node] + "/hash/" + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body := &bytes.Buffer{}
+		body.ReadFrom(resp.Body)
+		return resp.StatusCode, body.String()
+	}
+	hashed := nodes[0].pwHasher.hashPassword("angryMonkey")
+	var ids []string
+	for i := range nodes {
+		resp, err := http.PostForm(peers[i]+"/hash", url.Values{"password": {"angryMonkey"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := &bytes.Buffer{}
+		id.ReadFrom(resp.Body)
+		resp.Body.Close()
+		if owner, _ := nodes[i].cluster.owner(id.String()); owner != peers[i] {
+			t.Errorf("Expected node %d to issue its own ids, got one of %s", i, owner)
+		}
+		ids = append(ids, id.String())
+	}
+	for i := range nodes {
+		nodes[i].phStore.waitPendingStores()
+	}
+	for i := range nodes {
+		for _, id := range ids {
+			if code, hash := get(i, id); code != http.StatusOK || hash != hashed {
+				t.Errorf("Expected node %d to get %s from its owner, got %d %s", i, id, code, hash)
+			}
+		}
+	}
+	if forwarded := nodes[0].cluster.stats().Forwarded; forwarded != 2 {
+		t.Errorf("Expected 2 requests forwarded, got %d", forwarded)
+	}
+
+	// nodes rebuild their ring once the peers are reloaded, no longer forwarding to removed ones
+	writePeers(t, path, peers[0], peers[1])
+	for _, peer := range peers[:2] {
+		req, err := http.NewRequest(http.MethodPost, peer+"/admin/reload-peers", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected peers to be reloaded, got %d", resp.StatusCode)
+		}
+	}
+	services[2].Close()
+	if code, _ := get(0, ids[2]); code == http.StatusBadGateway {
+		t.Errorf("Expected removed node not to be forwarded to")
+	}
+	if !strings.Contains(buf.String(), "Reloaded 2 peers for admin at ") {
+		t.Errorf("Expected log indicating peers were reloaded: %s", buf.String())
+	}
+}
+
+func Test_clusterOwnerUnavailable(t *testing.T) {
+	buf := &bytes.Buffer{}
+	path := filepath.Join(t.TempDir(), "peers")
+	unavailable := httptest.NewServer(http.NotFoundHandler())
+	unavailable.Close()
+	writePeers(t, path, "http://node1", unavailable.URL)
+	cluster, err := OpenCluster(ClusterConfig{Self: "http://node1", PeersFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewPasswordHasherServer(log.New(buf, "", 0), WithCluster(cluster))
+	id := newRandomIdGenerator().nextId()
+	for cluster.owns(id) {
+		id = newRandomIdGenerator().nextId()
+	}
+
+	w := httptest.NewRecorder()
+	server.getHash(w, httptest.NewRequest(http.MethodGet, "/hash/"+id, nil))
+	if w.Code != http.StatusBadGateway || cluster.stats().Failed != 1 {
+		t.Errorf("Expected unavailable owner to fail, got %d", w.Code)
+	}
+	if !strings.Contains(buf.String(), "ERROR: Failed to forward to "+unavailable.URL) {
+		t.Errorf("Expected log indicating the failure: %s", buf.String())
+	}
+
+	// requests already forwarded are served here
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/hash/"+id, nil)
+	r.Header.Set(clusterForwardedHeader, unavailable.URL)
+	server.getHash(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected forwarded request to be served, got %d", w.Code)
+	}
+}
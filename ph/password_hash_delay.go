@@ -0,0 +1,141 @@
+package ph
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultHashDelay is how long hashes wait before becoming available, unless configured otherwise.
+	defaultHashDelay = 5 * time.Second
+
+	// tenantHeader tells the tenant a hash is submitted for, as set by a trusted proxy in front of the service.
+	tenantHeader = "X-Tenant"
+	// hashDelayHeader returns the delay chosen for a hash, as a Go duration.
+	hashDelayHeader = "X-Hash-Delay"
+)
+
+// errInvalidDelay is returned when a hash asks for a delay the policy does not allow.
+var errInvalidDelay = errors.New("delay not allowed")
+
+// delayRequest is what the delay policy gets to choose a hash's delay from: the delay asked for along with
+// the hash, if any, and the tenant it was submitted for, if known. The zero value asks for the default.
+type delayRequest struct {
+	delay     time.Duration
+	requested bool
+	tenant    string
+}
+
+// delayPolicy chooses how long a hash waits before becoming available.
+type delayPolicy interface {
+	delayFor(request delayRequest) (time.Duration, error)
+}
+
+// DelayConfig configures how long hashes wait before becoming available. Every hash waits the same Delay,
+// unless its tenant has a delay of its own, plus up to Jitter at random. If MaxRequestDelay is set, a hash may
+// ask for any delay from MinRequestDelay up to it, which is then used as is.
+type DelayConfig struct {
+	Delay           time.Duration
+	Tenants         map[string]time.Duration
+	Jitter          time.Duration
+	MinRequestDelay time.Duration
+	MaxRequestDelay time.Duration
+}
+
+// newDelayPolicy creates the policy for the given config, layering only what is configured.
+func newDelayPolicy(config DelayConfig) delayPolicy {
+	var policy delayPolicy = fixedDelayPolicy(config.Delay)
+	if len(config.Tenants) > 0 {
+		policy = &tenantDelayPolicy{delays: config.Tenants, fallback: policy}
+	}
+	if config.Jitter > 0 {
+		policy = &jitterDelayPolicy{jitter: config.Jitter, random: rand.Int63n, policy: policy}
+	}
+	if config.MaxRequestDelay > 0 {
+		policy = &requestDelayPolicy{min: config.MinRequestDelay, max: config.MaxRequestDelay, fallback: policy}
+	}
+	return policy
+}
+
+// ParseTenantDelays reads "<tenant>=<delay>" pairs separated by commas, such as "acme=1s,batch=1m".
+func ParseTenantDelays(value string) (map[string]time.Duration, error) {
+	delays := make(map[string]time.Duration)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		eq := strings.IndexByte(pair, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("expected \"<tenant>=<delay>\", got %q", pair)
+		}
+		delay, err := parseDuration(pair[eq+1:])
+		if err != nil || delay < 0 {
+			return nil, fmt.Errorf("invalid delay for tenant %s", pair[:eq])
+		}
+		delays[pair[:eq]] = delay
+	}
+	return delays, nil
+}
+
+// fixedDelayPolicy has every hash wait the same delay.
+type fixedDelayPolicy time.Duration
+
+// delayFor returns the fixed delay, refusing any delay asked for.
+func (policy fixedDelayPolicy) delayFor(request delayRequest) (time.Duration, error) {
+	if request.requested {
+		return 0, errInvalidDelay
+	}
+	return time.Duration(policy), nil
+}
+
+// requestDelayPolicy lets each hash ask for its own delay, within bounds, falling back to another policy.
+type requestDelayPolicy struct {
+	min      time.Duration
+	max      time.Duration
+	fallback delayPolicy
+}
+
+// delayFor returns the delay asked for, if any and within bounds.
+func (policy *requestDelayPolicy) delayFor(request delayRequest) (time.Duration, error) {
+	if !request.requested {
+		return policy.fallback.delayFor(request)
+	}
+	if request.delay < policy.min || request.delay > policy.max {
+		return 0, errInvalidDelay
+	}
+	return request.delay, nil
+}
+
+// tenantDelayPolicy has each known tenant wait a delay of its own, falling back to another policy.
+type tenantDelayPolicy struct {
+	delays   map[string]time.Duration
+	fallback delayPolicy
+}
+
+// delayFor returns the tenant's delay, if it has one.
+func (policy *tenantDelayPolicy) delayFor(request delayRequest) (time.Duration, error) {
+	if delay, ok := policy.delays[request.tenant]; ok && !request.requested {
+		return delay, nil
+	}
+	return policy.fallback.delayFor(request)
+}
+
+// jitterDelayPolicy adds a random delay to that of another policy, so hashes submitted together
+// do not all become available at once.
+type jitterDelayPolicy struct {
+	jitter time.Duration
+	random func(n int64) int64
+	policy delayPolicy
+}
+
+// delayFor returns the other policy's delay plus up to the jitter.
+func (policy *jitterDelayPolicy) delayFor(request delayRequest) (time.Duration, error) {
+	delay, err := policy.policy.delayFor(request)
+	if err != nil {
+		return 0, err
+	}
+	return delay + time.Duration(policy.random(int64(policy.jitter)+1)), nil
+}
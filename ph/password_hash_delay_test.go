@@ -0,0 +1,77 @@
+package ph
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_newDelayPolicy(t *testing.T) {
+	policy := newDelayPolicy(DelayConfig{
+		Delay:           5 * time.Second,
+		Tenants:         map[string]time.Duration{"acme": time.Second},
+		MinRequestDelay: time.Second,
+		MaxRequestDelay: time.Minute,
+	})
+	for _, test := range []struct {
+		request  delayRequest
+		expected time.Duration
+		err      error
+	}{
+		{delayRequest{}, 5 * time.Second, nil},
+		{delayRequest{tenant: "other"}, 5 * time.Second, nil},
+		{delayRequest{tenant: "acme"}, time.Second, nil},
+		{delayRequest{delay: 30 * time.Second, requested: true, tenant: "acme"}, 30 * time.Second, nil},
+		{delayRequest{delay: time.Second, requested: true}, time.Second, nil},
+		{delayRequest{delay: 0, requested: true}, 0, errInvalidDelay},
+		{delayRequest{delay: time.Hour, requested: true}, 0, errInvalidDelay},
+	} {
+		if delay, err := policy.delayFor(test.request); delay != test.expected || err != test.err {
+			t.Errorf("Unexpected delay for %+v: %v %v", test.request, delay, err)
+		}
+	}
+
+	// no delay may be asked for unless allowed
+	if _, err := newDelayPolicy(DelayConfig{Delay: time.Second}).delayFor(delayRequest{requested: true}); err != errInvalidDelay {
+		t.Errorf("Expected requested delay to be refused: %v", err)
+	}
+}
+
+func Test_jitterDelayPolicy(t *testing.T) {
+	var bound int64
+	policy := &jitterDelayPolicy{
+		jitter: time.Second,
+		random: func(n int64) int64 {
+			bound = n
+			return n - 1
+		},
+		policy: fixedDelayPolicy(5 * time.Second),
+	}
+	if delay, err := policy.delayFor(delayRequest{}); delay != 6*time.Second || err != nil {
+		t.Errorf("Expected jitter to be added, got %v %v", delay, err)
+	}
+	if bound != int64(time.Second)+1 {
+		t.Errorf("Expected jitter up to a second, got %d", bound)
+	}
+	if _, err := policy.delayFor(delayRequest{requested: true}); err != errInvalidDelay {
+		t.Errorf("Expected refusal to be passed along: %v", err)
+	}
+
+	random := newDelayPolicy(DelayConfig{Delay: time.Second, Jitter: time.Millisecond})
+	for i := 0; i < 100; i++ {
+		if delay, _ := random.delayFor(delayRequest{}); delay < time.Second || delay > time.Second+time.Millisecond {
+			t.Fatalf("Unexpected delay: %v", delay)
+		}
+	}
+}
+
+func Test_ParseTenantDelays(t *testing.T) {
+	delays, err := ParseTenantDelays("acme=1s, batch=60 ,")
+	if err != nil || len(delays) != 2 || delays["acme"] != time.Second || delays["batch"] != time.Minute {
+		t.Errorf("Unexpected delays: %v %v", delays, err)
+	}
+	for _, value := range []string{"acme", "=1s", "acme=bogus", "acme=-1s"} {
+		if _, err := ParseTenantDelays(value); err == nil {
+			t.Errorf("Expected %q to fail", value)
+		}
+	}
+}
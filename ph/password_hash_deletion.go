@@ -0,0 +1,47 @@
+package ph
+
+import (
+	"time"
+)
+
+// defaultTombstoneWindow is how long deleted ids are remembered as such, unless configured otherwise.
+const defaultTombstoneWindow = 24 * time.Hour
+
+// tombstoneForgetBatch bounds how many tombstones a single deletion may forget, on top of the janitor's work.
+const tombstoneForgetBatch = 100
+
+// setTombstoneWindow changes how long deleted ids are remembered. It must be called before any password is deleted.
+func (store *passwordHashStore) setTombstoneWindow(window time.Duration) {
+	store.tombstoneWindow = window
+}
+
+// deletePassword removes a stored hash, or cancels a pending one, leaving a tombstone behind.
+// It returns what was known about the id beforehand: only available and pending hashes get deleted.
+// Past tombstones are forgotten here as well as by the janitor, so they do not pile up without expiry enabled.
+func (store *passwordHashStore) deletePassword(id string) hashState {
+	defer store.lock.Unlock()
+	store.lock.Lock()
+
+	now := store.now()
+	store.forgetGone(now, tombstoneForgetBatch)
+
+	state := hashUnknown
+	if _, ok := store.hashes.get(id); ok {
+		if at, expiring := store.expiresAt[id]; expiring && !now.Before(at) {
+			return hashExpired
+		}
+		store.removeHash(id)
+		state = hashAvailable
+	} else if gone, ok := store.gone[id]; ok {
+		return gone
+	} else if _, pending := store.pendingHashes[id]; pending && !store.cancelled[id] {
+		store.cancelled[id] = true
+		state = hashPending
+	} else {
+		return hashUnknown
+	}
+	if store.tombstoneWindow > 0 {
+		store.rememberGone(id, hashDeleted, now.Add(store.tombstoneWindow))
+	}
+	return state
+}
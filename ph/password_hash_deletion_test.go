@@ -0,0 +1,123 @@
+package ph
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_deletePasswordStored(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	store.storePassword("test", "1", 0, 0)
+	store.waitPendingStores()
+
+	if state := store.deletePassword("1"); state != hashAvailable {
+		t.Errorf("Expected stored hash to be deleted, got %d", state)
+	}
+	if hash, state := store.retrievePassword("1"); hash != "" || state != hashDeleted {
+		t.Errorf("Expected tombstone, got %s %d", hash, state)
+	}
+	if state := store.deletePassword("1"); state != hashDeleted {
+		t.Errorf("Expected second deletion to find the tombstone, got %d", state)
+	}
+	if state := store.deletePassword("2"); state != hashUnknown {
+		t.Errorf("Expected unknown id, got %d", state)
+	}
+}
+
+func Test_deletePasswordPending(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	var stored []string
+	store.onStored(func(id string, hashed string) {
+		stored = append(stored, id)
+	})
+	if err := store.storePassword("test", "1", 0, time.Second/100); err != nil {
+		t.Fatal(err)
+	}
+	if _, state := store.retrievePassword("1"); state != hashPending {
+		t.Errorf("Expected pending hash, got %d", state)
+	}
+	if state := store.deletePassword("1"); state != hashPending {
+		t.Errorf("Expected pending hash to be cancelled, got %d", state)
+	}
+	forceGoroutineScheduler()
+	store.waitPendingStores()
+
+	if _, state := store.retrievePassword("1"); state != hashDeleted {
+		t.Errorf("Expected cancelled hash to stay deleted, got %d", state)
+	}
+	if store.hashes.count() != 0 || len(stored) != 0 {
+		t.Error("Expected cancelled hash to never be stored")
+	}
+	if len(store.pendingHashes) != 0 || len(store.cancelled) != 0 {
+		t.Error("Expected cancellation to be cleaned up")
+	}
+	if !strings.Contains(buf.String(), "1 cancelled\n") {
+		t.Errorf("Expected log indicating cancellation: %s", buf.String())
+	}
+}
+
+func Test_deletePasswordReleasesCapacity(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newBoundedStore(buf, CapacityConfig{MaxRecords: 1, Policy: RejectPolicy})
+	if err := store.storePassword("test", "1", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	store.waitPendingStores()
+	store.deletePassword("1")
+	if err := store.reserveCapacity("2", "test"); err != nil {
+		t.Errorf("Expected deletion to make room: %v", err)
+	}
+}
+
+func Test_deletePasswordExpired(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store, now := newExpiringStore(buf, ExpiryConfig{TTL: time.Minute})
+	store.storePassword("test", "1", 0, 0)
+	store.waitPendingStores()
+	*now = now.Add(time.Minute)
+	if state := store.deletePassword("1"); state != hashExpired {
+		t.Errorf("Expected expired hash to be left to the janitor, got %d", state)
+	}
+}
+
+func Test_tombstonesForgotten(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store, now := newExpiringStore(buf, ExpiryConfig{})
+	store.setTombstoneWindow(time.Hour)
+	for i := 1; i <= 3; i++ {
+		store.storePassword("test", fmt.Sprint(i), 0, 0)
+		store.waitPendingStores()
+		store.deletePassword(fmt.Sprint(i))
+	}
+	if store.tombstones != 3 {
+		t.Errorf("Expected 3 tombstones, got %d", store.tombstones)
+	}
+
+	// the next deletion forgets past tombstones
+	*now = now.Add(time.Hour)
+	store.deletePassword("bogus")
+	if _, state := store.retrievePassword("1"); state != hashUnknown {
+		t.Errorf("Expected tombstone to be forgotten, got %d", state)
+	}
+	if store.tombstones != 0 || len(store.gone) != 0 {
+		t.Errorf("Expected no tombstones left, got %d", store.tombstones)
+	}
+}
+
+func Test_tombstonesDisabled(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	store.setTombstoneWindow(0)
+	store.storePassword("test", "1", 0, 0)
+	store.waitPendingStores()
+	store.deletePassword("1")
+	if _, state := store.retrievePassword("1"); state != hashUnknown {
+		t.Errorf("Expected no tombstone, got %d", state)
+	}
+}
@@ -0,0 +1,353 @@
+package ph
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// dumpAvailable, dumpPending, dumpExpired and dumpDeleted are the states of dumped records.
+	dumpAvailable = "available"
+	dumpPending   = "pending"
+	dumpExpired   = "expired"
+	dumpDeleted   = "deleted"
+
+	// dumpContentType is the media type of dumps, JSON Lines.
+	dumpContentType = "application/x-ndjson"
+)
+
+// errInvalidDump is returned when a dump holds a record which cannot be restored.
+var errInvalidDump = errors.New("invalid dump")
+
+// dumpedHash is a record of the store as dumped, one JSON object per line. Stored hashes have when they expire,
+// if ever, and pending ones when they are due along with their time-to-live, if given. Expired and deleted ids
+// have no hash, only when they are forgotten.
+type dumpedHash struct {
+	Id      string        `json:"id"`
+	State   string        `json:"state"`
+	Hash    string        `json:"hash,omitempty"`
+	Expires *time.Time    `json:"expires,omitempty"`
+	Due     *time.Time    `json:"due,omitempty"`
+	TTL     time.Duration `json:"ttl,omitempty"`
+	Until   *time.Time    `json:"until,omitempty"`
+}
+
+// restoreReport tells how many records were restored, skipped as already known or outdated, and rejected
+// for lack of room, as returned by the restore endpoint.
+type restoreReport struct {
+	Restored int `json:"restored"`
+	Skipped  int `json:"skipped"`
+	Rejected int `json:"rejected"`
+}
+
+// dumpableStore is a store whose records can be dumped and restored.
+type dumpableStore interface {
+	dumpHashes() []dumpedHash
+	restoreHashes(hashes []dumpedHash) (restoreReport, error)
+}
+
+// idAdvancer is an id generator which must be told of ids issued elsewhere, such as restored ones,
+// so it never issues them again.
+type idAdvancer interface {
+	advancePast(id string)
+}
+
+// dumpHashes copies every record of the store as of now.
+func (store *passwordHashStore) dumpHashes() []dumpedHash {
+	defer store.lock.RUnlock()
+	store.lock.RLock()
+	return store.appendDump(nil)
+}
+
+// appendDump appends every record of the store to the given ones. Must be called with the read lock held.
+func (store *passwordHashStore) appendDump(dumped []dumpedHash) []dumpedHash {
+	store.hashes.each(func(id string, hashed string) {
+		hash := dumpedHash{Id: id, State: dumpAvailable, Hash: hashed}
+		if at, expiring := store.expiresAt[id]; expiring {
+			hash.Expires = &at
+		}
+		dumped = append(dumped, hash)
+	})
+	for id, pending := range store.pendingHashes {
+		if !store.cancelled[id] {
+			due := pending.due
+			dumped = append(dumped, dumpedHash{Id: id, State: dumpPending, Hash: pending.hashed, Due: &due, TTL: pending.ttl})
+		}
+	}
+	for _, due := range store.forgetting {
+		if state, ok := store.gone[due.id]; ok {
+			until := due.at
+			hash := dumpedHash{Id: due.id, State: dumpDeleted, Until: &until}
+			if state == hashExpired {
+				hash.State = dumpExpired
+			}
+			dumped = append(dumped, hash)
+		}
+	}
+	return dumped
+}
+
+// restoreHashes puts back the given records, skipping ids already known so restoring twice changes nothing.
+func (store *passwordHashStore) restoreHashes(hashes []dumpedHash) (restoreReport, error) {
+	return store.restoreDump(hashes, nil), nil
+}
+
+// restoreDump puts back stored hashes, and remembers expired and deleted ids, as of when they were dumped, while
+// pending hashes are re-scheduled for whatever remains of their delay. Records past their expiry, or due to be
+// forgotten, are skipped. The given function, if any, is called for each pending hash before it is scheduled.
+func (store *passwordHashStore) restoreDump(hashes []dumpedHash, onPending func(hash dumpedHash)) restoreReport {
+	report := restoreReport{}
+	var rejected []string
+	now := store.now()
+	store.lock.Lock()
+	for _, hash := range hashes {
+		if hash.State == dumpPending {
+			continue
+		}
+		if store.knowsLocked(hash.Id) {
+			report.Skipped++
+			continue
+		}
+		switch hash.State {
+		case dumpAvailable:
+			if hash.Expires != nil && !hash.Expires.After(now) {
+				report.Skipped++
+				continue
+			}
+			if err := store.reserveCapacityLocked(hash.Id, hash.Hash); err != nil {
+				rejected = append(rejected, hash.Id)
+				continue
+			}
+			store.hashes.set(hash.Id, hash.Hash)
+			if hash.Expires != nil {
+				store.scheduleExpiryAt(hash.Id, *hash.Expires)
+			}
+			store.trackCapacity(hash.Id, hash.Hash)
+		case dumpExpired, dumpDeleted:
+			if !hash.Until.After(now) {
+				report.Skipped++
+				continue
+			}
+			state := hashDeleted
+			if hash.State == dumpExpired {
+				state = hashExpired
+			}
+			store.rememberGone(hash.Id, state, *hash.Until)
+		}
+		report.Restored++
+	}
+	store.lock.Unlock()
+	store.notifyRemoved()
+	for _, id := range rejected {
+		store.logger.Printf("No room to restore %s", id)
+	}
+	report.Rejected = len(rejected)
+
+	for _, hash := range hashes {
+		if hash.State != dumpPending {
+			continue
+		}
+		if store.knows(hash.Id) {
+			report.Skipped++
+			continue
+		}
+		if err := store.reserveCapacity(hash.Id, hash.Hash); err != nil {
+			store.logger.Printf("No room to restore %s", hash.Id)
+			report.Rejected++
+			continue
+		}
+		if onPending != nil {
+			onPending(hash)
+		}
+		store.schedulePendingAt(hash.Hash, hash.Id, hash.TTL, *hash.Due)
+		report.Restored++
+	}
+	return report
+}
+
+// restoreHashes restores the records, then takes a snapshot so they survive a restart.
+func (logStore *logPasswordHashStore) restoreHashes(hashes []dumpedHash) (restoreReport, error) {
+	report := logStore.passwordHashStore.restoreDump(hashes, func(hash dumpedHash) {
+		record := logRecord{kind: logSubmitted, at: logStore.now(), id: hash.Id, hashed: hash.Hash, ttl: hash.TTL, available: *hash.Due}
+		logStore.pendingLock.Lock()
+		logStore.pending[hash.Id] = record
+		logStore.pendingLock.Unlock()
+	})
+	if report.Restored > 0 {
+		if _, err := logStore.snapshot(); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// dumpHashes copies the records of every shard at once, holding all their locks, so the dump is consistent.
+func (store *shardedPasswordHashStore) dumpHashes() []dumpedHash {
+	for _, shard := range store.shards {
+		shard.lock.RLock()
+	}
+	var dumped []dumpedHash
+	for _, shard := range store.shards {
+		dumped = shard.appendDump(dumped)
+	}
+	for _, shard := range store.shards {
+		shard.lock.RUnlock()
+	}
+	return dumped
+}
+
+// restoreHashes restores each record into the shard of its id.
+func (store *shardedPasswordHashStore) restoreHashes(hashes []dumpedHash) (restoreReport, error) {
+	byShard := make(map[*passwordHashStore][]dumpedHash)
+	for _, hash := range hashes {
+		shard := store.shard(hash.Id)
+		byShard[shard] = append(byShard[shard], hash)
+	}
+	report := restoreReport{}
+	for shard, hashes := range byShard {
+		restored := shard.restoreDump(hashes, nil)
+		report.Restored += restored.Restored
+		report.Skipped += restored.Skipped
+		report.Rejected += restored.Rejected
+	}
+	return report, nil
+}
+
+// dumpHashes dumps the wrapped store, whose hashes stay sealed: they can only be restored with the same data keys.
+func (store *encryptingPasswordHashStore) dumpHashes() []dumpedHash {
+	return store.passwordHashStorer.(dumpableStore).dumpHashes()
+}
+
+// restoreHashes checks every hash opens with one of the data keys before restoring anything into the wrapped store.
+func (store *encryptingPasswordHashStore) restoreHashes(hashes []dumpedHash) (restoreReport, error) {
+	for _, hash := range hashes {
+		if hash.Hash == "" {
+			continue
+		}
+		if _, _, err := store.keys.open(hash.Id, hash.Hash); err != nil {
+			return restoreReport{}, fmt.Errorf("%w: hash of %s does not open: %v", errInvalidDump, hash.Id, err)
+		}
+	}
+	return store.passwordHashStorer.(dumpableStore).restoreHashes(hashes)
+}
+
+// writeDump writes the records as JSON Lines.
+func writeDump(w io.Writer, dumped []dumpedHash) error {
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	for _, hash := range dumped {
+		if err := encoder.Encode(hash); err != nil {
+			return err
+		}
+	}
+	return buffered.Flush()
+}
+
+// readDump reads and validates every record of a dump, failing on the first invalid one, so nothing
+// is restored from a dump with any invalid record.
+func readDump(r io.Reader, validId func(id string) bool) ([]dumpedHash, error) {
+	hashes := []dumpedHash{}
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLogRecord)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var hash dumpedHash
+		if err := json.Unmarshal(scanner.Bytes(), &hash); err != nil {
+			return nil, fmt.Errorf("%w: line %d: malformed record", errInvalidDump, line)
+		}
+		if err := validateDumped(hash, validId); err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", errInvalidDump, line, err)
+		}
+		if seen[hash.Id] {
+			return nil, fmt.Errorf("%w: line %d: duplicate id %s", errInvalidDump, line, hash.Id)
+		}
+		seen[hash.Id] = true
+		hashes = append(hashes, hash)
+	}
+	return hashes, scanner.Err()
+}
+
+// validateDumped checks a record has a valid id, and what its state calls for.
+func validateDumped(hash dumpedHash, validId func(id string) bool) error {
+	if !validId(hash.Id) {
+		return fmt.Errorf("invalid id %q", hash.Id)
+	}
+	switch hash.State {
+	case dumpAvailable:
+		if hash.Hash == "" {
+			return errors.New("missing hash")
+		}
+	case dumpPending:
+		if hash.Hash == "" || hash.Due == nil {
+			return errors.New("missing hash or due time")
+		}
+		if hash.TTL < 0 {
+			return errors.New("negative ttl")
+		}
+	case dumpExpired, dumpDeleted:
+		if hash.Hash != "" || hash.Until == nil {
+			return errors.New("expected no hash and a time to forget")
+		}
+	default:
+		return fmt.Errorf("unknown state %q", hash.State)
+	}
+	return nil
+}
+
+// DumpHashes gets a dump of the service at the given base URL, such as "http://localhost:8090", using the
+// admin token, and writes it to the given writer.
+func DumpHashes(baseURL string, token string, out io.Writer) error {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(baseURL, "/")+"/admin/dump", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := adminRequest(req, token)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+// RestoreHashes sends the dump read from the given reader to the service at the given base URL, using the
+// admin token, and writes the report it returns to the given writer.
+func RestoreHashes(baseURL string, token string, in io.Reader, out io.Writer) error {
+	req, err := http.NewRequest("POST", strings.TrimSuffix(baseURL, "/")+"/admin/restore", in)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", dumpContentType)
+	resp, err := adminRequest(req, token)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+// adminRequest sends the request with the admin token, failing with whatever the service said unless it succeeded.
+func adminRequest(req *http.Request, token string) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
@@ -0,0 +1,312 @@
+package ph
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newDumpedStore creates a store holding a hash of each state: 1 stored, 2 stored until it expires,
+// 3 pending, 4 deleted and 5 expired.
+func newDumpedStore(buf *bytes.Buffer) *passwordHashStore {
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	store.setExpiry(ExpiryConfig{Retention: time.Hour})
+	for _, id := range []string{"1", "2", "4", "5"} {
+		ttl := time.Duration(0)
+		if id != "1" {
+			ttl = time.Hour
+		}
+		store.storePassword("hash-"+id, id, ttl, 0)
+	}
+	store.waitPendingStores()
+	store.storePassword("hash-3", "3", time.Minute, time.Hour)
+	store.deletePassword("4")
+	store.lock.Lock()
+	store.removeHash("5")
+	store.rememberGone("5", hashExpired, store.now().Add(time.Hour))
+	store.lock.Unlock()
+	return store
+}
+
+// sortedDump dumps the store, sorted by id.
+func sortedDump(store dumpableStore) []dumpedHash {
+	dumped := store.dumpHashes()
+	sort.Slice(dumped, func(i, j int) bool {
+		return dumped[i].Id < dumped[j].Id
+	})
+	return dumped
+}
+
+func Test_dumpHashes(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newDumpedStore(buf)
+	defer store.drainPending(ShutdownConfig{Mode: ShutdownAbandon})
+
+	dumped := sortedDump(store)
+	if len(dumped) != 5 {
+		t.Fatalf("Expected a record per id, got %+v", dumped)
+	}
+	states := []string{dumpAvailable, dumpAvailable, dumpPending, dumpDeleted, dumpExpired}
+	for i, hash := range dumped {
+		if hash.State != states[i] {
+			t.Errorf("Expected %s to be %s, got %s", hash.Id, states[i], hash.State)
+		}
+	}
+	if dumped[0].Hash != "hash-1" || dumped[0].Expires != nil {
+		t.Errorf("Unexpected stored hash: %+v", dumped[0])
+	}
+	if dumped[1].Expires == nil || dumped[1].Expires.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("Expected hash to expire in an hour: %+v", dumped[1])
+	}
+	if dumped[2].Hash != "hash-3" || dumped[2].Due == nil || dumped[2].TTL != time.Minute {
+		t.Errorf("Unexpected pending hash: %+v", dumped[2])
+	}
+	if dumped[3].Hash != "" || dumped[3].Until == nil || dumped[4].Until == nil {
+		t.Errorf("Expected gone ids to be remembered: %+v %+v", dumped[3], dumped[4])
+	}
+
+	// cancelled hashes are left out
+	store.deletePassword("3")
+	if dumped := sortedDump(store); len(dumped) != 5 || dumped[2].State != dumpDeleted {
+		t.Errorf("Expected cancelled hash to be dumped as deleted: %+v", dumped)
+	}
+}
+
+func Test_restoreHashes(t *testing.T) {
+	buf := &bytes.Buffer{}
+	source := newDumpedStore(buf)
+	defer source.drainPending(ShutdownConfig{Mode: ShutdownAbandon})
+	dumped := sortedDump(source)
+	past := time.Now().Add(-time.Second)
+	dumped = append(dumped,
+		dumpedHash{Id: "6", State: dumpAvailable, Hash: "hash-6", Expires: &past},
+		dumpedHash{Id: "7", State: dumpDeleted, Until: &past})
+
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	store.setExpiry(ExpiryConfig{Retention: time.Hour})
+	defer store.drainPending(ShutdownConfig{Mode: ShutdownAbandon})
+	report, err := store.restoreHashes(dumped)
+	if err != nil || report != (restoreReport{Restored: 5, Skipped: 2}) {
+		t.Errorf("Unexpected report: %+v %v", report, err)
+	}
+	restored := sortedDump(store)
+	if len(restored) != 5 {
+		t.Fatalf("Expected outdated records to be skipped, got %+v", restored)
+	}
+	for i, hash := range restored {
+		if hash.Id != dumped[i].Id || hash.State != dumped[i].State || hash.Hash != dumped[i].Hash {
+			t.Errorf("Expected %+v to be restored as is, got %+v", dumped[i], hash)
+		}
+	}
+	if !restored[1].Expires.Equal(*dumped[1].Expires) || !restored[2].Due.Equal(*dumped[2].Due) || !restored[3].Until.Equal(*dumped[3].Until) {
+		t.Errorf("Expected times to be restored as is: %+v", restored)
+	}
+	if _, state := store.retrievePassword("3"); state != hashPending {
+		t.Errorf("Expected hash to be pending, got %d", state)
+	}
+
+	// restoring again changes nothing
+	report, err = store.restoreHashes(dumped)
+	if err != nil || report != (restoreReport{Skipped: 7}) {
+		t.Errorf("Unexpected report: %+v %v", report, err)
+	}
+}
+
+func Test_restoreHashesNoRoom(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	store.setCapacity(CapacityConfig{MaxRecords: 1, Policy: RejectPolicy})
+	due := time.Now().Add(time.Hour)
+	report, err := store.restoreHashes([]dumpedHash{
+		{Id: "1", State: dumpAvailable, Hash: "hash-1"},
+		{Id: "2", State: dumpPending, Hash: "hash-2", Due: &due},
+	})
+	if err != nil || report != (restoreReport{Restored: 1, Rejected: 1}) {
+		t.Errorf("Unexpected report: %+v %v", report, err)
+	}
+	if !strings.Contains(buf.String(), "No room to restore 2\n") {
+		t.Errorf("Expected log indicating rejection: %s", buf.String())
+	}
+}
+
+func Test_readDump(t *testing.T) {
+	cases := []struct {
+		dump string
+		err  string
+	}{
+		{`{"id":"1","state":"available","hash":"x"}` + "\n\n" + `{"id":"2","state":"deleted","until":"2020-01-01T00:00:00Z"}`, ""},
+		{`{"id":"1","state":"available","hash":"x"}` + "\n" + `{"id":"1","state":"available","hash":"x"}`, "invalid dump: line 2: duplicate id 1"},
+		{`{"id":"1"`, "invalid dump: line 1: malformed record"},
+		{`{"id":"a","state":"available","hash":"x"}`, `invalid dump: line 1: invalid id "a"`},
+		{`{"id":"1","state":"stored","hash":"x"}`, `invalid dump: line 1: unknown state "stored"`},
+		{`{"id":"1","state":"available"}`, "invalid dump: line 1: missing hash"},
+		{`{"id":"1","state":"pending","hash":"x"}`, "invalid dump: line 1: missing hash or due time"},
+		{`{"id":"1","state":"pending","hash":"x","due":"2020-01-01T00:00:00Z","ttl":-1}`, "invalid dump: line 1: negative ttl"},
+		{`{"id":"1","state":"expired","hash":"x","until":"2020-01-01T00:00:00Z"}`, "invalid dump: line 1: expected no hash and a time to forget"},
+	}
+	for _, c := range cases {
+		hashes, err := readDump(strings.NewReader(c.dump), validDecimalId)
+		if c.err == "" {
+			if err != nil || len(hashes) != 2 {
+				t.Errorf("Expected valid dump, got %+v %v", hashes, err)
+			}
+		} else if err == nil || err.Error() != c.err || !errors.Is(err, errInvalidDump) {
+			t.Errorf("Expected %q, got %v", c.err, err)
+		}
+	}
+}
+
+func Test_shardedDump(t *testing.T) {
+	buf := &bytes.Buffer{}
+	source := newDumpedStore(buf)
+	defer source.drainPending(ShutdownConfig{Mode: ShutdownAbandon})
+	dumped := sortedDump(source)
+
+	store := newShardedPasswordHashStore(log.New(buf, "", 0), 4)
+	store.setExpiry(ExpiryConfig{Retention: time.Hour})
+	defer store.drainPending(ShutdownConfig{Mode: ShutdownAbandon})
+	if report, err := store.restoreHashes(dumped); err != nil || report != (restoreReport{Restored: 5}) {
+		t.Errorf("Unexpected report: %+v %v", report, err)
+	}
+	restored := sortedDump(store)
+	if len(restored) != 5 {
+		t.Fatalf("Expected every record to be dumped from all shards, got %+v", restored)
+	}
+	for i, hash := range restored {
+		if hash.Id != dumped[i].Id || hash.State != dumped[i].State {
+			t.Errorf("Expected %+v to be restored as is, got %+v", dumped[i], hash)
+		}
+	}
+}
+
+func Test_logPasswordHashStoreRestoreHashes(t *testing.T) {
+	buf := &bytes.Buffer{}
+	source := newDumpedStore(buf)
+	defer source.drainPending(ShutdownConfig{Mode: ShutdownAbandon})
+	dumped := sortedDump(source)
+
+	dir := t.TempDir()
+	store := newLogPasswordHashStore(newPasswordHashStore(log.New(buf, "", 0)), openTestLog(t, dir))
+	store.setExpiry(ExpiryConfig{Retention: time.Hour})
+	if report, err := store.restoreHashes(dumped); err != nil || report.Restored != 5 {
+		t.Errorf("Unexpected report: %+v %v", report, err)
+	}
+	// crash right after restoring
+	store.hashLog.Close()
+
+	buf.Reset()
+	store = newLogPasswordHashStore(newPasswordHashStore(log.New(buf, "", 0)), openTestLog(t, dir))
+	defer store.close()
+	defer store.drainPending(ShutdownConfig{Mode: ShutdownAbandon})
+	if hash, state := store.retrievePassword("2"); hash != "hash-2" || state != hashAvailable {
+		t.Errorf("Expected restored hash to survive restart, got %s %d", hash, state)
+	}
+	if _, state := store.retrievePassword("3"); state != hashPending {
+		t.Errorf("Expected restored pending hash to survive restart, got %d", state)
+	}
+	if _, state := store.retrievePassword("4"); state != hashDeleted {
+		t.Errorf("Expected restored deletion to survive restart, got %d", state)
+	}
+	if !strings.Contains(buf.String(), "Restored 2 hashes, 1 pending, from snapshot and 0 log records\n") {
+		t.Errorf("Expected log indicating restoration: %s", buf.String())
+	}
+}
+
+func Test_encryptingRestoreHashes(t *testing.T) {
+	buf := &bytes.Buffer{}
+	source := newEncryptedStore(t, buf, newPasswordHashStore(log.New(buf, "", 0)))
+	source.storePassword("very-hashed", "1", 0, 0)
+	source.waitPendingStores()
+	dumped := source.dumpHashes()
+	if len(dumped) != 1 || !strings.HasPrefix(dumped[0].Hash, "k1.") {
+		t.Fatalf("Expected hash to be dumped sealed: %+v", dumped)
+	}
+
+	// another key ring does not open it
+	store := newEncryptedStore(t, buf, newPasswordHashStore(log.New(buf, "", 0)))
+	if _, err := store.restoreHashes(dumped); !errors.Is(err, errInvalidDump) {
+		t.Errorf("Expected hash to be refused, got %v", err)
+	}
+	if _, state := store.retrievePassword("1"); state != hashUnknown {
+		t.Errorf("Expected nothing to be restored, got %d", state)
+	}
+}
+
+func Test_dumpAndRestore(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := log.New(buf, "", 0)
+	source := NewPasswordHasherServer(logger, WithIdStrategy(SequentialIds, 0), WithAdminToken("admin-secret"), WithDelay(DelayConfig{}))
+	for i := 0; i < 3; i++ {
+		source.phStore.storePassword("hash", source.idGen.nextId(), 0, 0)
+	}
+	source.phStore.waitPendingStores()
+	sourceService := httptest.NewServer(source.http.Handler)
+	defer sourceService.Close()
+
+	dump := &bytes.Buffer{}
+	if err := DumpHashes(sourceService.URL, "admin-secret", dump); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(dump.String(), "\n") != 3 {
+		t.Errorf("Expected a line per hash: %s", dump.String())
+	}
+	if err := DumpHashes(sourceService.URL, "bogus", &bytes.Buffer{}); err == nil || err.Error() != "403 Forbidden: Forbidden" {
+		t.Errorf("Expected dump to be refused, got %v", err)
+	}
+
+	target := NewPasswordHasherServer(logger, WithIdStrategy(SequentialIds, 0), WithAdminToken("admin-secret"))
+	targetService := httptest.NewServer(target.http.Handler)
+	defer targetService.Close()
+	report := &bytes.Buffer{}
+	if err := RestoreHashes(targetService.URL, "admin-secret", bytes.NewReader(dump.Bytes()), report); err != nil {
+		t.Fatal(err)
+	}
+	if report.String() != `{"restored":3,"skipped":0,"rejected":0}` {
+		t.Errorf("Unexpected report: %s", report.String())
+	}
+	if hash, state := target.phStore.retrievePassword("2"); hash != "hash" || state != hashAvailable {
+		t.Errorf("Expected hash to be restored, got %s %d", hash, state)
+	}
+	if id := target.idGen.nextId(); id != "4" {
+		t.Errorf("Expected ids to move past restored ones, got %s", id)
+	}
+	if !strings.Contains(buf.String(), "Restored 3 records, skipped 0, rejected 0, for admin at ") {
+		t.Errorf("Expected log indicating restoration: %s", buf.String())
+	}
+
+	err := RestoreHashes(targetService.URL, "admin-secret", strings.NewReader(`{"id":"x"}`), report)
+	if err == nil || err.Error() != `400 Bad Request: invalid dump: line 1: invalid id "x"` {
+		t.Errorf("Expected invalid dump to be refused, got %v", err)
+	}
+}
+
+func Test_restoreStoreNotDumpable(t *testing.T) {
+	buf := &bytes.Buffer{}
+	server := &PasswordHasherServer{admin: "admin-secret", logger: log.New(buf, "", 0)}
+	for _, path := range []string{"/admin/dump", "/admin/restore"} {
+		method := http.MethodGet
+		if path == "/admin/restore" {
+			method = http.MethodPost
+		}
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(method, path, strings.NewReader(""))
+		if err != nil {
+			panic(err)
+		}
+		r.Header.Set("Authorization", "Bearer admin-secret")
+		if path == "/admin/dump" {
+			server.dumpStore(w, r)
+		} else {
+			server.restoreStore(w, r)
+		}
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected %s to be not found, got %d", path, w.Code)
+		}
+	}
+}
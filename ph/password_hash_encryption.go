@@ -0,0 +1,226 @@
+package ph
+
+import (
+	"context"
+	"errors"
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rewriteBatchSize bounds how many hashes are rewritten while holding the write lock.
+const rewriteBatchSize = 1000
+
+// errNotRewritable is returned when re-encrypting a store which cannot rewrite its hashes in place.
+var errNotRewritable = errors.New("store cannot rewrite its hashes")
+
+// keyRotator is a store whose data key can be rotated on demand.
+type keyRotator interface {
+	rotateKey() (string, error)
+}
+
+// rewritableStore is a store whose stored hashes can be rewritten in place, such as to re-encrypt them.
+type rewritableStore interface {
+	rewriteHashes(rewrite func(id string, hashed string) (string, bool)) int
+}
+
+// encryptionStats are the data key and re-encryption counts reported by the stats endpoint.
+type encryptionStats struct {
+	Key         string `json:"key"`
+	Keys        int    `json:"keys"`
+	Reencrypted int64  `json:"reencrypted"`
+	Failed      int64  `json:"failed"`
+}
+
+// encryptingPasswordHashStore seals hashes with AES-256-GCM before handing them to the store it wraps,
+// so they are encrypted at rest wherever that store keeps them, and opens them again on the way out.
+type encryptingPasswordHashStore struct {
+	reencryptedCount int64
+	failedCount      int64
+	passwordHashStorer
+	keys   *KeyRing
+	logger *log.Logger
+
+	// the re-encryption job, of which only one runs at a time
+	reencrypting     bool
+	reencryptionLock sync.Mutex
+	reencryption     sync.WaitGroup
+}
+
+// newEncryptingPasswordHashStore wraps the given store, sealing hashes with the current key of the ring.
+func newEncryptingPasswordHashStore(logger *log.Logger, store passwordHashStorer, keys *KeyRing) *encryptingPasswordHashStore {
+	return &encryptingPasswordHashStore{passwordHashStorer: store, keys: keys, logger: logger}
+}
+
+// storePassword seals the hash, bound to its id, and stores it sealed.
+func (store *encryptingPasswordHashStore) storePassword(hashed string, id string, ttl time.Duration, delay time.Duration) error {
+	return store.storePasswordContext(context.Background(), hashed, id, ttl, delay)
+}
+
+// storePasswordContext seals the hash, storing it with the given context.
+func (store *encryptingPasswordHashStore) storePasswordContext(ctx context.Context, hashed string, id string, ttl time.Duration, delay time.Duration) error {
+	sealed, err := store.keys.seal(id, hashed)
+	if err != nil {
+		store.logger.Printf("ERROR: Failed to seal hash for %s: %v", id, err)
+		return err
+	}
+	return storeWithContext(ctx, store.passwordHashStorer, sealed, id, ttl, delay)
+}
+
+// retrievePassword opens the stored hash, if any. A hash which cannot be opened, its key lost or its data
+// tampered with, is reported as failed rather than unknown, so it does not pass for one never stored.
+func (store *encryptingPasswordHashStore) retrievePassword(id string) (string, hashState) {
+	return store.retrievePasswordContext(context.Background(), id)
+}
+
+// retrievePasswordContext opens the hash retrieved with the given context, if any.
+func (store *encryptingPasswordHashStore) retrievePasswordContext(ctx context.Context, id string) (string, hashState) {
+	sealed, state := retrieveWithContext(ctx, store.passwordHashStorer, id)
+	if state != hashAvailable {
+		return sealed, state
+	}
+	hashed, _, err := store.keys.open(id, sealed)
+	if err != nil {
+		store.logger.Printf("ERROR: Failed to open hash for %s: %v", id, err)
+		return "", hashFailed
+	}
+	return hashed, state
+}
+
+// deletePasswordContext removes the hash with the given context.
+func (store *encryptingPasswordHashStore) deletePasswordContext(ctx context.Context, id string) hashState {
+	return deleteWithContext(ctx, store.passwordHashStorer, id)
+}
+
+// onStored registers a listener for stored hashes, which it gets opened.
+func (store *encryptingPasswordHashStore) onStored(listener storeListener) {
+	store.passwordHashStorer.onStored(func(id string, sealed string) {
+		hashed, _, err := store.keys.open(id, sealed)
+		if err != nil {
+			store.logger.Printf("ERROR: Failed to open hash for %s: %v", id, err)
+			return
+		}
+		listener(id, hashed)
+	})
+}
+
+// rotateKey switches to a new data key, then re-encrypts every stored hash with it in the background.
+// Pending hashes are stored with the key they were sealed with, so they are left to a later rotation.
+func (store *encryptingPasswordHashStore) rotateKey() (string, error) {
+	if _, ok := store.passwordHashStorer.(rewritableStore); !ok {
+		return "", errNotRewritable
+	}
+	kid, err := store.keys.Rotate()
+	if err != nil {
+		return "", err
+	}
+	store.logger.Printf("Rotated to data key %s", kid)
+	store.startReencrypting()
+	return kid, nil
+}
+
+// startReencrypting runs the re-encryption job, unless already running. A running job picks up the current
+// key as it goes, so there is no need to run another one.
+func (store *encryptingPasswordHashStore) startReencrypting() {
+	defer store.reencryptionLock.Unlock()
+	store.reencryptionLock.Lock()
+	if store.reencrypting {
+		return
+	}
+	store.reencrypting = true
+	store.reencryption.Add(1)
+	go store.reencrypt()
+}
+
+// reencrypt rewrites every stored hash sealed with any but the current key.
+func (store *encryptingPasswordHashStore) reencrypt() {
+	defer store.reencryption.Done()
+	store.logger.Print("Re-encrypting hashes...")
+	rewritten := store.passwordHashStorer.(rewritableStore).rewriteHashes(func(id string, sealed string) (string, bool) {
+		hashed, kid, err := store.keys.open(id, sealed)
+		if err != nil {
+			atomic.AddInt64(&store.failedCount, 1)
+			store.logger.Printf("ERROR: Failed to open hash for %s: %v", id, err)
+			return "", false
+		}
+		if kid == store.keys.currentKey() {
+			return "", false
+		}
+		resealed, err := store.keys.seal(id, hashed)
+		if err != nil {
+			atomic.AddInt64(&store.failedCount, 1)
+			return "", false
+		}
+		return resealed, true
+	})
+	atomic.AddInt64(&store.reencryptedCount, int64(rewritten))
+	store.reencryptionLock.Lock()
+	store.reencrypting = false
+	store.reencryptionLock.Unlock()
+	store.logger.Printf("%d hashes re-encrypted", rewritten)
+}
+
+// rewriteHashes replaces the stored hashes for which the given function returns a new value, a batch at
+// a time, so readers are never blocked for long. Pending hashes are left alone.
+func (store *passwordHashStore) rewriteHashes(rewrite func(id string, hashed string) (string, bool)) (rewritten int) {
+	store.lock.RLock()
+	ids := make([]string, 0, store.hashes.count())
+	store.hashes.each(func(id string, hashed string) {
+		ids = append(ids, id)
+	})
+	store.lock.RUnlock()
+
+	for start := 0; start < len(ids); start += rewriteBatchSize {
+		end := start + rewriteBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		store.lock.Lock()
+		for _, id := range ids[start:end] {
+			hashed, ok := store.hashes.get(id)
+			if !ok {
+				continue // removed meanwhile
+			}
+			if updated, ok := rewrite(id, hashed); ok {
+				store.hashes.set(id, updated)
+				if store.capacity != nil {
+					store.usedBytes += int64(len(updated) - len(hashed))
+				}
+				rewritten++
+			}
+		}
+		store.lock.Unlock()
+		runtime.Gosched()
+	}
+	return rewritten
+}
+
+// rewriteHashes rewrites the stored hashes, then takes a snapshot so the old values are dropped from the log.
+func (logStore *logPasswordHashStore) rewriteHashes(rewrite func(id string, hashed string) (string, bool)) int {
+	rewritten := logStore.passwordHashStore.rewriteHashes(rewrite)
+	if rewritten > 0 {
+		if _, err := logStore.snapshot(); err != nil {
+			logStore.logger.Printf("ERROR: Failed to take snapshot: %v", err)
+		}
+	}
+	return rewritten
+}
+
+// collectStats adds the data key and re-encryption counts to the wrapped store's stats.
+func (store *encryptingPasswordHashStore) collectStats(stats *serverStats) {
+	store.passwordHashStorer.collectStats(stats)
+	stats.Encryption = &encryptionStats{
+		Key:         store.keys.currentKey(),
+		Keys:        store.keys.keyCount(),
+		Reencrypted: atomic.LoadInt64(&store.reencryptedCount),
+		Failed:      atomic.LoadInt64(&store.failedCount),
+	}
+}
+
+// close waits for any re-encryption job before closing the wrapped store.
+func (store *encryptingPasswordHashStore) close() error {
+	store.reencryption.Wait()
+	return store.passwordHashStorer.close()
+}
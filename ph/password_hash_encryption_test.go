@@ -0,0 +1,124 @@
+package ph
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newEncryptedStore(t *testing.T, buf *bytes.Buffer, inner passwordHashStorer) *encryptingPasswordHashStore {
+	ring := openTestKeyRing(t, filepath.Join(t.TempDir(), "data.keys"))
+	return newEncryptingPasswordHashStore(log.New(buf, "", 0), inner, ring)
+}
+
+func Test_encryptingPasswordHashStore(t *testing.T) {
+	buf := &bytes.Buffer{}
+	inner := newPasswordHashStore(log.New(buf, "", 0))
+	store := newEncryptedStore(t, buf, inner)
+	var stored string
+	store.onStored(func(id string, hashed string) {
+		stored = hashed
+	})
+	if err := store.storePassword("very-hashed", "1", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	forceGoroutineScheduler()
+	store.waitPendingStores()
+
+	if sealed, _ := inner.hashes.get("1"); !strings.HasPrefix(sealed, "k1.") {
+		t.Errorf("Expected hash to be stored sealed, got %s", sealed)
+	}
+	if hash, state := store.retrievePassword("1"); hash != "very-hashed" || state != hashAvailable {
+		t.Errorf("Expected hash to be opened, got %s %d", hash, state)
+	}
+	if stored != "very-hashed" {
+		t.Errorf("Expected listeners to get the hash opened, got %s", stored)
+	}
+	if _, state := store.retrievePassword("2"); state != hashUnknown {
+		t.Errorf("Expected unknown id, got %d", state)
+	}
+
+	// a hash moved to another id does not open
+	sealed, _ := inner.hashes.get("1")
+	inner.hashes.set("2", sealed)
+	if hash, state := store.retrievePassword("2"); hash != "" || state != hashFailed {
+		t.Errorf("Expected tampered hash to be refused, got %s %d", hash, state)
+	}
+	if _, err := (storeAdapter{store}).Get(context.Background(), "2"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected tampered hash to fail the store, got %v", err)
+	}
+	if !strings.Contains(buf.String(), "ERROR: Failed to open hash for 2: corrupt sealed hash\n") {
+		t.Errorf("Expected log indicating failure: %s", buf.String())
+	}
+}
+
+func Test_rotateKeyReencrypts(t *testing.T) {
+	buf := &bytes.Buffer{}
+	inner := newPasswordHashStore(log.New(buf, "", 0))
+	inner.setCapacity(CapacityConfig{MaxRecords: 10})
+	store := newEncryptedStore(t, buf, inner)
+	for _, id := range []string{"1", "2", "3"} {
+		store.storePassword("hash-"+id, id, 0, 0)
+	}
+	forceGoroutineScheduler()
+	store.waitPendingStores()
+	used := inner.usedBytes
+
+	kid, err := store.rotateKey()
+	if err != nil || kid != "k2" {
+		t.Fatalf("Unexpected rotation: %s %v", kid, err)
+	}
+	store.close()
+	inner.hashes.each(func(id string, sealed string) {
+		if !strings.HasPrefix(sealed, "k2.") {
+			t.Errorf("Expected %s to be re-encrypted, got %s", id, sealed)
+		}
+		if hash, _ := store.retrievePassword(id); hash != "hash-"+id {
+			t.Errorf("Expected %s to open after re-encryption, got %s", id, hash)
+		}
+	})
+	if inner.usedBytes != used {
+		t.Errorf("Expected size to be unchanged, got %d instead of %d", inner.usedBytes, used)
+	}
+	if !strings.Contains(buf.String(), "Rotated to data key k2\nRe-encrypting hashes...\n3 hashes re-encrypted\n") {
+		t.Errorf("Expected log indicating re-encryption: %s", buf.String())
+	}
+
+	stats := &serverStats{}
+	store.collectStats(stats)
+	if *stats.Encryption != (encryptionStats{Key: "k2", Keys: 2, Reencrypted: 3}) {
+		t.Errorf("Unexpected stats: %+v", stats.Encryption)
+	}
+
+	if _, err := newEncryptedStore(t, buf, &MockStore{t: t}).rotateKey(); err != errNotRewritable {
+		t.Errorf("Expected store without rewriting to refuse rotation: %v", err)
+	}
+}
+
+func Test_rotateKeyLogged(t *testing.T) {
+	buf := &bytes.Buffer{}
+	dir := t.TempDir()
+	now := time.Unix(1000, 0)
+	logStore := newLoggedStore(t, buf, dir, now)
+	store := newEncryptedStore(t, buf, logStore)
+	store.storePassword("hash-1", "1", 0, 0)
+	forceGoroutineScheduler()
+	store.waitPendingStores()
+	store.rotateKey()
+	store.reencryption.Wait()
+
+	// the snapshot taken after re-encrypting leaves no hash sealed with the old key on disk
+	snapshot := logStore.capture(0)
+	if len(snapshot.stored) != 1 || !strings.HasPrefix(snapshot.stored[0].hashed, "k2.") {
+		t.Errorf("Unexpected snapshot: %+v", snapshot)
+	}
+	if stats := logStore.hashLog.logStats(now); stats.SnapshotAge == nil || stats.Bytes != 0 {
+		t.Errorf("Expected log to be compacted after re-encrypting: %+v", stats)
+	}
+	store.close()
+}
@@ -0,0 +1,203 @@
+package ph
+
+import (
+	"container/heap"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// ExpiryConfig configures how long stored hashes are kept, and how the janitor purges them.
+// A zero TTL keeps hashes forever, unless a TTL is given along with the password.
+type ExpiryConfig struct {
+	TTL       time.Duration
+	MaxTTL    time.Duration
+	Retention time.Duration
+	Interval  time.Duration
+	BatchSize int
+}
+
+const (
+	defaultExpiryRetention = 24 * time.Hour
+	defaultExpiryInterval  = time.Minute
+	defaultExpiryBatchSize = 1000
+)
+
+// expiryStats are the expiry counts reported by the stats endpoint.
+type expiryStats struct {
+	Expired    int64 `json:"expired"`
+	Remembered int64 `json:"remembered"`
+}
+
+// expiringHash is an entry of the expiry queue, ordered by its deadline.
+type expiringHash struct {
+	id string
+	at time.Time
+}
+
+// expiryQueue is a min-heap of hashes by their expiry deadline.
+type expiryQueue []expiringHash
+
+func (queue expiryQueue) Len() int            { return len(queue) }
+func (queue expiryQueue) Less(i, j int) bool  { return queue[i].at.Before(queue[j].at) }
+func (queue expiryQueue) Swap(i, j int)       { queue[i], queue[j] = queue[j], queue[i] }
+func (queue *expiryQueue) Push(x interface{}) { *queue = append(*queue, x.(expiringHash)) }
+func (queue *expiryQueue) Pop() interface{} {
+	old := *queue
+	last := old[len(old)-1]
+	*queue = old[:len(old)-1]
+	return last
+}
+
+// setExpiry enables expiry of stored hashes, filling in defaults for any unset janitor settings.
+// It must be called before any password is stored.
+func (store *passwordHashStore) setExpiry(config ExpiryConfig) {
+	if config.Retention <= 0 {
+		config.Retention = defaultExpiryRetention
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultExpiryInterval
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultExpiryBatchSize
+	}
+	store.expiry = &config
+}
+
+// scheduleExpiry records when a hash stored at the given time expires, if ever. Must be called with the write lock held.
+func (store *passwordHashStore) scheduleExpiry(id string, stored time.Time, ttl time.Duration) {
+	if ttl <= 0 && store.expiry != nil {
+		ttl = store.expiry.TTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	store.scheduleExpiryAt(id, stored.Add(ttl))
+}
+
+// scheduleExpiryAt records when a stored hash expires. Must be called with the write lock held.
+func (store *passwordHashStore) scheduleExpiryAt(id string, at time.Time) {
+	store.expiresAt[id] = at
+	heap.Push(&store.expiring, expiringHash{id, at})
+}
+
+// expireHashes removes every hash due by now, and forgets expired ids past their retention.
+// The write lock is only held for up to one batch at a time, so readers are never blocked for long.
+func (store *passwordHashStore) expireHashes(now time.Time) (expired int) {
+	for {
+		removed, more := store.expireBatch(now)
+		store.notifyRemoved()
+		expired += removed
+		if !more {
+			return expired
+		}
+		runtime.Gosched()
+	}
+}
+
+// expireBatch removes up to one batch of due hashes and forgotten ids, telling whether more are due.
+func (store *passwordHashStore) expireBatch(now time.Time) (expired int, more bool) {
+	defer store.lock.Unlock()
+	store.lock.Lock()
+
+	work := 0
+	for ; work < store.expiry.BatchSize; work++ {
+		if len(store.expiring) == 0 || store.expiring[0].at.After(now) {
+			break
+		}
+		due := heap.Pop(&store.expiring).(expiringHash)
+		if at, ok := store.expiresAt[due.id]; !ok || !at.Equal(due.at) {
+			continue // already removed some other way
+		}
+		store.removeHash(due.id)
+		store.rememberGone(due.id, hashExpired, due.at.Add(store.expiry.Retention))
+		store.noteRemoved(due.id, hashExpired, due.at)
+		expired++
+	}
+	work += store.forgetGone(now, store.expiry.BatchSize-work)
+	atomic.AddInt64(&store.expiredCount, int64(expired))
+
+	more = (len(store.expiring) > 0 && !store.expiring[0].at.After(now)) ||
+		(len(store.forgetting) > 0 && !store.forgetting[0].at.After(now))
+	return expired, more
+}
+
+// rememberGone keeps an expired or deleted id known as such until the given time.
+// Must be called with the write lock held.
+func (store *passwordHashStore) rememberGone(id string, state hashState, until time.Time) {
+	store.gone[id] = state
+	heap.Push(&store.forgetting, expiringHash{id, until})
+	if state == hashExpired {
+		store.expiredIds++
+	} else {
+		store.tombstones++
+	}
+}
+
+// forgetGone forgets up to the given number of expired or deleted ids which are due by now.
+// Must be called with the write lock held.
+func (store *passwordHashStore) forgetGone(now time.Time, limit int) (forgotten int) {
+	for ; forgotten < limit && len(store.forgetting) > 0 && !store.forgetting[0].at.After(now); forgotten++ {
+		due := heap.Pop(&store.forgetting).(expiringHash)
+		if store.gone[due.id] == hashExpired {
+			store.expiredIds--
+		} else {
+			store.tombstones--
+		}
+		delete(store.gone, due.id)
+	}
+	return forgotten
+}
+
+// startExpiring runs the janitor in the background, if expiry is enabled.
+func (store *passwordHashStore) startExpiring() {
+	if store.expiry == nil {
+		return
+	}
+	store.janitorStop = make(chan bool)
+	store.janitor.Add(1)
+	go store.runJanitor(store.janitorStop)
+}
+
+// runJanitor periodically expires hashes until stopped.
+func (store *passwordHashStore) runJanitor(stop chan bool) {
+	defer store.janitor.Done()
+	store.logger.Print("Expiring hashes...")
+	ticker := time.NewTicker(store.expiry.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if expired := store.expireHashes(store.now()); expired > 0 {
+				store.logger.Printf("%d hashes expired", expired)
+			}
+		case <-stop:
+			store.logger.Print("Done expiring hashes")
+			return
+		}
+	}
+}
+
+// stopExpiring interrupts the janitor, waiting for it to finish its current run.
+func (store *passwordHashStore) stopExpiring() {
+	if store.janitorStop == nil {
+		return
+	}
+	close(store.janitorStop)
+	store.janitor.Wait()
+	store.janitorStop = nil
+}
+
+// expiryStats returns the expiry counts, or nil if expiry is disabled.
+func (store *passwordHashStore) expiryStats() *expiryStats {
+	if store.expiry == nil {
+		return nil
+	}
+	store.lock.RLock()
+	remembered := store.expiredIds
+	store.lock.RUnlock()
+	return &expiryStats{
+		Expired:    atomic.LoadInt64(&store.expiredCount),
+		Remembered: remembered,
+	}
+}
@@ -0,0 +1,144 @@
+package ph
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newExpiringStore(buf *bytes.Buffer, config ExpiryConfig) (*passwordHashStore, *time.Time) {
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	store.setExpiry(config)
+	now := time.Unix(1000, 0)
+	store.now = func() time.Time {
+		return now
+	}
+	return store, &now
+}
+
+func Test_setExpiry(t *testing.T) {
+	store := newPasswordHashStore(nil)
+	store.setExpiry(ExpiryConfig{TTL: time.Minute})
+	if store.expiry.Retention != defaultExpiryRetention {
+		t.Errorf("Unexpected default retention: %v", store.expiry.Retention)
+	}
+	if store.expiry.Interval != defaultExpiryInterval {
+		t.Errorf("Unexpected default interval: %v", store.expiry.Interval)
+	}
+	if store.expiry.BatchSize != defaultExpiryBatchSize {
+		t.Errorf("Unexpected default batch size: %d", store.expiry.BatchSize)
+	}
+}
+
+func Test_retrievePasswordExpired(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store, now := newExpiringStore(buf, ExpiryConfig{TTL: time.Minute})
+	store.storePassword("default", "1", 0, 0)
+	store.waitPendingStores()
+	store.storePassword("custom", "2", time.Hour, 0)
+	store.waitPendingStores()
+	buf.Reset()
+
+	*now = now.Add(time.Minute)
+	if hash, state := store.retrievePassword("1"); hash != "" || state != hashExpired {
+		t.Errorf("Expected hash to expire after the default TTL, got %s %d", hash, state)
+	}
+	if hash, state := store.retrievePassword("2"); hash != "custom" || state != hashAvailable {
+		t.Errorf("Expected hash with custom TTL to be available, got %s %d", hash, state)
+	}
+	if buf.String() != "Getting for 1\nPassword hash for 1 expired\nGetting for 2\n" {
+		t.Errorf("Expected log to indicate expired hash: %s", buf.String())
+	}
+}
+
+func Test_expireHashes(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store, now := newExpiringStore(buf, ExpiryConfig{TTL: time.Minute, Retention: time.Hour, BatchSize: 2})
+	for i := 1; i <= 5; i++ {
+		store.storePassword("test", fmt.Sprint(i), 0, 0)
+		store.waitPendingStores()
+	}
+	store.storePassword("test", "forever", 24*time.Hour, 0)
+	store.waitPendingStores()
+
+	if expired := store.expireHashes(*now); expired != 0 {
+		t.Errorf("Expected nothing to expire yet, got %d", expired)
+	}
+
+	*now = now.Add(time.Minute)
+	if removed, more := store.expireBatch(*now); removed != 2 || !more {
+		t.Errorf("Expected a single batch to be bounded, got %d %v", removed, more)
+	}
+	if expired := store.expireHashes(*now); expired != 3 {
+		t.Errorf("Expected remaining hashes to expire, got %d", expired)
+	}
+	if store.hashes.count() != 1 || len(store.expiresAt) != 1 || len(store.expiring) != 1 {
+		t.Errorf("Expected only the long-lived hash to remain: %v", store.hashes)
+	}
+	if _, state := store.retrievePassword("3"); state != hashExpired {
+		t.Error("Expected removed hash to be remembered as expired")
+	}
+	if _, state := store.retrievePassword("bogus"); state != hashUnknown {
+		t.Error("Expected unknown id to stay unknown")
+	}
+	stats := store.expiryStats()
+	if stats.Expired != 5 || stats.Remembered != 5 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	*now = now.Add(time.Hour)
+	store.expireHashes(*now)
+	if _, state := store.retrievePassword("3"); state != hashUnknown {
+		t.Error("Expected expired id to be forgotten after the retention")
+	}
+	stats = store.expiryStats()
+	if stats.Expired != 5 || stats.Remembered != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func Test_expiryStatsDisabled(t *testing.T) {
+	store := newPasswordHashStore(nil)
+	if store.expiryStats() != nil {
+		t.Error("Expected no expiry stats when disabled")
+	}
+	stats := &serverStats{}
+	store.collectStats(stats)
+	if stats.Expiry != nil {
+		t.Error("Expected no expiry stats when disabled")
+	}
+}
+
+func Test_startExpiring(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	store.setExpiry(ExpiryConfig{TTL: time.Millisecond, Interval: time.Millisecond})
+	store.startExpiring()
+	store.storePassword("test", "1", 0, 0)
+	store.waitPendingStores()
+	forceGoroutineScheduler()
+	store.stopExpiring()
+
+	if store.hashes.count() != 0 {
+		t.Error("Expected the janitor to remove the expired hash")
+	}
+	if !strings.Contains(buf.String(), "Expiring hashes...\n") || !strings.HasSuffix(buf.String(), "Done expiring hashes\n") {
+		t.Errorf("Expected log on start and stop: %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "1 hashes expired\n") {
+		t.Errorf("Expected log of expired hashes: %s", buf.String())
+	}
+}
+
+func Test_startExpiringDisabled(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	store.startExpiring()
+	store.stopExpiring()
+	if buf.String() != "" {
+		t.Errorf("Expected no janitor when expiry is disabled: %s", buf.String())
+	}
+}
@@ -0,0 +1,191 @@
+package ph
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultIdempotencyWindow = 24 * time.Hour
+	defaultIdempotencyKeys   = 100000
+
+	// maxIdempotencyKeyLength bounds the keys accepted, so memory stays bounded along with their count.
+	maxIdempotencyKeyLength = 255
+
+	// idempotencyKeyHeader names a hash request, so retrying it returns the id of the original one.
+	idempotencyKeyHeader = "Idempotency-Key"
+	// idempotentReplayedHeader tells a response is that of the original request, replayed.
+	idempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+// IdempotencyConfig configures how long idempotency keys are remembered (24 hours by default), and how many of
+// them at most (100000 by default), the oldest being forgotten first.
+type IdempotencyConfig struct {
+	Window  time.Duration
+	MaxKeys int
+}
+
+// idempotencyOutcome tells what to do with a request carrying an idempotency key.
+type idempotencyOutcome int
+
+const (
+	// idempotencyNew means the key is new, and the request is to be served.
+	idempotencyNew idempotencyOutcome = iota
+	// idempotencyReplay means the same request was served already, and its response is to be returned again.
+	idempotencyReplay
+	// idempotencyMismatch means the key was used for a different request.
+	idempotencyMismatch
+	// idempotencyInFlight means the same request is still being served.
+	idempotencyInFlight
+)
+
+// idempotentResponse is what is returned again when a request is retried: its id, along with the retrieval
+// token and delay returned with it.
+type idempotentResponse struct {
+	id    string
+	token string
+	delay time.Duration
+}
+
+// idempotencyStats are the counts of idempotency keys, as reported by the stats endpoint.
+type idempotencyStats struct {
+	Keys       int   `json:"keys"`
+	Replayed   int64 `json:"replayed"`
+	Mismatched int64 `json:"mismatched"`
+	Evicted    int64 `json:"evicted"`
+}
+
+// idempotencyEntry is a remembered key, along with the fingerprint of its request and, once served, its response.
+type idempotencyEntry struct {
+	key         string
+	fingerprint []byte
+	response    *idempotentResponse
+	expires     time.Time
+}
+
+// idempotencyCache remembers idempotency keys for a window, up to a number of them. As every key gets the same
+// window, they expire in the order they were first used, so a single list keeps them in expiry order, and the
+// oldest is forgotten first when full. Requests are fingerprinted with an HMAC under a random key, so nothing
+// remembered helps guessing the passwords they carried.
+type idempotencyCache struct {
+	lock    sync.Mutex
+	secret  []byte
+	window  time.Duration
+	maxKeys int
+	entries map[string]*list.Element
+	order   *list.List
+	now     func() time.Time
+
+	replayed   int64
+	mismatched int64
+	evicted    int64
+}
+
+// newIdempotencyCache creates an empty cache for the given config.
+func newIdempotencyCache(config IdempotencyConfig) *idempotencyCache {
+	if config.Window <= 0 {
+		config.Window = defaultIdempotencyWindow
+	}
+	if config.MaxKeys <= 0 {
+		config.MaxKeys = defaultIdempotencyKeys
+	}
+	secret := make([]byte, sha256.Size)
+	readRandom(secret)
+	return &idempotencyCache{
+		secret:  secret,
+		window:  config.Window,
+		maxKeys: config.MaxKeys,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+// scopedIdempotencyKey scopes the idempotency key of a request to the tenant it is submitted for, if any, so
+// tenants cannot collide on the same keys.
+func scopedIdempotencyKey(req *http.Request, key string) string {
+	return req.Header.Get(tenantHeader) + "\x00" + key
+}
+
+// fingerprint returns the HMAC of what makes a request: its parsed form, in a canonical order, and its tenant.
+func (cache *idempotencyCache) fingerprint(req *http.Request) []byte {
+	mac := hmac.New(sha256.New, cache.secret)
+	mac.Write([]byte(req.Form.Encode()))
+	mac.Write([]byte{0})
+	mac.Write([]byte(req.Header.Get(tenantHeader)))
+	return mac.Sum(nil)
+}
+
+// begin looks up the key, remembering it as in flight if new, and tells what to do with its request.
+// The response of the original request is returned along with a replay.
+func (cache *idempotencyCache) begin(key string, fingerprint []byte) (*idempotentResponse, idempotencyOutcome) {
+	defer cache.lock.Unlock()
+	cache.lock.Lock()
+	now := cache.now()
+	cache.expire(now)
+	if element, ok := cache.entries[key]; ok {
+		entry := element.Value.(*idempotencyEntry)
+		switch {
+		case !hmac.Equal(entry.fingerprint, fingerprint):
+			cache.mismatched++
+			return nil, idempotencyMismatch
+		case entry.response == nil:
+			return nil, idempotencyInFlight
+		}
+		cache.replayed++
+		return entry.response, idempotencyReplay
+	}
+	for cache.order.Len() >= cache.maxKeys {
+		cache.remove(cache.order.Front())
+		cache.evicted++
+	}
+	cache.entries[key] = cache.order.PushBack(&idempotencyEntry{key: key, fingerprint: fingerprint, expires: now.Add(cache.window)})
+	return nil, idempotencyNew
+}
+
+// complete remembers the response of a request served, to be returned again when retried.
+func (cache *idempotencyCache) complete(key string, response idempotentResponse) {
+	defer cache.lock.Unlock()
+	cache.lock.Lock()
+	if element, ok := cache.entries[key]; ok {
+		element.Value.(*idempotencyEntry).response = &response
+	}
+}
+
+// abandon forgets the key of a request which failed, so it can be retried as new.
+func (cache *idempotencyCache) abandon(key string) {
+	defer cache.lock.Unlock()
+	cache.lock.Lock()
+	if element, ok := cache.entries[key]; ok {
+		cache.remove(element)
+	}
+}
+
+// expire forgets every key whose window is over by now. Must be called with the lock held.
+func (cache *idempotencyCache) expire(now time.Time) {
+	for front := cache.order.Front(); front != nil && !now.Before(front.Value.(*idempotencyEntry).expires); front = cache.order.Front() {
+		cache.remove(front)
+	}
+}
+
+// remove forgets a key. Must be called with the lock held.
+func (cache *idempotencyCache) remove(element *list.Element) {
+	delete(cache.entries, element.Value.(*idempotencyEntry).key)
+	cache.order.Remove(element)
+}
+
+// stats returns the keys remembered, and how many requests were replayed, mismatched and evicted.
+func (cache *idempotencyCache) stats() *idempotencyStats {
+	defer cache.lock.Unlock()
+	cache.lock.Lock()
+	return &idempotencyStats{
+		Keys:       cache.order.Len(),
+		Replayed:   cache.replayed,
+		Mismatched: cache.mismatched,
+		Evicted:    cache.evicted,
+	}
+}
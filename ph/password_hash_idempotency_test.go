@@ -0,0 +1,148 @@
+package ph
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// idempotentRequest creates a parsed hash request for the given form, with the given tenant, if any.
+func idempotentRequest(form string, tenant string) *http.Request {
+	r, err := http.NewRequest(http.MethodPost, "/hash", strings.NewReader(form))
+	if err != nil {
+		panic(err)
+	}
+	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	if tenant != "" {
+		r.Header.Set(tenantHeader, tenant)
+	}
+	if err := r.ParseForm(); err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func Test_idempotencyCache(t *testing.T) {
+	cache := newIdempotencyCache(IdempotencyConfig{Window: time.Hour, MaxKeys: 2})
+	start := time.Now()
+	cache.now = func() time.Time { return start }
+	original := cache.fingerprint(idempotentRequest("password=angryMonkey", ""))
+	if !bytes.Equal(original, cache.fingerprint(idempotentRequest("password=angryMonkey", ""))) {
+		t.Error("Expected the same request to have the same fingerprint")
+	}
+	for _, other := range []*http.Request{idempotentRequest("password=happyMonkey", ""), idempotentRequest("password=angryMonkey", "acme")} {
+		if bytes.Equal(original, cache.fingerprint(other)) {
+			t.Errorf("Expected %v to have another fingerprint", other.Form)
+		}
+	}
+	if bytes.Contains(original, []byte("angryMonkey")) {
+		t.Error("Expected the fingerprint not to hold the password")
+	}
+
+	if _, outcome := cache.begin("a", original); outcome != idempotencyNew {
+		t.Errorf("Expected new key, got %d", outcome)
+	}
+	if _, outcome := cache.begin("a", original); outcome != idempotencyInFlight {
+		t.Errorf("Expected key to be in flight, got %d", outcome)
+	}
+	cache.complete("a", idempotentResponse{id: "1", delay: time.Second})
+	if response, outcome := cache.begin("a", original); outcome != idempotencyReplay || response.id != "1" {
+		t.Errorf("Expected response to be replayed, got %d %v", outcome, response)
+	}
+	if _, outcome := cache.begin("a", []byte("other")); outcome != idempotencyMismatch {
+		t.Errorf("Expected key reused for another request to mismatch, got %d", outcome)
+	}
+
+	// failed requests may be retried
+	cache.begin("b", original)
+	cache.abandon("b")
+	if _, outcome := cache.begin("b", original); outcome != idempotencyNew {
+		t.Errorf("Expected abandoned key to be new again, got %d", outcome)
+	}
+
+	// the oldest key is forgotten when full
+	cache.begin("c", original)
+	if _, outcome := cache.begin("a", original); outcome != idempotencyNew {
+		t.Errorf("Expected oldest key to be evicted, got %d", outcome)
+	}
+
+	cache.now = func() time.Time { return start.Add(time.Hour) }
+	if _, outcome := cache.begin("c", original); outcome != idempotencyNew {
+		t.Errorf("Expected key to expire after the window, got %d", outcome)
+	}
+	stats := cache.stats()
+	if *stats != (idempotencyStats{Keys: 1, Replayed: 1, Mismatched: 1, Evicted: 2}) {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func Test_hashIdempotency(t *testing.T) {
+	buf := &bytes.Buffer{}
+	server := NewPasswordHasherServer(log.New(buf, "", 0), WithIdempotency(IdempotencyConfig{}),
+		WithDelay(DelayConfig{}), WithIdStrategy(SequentialIds, 0))
+	defer server.phStore.close()
+	server.phStats.startAccumulating()
+	defer server.phStats.stopAccumulating()
+
+	post := func(form string, key string, tenant string) *httptest.ResponseRecorder {
+		r := idempotentRequest(form, tenant)
+		r.Header.Set(idempotencyKeyHeader, key)
+		w := httptest.NewRecorder()
+		server.http.Handler.ServeHTTP(w, r)
+		return w
+	}
+	form := url.Values{"password": {"angryMonkey"}}.Encode()
+	if w := post(form, "key-1", ""); w.Code != http.StatusOK || w.Body.String() != "1" || w.Header().Get(idempotentReplayedHeader) != "" {
+		t.Fatalf("Unexpected response, got %d %s", w.Code, w.Body.String())
+	}
+	w := post(form, "key-1", "")
+	if w.Code != http.StatusOK || w.Body.String() != "1" || w.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Errorf("Expected retry to return the original id, got %d %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get(hashDelayHeader) != "0s" {
+		t.Errorf("Expected retry to return the original delay, got %s", w.Header().Get(hashDelayHeader))
+	}
+	if w := post("password=happyMonkey", "key-1", ""); w.Code != http.StatusUnprocessableEntity || w.Body.String() != "Idempotency Key Reused" {
+		t.Errorf("Expected key reused for another password to fail, got %d %s", w.Code, w.Body.String())
+	}
+	if w := post(form, "key-1", "acme"); w.Code != http.StatusOK || w.Body.String() != "2" {
+		t.Errorf("Expected keys to be scoped to tenants, got %d %s", w.Code, w.Body.String())
+	}
+	if w := post(form, strings.Repeat("k", maxIdempotencyKeyLength+1), ""); w.Code != http.StatusBadRequest || w.Body.String() != "Invalid Idempotency Key" {
+		t.Errorf("Expected too long key to be refused, got %d %s", w.Code, w.Body.String())
+	}
+	if w := post(form, "", ""); w.Code != http.StatusOK || w.Body.String() != "3" {
+		t.Errorf("Expected requests without key to be hashed again, got %d %s", w.Code, w.Body.String())
+	}
+
+	server.idempotency.begin(scopedIdempotencyKey(idempotentRequest(form, ""), "key-2"), server.idempotency.fingerprint(idempotentRequest(form, "")))
+	if w := post(form, "key-2", ""); w.Code != http.StatusConflict || w.Body.String() != "Request In Progress" {
+		t.Errorf("Expected retry of a request in flight to conflict, got %d %s", w.Code, w.Body.String())
+	}
+
+	r, err := http.NewRequest(http.MethodGet, "/stats", nil)
+	if err != nil {
+		panic(err)
+	}
+	w = httptest.NewRecorder()
+	server.http.Handler.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), `"idempotency":{"keys":3,"replayed":1,"mismatched":1,"evicted":0}`) {
+		t.Errorf("Unexpected stats: %s", w.Body.String())
+	}
+}
+
+func Test_hashIdempotencyStoreFailure(t *testing.T) {
+	server := NewPasswordHasherServer(log.New(&bytes.Buffer{}, "", 0), WithIdempotency(IdempotencyConfig{}),
+		WithStore(&failingStore{}), WithIdStrategy(SequentialIds, 0))
+	r := idempotentRequest("password=angryMonkey", "")
+	r.Header.Set(idempotencyKeyHeader, "key-1")
+	server.http.Handler.ServeHTTP(httptest.NewRecorder(), r)
+	if stats := server.idempotency.stats(); stats.Keys != 0 {
+		t.Errorf("Expected key of a failed request to be forgotten, got %+v", stats)
+	}
+}
@@ -0,0 +1,247 @@
+package ph
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// idGenerator is the minimal interface for issuing the ids hashed passwords are stored by.
+type idGenerator interface {
+	nextId() string
+	validId(id string) bool
+}
+
+// IdStrategy selects how ids are issued for hashed passwords.
+type IdStrategy string
+
+const (
+	// RandomIds issues 128-bit random ids as 32 hex digits. This is the default.
+	RandomIds IdStrategy = "random"
+	// UUIDv7Ids issues time-ordered UUIDs (RFC 9562), with 74 random bits each.
+	UUIDv7Ids IdStrategy = "uuidv7"
+	// SnowflakeIds issues time-ordered 63-bit integers made of a timestamp, node id and sequence.
+	// These are unique across nodes, but about as guessable as sequential ids.
+	SnowflakeIds IdStrategy = "snowflake"
+	// SequentialIds issues 1, 2, 3... which is easy to debug, but trivially guessable.
+	SequentialIds IdStrategy = "sequential"
+)
+
+// ParseIdStrategy validates the name of an id strategy.
+func ParseIdStrategy(name string) (IdStrategy, error) {
+	switch strategy := IdStrategy(name); strategy {
+	case RandomIds, UUIDv7Ids, SnowflakeIds, SequentialIds:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("unknown id strategy %q", name)
+}
+
+// ValidateIdNode fails for a node id out of the range SnowflakeIds can encode, 0-1023.
+func ValidateIdNode(node int64) error {
+	if node < 0 || node > snowflakeMaxNode {
+		return fmt.Errorf("id node %d out of range (0-%d)", node, snowflakeMaxNode)
+	}
+	return nil
+}
+
+// newIdGenerator creates the generator for the given strategy. The node is only used by Snowflake ids.
+func newIdGenerator(strategy IdStrategy, node int64) idGenerator {
+	switch strategy {
+	case UUIDv7Ids:
+		return newUUIDv7IdGenerator()
+	case SnowflakeIds:
+		return newSnowflakeIdGenerator(node)
+	case SequentialIds:
+		return newSequentialIdGenerator()
+	}
+	return newRandomIdGenerator()
+}
+
+// sequentialIdGenerator issues ids from an ever-increasing counter, starting at 1.
+type sequentialIdGenerator struct {
+	last int64
+}
+
+// newSequentialIdGenerator creates a new sequential generator.
+func newSequentialIdGenerator() *sequentialIdGenerator {
+	return &sequentialIdGenerator{}
+}
+
+// nextId increments the counter, safe for concurrent use.
+func (gen *sequentialIdGenerator) nextId() string {
+	return strconv.FormatInt(atomic.AddInt64(&gen.last, 1), 10)
+}
+
+// validId accepts positive decimal integers, in their canonical form only.
+func (gen *sequentialIdGenerator) validId(id string) bool {
+	return validDecimalId(id)
+}
+
+// advancePast moves the counter up to the given id, if behind, so it is never issued again.
+func (gen *sequentialIdGenerator) advancePast(id string) {
+	value, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return
+	}
+	for last := atomic.LoadInt64(&gen.last); last < value; last = atomic.LoadInt64(&gen.last) {
+		if atomic.CompareAndSwapInt64(&gen.last, last, value) {
+			return
+		}
+	}
+}
+
+// randomIdGenerator issues 128-bit ids from a cryptographically secure source.
+type randomIdGenerator struct{}
+
+// newRandomIdGenerator creates a new random generator.
+func newRandomIdGenerator() *randomIdGenerator {
+	return &randomIdGenerator{}
+}
+
+// nextId returns 16 random bytes as lowercase hex.
+func (gen *randomIdGenerator) nextId() string {
+	var id [16]byte
+	readRandom(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// validId accepts exactly 32 lowercase hex digits.
+func (gen *randomIdGenerator) validId(id string) bool {
+	return len(id) == 32 && isLowerHex(id)
+}
+
+// uuidV7IdGenerator issues version 7 UUIDs: a 48-bit millisecond timestamp followed by random bits.
+type uuidV7IdGenerator struct {
+	now func() time.Time
+}
+
+// newUUIDv7IdGenerator creates a new UUIDv7 generator.
+func newUUIDv7IdGenerator() *uuidV7IdGenerator {
+	return &uuidV7IdGenerator{now: time.Now}
+}
+
+// nextId returns the UUID in its canonical, hyphenated form.
+func (gen *uuidV7IdGenerator) nextId() string {
+	var id [16]byte
+	readRandom(id[6:])
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(gen.now().UnixNano()/int64(time.Millisecond)))
+	copy(id[:6], ms[2:])
+	id[6] = 0x70 | (id[6] & 0x0f) // version 7
+	id[8] = 0x80 | (id[8] & 0x3f) // RFC variant
+
+	encoded := hex.EncodeToString(id[:])
+	return encoded[0:8] + "-" + encoded[8:12] + "-" + encoded[12:16] + "-" + encoded[16:20] + "-" + encoded[20:]
+}
+
+// validId accepts canonical lowercase UUIDs with version 7 and the RFC variant.
+func (gen *uuidV7IdGenerator) validId(id string) bool {
+	if len(id) != 36 || id[8] != '-' || id[13] != '-' || id[18] != '-' || id[23] != '-' {
+		return false
+	}
+	if !isLowerHex(id[0:8] + id[9:13] + id[14:18] + id[19:23] + id[24:]) {
+		return false
+	}
+	return id[14] == '7' && (id[19] == '8' || id[19] == '9' || id[19] == 'a' || id[19] == 'b')
+}
+
+const (
+	snowflakeNodeBits     = 10
+	snowflakeSequenceBits = 12
+	snowflakeMaxNode      = 1<<snowflakeNodeBits - 1
+	snowflakeMaxSequence  = 1<<snowflakeSequenceBits - 1
+)
+
+// snowflakeEpoch is the start of the 41-bit millisecond timestamp, which lasts for about 69 years.
+var snowflakeEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// snowflakeIdGenerator issues 63-bit ids made of a millisecond timestamp, a node id and a per-millisecond sequence.
+type snowflakeIdGenerator struct {
+	node     int64
+	lastTime int64
+	sequence int64
+	lock     sync.Mutex
+	now      func() time.Time
+}
+
+// newSnowflakeIdGenerator creates a new Snowflake generator for the given node id (0-1023).
+func newSnowflakeIdGenerator(node int64) *snowflakeIdGenerator {
+	if err := ValidateIdNode(node); err != nil {
+		panic(err)
+	}
+	return &snowflakeIdGenerator{node: node, now: time.Now}
+}
+
+// nextId returns the id in decimal. If the sequence runs out within a millisecond, it waits for the next one.
+// A clock going backwards keeps using the last timestamp, so ids never repeat.
+func (gen *snowflakeIdGenerator) nextId() string {
+	gen.lock.Lock()
+	defer gen.lock.Unlock()
+
+	elapsed := gen.now().Sub(snowflakeEpoch).Milliseconds()
+	if elapsed <= gen.lastTime {
+		elapsed = gen.lastTime
+		gen.sequence = (gen.sequence + 1) & snowflakeMaxSequence
+		if gen.sequence == 0 {
+			for elapsed <= gen.lastTime {
+				time.Sleep(time.Millisecond / 10)
+				elapsed = gen.now().Sub(snowflakeEpoch).Milliseconds()
+			}
+		}
+	} else {
+		gen.sequence = 0
+	}
+	gen.lastTime = elapsed
+
+	id := elapsed<<(snowflakeNodeBits+snowflakeSequenceBits) | gen.node<<snowflakeSequenceBits | gen.sequence
+	return strconv.FormatInt(id, 10)
+}
+
+// validId accepts positive decimal integers, in their canonical form only.
+func (gen *snowflakeIdGenerator) validId(id string) bool {
+	return validDecimalId(id)
+}
+
+// advancePast moves the timestamp and sequence up to those of the given id, if behind, whatever its node,
+// so ids issued afterwards sort after it.
+func (gen *snowflakeIdGenerator) advancePast(id string) {
+	value, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return
+	}
+	elapsed, sequence := value>>(snowflakeNodeBits+snowflakeSequenceBits), value&snowflakeMaxSequence
+
+	gen.lock.Lock()
+	defer gen.lock.Unlock()
+	if elapsed > gen.lastTime || (elapsed == gen.lastTime && sequence > gen.sequence) {
+		gen.lastTime, gen.sequence = elapsed, sequence
+	}
+}
+
+// validDecimalId checks for a positive int64 without sign, leading zeros or any other decoration.
+func validDecimalId(id string) bool {
+	value, err := strconv.ParseInt(id, 10, 64)
+	return err == nil && value > 0 && strconv.FormatInt(value, 10) == id
+}
+
+// isLowerHex checks every character is a lowercase hex digit.
+func isLowerHex(value string) bool {
+	for _, c := range value {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// readRandom fills the buffer from the system's secure random source, which is not expected to fail.
+func readRandom(buf []byte) {
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+}
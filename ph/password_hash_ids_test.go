@@ -0,0 +1,186 @@
+package ph
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_ParseIdStrategy(t *testing.T) {
+	for _, name := range []string{"random", "uuidv7", "snowflake", "sequential"} {
+		if strategy, err := ParseIdStrategy(name); err != nil || string(strategy) != name {
+			t.Errorf("Expected %s to be valid: %v", name, err)
+		}
+	}
+	if _, err := ParseIdStrategy("bogus"); err == nil {
+		t.Error("Expected unknown strategy to fail")
+	}
+}
+
+func Test_ValidateIdNode(t *testing.T) {
+	for _, node := range []int64{0, snowflakeMaxNode} {
+		if err := ValidateIdNode(node); err != nil {
+			t.Errorf("Expected node %d to be valid: %v", node, err)
+		}
+	}
+	for _, node := range []int64{-1, snowflakeMaxNode + 1} {
+		if err := ValidateIdNode(node); err == nil {
+			t.Errorf("Expected node %d to be out of range", node)
+		}
+	}
+}
+
+func Test_newIdGenerator(t *testing.T) {
+	if _, ok := newIdGenerator(RandomIds, 0).(*randomIdGenerator); !ok {
+		t.Error("Expected random generator")
+	}
+	if _, ok := newIdGenerator(UUIDv7Ids, 0).(*uuidV7IdGenerator); !ok {
+		t.Error("Expected UUIDv7 generator")
+	}
+	if _, ok := newIdGenerator(SnowflakeIds, 0).(*snowflakeIdGenerator); !ok {
+		t.Error("Expected Snowflake generator")
+	}
+	if _, ok := newIdGenerator(SequentialIds, 0).(*sequentialIdGenerator); !ok {
+		t.Error("Expected sequential generator")
+	}
+}
+
+func Test_sequentialIdGenerator(t *testing.T) {
+	gen := newSequentialIdGenerator()
+	if id := gen.nextId(); id != "1" {
+		t.Errorf("Expected the first id to be 1, got %s", id)
+	}
+	if id := gen.nextId(); id != "2" {
+		t.Errorf("Expected the second id to be 2, got %s", id)
+	}
+	for id, expected := range map[string]bool{"1": true, "42": true, "0": false, "-1": false, "007": false, "+7": false, "bogus": false} {
+		if gen.validId(id) != expected {
+			t.Errorf("Expected %s to be valid=%v", id, expected)
+		}
+	}
+}
+
+func Test_sequentialIdGeneratorAdvancePast(t *testing.T) {
+	gen := newSequentialIdGenerator()
+	gen.advancePast("41")
+	gen.advancePast("7")
+	gen.advancePast("bogus")
+	if id := gen.nextId(); id != "42" {
+		t.Errorf("Expected ids to move past the highest restored one, got %s", id)
+	}
+}
+
+func Test_randomIdGenerator(t *testing.T) {
+	gen := newRandomIdGenerator()
+	first, second := gen.nextId(), gen.nextId()
+	if !gen.validId(first) || !gen.validId(second) {
+		t.Errorf("Expected valid ids: %s %s", first, second)
+	}
+	if first == second {
+		t.Error("Expected different ids")
+	}
+	for _, id := range []string{"", "1", "bogus", "0123456789ABCDEF0123456789abcdef", "0123456789abcdef0123456789abcde"} {
+		if gen.validId(id) {
+			t.Errorf("Expected %s to be invalid", id)
+		}
+	}
+}
+
+func Test_uuidV7IdGenerator(t *testing.T) {
+	gen := newUUIDv7IdGenerator()
+	gen.now = func() time.Time {
+		return time.Unix(0, 0x017F22E279B0*int64(time.Millisecond))
+	}
+	id := gen.nextId()
+	if !gen.validId(id) {
+		t.Errorf("Expected valid id: %s", id)
+	}
+	if id[:13] != "017f22e2-79b0" {
+		t.Errorf("Expected timestamp prefix, got %s", id)
+	}
+	for _, id := range []string{"", "bogus", "017f22e2-79b0-4cc3-98c4-dc0c0c07398f", "017f22e2-79b0-7cc3-c8c4-dc0c0c07398f", "017f22e279b07cc398c4dc0c0c07398f0000"} {
+		if gen.validId(id) {
+			t.Errorf("Expected %s to be invalid", id)
+		}
+	}
+}
+
+func Test_snowflakeIdGenerator(t *testing.T) {
+	gen := newSnowflakeIdGenerator(5)
+	now := snowflakeEpoch.Add(time.Second)
+	gen.now = func() time.Time {
+		return now
+	}
+
+	first, _ := strconv.ParseInt(gen.nextId(), 10, 64)
+	if first>>(snowflakeNodeBits+snowflakeSequenceBits) != 1000 {
+		t.Errorf("Expected timestamp in the id, got %d", first)
+	}
+	if (first>>snowflakeSequenceBits)&snowflakeMaxNode != 5 {
+		t.Errorf("Expected node in the id, got %d", first)
+	}
+
+	second, _ := strconv.ParseInt(gen.nextId(), 10, 64)
+	if second != first+1 {
+		t.Errorf("Expected sequence to increase within a millisecond, got %d %d", first, second)
+	}
+
+	// clock going backwards must not repeat ids
+	now = now.Add(-time.Second)
+	third, _ := strconv.ParseInt(gen.nextId(), 10, 64)
+	if third <= second {
+		t.Errorf("Expected ids to keep increasing, got %d %d", second, third)
+	}
+	if !gen.validId(strconv.FormatInt(third, 10)) {
+		t.Error("Expected valid id")
+	}
+}
+
+func Test_snowflakeIdGeneratorAdvancePast(t *testing.T) {
+	gen := newSnowflakeIdGenerator(5)
+	now := snowflakeEpoch.Add(time.Second)
+	gen.now = func() time.Time {
+		return now
+	}
+	restored := int64(2000)<<(snowflakeNodeBits+snowflakeSequenceBits) | 3<<snowflakeSequenceBits | 9
+	gen.advancePast(strconv.FormatInt(restored, 10))
+	gen.advancePast(strconv.FormatInt(restored-1, 10))
+
+	next, _ := strconv.ParseInt(gen.nextId(), 10, 64)
+	if next>>(snowflakeNodeBits+snowflakeSequenceBits) != 2000 || next&snowflakeMaxSequence != 10 {
+		t.Errorf("Expected ids to move past the restored one, got %d", next)
+	}
+}
+
+func Test_snowflakeIdGeneratorUnique(t *testing.T) {
+	gen := newSnowflakeIdGenerator(0)
+	ids := make(map[string]bool)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5000; j++ {
+				id := gen.nextId()
+				lock.Lock()
+				ids[id] = true
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(ids) != 20000 {
+		t.Errorf("Expected unique ids, got %d", len(ids))
+	}
+}
+
+func Test_newSnowflakeIdGeneratorOutOfRange(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected node out of range to panic")
+		}
+	}()
+	newSnowflakeIdGenerator(snowflakeMaxNode + 1)
+}
@@ -0,0 +1,211 @@
+package ph
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// masterKeySize is the size of the master key, as well as of every data key: AES-256.
+const masterKeySize = 32
+
+// errUnknownDataKey is returned when a hash was sealed with a data key missing from the key ring.
+var errUnknownDataKey = errors.New("unknown data key")
+
+// errCorruptSealedHash is returned when a sealed hash is malformed, or fails authentication.
+var errCorruptSealedHash = errors.New("corrupt sealed hash")
+
+// ParseMasterKey reads a master key written as 64 hex digits, ignoring surrounding whitespace.
+func ParseMasterKey(data []byte) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != masterKeySize {
+		return nil, fmt.Errorf("master key must be %d hex digits", 2*masterKeySize)
+	}
+	return key, nil
+}
+
+// KeyRing holds the data keys hashes are sealed with, each wrapped by the master key in a file of
+// "<key id> <wrapped key>" lines. The last key seals new hashes, while all of them can open old ones.
+type KeyRing struct {
+	path    string
+	master  cipher.AEAD
+	keys    map[string]cipher.AEAD
+	wrapped []string
+	current string
+	lock    sync.RWMutex
+}
+
+// OpenKeyRing loads the data keys from the given file, unwrapping them with the master key.
+// The file is created with a first data key if missing.
+func OpenKeyRing(path string, masterKey []byte) (*KeyRing, error) {
+	master, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	ring := &KeyRing{path: path, master: master, keys: make(map[string]cipher.AEAD)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		if _, err := ring.Rotate(); err != nil {
+			return nil, err
+		}
+		return ring, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("data key line %d: expected \"<key id> <wrapped key>\"", line)
+		}
+		key, err := ring.unwrap(fields[0], fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("data key line %d: %v", line, err)
+		}
+		ring.keys[fields[0]] = key
+		ring.wrapped = append(ring.wrapped, text)
+		ring.current = fields[0]
+	}
+	if ring.current == "" {
+		return nil, fmt.Errorf("no data keys in %s", path)
+	}
+	return ring, nil
+}
+
+// newGCM creates an AES-GCM cipher with the given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != masterKeySize {
+		return nil, fmt.Errorf("key must be %d bytes", masterKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// unwrap decrypts a data key with the master key, authenticating it along with its id.
+func (ring *KeyRing) unwrap(id string, wrapped string) (cipher.AEAD, error) {
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil || len(sealed) < ring.master.NonceSize() {
+		return nil, errors.New("malformed wrapped key")
+	}
+	nonce := sealed[:ring.master.NonceSize()]
+	key, err := ring.master.Open(nil, nonce, sealed[len(nonce):], []byte(id))
+	if err != nil {
+		return nil, errors.New("wrong master key")
+	}
+	return newGCM(key)
+}
+
+// Rotate generates a new data key, saving it wrapped before using it to seal new hashes.
+// It returns the id of the new key.
+func (ring *KeyRing) Rotate() (string, error) {
+	key := make([]byte, masterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	defer ring.lock.Unlock()
+	ring.lock.Lock()
+	id := ring.nextKeyId()
+	nonce := make([]byte, ring.master.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	wrapped := base64.StdEncoding.EncodeToString(ring.master.Seal(nonce, nonce, key, []byte(id)))
+	lines := append(ring.wrapped[:len(ring.wrapped):len(ring.wrapped)], id+" "+wrapped)
+	if err := writeFileAtomically(ring.path, []byte(strings.Join(lines, "\n")+"\n")); err != nil {
+		return "", err
+	}
+	ring.keys[id] = aead
+	ring.wrapped = lines
+	ring.current = id
+	return id, nil
+}
+
+// nextKeyId returns an id no data key of the ring has, numbered after the highest one, so a key retired from
+// the file never has its id, which is bound to the hashes it sealed, taken over by another.
+// Must be called with the lock held.
+func (ring *KeyRing) nextKeyId() string {
+	highest := 0
+	for id := range ring.keys {
+		if n, err := strconv.Atoi(strings.TrimPrefix(id, "k")); err == nil && strings.HasPrefix(id, "k") && n > highest {
+			highest = n
+		}
+	}
+	return "k" + strconv.Itoa(highest+1)
+}
+
+// currentKey returns the id of the data key sealing new hashes.
+func (ring *KeyRing) currentKey() string {
+	defer ring.lock.RUnlock()
+	ring.lock.RLock()
+	return ring.current
+}
+
+// keyCount returns how many data keys the ring holds.
+func (ring *KeyRing) keyCount() int {
+	defer ring.lock.RUnlock()
+	ring.lock.RLock()
+	return len(ring.keys)
+}
+
+// seal encrypts a hash with the current data key, bound to its id, as "<key id>.<nonce and ciphertext>".
+func (ring *KeyRing) seal(id string, hashed string) (string, error) {
+	ring.lock.RLock()
+	kid, aead := ring.current, ring.keys[ring.current]
+	ring.lock.RUnlock()
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(hashed), []byte(id))
+	return kid + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a hash sealed for the given id, also returning the id of the data key it was sealed with.
+func (ring *KeyRing) open(id string, value string) (string, string, error) {
+	dot := strings.IndexByte(value, '.')
+	if dot < 0 {
+		return "", "", errCorruptSealedHash
+	}
+	kid := value[:dot]
+	ring.lock.RLock()
+	aead, ok := ring.keys[kid]
+	ring.lock.RUnlock()
+	if !ok {
+		return "", kid, errUnknownDataKey
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(value[dot+1:])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", kid, errCorruptSealedHash
+	}
+	nonce := sealed[:aead.NonceSize()]
+	hashed, err := aead.Open(nil, nonce, sealed[len(nonce):], []byte(id))
+	if err != nil {
+		return "", kid, errCorruptSealedHash
+	}
+	return string(hashed), kid, nil
+}
@@ -0,0 +1,105 @@
+package ph
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testMasterKey = bytes.Repeat([]byte{7}, masterKeySize)
+
+func openTestKeyRing(t *testing.T, path string) *KeyRing {
+	ring, err := OpenKeyRing(path, testMasterKey)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return ring
+}
+
+func Test_ParseMasterKey(t *testing.T) {
+	key, err := ParseMasterKey([]byte(strings.Repeat("07", masterKeySize) + "\n"))
+	if err != nil || !bytes.Equal(key, testMasterKey) {
+		t.Errorf("Unexpected key: %x %v", key, err)
+	}
+	for _, data := range []string{"", "0707", strings.Repeat("zz", masterKeySize)} {
+		if _, err := ParseMasterKey([]byte(data)); err == nil {
+			t.Errorf("Expected %q to fail", data)
+		}
+	}
+}
+
+func Test_OpenKeyRing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.keys")
+	ring := openTestKeyRing(t, path)
+	if ring.currentKey() != "k1" || ring.keyCount() != 1 {
+		t.Errorf("Expected a first key to be created, got %s of %d", ring.currentKey(), ring.keyCount())
+	}
+	if kid, err := ring.Rotate(); err != nil || kid != "k2" {
+		t.Errorf("Unexpected rotation: %s %v", kid, err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[1], "k2 ") {
+		t.Errorf("Unexpected key file: %s", data)
+	}
+
+	reopened := openTestKeyRing(t, path)
+	if reopened.currentKey() != "k2" || reopened.keyCount() != 2 {
+		t.Errorf("Expected keys to be reloaded, got %s of %d", reopened.currentKey(), reopened.keyCount())
+	}
+	if _, err := OpenKeyRing(path, bytes.Repeat([]byte{8}, masterKeySize)); err == nil {
+		t.Error("Expected the wrong master key to be rejected")
+	}
+	if _, err := OpenKeyRing(path, testMasterKey[1:]); err == nil {
+		t.Error("Expected a short master key to be rejected")
+	}
+
+	// retiring the first key never has its id taken over by the next one
+	ioutil.WriteFile(path, []byte(strings.SplitN(string(data), "\n", 2)[1]), 0600)
+	retired := openTestKeyRing(t, path)
+	sealed, _ := retired.seal("1", "test")
+	if kid, err := retired.Rotate(); err != nil || kid != "k3" {
+		t.Errorf("Expected the key after the highest, got %s %v", kid, err)
+	}
+	if hashed, _, err := retired.open("1", sealed); hashed != "test" || err != nil {
+		t.Errorf("Expected hashes sealed before rotating to open, got %s %v", hashed, err)
+	}
+
+	for _, data := range []string{"\n", "k1\n", "k1 bogus\n"} {
+		ioutil.WriteFile(path, []byte(data), 0600)
+		if _, err := OpenKeyRing(path, testMasterKey); err == nil {
+			t.Errorf("Expected %q to fail", data)
+		}
+	}
+}
+
+func Test_sealHash(t *testing.T) {
+	ring := openTestKeyRing(t, filepath.Join(t.TempDir(), "data.keys"))
+	sealed, err := ring.seal("42", "very-hashed")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(sealed, "k1.") || strings.Contains(sealed, "very-hashed") {
+		t.Errorf("Unexpected sealed hash: %s", sealed)
+	}
+	if other, _ := ring.seal("42", "very-hashed"); other == sealed {
+		t.Error("Expected every seal to use a fresh nonce")
+	}
+
+	ring.Rotate()
+	if hashed, kid, err := ring.open("42", sealed); hashed != "very-hashed" || kid != "k1" || err != nil {
+		t.Errorf("Expected old key to stay readable, got %s %s %v", hashed, kid, err)
+	}
+	if _, _, err := ring.open("43", sealed); err != errCorruptSealedHash {
+		t.Errorf("Expected sealed hash to be bound to its id: %v", err)
+	}
+	if _, _, err := ring.open("42", "k9"+sealed[2:]); err != errUnknownDataKey {
+		t.Errorf("Expected unknown key to be reported: %v", err)
+	}
+	for _, bogus := range []string{"", "bogus", "k1.", "k1.!!", sealed[:len(sealed)-2]} {
+		if _, _, err := ring.open("42", bogus); err != errCorruptSealedHash {
+			t.Errorf("Expected %q to be rejected: %v", bogus, err)
+		}
+	}
+}
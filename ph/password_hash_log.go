@@ -0,0 +1,544 @@
+package ph
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncMode tells when appended log records are flushed to stable storage.
+type SyncMode string
+
+const (
+	// SyncAlways flushes every record before the operation it logs is acknowledged.
+	SyncAlways SyncMode = "always"
+	// SyncInterval flushes in the background, so a crash may lose up to one interval of records.
+	SyncInterval SyncMode = "interval"
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncMode = "never"
+)
+
+// LogConfig configures the write-ahead log that makes a store durable, kept in a directory of numbered segments
+// along with the latest snapshot of the store. A zero SnapshotInterval only takes snapshots on demand and on close.
+type LogConfig struct {
+	Dir              string
+	Sync             SyncMode
+	SyncInterval     time.Duration
+	SegmentSize      int64
+	SnapshotInterval time.Duration
+}
+
+const (
+	defaultSyncInterval = time.Second
+	defaultSegmentSize  = 64 << 20
+
+	// logFrameHeader is the size of the length and checksum preceding each record.
+	logFrameHeader = 8
+	// maxLogRecord bounds the size of a single record, so a corrupt length cannot make us allocate wildly.
+	maxLogRecord = 1 << 20
+
+	logSegmentSuffix = ".log"
+)
+
+// logCRCTable is the Castagnoli polynomial, which is hardware accelerated on most platforms.
+var logCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorruptLogRecord is returned when a record fails to decode despite a valid checksum.
+var errCorruptLogRecord = errors.New("corrupt log record")
+
+// logRecordKind tells what a log record stands for.
+type logRecordKind byte
+
+const (
+	// logSubmitted records a hash waiting out its delay.
+	logSubmitted logRecordKind = iota + 1
+	// logStored records a submitted hash becoming available.
+	logStored
+	// logDeleted records a hash deleted, whether stored or still pending.
+	logDeleted
+	// logEvicted records a stored hash evicted from a full store.
+	logEvicted
+	// logExpired records a stored hash removed once its time-to-live passed, as of when it did.
+	logExpired
+)
+
+// logRecord is a single entry of the write-ahead log. Only submitted records carry the hash itself,
+// along with its time-to-live and when it becomes available.
+type logRecord struct {
+	kind      logRecordKind
+	at        time.Time
+	id        string
+	hashed    string
+	ttl       time.Duration
+	available time.Time
+}
+
+// HashLog is an append-only, checksummed log of changes to a store, replayed to rebuild it after a restart.
+// Each record is framed by its length and CRC-32C, so a torn or corrupt tail is detected and cut off on open.
+// The log is split in segments, so those covered by a snapshot can be dropped as a whole.
+type HashLog struct {
+	config   LogConfig
+	file     *os.File
+	segment  uint64
+	segments map[uint64]int64
+	lock     sync.Mutex
+	dirty    bool
+
+	// what was read on open, only kept until the store is rebuilt
+	snapshot         *storeSnapshot
+	replayed         []logRecord
+	truncated        int64
+	invalidSnapshots int
+	snapshotTaken    time.Time
+
+	stop    chan bool
+	syncing sync.WaitGroup
+}
+
+// OpenHashLog opens (or creates) the log in the configured directory, reading back the latest valid snapshot
+// and every valid record after it. Anything after the first invalid record of the last segment is truncated,
+// since it can only be the result of a crash mid-write, while an invalid record in any earlier segment fails
+// the open, as those were complete before the next one was started.
+func OpenHashLog(config LogConfig) (*HashLog, error) {
+	if config.Sync == "" {
+		config.Sync = SyncAlways
+	}
+	if config.SyncInterval <= 0 {
+		config.SyncInterval = defaultSyncInterval
+	}
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = defaultSegmentSize
+	}
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, err
+	}
+	hashLog := &HashLog{config: config, segments: make(map[uint64]int64)}
+	if err := hashLog.replay(); err != nil {
+		if hashLog.file != nil {
+			hashLog.file.Close()
+		}
+		return nil, err
+	}
+	if config.Sync == SyncInterval {
+		hashLog.stop = make(chan bool)
+		hashLog.syncing.Add(1)
+		go hashLog.syncPeriodically()
+	}
+	return hashLog, nil
+}
+
+// segmentPath is where the segment with the given number is kept.
+func (hashLog *HashLog) segmentPath(segment uint64) string {
+	return filepath.Join(hashLog.config.Dir, fmt.Sprintf("%016d%s", segment, logSegmentSuffix))
+}
+
+// listFiles returns the numbers of the files in the log directory having the given suffix, in order.
+func (hashLog *HashLog) listFiles(suffix string) ([]uint64, error) {
+	infos, err := ioutil.ReadDir(hashLog.config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var numbers []uint64
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		if number, err := strconv.ParseUint(strings.TrimSuffix(name, suffix), 10, 64); err == nil {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers, nil
+}
+
+// replay loads the latest valid snapshot, then reads every valid record of the segments it does not cover,
+// leaving the last segment open for appending. It fails rather than lose hashes when the segments left start
+// after the snapshot, as happens once the only snapshot covering compacted segments gets corrupted.
+func (hashLog *HashLog) replay() error {
+	first, err := hashLog.loadSnapshot()
+	if err != nil {
+		return err
+	}
+	segments, err := hashLog.listFiles(logSegmentSuffix)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if segment >= first {
+			if segment > first {
+				return fmt.Errorf("%w: no valid snapshot covers the segments before %d", errCorruptSnapshot, segment)
+			}
+			break
+		}
+	}
+	for _, segment := range segments {
+		if segment < first {
+			// covered by the snapshot, but not yet dropped when compaction was interrupted
+			if err := os.Remove(hashLog.segmentPath(segment)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := hashLog.replaySegment(segment, segment == segments[len(segments)-1]); err != nil {
+			return err
+		}
+	}
+
+	if len(hashLog.segments) == 0 {
+		return hashLog.openSegment(first)
+	}
+	last := segments[len(segments)-1]
+	file, err := os.OpenFile(hashLog.segmentPath(last), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	hashLog.file, hashLog.segment = file, last
+	return nil
+}
+
+// replaySegment reads every valid record from the segment. The last segment is truncated after its last valid
+// record, while any other fails on an invalid one.
+func (hashLog *HashLog) replaySegment(segment uint64, last bool) error {
+	file, err := os.OpenFile(hashLog.segmentPath(segment), os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		record, size, err := readLogRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && !last {
+			return fmt.Errorf("%w in segment %d at offset %d, before the last segment: %v", errCorruptLogRecord, segment, offset, err)
+		}
+		if err != nil {
+			hashLog.truncated += info.Size() - offset
+			if err := file.Truncate(offset); err != nil {
+				return err
+			}
+			if err := file.Sync(); err != nil {
+				return err
+			}
+			break
+		}
+		hashLog.replayed = append(hashLog.replayed, record)
+		offset += size
+	}
+	hashLog.segments[segment] = offset
+	return nil
+}
+
+// openSegment starts a new, empty segment to append to. Must be called with the lock held, if open.
+func (hashLog *HashLog) openSegment(segment uint64) error {
+	file, err := os.OpenFile(hashLog.segmentPath(segment), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(hashLog.config.Dir); err != nil {
+		file.Close()
+		return err
+	}
+	hashLog.file, hashLog.segment = file, segment
+	hashLog.segments[segment] = 0
+	return nil
+}
+
+// rotate closes the current segment and starts the next one, returning the number of the latter.
+func (hashLog *HashLog) rotate() (uint64, error) {
+	defer hashLog.lock.Unlock()
+	hashLog.lock.Lock()
+	if hashLog.file == nil {
+		return 0, os.ErrClosed
+	}
+	if err := hashLog.rotateLocked(); err != nil {
+		return 0, err
+	}
+	return hashLog.segment, nil
+}
+
+// rotateLocked is rotate with the lock already held.
+func (hashLog *HashLog) rotateLocked() error {
+	if err := hashLog.file.Sync(); err != nil {
+		return err
+	}
+	if err := hashLog.file.Close(); err != nil {
+		return err
+	}
+	hashLog.dirty = false
+	if err := hashLog.openSegment(hashLog.segment + 1); err != nil {
+		hashLog.file = nil
+		return err
+	}
+	return nil
+}
+
+// compact drops the segments before the given one, once covered by a snapshot.
+func (hashLog *HashLog) compact(first uint64) error {
+	defer hashLog.lock.Unlock()
+	hashLog.lock.Lock()
+	for segment := range hashLog.segments {
+		if segment >= first {
+			continue
+		}
+		if err := os.Remove(hashLog.segmentPath(segment)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(hashLog.segments, segment)
+	}
+	return nil
+}
+
+// syncDir flushes a directory, so files just created or renamed in it survive a crash.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// readLogRecord reads and verifies a single framed record, returning io.EOF only at a clean end of the log.
+func readLogRecord(reader io.Reader) (logRecord, int64, error) {
+	var header [logFrameHeader]byte
+	if n, err := io.ReadFull(reader, header[:]); err != nil {
+		if err == io.EOF && n == 0 {
+			return logRecord{}, 0, io.EOF
+		}
+		return logRecord{}, 0, io.ErrUnexpectedEOF
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length == 0 || length > maxLogRecord {
+		return logRecord{}, 0, errCorruptLogRecord
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return logRecord{}, 0, io.ErrUnexpectedEOF
+	}
+	if crc32.Checksum(payload, logCRCTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return logRecord{}, 0, errCorruptLogRecord
+	}
+	record, err := decodeLogRecord(payload)
+	return record, int64(logFrameHeader + length), err
+}
+
+// encodeLogRecord frames the record with its length and checksum, ready to be written in one go.
+func encodeLogRecord(record logRecord) []byte {
+	payload := make([]byte, 0, 32+len(record.id)+len(record.hashed))
+	payload = append(payload, byte(record.kind))
+	payload = appendInt64(payload, record.at.UnixNano())
+	payload = appendString(payload, record.id)
+	if record.kind == logSubmitted {
+		payload = appendString(payload, record.hashed)
+		payload = appendInt64(payload, int64(record.ttl))
+		payload = appendInt64(payload, record.available.UnixNano())
+	}
+
+	frame := make([]byte, logFrameHeader, logFrameHeader+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(payload, logCRCTable))
+	return append(frame, payload...)
+}
+
+// decodeLogRecord parses a verified payload back into a record.
+func decodeLogRecord(payload []byte) (logRecord, error) {
+	decoder := &logDecoder{data: payload}
+	record := logRecord{kind: logRecordKind(decoder.byte())}
+	record.at = time.Unix(0, decoder.int64())
+	record.id = decoder.string()
+	switch record.kind {
+	case logSubmitted:
+		record.hashed = decoder.string()
+		record.ttl = time.Duration(decoder.int64())
+		record.available = time.Unix(0, decoder.int64())
+	case logStored, logDeleted, logEvicted, logExpired:
+	default:
+		return logRecord{}, errCorruptLogRecord
+	}
+	if decoder.failed || len(decoder.data) != 0 {
+		return logRecord{}, errCorruptLogRecord
+	}
+	return record, nil
+}
+
+// appendInt64 appends a fixed-size big-endian integer.
+func appendInt64(buf []byte, value int64) []byte {
+	var encoded [8]byte
+	binary.BigEndian.PutUint64(encoded[:], uint64(value))
+	return append(buf, encoded[:]...)
+}
+
+// appendString appends a length-prefixed string.
+func appendString(buf []byte, value string) []byte {
+	var length [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(length[:], uint64(len(value)))
+	return append(append(buf, length[:n]...), value...)
+}
+
+// logDecoder consumes a payload field by field, remembering whether it ever ran short.
+type logDecoder struct {
+	data   []byte
+	failed bool
+}
+
+func (decoder *logDecoder) byte() byte {
+	if len(decoder.data) < 1 {
+		decoder.failed = true
+		return 0
+	}
+	value := decoder.data[0]
+	decoder.data = decoder.data[1:]
+	return value
+}
+
+func (decoder *logDecoder) int64() int64 {
+	if len(decoder.data) < 8 {
+		decoder.failed = true
+		return 0
+	}
+	value := int64(binary.BigEndian.Uint64(decoder.data))
+	decoder.data = decoder.data[8:]
+	return value
+}
+
+func (decoder *logDecoder) string() string {
+	length, n := binary.Uvarint(decoder.data)
+	if n <= 0 || uint64(len(decoder.data)-n) < length {
+		decoder.failed = true
+		return ""
+	}
+	value := string(decoder.data[n : n+int(length)])
+	decoder.data = decoder.data[n+int(length):]
+	return value
+}
+
+// writeFileAtomically replaces the file with the given data, renaming it into place once flushed.
+func writeFileAtomically(path string, data []byte) error {
+	file, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if errC := file.Close(); err == nil {
+		err = errC
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+	}
+	return err
+}
+
+// append writes the record at the end of the log, flushing it right away if so configured.
+// The segment is rotated once it grows past the configured size.
+func (hashLog *HashLog) append(record logRecord) error {
+	frame := encodeLogRecord(record)
+	defer hashLog.lock.Unlock()
+	hashLog.lock.Lock()
+	if hashLog.file == nil {
+		return os.ErrClosed
+	}
+	if _, err := hashLog.file.Write(frame); err != nil {
+		return err
+	}
+	hashLog.segments[hashLog.segment] += int64(len(frame))
+	if hashLog.segments[hashLog.segment] >= hashLog.config.SegmentSize {
+		return hashLog.rotateLocked()
+	}
+	if hashLog.config.Sync == SyncAlways {
+		return hashLog.file.Sync()
+	}
+	hashLog.dirty = true
+	return nil
+}
+
+// syncPeriodically flushes any appended records every interval until the log is closed.
+func (hashLog *HashLog) syncPeriodically() {
+	defer hashLog.syncing.Done()
+	ticker := time.NewTicker(hashLog.config.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			hashLog.lock.Lock()
+			if hashLog.dirty && hashLog.file != nil {
+				hashLog.dirty = false
+				if err := hashLog.file.Sync(); err != nil {
+					hashLog.dirty = true
+				}
+			}
+			hashLog.lock.Unlock()
+		case <-hashLog.stop:
+			return
+		}
+	}
+}
+
+// takeReplayed hands over the snapshot and records read on open, which are only kept until the store is rebuilt.
+func (hashLog *HashLog) takeReplayed() (*storeSnapshot, []logRecord) {
+	snapshot, records := hashLog.snapshot, hashLog.replayed
+	hashLog.snapshot, hashLog.replayed = nil, nil
+	return snapshot, records
+}
+
+// logStats returns the age of the latest snapshot and the size of the log since, as of the given time.
+func (hashLog *HashLog) logStats(now time.Time) *logStats {
+	defer hashLog.lock.Unlock()
+	hashLog.lock.Lock()
+	stats := &logStats{Segments: len(hashLog.segments)}
+	for _, size := range hashLog.segments {
+		stats.Bytes += size
+	}
+	if !hashLog.snapshotTaken.IsZero() {
+		age := int64(now.Sub(hashLog.snapshotTaken) / time.Second)
+		stats.SnapshotAge = &age
+	}
+	return stats
+}
+
+// Close flushes and closes the log. Appending afterwards fails.
+func (hashLog *HashLog) Close() error {
+	if hashLog.stop != nil {
+		close(hashLog.stop)
+		hashLog.syncing.Wait()
+		hashLog.stop = nil
+	}
+	defer hashLog.lock.Unlock()
+	hashLog.lock.Lock()
+	if hashLog.file == nil {
+		return nil
+	}
+	err := hashLog.file.Sync()
+	if errC := hashLog.file.Close(); err == nil {
+		err = errC
+	}
+	hashLog.file = nil
+	if err != nil {
+		return fmt.Errorf("closing hash log: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+package ph
+
+import (
+	"sync"
+	"time"
+)
+
+// logPasswordHashStore is an in-memory store made durable by a write-ahead log. Every submitted hash is
+// logged before being acknowledged, and every stored, deleted, evicted or expired one once it is, so the store
+// can be rebuilt after a restart, pending hashes included. Snapshots of the whole store let the log be compacted.
+type logPasswordHashStore struct {
+	*passwordHashStore
+	hashLog *HashLog
+
+	// pending hashes as submitted, which only the log knows about otherwise
+	pending     map[string]logRecord
+	pendingLock sync.Mutex
+
+	// changes hold the read lock while logging and applying a change, so a snapshot (holding the write lock)
+	// never covers a logged change missing from the store, or the other way around
+	changes      sync.RWMutex
+	snapshotting sync.Mutex
+	snapshotStop chan bool
+	snapshots    sync.WaitGroup
+}
+
+// snapshotter is a store which can take snapshots of itself on demand.
+type snapshotter interface {
+	snapshot() (*storeSnapshot, error)
+}
+
+// restoredHash is a hash being replayed, along with what else the snapshot and log say about it.
+type restoredHash struct {
+	submitted logRecord
+	stored    time.Time
+	expires   time.Time
+	committed bool
+	// snapshotted hashes have their expiry, if any, rather than when they were stored
+	snapshotted bool
+}
+
+// newLogPasswordHashStore rebuilds the given (empty) store from the log, then logs any further change to it.
+// It must be called after the store is configured, but before any listener is registered. Restored hashes
+// whose delay is already over are stored right away, unless the store holds pending hashes back until every
+// other listener is registered too.
+func newLogPasswordHashStore(store *passwordHashStore, hashLog *HashLog) *logPasswordHashStore {
+	logStore := &logPasswordHashStore{
+		passwordHashStore: store,
+		hashLog:           hashLog,
+		pending:           make(map[string]logRecord),
+	}
+	if hashLog.invalidSnapshots > 0 {
+		store.logger.Printf("Skipped %d invalid snapshots", hashLog.invalidSnapshots)
+	}
+	store.onStored(logStore.logStored)
+	store.onRemoved(logStore.logRemoved)
+	logStore.restore(hashLog.takeReplayed())
+	if hashLog.truncated > 0 {
+		store.logger.Printf("Hash log truncated by %d bytes", hashLog.truncated)
+	}
+	if hashLog.config.SnapshotInterval > 0 {
+		logStore.snapshotStop = make(chan bool)
+		logStore.snapshots.Add(1)
+		go logStore.snapshotPeriodically(logStore.snapshotStop)
+	}
+	return logStore
+}
+
+// restore applies the snapshot, if any, then replays the log records in order: stored hashes are put back
+// as of when they were stored, deleted and expired ones are remembered as such, evicted ones are forgotten,
+// and pending ones are re-scheduled for whatever remains of their delay.
+func (logStore *logPasswordHashStore) restore(snapshot *storeSnapshot, records []logRecord) {
+	store := logStore.passwordHashStore
+	hashes := make(map[string]*restoredHash)
+	var order []string
+	gone := make(map[string]snapshotGoneId)
+	if snapshot != nil {
+		for _, hash := range snapshot.stored {
+			order = append(order, hash.id)
+			hashes[hash.id] = &restoredHash{
+				submitted:   logRecord{kind: logSubmitted, id: hash.id, hashed: hash.hashed},
+				expires:     hash.expires,
+				committed:   true,
+				snapshotted: true,
+			}
+		}
+		for _, record := range snapshot.pending {
+			if _, ok := hashes[record.id]; !ok {
+				order = append(order, record.id)
+				hashes[record.id] = &restoredHash{submitted: record}
+			}
+		}
+		for _, id := range snapshot.gone {
+			gone[id.id] = id
+		}
+	}
+	for _, record := range records {
+		switch record.kind {
+		case logSubmitted:
+			if _, ok := hashes[record.id]; !ok {
+				order = append(order, record.id)
+				hashes[record.id] = &restoredHash{submitted: record}
+			}
+		case logStored:
+			if hash, ok := hashes[record.id]; ok && !hash.committed {
+				hash.stored = record.at
+				hash.committed = true
+			}
+		case logDeleted:
+			delete(hashes, record.id)
+			gone[record.id] = snapshotGoneId{record.id, hashDeleted, record.at.Add(store.tombstoneWindow)}
+		case logEvicted:
+			delete(hashes, record.id)
+		case logExpired:
+			delete(hashes, record.id)
+			if store.expiry != nil {
+				gone[record.id] = snapshotGoneId{record.id, hashExpired, record.at.Add(store.expiry.Retention)}
+			}
+		}
+	}
+
+	now := store.now()
+	restored, rescheduled := 0, 0
+	store.lock.Lock()
+	for _, id := range order {
+		hash, ok := hashes[id]
+		if !ok || !hash.committed {
+			continue
+		}
+		store.hashes.set(id, hash.submitted.hashed)
+		if !hash.snapshotted {
+			store.scheduleExpiry(id, hash.stored, hash.submitted.ttl)
+		} else if !hash.expires.IsZero() {
+			store.scheduleExpiryAt(id, hash.expires)
+		}
+		store.trackCapacity(id, hash.submitted.hashed)
+		restored++
+	}
+	for _, id := range gone {
+		if id.until.After(now) {
+			store.rememberGone(id.id, id.state, id.until)
+		}
+	}
+	store.lock.Unlock()
+	store.notifyRemoved()
+
+	for _, id := range order {
+		hash, ok := hashes[id]
+		if !ok || hash.committed {
+			continue
+		}
+		if err := store.reserveCapacity(id, hash.submitted.hashed); err != nil {
+			store.logger.Printf("No room to restore %s", id)
+			continue
+		}
+		delay := hash.submitted.available.Sub(now)
+		if delay < 0 {
+			delay = 0
+		}
+		logStore.pendingLock.Lock()
+		logStore.pending[id] = hash.submitted
+		logStore.pendingLock.Unlock()
+		store.schedulePending(hash.submitted.hashed, id, hash.submitted.ttl, delay)
+		rescheduled++
+	}
+	if snapshot != nil {
+		store.logger.Printf("Restored %d hashes, %d pending, from snapshot and %d log records", restored, rescheduled, len(records))
+	} else if len(records) > 0 {
+		store.logger.Printf("Restored %d hashes, %d pending, from %d log records", restored, rescheduled, len(records))
+	}
+}
+
+// storePassword logs the submitted hash before storing it, failing without storing anything if it cannot be logged.
+func (logStore *logPasswordHashStore) storePassword(hashed string, id string, ttl time.Duration, delay time.Duration) error {
+	defer logStore.changes.RUnlock()
+	logStore.changes.RLock()
+
+	store := logStore.passwordHashStore
+	if err := store.refuseKnown(id); err != nil {
+		return err
+	}
+	if err := store.reserveCapacity(id, hashed); err != nil {
+		store.logger.Printf("No room to store for %s", id)
+		return err
+	}
+	now := store.now()
+	record := logRecord{kind: logSubmitted, at: now, id: id, hashed: hashed, ttl: ttl, available: now.Add(delay)}
+	if err := logStore.hashLog.append(record); err != nil {
+		store.logger.Printf("ERROR: Failed to log %s: %v", id, err)
+		store.lock.Lock()
+		store.releaseCapacity(id, hashed)
+		store.lock.Unlock()
+		return err
+	}
+	logStore.pendingLock.Lock()
+	logStore.pending[id] = record
+	logStore.pendingLock.Unlock()
+	store.schedulePending(hashed, id, ttl, delay)
+	return nil
+}
+
+// deletePassword logs the deletion of a stored or pending hash.
+func (logStore *logPasswordHashStore) deletePassword(id string) hashState {
+	defer logStore.changes.RUnlock()
+	logStore.changes.RLock()
+
+	state := logStore.passwordHashStore.deletePassword(id)
+	if state == hashAvailable || state == hashPending {
+		logStore.forgetPending(id)
+		logStore.logDeleted(id)
+	}
+	return state
+}
+
+// logStored is the store listener logging hashes once they become available.
+func (logStore *logPasswordHashStore) logStored(id string, hashed string) {
+	defer logStore.changes.RUnlock()
+	logStore.changes.RLock()
+
+	logStore.forgetPending(id)
+	logStore.appendOrComplain(logRecord{kind: logStored, at: logStore.now(), id: id})
+}
+
+// logRemoved is the removal listener logging hashes once evicted or expired.
+func (logStore *logPasswordHashStore) logRemoved(id string, state hashState, at time.Time) {
+	defer logStore.changes.RUnlock()
+	logStore.changes.RLock()
+
+	kind := logEvicted
+	if state == hashExpired {
+		kind = logExpired
+	}
+	logStore.appendOrComplain(logRecord{kind: kind, at: at, id: id})
+}
+
+// logDeleted logs a hash as deleted.
+func (logStore *logPasswordHashStore) logDeleted(id string) {
+	logStore.appendOrComplain(logRecord{kind: logDeleted, at: logStore.now(), id: id})
+}
+
+// forgetPending drops a hash no longer pending.
+func (logStore *logPasswordHashStore) forgetPending(id string) {
+	logStore.pendingLock.Lock()
+	delete(logStore.pending, id)
+	logStore.pendingLock.Unlock()
+}
+
+// appendOrComplain appends a record the caller cannot fail on, so a failure is only logged.
+// Replaying the log without it is still consistent, only less up to date.
+func (logStore *logPasswordHashStore) appendOrComplain(record logRecord) {
+	if err := logStore.hashLog.append(record); err != nil {
+		logStore.logger.Printf("ERROR: Failed to log %s: %v", record.id, err)
+	}
+}
+
+// snapshot saves the whole store, then drops the log segments it covers.
+// Changes are only held up while the log is rotated and the store copied, not while the snapshot is written.
+func (logStore *logPasswordHashStore) snapshot() (*storeSnapshot, error) {
+	defer logStore.snapshotting.Unlock()
+	logStore.snapshotting.Lock()
+
+	logStore.changes.Lock()
+	segment, err := logStore.hashLog.rotate()
+	if err != nil {
+		logStore.changes.Unlock()
+		return nil, err
+	}
+	snapshot := logStore.capture(segment)
+	logStore.changes.Unlock()
+
+	if err := logStore.hashLog.writeSnapshot(snapshot); err != nil {
+		return nil, err
+	}
+	if err := logStore.hashLog.compact(segment); err != nil {
+		return nil, err
+	}
+	logStore.logger.Printf("Snapshot of %d hashes, %d pending, taken", len(snapshot.stored), len(snapshot.pending))
+	return snapshot, nil
+}
+
+// capture copies the state of the store. Pending hashes stored meanwhile are left in,
+// since their stored state takes precedence when restoring.
+func (logStore *logPasswordHashStore) capture(segment uint64) *storeSnapshot {
+	store := logStore.passwordHashStore
+	snapshot := &storeSnapshot{taken: store.now(), segment: segment}
+
+	store.lock.RLock()
+	snapshot.stored = make([]snapshotHash, 0, store.hashes.count())
+	store.hashes.each(func(id string, hashed string) {
+		snapshot.stored = append(snapshot.stored, snapshotHash{id, hashed, store.expiresAt[id]})
+	})
+	snapshot.gone = make([]snapshotGoneId, 0, len(store.forgetting))
+	for _, due := range store.forgetting {
+		if state, ok := store.gone[due.id]; ok {
+			snapshot.gone = append(snapshot.gone, snapshotGoneId{due.id, state, due.at})
+		}
+	}
+	store.lock.RUnlock()
+
+	logStore.pendingLock.Lock()
+	snapshot.pending = make([]logRecord, 0, len(logStore.pending))
+	for _, record := range logStore.pending {
+		snapshot.pending = append(snapshot.pending, record)
+	}
+	logStore.pendingLock.Unlock()
+	return snapshot
+}
+
+// snapshotPeriodically takes a snapshot every interval until stopped.
+func (logStore *logPasswordHashStore) snapshotPeriodically(stop chan bool) {
+	defer logStore.snapshots.Done()
+	ticker := time.NewTicker(logStore.hashLog.config.SnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := logStore.snapshot(); err != nil {
+				logStore.logger.Printf("ERROR: Failed to take snapshot: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// collectStats adds the snapshot age and log size to the store's own stats.
+func (logStore *logPasswordHashStore) collectStats(stats *serverStats) {
+	logStore.passwordHashStore.collectStats(stats)
+	stats.Log = logStore.hashLog.logStats(logStore.now())
+}
+
+// close takes a last snapshot, so there is little to replay on restart, then closes the log.
+// It must only be called once no more pending stores exist.
+func (logStore *logPasswordHashStore) close() error {
+	if logStore.snapshotStop != nil {
+		close(logStore.snapshotStop)
+		logStore.snapshots.Wait()
+		logStore.snapshotStop = nil
+	}
+	if _, err := logStore.snapshot(); err != nil {
+		logStore.logger.Printf("ERROR: Failed to take snapshot: %v", err)
+	}
+	return logStore.hashLog.Close()
+}
@@ -0,0 +1,163 @@
+package ph
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newLoggedStore(t *testing.T, buf *bytes.Buffer, dir string, now time.Time) *logPasswordHashStore {
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	store.now = func() time.Time {
+		return now
+	}
+	return newLogPasswordHashStore(store, openTestLog(t, dir))
+}
+
+func Test_logPasswordHashStoreRestart(t *testing.T) {
+	buf := &bytes.Buffer{}
+	dir := t.TempDir()
+	now := time.Unix(1000, 0)
+	store := newLoggedStore(t, buf, dir, now)
+	for _, id := range []string{"1", "2", "3"} {
+		if err := store.storePassword("hash-"+id, id, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	forceGoroutineScheduler()
+	store.waitPendingStores()
+	if state := store.deletePassword("2"); state != hashAvailable {
+		t.Errorf("Expected stored hash to be deleted, got %d", state)
+	}
+	// crash without taking a snapshot
+	store.hashLog.Close()
+
+	buf.Reset()
+	store = newLoggedStore(t, buf, dir, now)
+	defer store.close()
+	if hash, state := store.retrievePassword("1"); hash != "hash-1" || state != hashAvailable {
+		t.Errorf("Expected hash to survive restart, got %s %d", hash, state)
+	}
+	if hash, state := store.retrievePassword("3"); hash != "hash-3" || state != hashAvailable {
+		t.Errorf("Expected hash to survive restart, got %s %d", hash, state)
+	}
+	if _, state := store.retrievePassword("2"); state != hashDeleted {
+		t.Errorf("Expected deletion to survive restart, got %d", state)
+	}
+	if !strings.Contains(buf.String(), "Restored 2 hashes, 0 pending, from 7 log records\n") {
+		t.Errorf("Expected log indicating restoration: %s", buf.String())
+	}
+}
+
+func Test_logPasswordHashStoreRestartPending(t *testing.T) {
+	buf := &bytes.Buffer{}
+	dir := t.TempDir()
+	now := time.Unix(1000, 0)
+	store := newLoggedStore(t, buf, dir, now)
+	store.storePassword("hash-1", "1", 0, time.Hour)
+	store.storePassword("hash-2", "2", 0, time.Hour)
+	store.deletePassword("2")
+	// crash while both are pending: the log is closed, but never the store
+	store.hashLog.Close()
+
+	// restarting before the delay is over keeps waiting for what remains of it
+	buf.Reset()
+	store = newLoggedStore(t, buf, dir, now.Add(time.Hour-time.Second/100))
+	if _, state := store.retrievePassword("1"); state != hashPending {
+		t.Errorf("Expected hash to be pending again, got %d", state)
+	}
+	if _, state := store.retrievePassword("2"); state != hashDeleted {
+		t.Errorf("Expected cancelled hash to stay deleted, got %d", state)
+	}
+	forceGoroutineScheduler()
+	store.waitPendingStores()
+	if hash, state := store.retrievePassword("1"); hash != "hash-1" || state != hashAvailable {
+		t.Errorf("Expected hash stored after its remaining delay, got %s %d", hash, state)
+	}
+	if !strings.Contains(buf.String(), "Restored 0 hashes, 1 pending, from 3 log records\n") {
+		t.Errorf("Expected log indicating restoration: %s", buf.String())
+	}
+	store.hashLog.Close()
+
+	// and the hash stored after restarting is logged too
+	buf.Reset()
+	store = newLoggedStore(t, buf, dir, now.Add(2*time.Hour))
+	defer store.close()
+	if hash, state := store.retrievePassword("1"); hash != "hash-1" || state != hashAvailable {
+		t.Errorf("Expected hash to survive another restart, got %s %d", hash, state)
+	}
+}
+
+func Test_logPasswordHashStoreExpiry(t *testing.T) {
+	buf := &bytes.Buffer{}
+	dir := t.TempDir()
+	now := time.Unix(1000, 0)
+	store := newLoggedStore(t, buf, dir, now)
+	store.storePassword("hash-1", "1", time.Minute, 0)
+	forceGoroutineScheduler()
+	store.waitPendingStores()
+	store.close()
+
+	// the time-to-live counts from when the hash was first stored
+	store = newLoggedStore(t, buf, dir, now.Add(time.Minute))
+	defer store.close()
+	if _, state := store.retrievePassword("1"); state != hashExpired {
+		t.Errorf("Expected hash to expire as it would have without a restart, got %d", state)
+	}
+}
+
+func Test_logPasswordHashStoreEvictionAndExpiry(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Unix(1000, 0)
+	open := func() *logPasswordHashStore {
+		store := newPasswordHashStore(log.New(&bytes.Buffer{}, "", 0))
+		store.now = func() time.Time {
+			return now
+		}
+		store.setCapacity(CapacityConfig{MaxRecords: 2})
+		store.setExpiry(ExpiryConfig{Retention: time.Hour})
+		return newLogPasswordHashStore(store, openTestLog(t, dir))
+	}
+	store := open()
+	store.storePassword("hash-1", "1", 0, 0)
+	store.storePassword("hash-2", "2", time.Minute, 0)
+	store.waitPendingStores()
+	now = now.Add(time.Minute)
+	store.expireHashes(now)
+	store.storePassword("hash-3", "3", 0, 0)
+	store.waitPendingStores()
+	// 1 becomes the most recently used, so 3 is evicted rather than 1
+	store.retrievePassword("1")
+	store.storePassword("hash-4", "4", 0, 0)
+	store.waitPendingStores()
+	// crash without taking a snapshot
+	store.hashLog.Close()
+
+	store = open()
+	defer store.close()
+	for id, expected := range map[string]hashState{"1": hashAvailable, "2": hashExpired, "3": hashUnknown, "4": hashAvailable} {
+		if _, state := store.retrievePassword(id); state != expected {
+			t.Errorf("Expected %s to be restored as %d, got %d", id, expected, state)
+		}
+	}
+	if stats := store.capacityStats(); stats.Records != 2 || stats.Evicted != 0 {
+		t.Errorf("Expected nothing to be evicted again on restart: %+v", stats)
+	}
+}
+
+func Test_logPasswordHashStoreClosed(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newLoggedStore(t, buf, t.TempDir(), time.Unix(1000, 0))
+	store.close()
+	if err := store.storePassword("hash-1", "1", 0, 0); err == nil {
+		t.Error("Expected hash that cannot be logged to be refused")
+	}
+	if _, state := store.retrievePassword("1"); state != hashUnknown {
+		t.Errorf("Expected refused hash to be unknown, got %d", state)
+	}
+	if !strings.Contains(buf.String(), "ERROR: Failed to log 1: ") {
+		t.Errorf("Expected log indicating failure: %s", buf.String())
+	}
+}
@@ -0,0 +1,205 @@
+package ph
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func openTestLog(t *testing.T, dir string) *HashLog {
+	hashLog, err := OpenHashLog(LogConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return hashLog
+}
+
+func Test_HashLogRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	at := time.Unix(1000, 5)
+	records := []logRecord{
+		{kind: logSubmitted, at: at, id: "1", hashed: "test", ttl: time.Minute, available: at.Add(5 * time.Second)},
+		{kind: logStored, at: at.Add(5 * time.Second), id: "1"},
+		{kind: logDeleted, at: at.Add(time.Minute), id: "1"},
+		{kind: logEvicted, at: at.Add(time.Minute), id: "2"},
+		{kind: logExpired, at: at.Add(time.Hour), id: "3"},
+	}
+	hashLog := openTestLog(t, dir)
+	if hashLog.config.Sync != SyncAlways {
+		t.Errorf("Unexpected default sync mode: %s", hashLog.config.Sync)
+	}
+	for _, record := range records {
+		if err := hashLog.append(record); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if err := hashLog.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := hashLog.append(records[0]); err != os.ErrClosed {
+		t.Errorf("Expected closed log to refuse records: %v", err)
+	}
+
+	hashLog = openTestLog(t, dir)
+	defer hashLog.Close()
+	snapshot, replayed := hashLog.takeReplayed()
+	if snapshot != nil {
+		t.Errorf("Unexpected snapshot: %+v", snapshot)
+	}
+	if len(replayed) != len(records) || hashLog.truncated != 0 {
+		t.Fatalf("Unexpected replay: %+v, truncated %d", replayed, hashLog.truncated)
+	}
+	for i, record := range records {
+		if replayed[i].kind != record.kind || replayed[i].id != record.id || replayed[i].hashed != record.hashed ||
+			replayed[i].ttl != record.ttl || !replayed[i].at.Equal(record.at) || !replayed[i].available.Equal(record.available) {
+			t.Errorf("Unexpected record %d: %+v", i, replayed[i])
+		}
+	}
+	if _, replayed := hashLog.takeReplayed(); replayed != nil {
+		t.Error("Expected replayed records to be handed over only once")
+	}
+}
+
+func Test_HashLogTruncatesTail(t *testing.T) {
+	submitted := logRecord{kind: logSubmitted, at: time.Unix(1000, 0), id: "1", hashed: "test"}
+	stored := logRecord{kind: logStored, at: time.Unix(1005, 0), id: "1"}
+	first, second := len(encodeLogRecord(submitted)), len(encodeLogRecord(stored))
+	for _, test := range []struct {
+		name   string
+		damage func(data []byte) []byte
+		intact int
+	}{
+		{"torn", func(data []byte) []byte { return data[:len(data)-3] }, 1},
+		{"corrupt", func(data []byte) []byte { data[len(data)-1] ^= 0xff; return data }, 1},
+		{"garbage", func(data []byte) []byte { return append(data, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1) }, 2},
+	} {
+		dir := t.TempDir()
+		hashLog := openTestLog(t, dir)
+		path := hashLog.segmentPath(1)
+		hashLog.append(submitted)
+		hashLog.append(stored)
+		hashLog.Close()
+		data, _ := ioutil.ReadFile(path)
+		if err := ioutil.WriteFile(path, test.damage(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		hashLog = openTestLog(t, dir)
+		if _, replayed := hashLog.takeReplayed(); len(replayed) != test.intact {
+			t.Errorf("%s: expected only the intact records, got %+v", test.name, replayed)
+		}
+		if hashLog.truncated == 0 {
+			t.Errorf("%s: expected truncation to be reported", test.name)
+		}
+		size := int64(first)
+		if test.intact == 2 {
+			size += int64(second)
+		}
+		if info, _ := os.Stat(path); info.Size() != size {
+			t.Errorf("%s: expected log truncated to %d bytes, got %d", test.name, size, info.Size())
+		}
+
+		// appending after truncation yields a valid log again
+		hashLog.append(logRecord{kind: logDeleted, at: time.Unix(1010, 0), id: "1"})
+		hashLog.Close()
+		hashLog = openTestLog(t, dir)
+		if _, replayed := hashLog.takeReplayed(); len(replayed) != test.intact+1 || hashLog.truncated != 0 {
+			t.Errorf("%s: expected appended record after truncation, got %+v", test.name, replayed)
+		}
+		hashLog.Close()
+	}
+}
+
+func Test_HashLogSegments(t *testing.T) {
+	dir := t.TempDir()
+	hashLog, err := OpenHashLog(LogConfig{Dir: dir, SegmentSize: 1})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		hashLog.append(logRecord{kind: logStored, at: time.Unix(1000, 0), id: id})
+	}
+	if hashLog.segment != 4 || len(hashLog.segments) != 4 {
+		t.Errorf("Expected a segment per record, got %d of %d", hashLog.segment, len(hashLog.segments))
+	}
+	// segments are only compacted once a snapshot covers them
+	if err := hashLog.writeSnapshot(&storeSnapshot{taken: time.Unix(1000, 0), segment: 3}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := hashLog.compact(3); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := os.Stat(hashLog.segmentPath(2)); !os.IsNotExist(err) {
+		t.Errorf("Expected compacted segment to be removed: %v", err)
+	}
+	hashLog.Close()
+
+	hashLog = openTestLog(t, dir)
+	defer hashLog.Close()
+	if _, replayed := hashLog.takeReplayed(); len(replayed) != 1 || replayed[0].id != "3" {
+		t.Errorf("Expected records of remaining segments only, got %+v", replayed)
+	}
+	if hashLog.segment != 4 {
+		t.Errorf("Expected to append to the last segment, got %d", hashLog.segment)
+	}
+}
+
+func Test_HashLogSegmentCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	hashLog, err := OpenHashLog(LogConfig{Dir: dir, SegmentSize: 1})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		hashLog.append(logRecord{kind: logStored, at: time.Unix(1000, 0), id: id})
+	}
+	hashLog.Close()
+	path := hashLog.segmentPath(2)
+	data, _ := ioutil.ReadFile(path)
+	if err := ioutil.WriteFile(path, data[:len(data)-3], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// a segment followed by others was complete, so it is not cut off
+	if _, err := OpenHashLog(LogConfig{Dir: dir}); !errors.Is(err, errCorruptLogRecord) {
+		t.Errorf("Expected damaged segment to fail the open, got %v", err)
+	}
+	if info, _ := os.Stat(path); info.Size() != int64(len(data)-3) {
+		t.Errorf("Expected damaged segment to be left as is, got %d bytes", info.Size())
+	}
+}
+
+func Test_HashLogSyncInterval(t *testing.T) {
+	hashLog, err := OpenHashLog(LogConfig{Dir: t.TempDir(), Sync: SyncInterval, SyncInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	hashLog.append(logRecord{kind: logStored, at: time.Unix(1000, 0), id: "1"})
+	for i := 0; i < 100; i++ {
+		hashLog.lock.Lock()
+		dirty := hashLog.dirty
+		hashLog.lock.Unlock()
+		if !dirty {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if hashLog.dirty {
+		t.Error("Expected the log to be flushed in the background")
+	}
+	if err := hashLog.Close(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func Test_decodeLogRecord(t *testing.T) {
+	frame := encodeLogRecord(logRecord{kind: logSubmitted, at: time.Unix(1000, 0), id: "1", hashed: "test"})
+	payload := frame[logFrameHeader:]
+	for _, bogus := range [][]byte{payload[:len(payload)-1], append(payload, 0), {9, 0, 0, 0, 0, 0, 0, 0, 0, 0}} {
+		if _, err := decodeLogRecord(bogus); err != errCorruptLogRecord {
+			t.Errorf("Expected %v to be rejected: %v", bogus, err)
+		}
+	}
+}
@@ -0,0 +1,653 @@
+package ph
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// replicationStored, replicationDeleted, replicationSnapshot and replicationHeartbeat are the kinds of
+	// replication events: a hash stored or deleted, the whole store to start over from, and the primary's
+	// sequence number while nothing else happens.
+	replicationStored    = "stored"
+	replicationDeleted   = "deleted"
+	replicationSnapshot  = "snapshot"
+	replicationHeartbeat = "heartbeat"
+
+	defaultReplicationJournal   = 100000
+	defaultReplicationHeartbeat = time.Second
+	defaultFollowerRetry        = time.Second
+)
+
+// errReadOnly is returned when writing to a follower, which only gets writes from its primary.
+var errReadOnly = errors.New("read only")
+
+// replicaStore is a store a follower can apply replicated mutations to, and start over from a snapshot into.
+type replicaStore interface {
+	configurableStore
+	dumpableStore
+	applyStored(id string, hashed string, stored time.Time, ttl time.Duration)
+}
+
+// replicationEvent is a store mutation as streamed from a primary to its followers, one JSON object per line.
+// Snapshots carry the epoch of the journal and every record of the store, as of the sequence number.
+type replicationEvent struct {
+	Seq     uint64        `json:"seq"`
+	Op      string        `json:"op"`
+	At      time.Time     `json:"at"`
+	Id      string        `json:"id,omitempty"`
+	Hash    string        `json:"hash,omitempty"`
+	TTL     time.Duration `json:"ttl,omitempty"`
+	Epoch   string        `json:"epoch,omitempty"`
+	Records []dumpedHash  `json:"records,omitempty"`
+}
+
+// replicationStats are the replication state reported by the stats endpoint. A primary reports the latest
+// sequence number and how many followers are streaming, and a follower how far behind the primary it is,
+// in mutations and in seconds since it was last caught up.
+type replicationStats struct {
+	Role       string  `json:"role"`
+	Epoch      string  `json:"epoch"`
+	Head       uint64  `json:"head"`
+	Followers  int     `json:"followers,omitempty"`
+	Applied    uint64  `json:"applied,omitempty"`
+	Lag        uint64  `json:"lag,omitempty"`
+	LagSeconds float64 `json:"lag_seconds,omitempty"`
+	Connected  bool    `json:"connected,omitempty"`
+}
+
+// FollowerConfig configures a follower: the base URL of its primary, such as "http://primary:8090", and how
+// long to wait before reconnecting once disconnected. Followers authenticate with their own admin token,
+// which must be the same as the primary's.
+type FollowerConfig struct {
+	Primary string
+	Retry   time.Duration
+}
+
+// replicationJournal keeps the latest mutations of a primary by sequence number, so followers can catch up
+// after a disconnect. Its epoch changes whenever the primary starts over, or rewrites its store in a way the
+// journal does not tell, so followers further behind, or from another epoch, start over from a snapshot.
+type replicationJournal struct {
+	lock      sync.Mutex
+	epoch     string
+	first     uint64
+	entries   []replicationEvent
+	size      int
+	changed   chan bool
+	closed    bool
+	followers int
+	heartbeat time.Duration
+}
+
+// newReplicationJournal creates an empty journal keeping up to the given number of mutations.
+func newReplicationJournal(size int) *replicationJournal {
+	if size <= 0 {
+		size = defaultReplicationJournal
+	}
+	return &replicationJournal{
+		epoch:     newReplicationEpoch(),
+		first:     1,
+		size:      size,
+		changed:   make(chan bool),
+		heartbeat: defaultReplicationHeartbeat,
+	}
+}
+
+// newReplicationEpoch returns a random epoch, telling apart journals of different runs.
+func newReplicationEpoch() string {
+	var epoch [8]byte
+	readRandom(epoch[:])
+	return hex.EncodeToString(epoch[:])
+}
+
+// append adds a mutation under the next sequence number, dropping the oldest one if full, and wakes up streams.
+func (journal *replicationJournal) append(event replicationEvent) {
+	defer journal.lock.Unlock()
+	journal.lock.Lock()
+	event.Seq = journal.first + uint64(len(journal.entries))
+	journal.entries = append(journal.entries, event)
+	if len(journal.entries) > journal.size {
+		journal.entries[0] = replicationEvent{}
+		journal.entries = journal.entries[1:]
+		journal.first++
+	}
+	journal.wake()
+}
+
+// reset starts a new epoch, dropping every mutation, so followers start over from a snapshot.
+func (journal *replicationJournal) reset() {
+	defer journal.lock.Unlock()
+	journal.lock.Lock()
+	journal.epoch = newReplicationEpoch()
+	journal.first += uint64(len(journal.entries))
+	journal.entries = nil
+	journal.wake()
+}
+
+// close ends every stream, so the server can shut down.
+func (journal *replicationJournal) close() {
+	defer journal.lock.Unlock()
+	journal.lock.Lock()
+	journal.closed = true
+	journal.wake()
+}
+
+// wake tells streams the journal changed. Must be called with the lock held.
+func (journal *replicationJournal) wake() {
+	close(journal.changed)
+	journal.changed = make(chan bool)
+}
+
+// position returns the epoch and latest sequence number.
+func (journal *replicationJournal) position() (string, uint64) {
+	defer journal.lock.Unlock()
+	journal.lock.Lock()
+	return journal.epoch, journal.first + uint64(len(journal.entries)) - 1
+}
+
+// since returns the mutations after the given sequence number of the given epoch, or false if they are not
+// all kept anymore, along with a channel closed once more are appended.
+func (journal *replicationJournal) since(epoch string, after uint64) ([]replicationEvent, bool, <-chan bool) {
+	defer journal.lock.Unlock()
+	journal.lock.Lock()
+	if epoch != journal.epoch || after+1 < journal.first || after+1 > journal.first+uint64(len(journal.entries)) {
+		return nil, false, journal.changed
+	}
+	events := make([]replicationEvent, len(journal.entries)-int(after+1-journal.first))
+	copy(events, journal.entries[after+1-journal.first:])
+	return events, true, journal.changed
+}
+
+// stream sends the mutations after the given sequence number of the given epoch, then every further one as
+// it is appended, until the context is done, sending fails or the journal is closed. A snapshot of the store
+// is sent first if the follower is too far behind, or from another epoch, and again whenever the epoch changes.
+func (journal *replicationJournal) stream(ctx context.Context, epoch string, after uint64, dumps dumpableStore, send func(event replicationEvent) error) error {
+	journal.lock.Lock()
+	journal.followers++
+	journal.lock.Unlock()
+	defer func() {
+		journal.lock.Lock()
+		journal.followers--
+		journal.lock.Unlock()
+	}()
+
+	heartbeat := time.NewTicker(journal.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		events, ok, changed := journal.since(epoch, after)
+		if !ok {
+			// mutations journaled after the position are applied again over the snapshot, which is harmless
+			epoch, after = journal.position()
+			snapshot := replicationEvent{Seq: after, Op: replicationSnapshot, At: time.Now(), Epoch: epoch, Records: dumps.dumpHashes()}
+			if err := send(snapshot); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, event := range events {
+			if err := send(event); err != nil {
+				return err
+			}
+			after = event.Seq
+		}
+		if len(events) > 0 {
+			continue
+		}
+
+		select {
+		case <-changed:
+			journal.lock.Lock()
+			closed := journal.closed
+			journal.lock.Unlock()
+			if closed {
+				return nil
+			}
+		case <-heartbeat.C:
+			_, head := journal.position()
+			if err := send(replicationEvent{Seq: head, Op: replicationHeartbeat, At: time.Now()}); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// stats returns the epoch, latest sequence number and number of streaming followers.
+func (journal *replicationJournal) stats() *replicationStats {
+	defer journal.lock.Unlock()
+	journal.lock.Lock()
+	return &replicationStats{
+		Role:      "primary",
+		Epoch:     journal.epoch,
+		Head:      journal.first + uint64(len(journal.entries)) - 1,
+		Followers: journal.followers,
+	}
+}
+
+// replicatingPasswordHashStore journals every hash stored or deleted in the store it wraps, for followers.
+// Hashes are journaled in the order their mutations took effect: a hash deleted right as it is stored, before
+// listeners were told of it, is only journaled as deleted, so followers never see it stored afterwards.
+// Hashes the wrapped store evicts to make room, or expires, are not journaled: followers expire them on their
+// own, and keep evicted ones until they expire or get evicted there too.
+type replicatingPasswordHashStore struct {
+	passwordHashStorer
+	journal *replicationJournal
+
+	// time-to-live of pending hashes not journaled yet, and those deleted before being journaled as stored
+	lock        sync.Mutex
+	unjournaled map[string]time.Duration
+	dropped     map[string]bool
+}
+
+// newReplicatingPasswordHashStore wraps the given store, journaling its mutations.
+func newReplicatingPasswordHashStore(store passwordHashStorer, journal *replicationJournal) *replicatingPasswordHashStore {
+	replicating := &replicatingPasswordHashStore{
+		passwordHashStorer: store,
+		journal:            journal,
+		unjournaled:        make(map[string]time.Duration),
+		dropped:            make(map[string]bool),
+	}
+	if dumpable, ok := store.(dumpableStore); ok {
+		replicating.trackPending(dumpable.dumpHashes())
+	}
+	store.onStored(replicating.journalStored)
+	return replicating
+}
+
+// trackPending remembers the pending hashes among the given ones as not journaled yet, such as those restored.
+func (store *replicatingPasswordHashStore) trackPending(hashes []dumpedHash) {
+	defer store.lock.Unlock()
+	store.lock.Lock()
+	for _, hash := range hashes {
+		if hash.State == dumpPending {
+			store.unjournaled[hash.Id] = hash.TTL
+		}
+	}
+}
+
+// storePassword remembers the hash as not journaled yet, along with its time-to-live, until it is stored.
+func (store *replicatingPasswordHashStore) storePassword(hashed string, id string, ttl time.Duration, delay time.Duration) error {
+	store.lock.Lock()
+	store.unjournaled[id] = ttl
+	store.lock.Unlock()
+	err := store.passwordHashStorer.storePassword(hashed, id, ttl, delay)
+	if err != nil {
+		store.lock.Lock()
+		delete(store.unjournaled, id)
+		store.lock.Unlock()
+	}
+	return err
+}
+
+// journalStored is the store listener journaling hashes once they become available, unless deleted meanwhile.
+func (store *replicatingPasswordHashStore) journalStored(id string, hashed string) {
+	defer store.lock.Unlock()
+	store.lock.Lock()
+	ttl := store.unjournaled[id]
+	delete(store.unjournaled, id)
+	if store.dropped[id] {
+		delete(store.dropped, id)
+		return
+	}
+	store.journal.append(replicationEvent{Op: replicationStored, At: time.Now(), Id: id, Hash: hashed, TTL: ttl})
+}
+
+// deletePassword journals the deletion of a stored or pending hash. A hash just stored, but not journaled yet,
+// is dropped once its listener runs, so it is not journaled after its deletion.
+func (store *replicatingPasswordHashStore) deletePassword(id string) hashState {
+	defer store.lock.Unlock()
+	store.lock.Lock()
+	state := store.passwordHashStorer.deletePassword(id)
+	if state != hashAvailable && state != hashPending {
+		return state
+	}
+	if _, unjournaled := store.unjournaled[id]; unjournaled {
+		if state == hashPending {
+			// cancelled, its listener never runs
+			delete(store.unjournaled, id)
+		} else {
+			store.dropped[id] = true
+		}
+	}
+	store.journal.append(replicationEvent{Op: replicationDeleted, At: time.Now(), Id: id})
+	return state
+}
+
+// dumpHashes dumps the wrapped store.
+func (store *replicatingPasswordHashStore) dumpHashes() []dumpedHash {
+	return store.passwordHashStorer.(dumpableStore).dumpHashes()
+}
+
+// restoreHashes restores into the wrapped store, then starts a new epoch so followers get what was restored.
+func (store *replicatingPasswordHashStore) restoreHashes(hashes []dumpedHash) (restoreReport, error) {
+	store.trackPending(hashes)
+	report, err := store.passwordHashStorer.(dumpableStore).restoreHashes(hashes)
+	if report.Restored > 0 {
+		store.journal.reset()
+	}
+	return report, err
+}
+
+// rewriteHashes rewrites the wrapped store's hashes, then starts a new epoch so followers get the new values.
+func (store *replicatingPasswordHashStore) rewriteHashes(rewrite func(id string, hashed string) (string, bool)) int {
+	rewritable, ok := store.passwordHashStorer.(rewritableStore)
+	if !ok {
+		return 0
+	}
+	rewritten := rewritable.rewriteHashes(rewrite)
+	if rewritten > 0 {
+		store.journal.reset()
+	}
+	return rewritten
+}
+
+// collectStats adds the journal's position to the wrapped store's stats.
+func (store *replicatingPasswordHashStore) collectStats(stats *serverStats) {
+	store.passwordHashStorer.collectStats(stats)
+	stats.Replication = store.journal.stats()
+}
+
+// applyStored stores a hash replicated from a primary right away, expiring as it would there, unless its id
+// is remembered as deleted meanwhile.
+func (store *passwordHashStore) applyStored(id string, hashed string, stored time.Time, ttl time.Duration) {
+	store.lock.Lock()
+	if _, gone := store.gone[id]; gone {
+		store.lock.Unlock()
+		return
+	}
+	store.removeHash(id)
+	err := store.reserveCapacityLocked(id, hashed)
+	if err == nil {
+		store.hashes.set(id, hashed)
+		store.scheduleExpiry(id, stored, ttl)
+		store.trackCapacity(id, hashed)
+	}
+	store.lock.Unlock()
+	store.notifyRemoved()
+	if err != nil {
+		store.logger.Printf("No room to replicate %s", id)
+	}
+}
+
+// applyStored stores a replicated hash in the shard of its id.
+func (store *shardedPasswordHashStore) applyStored(id string, hashed string, stored time.Time, ttl time.Duration) {
+	store.shard(id).applyStored(id, hashed, stored, ttl)
+}
+
+// followerPasswordHashStore is a read-only store mirroring that of a primary, by applying the mutations it
+// streams in order. Starting over from a snapshot builds a new store, swapped in once complete, so reads
+// never see a partial one. Hashes pending on the primary only show up once stored there.
+type followerPasswordHashStore struct {
+	lock     sync.RWMutex
+	store    replicaStore
+	newStore func() replicaStore
+	config   FollowerConfig
+	token    string
+	logger   *log.Logger
+	expiring bool
+
+	// position in the primary's journal, and when this store was last caught up with it
+	epoch      string
+	applied    uint64
+	head       uint64
+	connected  bool
+	caughtUpAt time.Time
+
+	following     sync.WaitGroup
+	stopFollowing context.CancelFunc
+}
+
+// newFollowerPasswordHashStore creates a follower starting with the given (empty) store, and creating
+// new ones to start over from snapshots. It authenticates with the given admin token.
+func newFollowerPasswordHashStore(logger *log.Logger, config FollowerConfig, token string, store replicaStore, newStore func() replicaStore) *followerPasswordHashStore {
+	if config.Retry <= 0 {
+		config.Retry = defaultFollowerRetry
+	}
+	return &followerPasswordHashStore{
+		store:      store,
+		newStore:   newStore,
+		config:     config,
+		token:      token,
+		logger:     logger,
+		caughtUpAt: time.Now(),
+	}
+}
+
+// current returns the store reads are served from.
+func (follower *followerPasswordHashStore) current() replicaStore {
+	defer follower.lock.RUnlock()
+	follower.lock.RLock()
+	return follower.store
+}
+
+// storePassword refuses any write, which only comes from the primary.
+func (follower *followerPasswordHashStore) storePassword(hashed string, id string, ttl time.Duration, delay time.Duration) error {
+	return errReadOnly
+}
+
+// retrievePassword gets the hash from the current store.
+func (follower *followerPasswordHashStore) retrievePassword(id string) (string, hashState) {
+	return follower.current().retrievePassword(id)
+}
+
+// deletePassword refuses any write, which only comes from the primary.
+func (follower *followerPasswordHashStore) deletePassword(id string) hashState {
+	return hashUnknown
+}
+
+// waitPendingStores has nothing to wait for, since hashes are replicated once stored.
+func (follower *followerPasswordHashStore) waitPendingStores() {
+	follower.current().waitPendingStores()
+}
+
+// onStored ignores listeners, as callbacks are delivered by the primary.
+func (follower *followerPasswordHashStore) onStored(listener storeListener) {
+}
+
+// startExpiring expires hashes of the current store, and of any store swapped in later.
+func (follower *followerPasswordHashStore) startExpiring() {
+	defer follower.lock.Unlock()
+	follower.lock.Lock()
+	follower.expiring = true
+	follower.store.startExpiring()
+}
+
+// stopExpiring stops expiring hashes of the current store.
+func (follower *followerPasswordHashStore) stopExpiring() {
+	defer follower.lock.Unlock()
+	follower.lock.Lock()
+	follower.expiring = false
+	follower.store.stopExpiring()
+}
+
+// collectStats adds how far behind the primary the follower is to the current store's stats.
+func (follower *followerPasswordHashStore) collectStats(stats *serverStats) {
+	follower.current().collectStats(stats)
+	follower.lock.RLock()
+	replication := &replicationStats{
+		Role:      "follower",
+		Epoch:     follower.epoch,
+		Head:      follower.head,
+		Applied:   follower.applied,
+		Lag:       follower.head - follower.applied,
+		Connected: follower.connected,
+	}
+	if !follower.connected || follower.applied < follower.head {
+		replication.LagSeconds = time.Since(follower.caughtUpAt).Seconds()
+	}
+	follower.lock.RUnlock()
+	stats.Replication = replication
+}
+
+// drainPending has nothing to drain, since hashes are replicated once stored.
+func (follower *followerPasswordHashStore) drainPending(config ShutdownConfig) (shutdownReport, error) {
+	return shutdownReport{Mode: config.Mode}, nil
+}
+
+// close stops following the primary.
+func (follower *followerPasswordHashStore) close() error {
+	follower.stop()
+	return nil
+}
+
+// dumpHashes dumps the current store.
+func (follower *followerPasswordHashStore) dumpHashes() []dumpedHash {
+	return follower.current().dumpHashes()
+}
+
+// restoreHashes refuses any write, which only comes from the primary.
+func (follower *followerPasswordHashStore) restoreHashes(hashes []dumpedHash) (restoreReport, error) {
+	return restoreReport{}, errReadOnly
+}
+
+// start follows the primary in the background until stopped, reconnecting whenever disconnected.
+func (follower *followerPasswordHashStore) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	follower.stopFollowing = cancel
+	follower.following.Add(1)
+	go func() {
+		defer follower.following.Done()
+		for {
+			err := follower.follow(ctx)
+			follower.lock.Lock()
+			follower.connected = false
+			follower.lock.Unlock()
+			if ctx.Err() != nil {
+				return
+			}
+			follower.logger.Printf("Replication from %s interrupted: %v", follower.config.Primary, err)
+			select {
+			case <-time.After(follower.config.Retry):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// stop interrupts following the primary, waiting for the current mutation to be applied.
+func (follower *followerPasswordHashStore) stop() {
+	if follower.stopFollowing == nil {
+		return
+	}
+	follower.stopFollowing()
+	follower.following.Wait()
+	follower.stopFollowing = nil
+}
+
+// follow streams mutations from the primary, from the last one applied, applying each in turn until disconnected.
+func (follower *followerPasswordHashStore) follow(ctx context.Context) error {
+	follower.lock.RLock()
+	url := fmt.Sprintf("%s/admin/replicate?epoch=%s&after=%d", strings.TrimSuffix(follower.config.Primary, "/"), follower.epoch, follower.applied)
+	follower.lock.RUnlock()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := adminRequest(req, follower.token)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	follower.lock.Lock()
+	follower.connected = true
+	follower.lock.Unlock()
+	follower.logger.Printf("Following %s", follower.config.Primary)
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event replicationEvent
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		if err := follower.apply(event); err != nil {
+			return err
+		}
+	}
+}
+
+// apply applies a mutation streamed by the primary, which must be the next one unless starting over.
+func (follower *followerPasswordHashStore) apply(event replicationEvent) error {
+	if event.Op == replicationSnapshot {
+		follower.applySnapshot(event)
+		return nil
+	}
+
+	follower.lock.RLock()
+	applied, store := follower.applied, follower.store
+	follower.lock.RUnlock()
+	switch event.Op {
+	case replicationStored, replicationDeleted:
+		if event.Seq != applied+1 {
+			return fmt.Errorf("expected mutation %d, got %d", applied+1, event.Seq)
+		}
+		if event.Op == replicationStored {
+			store.applyStored(event.Id, event.Hash, event.At, event.TTL)
+		} else {
+			store.deletePassword(event.Id)
+		}
+		applied = event.Seq
+	case replicationHeartbeat:
+	default:
+		return fmt.Errorf("unknown mutation %q", event.Op)
+	}
+
+	follower.lock.Lock()
+	follower.applied = applied
+	if event.Seq > follower.head {
+		follower.head = event.Seq
+	}
+	if follower.applied >= follower.head {
+		follower.caughtUpAt = time.Now()
+	}
+	follower.lock.Unlock()
+	return nil
+}
+
+// applySnapshot builds a new store from the snapshot, then swaps it in. Pending hashes are left out,
+// as they are replicated once stored.
+func (follower *followerPasswordHashStore) applySnapshot(event replicationEvent) {
+	store := follower.newStore()
+	records := make([]dumpedHash, 0, len(event.Records))
+	for _, record := range event.Records {
+		if record.State != dumpPending {
+			records = append(records, record)
+		}
+	}
+	_, _ = store.restoreHashes(records)
+
+	follower.lock.Lock()
+	previous := follower.store
+	follower.store = store
+	follower.epoch, follower.applied, follower.head = event.Epoch, event.Seq, event.Seq
+	follower.caughtUpAt = time.Now()
+	expiring := follower.expiring
+	if expiring {
+		store.startExpiring()
+	}
+	follower.lock.Unlock()
+	if expiring {
+		previous.stopExpiring()
+	}
+	follower.logger.Printf("Started over from a snapshot of %d records at %s/%d", len(records), event.Epoch, event.Seq)
+}
+
+// parseReplicationPosition reads the epoch and sequence number a follower asks to stream after.
+func parseReplicationPosition(req *http.Request) (string, uint64) {
+	query := req.URL.Query()
+	after, err := strconv.ParseUint(query.Get("after"), 10, 64)
+	if err != nil {
+		return "", 0
+	}
+	return query.Get("epoch"), after
+}
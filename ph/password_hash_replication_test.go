@@ -0,0 +1,317 @@
+package ph
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_replicationJournal(t *testing.T) {
+	journal := newReplicationJournal(3)
+	epoch, head := journal.position()
+	if events, ok, _ := journal.since(epoch, head); !ok || len(events) != 0 || head != 0 {
+		t.Errorf("Expected empty journal, got %v %v at %d", events, ok, head)
+	}
+	for _, id := range []string{"1", "2", "3", "4"} {
+		journal.append(replicationEvent{Op: replicationStored, Id: id, Hash: "hash"})
+	}
+	events, ok, _ := journal.since(epoch, 2)
+	if !ok || len(events) != 2 || events[0].Seq != 3 || events[1].Id != "4" {
+		t.Errorf("Unexpected events after 2: %v %v", events, ok)
+	}
+	if _, ok, _ := journal.since(epoch, 0); ok {
+		t.Error("Expected dropped events to need a snapshot")
+	}
+	if _, ok, _ := journal.since(epoch, 5); ok {
+		t.Error("Expected events ahead of the journal to need a snapshot")
+	}
+	if _, ok, _ := journal.since("other", 4); ok {
+		t.Error("Expected events of another epoch to need a snapshot")
+	}
+
+	_, _, changed := journal.since(epoch, 4)
+	journal.reset()
+	select {
+	case <-changed:
+	default:
+		t.Error("Expected reset to wake up streams")
+	}
+	if newEpoch, head := journal.position(); newEpoch == epoch || head != 4 {
+		t.Errorf("Expected a new epoch at the same position, got %s/%d", newEpoch, head)
+	}
+	if _, ok, _ := journal.since(epoch, 4); ok {
+		t.Error("Expected old epoch to need a snapshot")
+	}
+}
+
+func Test_replicationJournalStream(t *testing.T) {
+	journal := newReplicationJournal(10)
+	journal.heartbeat = 10 * time.Millisecond
+	journal.append(replicationEvent{Op: replicationStored, Id: "1", Hash: "hash"})
+	epoch, _ := journal.position()
+	dumps := newPasswordHashStore(log.New(&bytes.Buffer{}, "", 0))
+
+	events := make(chan replicationEvent, 10)
+	streamed := make(chan error, 1)
+	go func() {
+		streamed <- journal.stream(context.Background(), "", 0, dumps, func(event replicationEvent) error {
+			events <- event
+			return nil
+		})
+	}()
+	if event := <-events; event.Op != replicationSnapshot || event.Epoch != epoch || event.Seq != 1 {
+		t.Errorf("Expected a snapshot first, got %v", event)
+	}
+	journal.append(replicationEvent{Op: replicationDeleted, Id: "1"})
+	if event := <-events; event.Op != replicationDeleted || event.Seq != 2 {
+		t.Errorf("Expected deletion to be streamed, got %v", event)
+	}
+	if event := <-events; event.Op != replicationHeartbeat || event.Seq != 2 {
+		t.Errorf("Expected a heartbeat, got %v", event)
+	}
+	journal.close()
+	if err := <-streamed; err != nil {
+		t.Errorf("Expected stream to end with the journal, got %v", err)
+	}
+}
+
+func Test_replicatingPasswordHashStore(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	journal := newReplicationJournal(10)
+	replicating := newReplicatingPasswordHashStore(store, journal)
+	replicating.storePassword("hash-1", "1", time.Minute, 0)
+	replicating.storePassword("hash-2", "2", 0, 0)
+	replicating.waitPendingStores()
+	replicating.deletePassword("1")
+	replicating.deletePassword("3")
+
+	epoch, head := journal.position()
+	events, _, _ := journal.since(epoch, 0)
+	if head != 3 || len(events) != 3 {
+		t.Fatalf("Expected 3 mutations journaled, got %v", events)
+	}
+	stored := map[string]replicationEvent{events[0].Id: events[0], events[1].Id: events[1]}
+	if stored["1"].Hash != "hash-1" || stored["1"].TTL != time.Minute || stored["2"].TTL != 0 {
+		t.Errorf("Unexpected stored mutations: %v", events[:2])
+	}
+	if events[2].Op != replicationDeleted || events[2].Id != "1" {
+		t.Errorf("Unexpected deletion: %v", events[2])
+	}
+	if len(replicating.unjournaled) != 0 {
+		t.Errorf("Expected ttls to be forgotten once stored, got %v", replicating.unjournaled)
+	}
+
+	stats := &serverStats{}
+	replicating.collectStats(stats)
+	if stats.Replication == nil || stats.Replication.Role != "primary" || stats.Replication.Head != 3 || stats.Replication.Epoch != epoch {
+		t.Errorf("Unexpected replication stats: %v", stats.Replication)
+	}
+
+	replicating.restoreHashes([]dumpedHash{{Id: "4", State: dumpAvailable, Hash: "hash-4"}})
+	if newEpoch, _ := journal.position(); newEpoch == epoch {
+		t.Error("Expected restoring to start a new epoch")
+	}
+}
+
+func Test_replicatingPasswordHashStoreDeletedWhileStored(t *testing.T) {
+	store := newPasswordHashStore(log.New(&bytes.Buffer{}, "", 0))
+	journal := newReplicationJournal(10)
+	var replicating *replicatingPasswordHashStore
+	// deleted right as it is stored, before the journal's listener runs
+	store.onStored(func(id string, hashed string) {
+		if id == "1" {
+			replicating.deletePassword(id)
+		}
+	})
+	replicating = newReplicatingPasswordHashStore(store, journal)
+	replicating.storePassword("hash-1", "1", time.Minute, 0)
+	replicating.waitPendingStores()
+	// cancelled while pending
+	replicating.storePassword("hash-2", "2", 0, time.Hour)
+	replicating.deletePassword("2")
+
+	epoch, _ := journal.position()
+	events, _, _ := journal.since(epoch, 0)
+	if len(events) != 2 || events[0].Op != replicationDeleted || events[0].Id != "1" || events[1].Op != replicationDeleted {
+		t.Errorf("Expected only deletions to be journaled, got %v", events)
+	}
+	if len(replicating.unjournaled) != 0 || len(replicating.dropped) != 0 {
+		t.Errorf("Expected deleted hashes to be forgotten, got %v %v", replicating.unjournaled, replicating.dropped)
+	}
+	store.drainPending(ShutdownConfig{Mode: ShutdownAbandon})
+}
+
+func Test_followerPasswordHashStore(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := log.New(buf, "", 0)
+	newReplica := func() replicaStore { return newPasswordHashStore(logger) }
+	follower := newFollowerPasswordHashStore(logger, FollowerConfig{Primary: "http://primary"}, "admin-secret", newReplica(), newReplica)
+
+	if err := follower.storePassword("hash", "1", 0, 0); err != errReadOnly {
+		t.Errorf("Expected follower to be read only, got %v", err)
+	}
+	snapshot := replicationEvent{Seq: 2, Op: replicationSnapshot, Epoch: "e1", Records: []dumpedHash{
+		{Id: "1", State: dumpAvailable, Hash: "hash-1"},
+		{Id: "2", State: dumpPending, Hash: "hash-2", Due: &time.Time{}},
+	}}
+	if err := follower.apply(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if hash, state := follower.retrievePassword("1"); hash != "hash-1" || state != hashAvailable {
+		t.Errorf("Expected hash from the snapshot, got %s %d", hash, state)
+	}
+	if _, state := follower.retrievePassword("2"); state != hashUnknown {
+		t.Errorf("Expected pending hash to be left out, got %d", state)
+	}
+
+	if err := follower.apply(replicationEvent{Seq: 3, Op: replicationStored, At: time.Now(), Id: "2", Hash: "hash-2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.apply(replicationEvent{Seq: 4, Op: replicationDeleted, Id: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if hash, _ := follower.retrievePassword("2"); hash != "hash-2" {
+		t.Errorf("Expected stored hash to be applied, got %s", hash)
+	}
+	if _, state := follower.retrievePassword("1"); state != hashDeleted {
+		t.Errorf("Expected deletion to be applied, got %d", state)
+	}
+	if err := follower.apply(replicationEvent{Seq: 6, Op: replicationDeleted, Id: "2"}); err == nil || err.Error() != "expected mutation 5, got 6" {
+		t.Errorf("Expected gap to be refused, got %v", err)
+	}
+
+	if err := follower.apply(replicationEvent{Seq: 7, Op: replicationHeartbeat}); err != nil {
+		t.Fatal(err)
+	}
+	stats := &serverStats{}
+	follower.collectStats(stats)
+	if stats.Replication.Role != "follower" || stats.Replication.Applied != 4 || stats.Replication.Head != 7 || stats.Replication.Lag != 3 {
+		t.Errorf("Unexpected replication stats: %v", stats.Replication)
+	}
+}
+
+// waitReplicated polls the follower until it has the hash, failing the test if it takes too long.
+func waitReplicated(t *testing.T, follower *PasswordHasherServer, id string, hashed string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if hash, _ := follower.phStore.retrievePassword(id); hash == hashed {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Expected %s to be replicated", id)
+}
+
+func Test_replication(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := log.New(buf, "", 0)
+	primary := NewPasswordHasherServer(logger, WithIdStrategy(SequentialIds, 0), WithAdminToken("admin-secret"),
+		WithDelay(DelayConfig{}), WithReplicationJournal(100))
+	primary.phStats.startAccumulating()
+	defer primary.phStats.stopAccumulating()
+	primaryService := httptest.NewServer(primary.http.Handler)
+	defer primaryService.Close()
+	followers := make([]*PasswordHasherServer, 2)
+	for i := range followers {
+		followers[i] = NewPasswordHasherServer(logger, WithIdStrategy(SequentialIds, 0), WithAdminToken("admin-secret"),
+			WithFollower(FollowerConfig{Primary: primaryService.URL, Retry: 10 * time.Millisecond}))
+		followers[i].follower.start()
+	}
+	followerService := httptest.NewServer(followers[0].http.Handler)
+	defer followerService.Close()
+
+	hashed := primary.pwHasher.hashPassword("angryMonkey")
+	post := func() string {
+		resp, err := http.PostForm(primaryService.URL+"/hash", url.Values{"password": {"angryMonkey"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		id := &bytes.Buffer{}
+		id.ReadFrom(resp.Body)
+		return id.String()
+	}
+	first := post()
+	for _, follower := range followers {
+		waitReplicated(t, follower, first, hashed)
+	}
+	resp, err := http.Get(followerService.URL + "/hash/" + first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := &bytes.Buffer{}
+	body.ReadFrom(resp.Body)
+	resp.Body.Close()
+	if body.String() != hashed {
+		t.Errorf("Expected follower to serve the hash, got %s", body.String())
+	}
+
+	// followers catch up from where they left off once reconnected
+	primaryService.CloseClientConnections()
+	http.DefaultClient.CloseIdleConnections()
+	second := post()
+	for _, follower := range followers {
+		waitReplicated(t, follower, second, hashed)
+	}
+
+	resp, err = http.PostForm(followerService.URL+"/hash", url.Values{"password": {"angryMonkey"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected follower to refuse writes, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(followerService.URL + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := &serverStats{}
+	err = json.NewDecoder(resp.Body).Decode(stats)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Replication == nil || stats.Replication.Role != "follower" || stats.Replication.Applied != 2 || stats.Replication.Lag != 0 {
+		t.Errorf("Unexpected follower stats: %v", stats.Replication)
+	}
+
+	for _, follower := range followers {
+		follower.follower.stop()
+	}
+	primary.journal.close()
+	primaryService.Close()
+	if strings.Count(buf.String(), "Started over from a snapshot") != len(followers) {
+		t.Errorf("Expected followers to catch up without another snapshot: %s", buf.String())
+	}
+	if strings.Count(buf.String(), "Following "+primaryService.URL) != 2*len(followers) {
+		t.Errorf("Expected followers to reconnect: %s", buf.String())
+	}
+}
+
+func Test_replicateRefused(t *testing.T) {
+	buf := &bytes.Buffer{}
+	server := NewPasswordHasherServer(log.New(buf, "", 0), WithAdminToken("admin-secret"))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/admin/replicate", nil)
+	server.replicate(w, r)
+	if w.Code != http.StatusForbidden || !strings.Contains(buf.String(), "Refused to replicate for ") {
+		t.Errorf("Expected replication to be refused, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	server.replicate(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected replication to be not found without a journal, got %d", w.Code)
+	}
+}
@@ -0,0 +1,237 @@
+package ph
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRespPrefix  = "ph:"
+	defaultRespTimeout = 5 * time.Second
+
+	// maxRespBulk bounds the size of a bulk string read from the server, well above any hash.
+	maxRespBulk = 1 << 20
+)
+
+// errRespProtocol is returned when the server answers with something which is not RESP2.
+var errRespProtocol = errors.New("resp protocol error")
+
+// RespConfig configures a store kept in a Redis-compatible server: its address, such as "localhost:6379", the
+// password to authenticate with, if any, the prefix of every key ("ph:" by default), and how long to wait
+// for the server to answer (5 seconds by default).
+type RespConfig struct {
+	Addr     string
+	Password string
+	Prefix   string
+	Timeout  time.Duration
+}
+
+// respValue is a RESP2 reply: a simple string ('+'), an error ('-'), an integer (':'), a bulk string ('$'),
+// possibly null, or an array ('*') of replies.
+type respValue struct {
+	kind  byte
+	str   string
+	num   int64
+	null  bool
+	items []respValue
+}
+
+// err returns the error the server replied with, if any.
+func (value respValue) err() error {
+	if value.kind == '-' {
+		return fmt.Errorf("resp: %s", value.str)
+	}
+	return nil
+}
+
+// respClient sends commands to a Redis-compatible server over a single connection, one command or one
+// pipelined batch of commands at a time. The connection is made on first use, and made again after failing.
+type respClient struct {
+	config RespConfig
+	lock   sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// newRespClient creates a client of the configured server, without connecting yet.
+func newRespClient(config RespConfig) *respClient {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultRespTimeout
+	}
+	return &respClient{config: config}
+}
+
+// do sends a single command, returning its reply.
+func (client *respClient) do(args ...string) (respValue, error) {
+	replies, err := client.pipeline([][]string{args})
+	if err != nil {
+		return respValue{}, err
+	}
+	return replies[0], replies[0].err()
+}
+
+// pipeline sends every command before reading any reply, so the whole batch takes a single round trip.
+// Error replies are returned as such, along with the others, for callers to check each.
+func (client *respClient) pipeline(commands [][]string) ([]respValue, error) {
+	defer client.lock.Unlock()
+	client.lock.Lock()
+	if err := client.connect(); err != nil {
+		return nil, err
+	}
+	replies, err := client.roundTrip(commands)
+	if err != nil {
+		client.disconnect()
+		return nil, err
+	}
+	return replies, nil
+}
+
+// connect dials the server unless connected, authenticating if configured to. Must be called with the lock held.
+func (client *respClient) connect() error {
+	if client.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", client.config.Addr, client.config.Timeout)
+	if err != nil {
+		return err
+	}
+	client.conn, client.reader, client.writer = conn, bufio.NewReader(conn), bufio.NewWriter(conn)
+	if client.config.Password != "" {
+		replies, err := client.roundTrip([][]string{{"AUTH", client.config.Password}})
+		if err == nil {
+			err = replies[0].err()
+		}
+		if err != nil {
+			client.disconnect()
+			return err
+		}
+	}
+	return nil
+}
+
+// disconnect closes the connection, so the next command connects again. Must be called with the lock held.
+func (client *respClient) disconnect() {
+	if client.conn != nil {
+		_ = client.conn.Close()
+		client.conn, client.reader, client.writer = nil, nil, nil
+	}
+}
+
+// roundTrip writes the commands, then reads a reply for each. Must be called with the lock held.
+func (client *respClient) roundTrip(commands [][]string) ([]respValue, error) {
+	if err := client.conn.SetDeadline(time.Now().Add(client.config.Timeout)); err != nil {
+		return nil, err
+	}
+	for _, command := range commands {
+		if err := writeRespCommand(client.writer, command); err != nil {
+			return nil, err
+		}
+	}
+	if err := client.writer.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]respValue, len(commands))
+	for i := range replies {
+		reply, err := readRespValue(client.reader)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// close closes the connection, if any.
+func (client *respClient) close() error {
+	defer client.lock.Unlock()
+	client.lock.Lock()
+	client.disconnect()
+	return nil
+}
+
+// writeRespCommand writes a command as an array of bulk strings, the way clients send them.
+func writeRespCommand(w *bufio.Writer, args []string) error {
+	if _, err := fmt.Fprintf(w, "*%d\r\n", len(args)); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if _, err := fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRespValue reads a single reply, or command, as sent by a server, or client.
+func readRespValue(r *bufio.Reader) (respValue, error) {
+	line, err := readRespLine(r)
+	if err != nil {
+		return respValue{}, err
+	}
+	if len(line) == 0 {
+		return respValue{}, errRespProtocol
+	}
+	value := respValue{kind: line[0]}
+	switch value.kind {
+	case '+', '-':
+		value.str = line[1:]
+	case ':':
+		if value.num, err = strconv.ParseInt(line[1:], 10, 64); err != nil {
+			return respValue{}, errRespProtocol
+		}
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < -1 || size > maxRespBulk {
+			return respValue{}, errRespProtocol
+		}
+		if size == -1 {
+			value.null = true
+			break
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return respValue{}, err
+		}
+		if data[size] != '\r' || data[size+1] != '\n' {
+			return respValue{}, errRespProtocol
+		}
+		value.str = string(data[:size])
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < -1 || count > maxRespBulk {
+			return respValue{}, errRespProtocol
+		}
+		if count == -1 {
+			value.null = true
+			break
+		}
+		value.items = make([]respValue, count)
+		for i := range value.items {
+			if value.items[i], err = readRespValue(r); err != nil {
+				return respValue{}, err
+			}
+		}
+	default:
+		return respValue{}, errRespProtocol
+	}
+	return value, nil
+}
+
+// readRespLine reads a line ended by CRLF, without it.
+func readRespLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errRespProtocol
+	}
+	return line[:len(line)-2], nil
+}
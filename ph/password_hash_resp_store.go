@@ -0,0 +1,419 @@
+package ph
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// respRetryDelay is how long a hash the server failed to write waits before being written again.
+const respRetryDelay = time.Second
+
+// respStats are the counts of a store kept in a Redis-compatible server, as reported by the stats endpoint.
+type respStats struct {
+	Stored  int64 `json:"stored"`
+	Batches int64 `json:"batches"`
+	Errors  int64 `json:"errors"`
+}
+
+// respPasswordHashStore keeps stored hashes in a Redis-compatible server rather than in memory, so they are
+// shared by every instance using it and outlive any of them. Hashes wait out their delay in memory, then are
+// written in pipelined batches, each SET NX, with a PX time-to-live if they expire. Hashes the server fails to
+// write stay pending, written again after a while, until shutting down, while those whose id is already set are
+// dropped. Deleted ids are remembered by keys of their
+// own, expiring after the tombstone window, while expired hashes are simply gone, as the server removes them on
+// its own.
+type respPasswordHashStore struct {
+	client          *respClient
+	prefix          string
+	logger          *log.Logger
+	ttl             time.Duration
+	tombstoneWindow time.Duration
+	retryDelay      time.Duration
+
+	// hashes waiting out their delay, or being written, which are no longer retried once draining
+	lock          sync.Mutex
+	pendingHashes map[string]pendingStore
+	cancelled     map[string]bool
+	draining      bool
+	scheduler     *delayScheduler
+	pending       sync.WaitGroup
+	listeners     []storeListener
+
+	// hashes due, written by whichever committer finds no batch being written
+	batchLock sync.Mutex
+	batch     []pendingStore
+	writing   bool
+
+	storedCount int64
+	batchCount  int64
+	errorCount  int64
+}
+
+// newRespPasswordHashStore creates a store kept in the configured server.
+func newRespPasswordHashStore(logger *log.Logger, config RespConfig) *respPasswordHashStore {
+	if config.Prefix == "" {
+		config.Prefix = defaultRespPrefix
+	}
+	store := &respPasswordHashStore{
+		client:          newRespClient(config),
+		prefix:          config.Prefix,
+		logger:          logger,
+		tombstoneWindow: defaultTombstoneWindow,
+		retryDelay:      respRetryDelay,
+		pendingHashes:   make(map[string]pendingStore),
+		cancelled:       make(map[string]bool),
+	}
+	store.scheduler = newDelayScheduler(store.commitPending)
+	return store
+}
+
+// setExpiry makes hashes expire after the default time-to-live of the configuration, unless given their own.
+// The server expires them, so the rest of the configuration does not apply.
+func (store *respPasswordHashStore) setExpiry(config ExpiryConfig) {
+	store.ttl = config.TTL
+}
+
+// setTombstoneWindow changes how long deleted ids are remembered as such.
+func (store *respPasswordHashStore) setTombstoneWindow(window time.Duration) {
+	store.tombstoneWindow = window
+}
+
+// hashKey and goneKey are the keys of the hash of an id, and of its tombstone once deleted.
+func (store *respPasswordHashStore) hashKey(id string) string { return store.prefix + "hash:" + id }
+func (store *respPasswordHashStore) goneKey(id string) string { return store.prefix + "gone:" + id }
+
+// respMillis is the duration in whole milliseconds, as PX takes, rounding up what would otherwise be 0.
+func respMillis(duration time.Duration) string {
+	ms := duration.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	return strconv.FormatInt(ms, 10)
+}
+
+// storePassword imposes the given delay, writing the hash to the server after that.
+func (store *respPasswordHashStore) storePassword(hashed string, id string, ttl time.Duration, delay time.Duration) error {
+	store.schedulePending(pendingStore{hashed: hashed, id: id, ttl: ttl, due: time.Now().Add(delay)})
+	return nil
+}
+
+// schedulePending marks the id as pending and writes its hash once due.
+func (store *respPasswordHashStore) schedulePending(pending pendingStore) {
+	store.lock.Lock()
+	store.pendingHashes[pending.id] = pending
+	store.lock.Unlock()
+	store.pending.Add(1)
+	store.logger.Printf("Storing for %s...", pending.id)
+	store.scheduler.schedule(pending)
+}
+
+// commitPending queues a hash whose delay is over to be written, unless deleted meanwhile. Committers finding
+// a batch being written leave their hash to the next one, so the busier the store, the larger the batches.
+func (store *respPasswordHashStore) commitPending(pending pendingStore) {
+	if store.dropCancelled(pending.id) {
+		store.pending.Done()
+		store.logger.Printf("%s cancelled", pending.id)
+		return
+	}
+	store.batchLock.Lock()
+	store.batch = append(store.batch, pending)
+	if store.writing {
+		store.batchLock.Unlock()
+		return
+	}
+	store.writing = true
+	for len(store.batch) > 0 {
+		batch := store.batch
+		store.batch = nil
+		store.batchLock.Unlock()
+		store.writeBatch(batch)
+		store.batchLock.Lock()
+	}
+	store.writing = false
+	store.batchLock.Unlock()
+}
+
+// dropCancelled forgets a pending hash if it was deleted, telling whether it was.
+func (store *respPasswordHashStore) dropCancelled(id string) bool {
+	defer store.lock.Unlock()
+	store.lock.Lock()
+	if !store.cancelled[id] {
+		return false
+	}
+	delete(store.cancelled, id)
+	delete(store.pendingHashes, id)
+	return true
+}
+
+// writeBatch writes the hashes in a single pipeline, then tells listeners of those written. Hashes deleted
+// while being written are deleted again right after, while those failing to be written are written again
+// after the retry delay, unless deleted meanwhile or draining. Each SET is NX, so a hash is never written over
+// another one stored with the same id, such as by another instance: the hash is then dropped as failed.
+func (store *respPasswordHashStore) writeBatch(batch []pendingStore) {
+	commands := make([][]string, len(batch))
+	for i, pending := range batch {
+		commands[i] = []string{"SET", store.hashKey(pending.id), pending.hashed, "NX"}
+		ttl := pending.ttl
+		if ttl <= 0 {
+			ttl = store.ttl
+		}
+		if ttl > 0 {
+			commands[i] = append(commands[i], "PX", respMillis(ttl))
+		}
+	}
+	replies, err := store.client.pipeline(commands)
+	atomic.AddInt64(&store.batchCount, 1)
+	if err == nil {
+		err = store.checkCollisions(batch, replies)
+	}
+
+	var written, retried []pendingStore
+	var deleted [][]string
+	store.lock.Lock()
+	for i, pending := range batch {
+		failed := err
+		if failed == nil {
+			failed = replies[i].err()
+		}
+		collided := failed == nil && replies[i].null
+		if collided {
+			failed = ErrExists
+		}
+		if failed != nil {
+			atomic.AddInt64(&store.errorCount, 1)
+			store.logger.Printf("ERROR: Failed to store %s: %v", pending.id, failed)
+			if !collided && !store.draining && !store.cancelled[pending.id] {
+				retried = append(retried, pending)
+				continue
+			}
+			delete(store.cancelled, pending.id)
+			delete(store.pendingHashes, pending.id)
+			continue
+		}
+		delete(store.pendingHashes, pending.id)
+		if store.cancelled[pending.id] {
+			delete(store.cancelled, pending.id)
+			deleted = append(deleted, []string{"DEL", store.hashKey(pending.id)})
+			continue
+		}
+		written = append(written, pending)
+	}
+	store.lock.Unlock()
+	if len(deleted) > 0 {
+		if _, err := store.client.pipeline(deleted); err != nil {
+			store.logger.Printf("ERROR: Failed to delete cancelled hashes: %v", err)
+		}
+	}
+	for _, pending := range retried {
+		pending.due = time.Now().Add(store.retryDelay)
+		store.scheduler.schedule(pending)
+	}
+
+	// listeners run before completion, so waiting for pending stores also waits for them
+	for _, pending := range written {
+		atomic.AddInt64(&store.storedCount, 1)
+		for _, listener := range store.listeners {
+			listener(pending.id, pending.hashed)
+		}
+		store.logger.Printf("%s stored", pending.id)
+	}
+	for i := len(retried); i < len(batch); i++ {
+		store.pending.Done()
+	}
+}
+
+// checkCollisions gets the keys a SET NX of the batch found already set, clearing the reply of those holding
+// the very hash written, as happens when a write is retried after its reply was lost. The others are left as
+// collisions, their key holding another hash.
+func (store *respPasswordHashStore) checkCollisions(batch []pendingStore, replies []respValue) error {
+	var collided []int
+	var commands [][]string
+	for i, pending := range batch {
+		if replies[i].err() == nil && replies[i].null {
+			collided = append(collided, i)
+			commands = append(commands, []string{"GET", store.hashKey(pending.id)})
+		}
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+	held, err := store.client.pipeline(commands)
+	if err != nil {
+		return err
+	}
+	for j, i := range collided {
+		if held[j].err() == nil && !held[j].null && held[j].str == batch[i].hashed {
+			replies[i].null = false
+		}
+	}
+	return nil
+}
+
+// retrievePassword gets a hash from the server, telling apart ids still pending and deleted ones, both in
+// a single round trip. Ids cannot be told apart from unknown ones once expired.
+func (store *respPasswordHashStore) retrievePassword(id string) (string, hashState) {
+	store.logger.Printf("Getting for %s", id)
+	if store.isPending(id) {
+		return "", hashPending
+	}
+	replies, err := store.client.pipeline([][]string{{"GET", store.hashKey(id)}, {"EXISTS", store.goneKey(id)}})
+	if err == nil {
+		err = replies[0].err()
+	}
+	if err != nil {
+		atomic.AddInt64(&store.errorCount, 1)
+		store.logger.Printf("ERROR: Failed to get %s: %v", id, err)
+		return "", hashFailed
+	}
+	if !replies[0].null {
+		return replies[0].str, hashAvailable
+	}
+	if replies[1].num > 0 {
+		return "", hashDeleted
+	}
+	return "", hashUnknown
+}
+
+// isPending tells whether the id is waiting out its delay, and not deleted.
+func (store *respPasswordHashStore) isPending(id string) bool {
+	defer store.lock.Unlock()
+	store.lock.Lock()
+	_, pending := store.pendingHashes[id]
+	return pending && !store.cancelled[id]
+}
+
+// deletePassword removes a stored hash, or cancels a pending one, remembering the id as deleted for the
+// tombstone window. It returns what the store knew about the id beforehand.
+func (store *respPasswordHashStore) deletePassword(id string) hashState {
+	state := hashAvailable
+	store.lock.Lock()
+	if _, pending := store.pendingHashes[id]; pending && !store.cancelled[id] {
+		store.cancelled[id] = true
+		state = hashPending
+	}
+	store.lock.Unlock()
+
+	if state == hashAvailable {
+		replies, err := store.client.pipeline([][]string{{"DEL", store.hashKey(id)}, {"EXISTS", store.goneKey(id)}})
+		if err == nil {
+			err = replies[0].err()
+		}
+		if err != nil {
+			atomic.AddInt64(&store.errorCount, 1)
+			store.logger.Printf("ERROR: Failed to delete %s: %v", id, err)
+			return hashFailed
+		}
+		if replies[0].num == 0 {
+			if replies[1].num > 0 {
+				return hashDeleted
+			}
+			return hashUnknown
+		}
+	}
+	if store.tombstoneWindow <= 0 {
+		return state
+	}
+	if _, err := store.client.do("SET", store.goneKey(id), "deleted", "PX", respMillis(store.tombstoneWindow)); err != nil {
+		atomic.AddInt64(&store.errorCount, 1)
+		store.logger.Printf("ERROR: Failed to remember %s as deleted: %v", id, err)
+	}
+	return state
+}
+
+// waitPendingStores blocks until every pending hash is written, or dropped.
+func (store *respPasswordHashStore) waitPendingStores() {
+	store.pending.Wait()
+}
+
+// onStored registers a listener for stored hashes. It must be called before any password is stored.
+func (store *respPasswordHashStore) onStored(listener storeListener) {
+	store.listeners = append(store.listeners, listener)
+}
+
+// startExpiring has nothing to start, as the server expires hashes on its own.
+func (store *respPasswordHashStore) startExpiring() {
+}
+
+// stopExpiring has nothing to stop, as the server expires hashes on its own.
+func (store *respPasswordHashStore) stopExpiring() {
+}
+
+// collectStats reports how many hashes were written, in how many batches, and how many commands failed.
+func (store *respPasswordHashStore) collectStats(stats *serverStats) {
+	stats.Resp = &respStats{
+		Stored:  atomic.LoadInt64(&store.storedCount),
+		Batches: atomic.LoadInt64(&store.batchCount),
+		Errors:  atomic.LoadInt64(&store.errorCount),
+	}
+}
+
+// drainPending deals with the hashes still pending according to the shutdown mode, so none is left afterwards.
+// Flushed hashes are written in a single batch, and those failing to be written from now on are dropped.
+func (store *respPasswordHashStore) drainPending(config ShutdownConfig) (shutdownReport, error) {
+	store.lock.Lock()
+	store.draining = true
+	store.lock.Unlock()
+	return pendingDrain{
+		logger:    store.logger,
+		scheduler: store.scheduler,
+		pending:   &store.pending,
+		count:     store.pendingCount,
+		flush: func(drained []pendingStore) (int, error) {
+			var flushed []pendingStore
+			for _, pending := range drained {
+				if store.dropCancelled(pending.id) {
+					store.pending.Done()
+					continue
+				}
+				flushed = append(flushed, pending)
+			}
+			if len(flushed) > 0 {
+				store.writeBatch(flushed)
+			}
+			return len(flushed), nil
+		},
+		drop: store.dropPending,
+	}.run(config)
+}
+
+// dropPending gives up on a pending hash taken off the scheduler, telling whether it was still wanted.
+func (store *respPasswordHashStore) dropPending(pending pendingStore) bool {
+	defer store.pending.Done()
+	if store.dropCancelled(pending.id) {
+		return false
+	}
+	store.lock.Lock()
+	delete(store.pendingHashes, pending.id)
+	store.lock.Unlock()
+	return true
+}
+
+// pendingCount returns how many hashes are waiting out their delay, or being written, leaving out cancelled ones.
+func (store *respPasswordHashStore) pendingCount() int {
+	defer store.lock.Unlock()
+	store.lock.Lock()
+	return len(store.pendingHashes) - len(store.cancelled)
+}
+
+// loadSpool makes the hashes in the spool file pending again for whatever remained of their delay, then
+// removes the file.
+func (store *respPasswordHashStore) loadSpool(path string) error {
+	spooled, err := readSpool(path)
+	if err != nil || spooled == nil {
+		return err
+	}
+	for _, hash := range spooled {
+		store.schedulePending(pendingStore{hashed: hash.Hashed, id: hash.Id, ttl: hash.TTL, due: hash.Due})
+	}
+	store.logger.Printf("Reloaded %d pending hashes from %s", len(spooled), path)
+	return os.Remove(path)
+}
+
+// close closes the connection to the server.
+func (store *respPasswordHashStore) close() error {
+	return store.client.close()
+}
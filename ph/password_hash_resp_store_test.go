@@ -0,0 +1,229 @@
+package ph
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newFakeRespStore creates a store kept in a fake server, without any delay.
+func newFakeRespStore(t *testing.T, buf *bytes.Buffer) (*respPasswordHashStore, *fakeRespServer) {
+	server := newFakeRespServer(t, "")
+	store := newRespPasswordHashStore(log.New(buf, "", 0), RespConfig{Addr: server.addr()})
+	t.Cleanup(func() { store.close() })
+	return store, server
+}
+
+func Test_respPasswordHashStore(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store, server := newFakeRespStore(t, buf)
+	store.setExpiry(ExpiryConfig{TTL: time.Hour})
+	stored := map[string]string{}
+	store.onStored(func(id string, hashed string) { stored[id] = hashed })
+
+	store.storePassword("hash-1", "1", 0, 0)
+	store.storePassword("hash-2", "2", 90*time.Second, 0)
+	store.waitPendingStores()
+	if hash, state := store.retrievePassword("1"); hash != "hash-1" || state != hashAvailable {
+		t.Errorf("Expected hash to be stored, got %s %d", hash, state)
+	}
+	if stored["2"] != "hash-2" {
+		t.Errorf("Expected listener to be told of stored hashes, got %v", stored)
+	}
+	sent := strings.Join(server.sent(), "\n")
+	if !strings.Contains(sent, "SET ph:hash:1 hash-1 NX PX 3600000") || !strings.Contains(sent, "SET ph:hash:2 hash-2 NX PX 90000") {
+		t.Errorf("Expected hashes to be set with their ttl: %s", sent)
+	}
+
+	if state := store.deletePassword("1"); state != hashAvailable {
+		t.Errorf("Expected stored hash to be deleted, got %d", state)
+	}
+	if _, state := store.retrievePassword("1"); state != hashDeleted {
+		t.Errorf("Expected deleted id to be remembered, got %d", state)
+	}
+	if state := store.deletePassword("1"); state != hashDeleted {
+		t.Errorf("Expected deleting again to tell it is gone, got %d", state)
+	}
+	if state := store.deletePassword("3"); state != hashUnknown {
+		t.Errorf("Expected unknown id, got %d", state)
+	}
+	if _, state := store.retrievePassword("3"); state != hashUnknown {
+		t.Errorf("Expected unknown id, got %d", state)
+	}
+	if !strings.Contains(strings.Join(server.sent(), "\n"), "SET ph:gone:1 deleted PX 86400000") {
+		t.Errorf("Expected tombstone to expire after the window: %v", server.sent())
+	}
+
+	stats := &serverStats{}
+	store.collectStats(stats)
+	if stats.Resp == nil || stats.Resp.Stored != 2 || stats.Resp.Errors != 0 {
+		t.Errorf("Unexpected stats: %v", stats.Resp)
+	}
+}
+
+func Test_respPasswordHashStorePending(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store, server := newFakeRespStore(t, buf)
+	store.storePassword("hash-1", "1", 0, time.Hour)
+	store.storePassword("hash-2", "2", 0, time.Hour)
+	if _, state := store.retrievePassword("1"); state != hashPending {
+		t.Errorf("Expected hash to be pending, got %d", state)
+	}
+	if state := store.deletePassword("1"); state != hashPending {
+		t.Errorf("Expected pending hash to be cancelled, got %d", state)
+	}
+	if _, state := store.retrievePassword("1"); state != hashDeleted {
+		t.Errorf("Expected cancelled id to be remembered, got %d", state)
+	}
+
+	report, err := store.drainPending(ShutdownConfig{Mode: ShutdownFlush})
+	if err != nil || report.Flushed != 1 {
+		t.Errorf("Expected the remaining hash to be flushed, got %v %v", report, err)
+	}
+	if hash, _ := store.retrievePassword("2"); hash != "hash-2" {
+		t.Errorf("Expected flushed hash to be stored, got %s", hash)
+	}
+	if strings.Contains(strings.Join(server.sent(), "\n"), "SET ph:hash:1") {
+		t.Errorf("Expected cancelled hash never to be written: %v", server.sent())
+	}
+}
+
+func Test_respPasswordHashStoreBatches(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store, _ := newFakeRespStore(t, buf)
+	due := time.Now().Add(50 * time.Millisecond)
+	for i := 0; i < 200; i++ {
+		store.schedulePending(pendingStore{hashed: "hash", id: strconv.Itoa(i), due: due})
+	}
+	store.waitPendingStores()
+	stats := &serverStats{}
+	store.collectStats(stats)
+	if stats.Resp.Stored != 200 || stats.Resp.Batches >= 200 {
+		t.Errorf("Expected hashes due together to be written in batches, got %v", stats.Resp)
+	}
+	if hash, _ := store.retrievePassword("199"); hash != "hash" {
+		t.Errorf("Expected every hash to be stored, got %s", hash)
+	}
+}
+
+func Test_respPasswordHashStoreUnavailable(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store, server := newFakeRespStore(t, buf)
+	store.retryDelay = time.Millisecond
+	server.close()
+	store.storePassword("hash", "1", 0, 0)
+	for i := 0; i < 1000 && atomic.LoadInt64(&store.errorCount) < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	// the hash stays pending, written again until shutting down
+	if _, state := store.retrievePassword("1"); state != hashPending {
+		t.Errorf("Expected hash to stay pending, got %d", state)
+	}
+	if _, state := store.retrievePassword("2"); state != hashFailed {
+		t.Errorf("Expected the store to fail, got %d", state)
+	}
+	if state := store.deletePassword("2"); state != hashFailed {
+		t.Errorf("Expected the store to fail deleting, got %d", state)
+	}
+	if !strings.Contains(buf.String(), "ERROR: Failed to store 1: ") || !strings.Contains(buf.String(), "ERROR: Failed to get 2: ") ||
+		!strings.Contains(buf.String(), "ERROR: Failed to delete 2: ") {
+		t.Errorf("Expected log indicating the failures: %s", buf.String())
+	}
+	w := httptest.NewRecorder()
+	withStore(&PasswordHasherServer{idGen: newSequentialIdGenerator(), phStore: store, logger: log.New(buf, "", 0)}).
+		getHash(w, &http.Request{Method: http.MethodGet, URL: &url.URL{Path: "/hash/2"}})
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected a failing store to be a server error, got %d", w.Code)
+	}
+	if _, err := store.drainPending(ShutdownConfig{Mode: ShutdownAbandon}); err != nil || store.pendingCount() != 0 {
+		t.Errorf("Expected hash to be given up on once shutting down, got %d %v", store.pendingCount(), err)
+	}
+	stats := &serverStats{}
+	store.collectStats(stats)
+	if stats.Resp.Errors < 5 || stats.Resp.Stored != 0 {
+		t.Errorf("Unexpected stats: %v", stats.Resp)
+	}
+}
+
+func Test_respPasswordHashStoreCollision(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store, server := newFakeRespStore(t, buf)
+	stored := map[string]string{}
+	store.onStored(func(id string, hashed string) { stored[id] = hashed })
+	server.lock.Lock()
+	server.values[store.hashKey("1")] = "other"
+	// as left by a write whose reply was lost
+	server.values[store.hashKey("2")] = "hash-2"
+	server.lock.Unlock()
+
+	store.storePassword("hash-1", "1", 0, 0)
+	store.storePassword("hash-2", "2", 0, 0)
+	store.waitPendingStores()
+	if hash, _ := store.retrievePassword("1"); hash != "other" {
+		t.Errorf("Expected hash stored with the same id to be kept, got %s", hash)
+	}
+	if _, ok := stored["1"]; ok || stored["2"] != "hash-2" {
+		t.Errorf("Expected listener to be told of the hash written only, got %v", stored)
+	}
+	if !strings.Contains(buf.String(), "ERROR: Failed to store 1: hash id already exists\n") {
+		t.Errorf("Expected log indicating the collision: %s", buf.String())
+	}
+	stats := &serverStats{}
+	store.collectStats(stats)
+	if stats.Resp.Stored != 1 || stats.Resp.Errors != 1 {
+		t.Errorf("Unexpected stats: %+v", stats.Resp)
+	}
+}
+
+func Test_respPasswordHashStoreRetry(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store, server := newFakeRespStore(t, buf)
+	store.retryDelay = time.Millisecond
+	server.failNext(1)
+	store.storePassword("hash-1", "1", 0, 0)
+	store.waitPendingStores()
+	if hash, state := store.retrievePassword("1"); hash != "hash-1" || state != hashAvailable {
+		t.Errorf("Expected hash to be written once the server recovered, got %s %d", hash, state)
+	}
+
+	// time-to-live under a millisecond is rounded up, as PX 0 is refused
+	store.storePassword("hash-2", "2", time.Microsecond, 0)
+	store.waitPendingStores()
+	// no tombstone without a tombstone window
+	store.setTombstoneWindow(0)
+	if state := store.deletePassword("1"); state != hashAvailable {
+		t.Errorf("Expected hash to be deleted, got %d", state)
+	}
+	sent := strings.Join(server.sent(), "\n")
+	if !strings.Contains(sent, "SET "+store.hashKey("2")+" hash-2 NX PX 1\n") || strings.Contains(sent, store.goneKey("1")+" deleted") {
+		t.Errorf("Unexpected commands:\n%s", sent)
+	}
+	stats := &serverStats{}
+	store.collectStats(stats)
+	if stats.Resp.Errors != 1 || stats.Resp.Stored != 2 {
+		t.Errorf("Unexpected stats: %v", stats.Resp)
+	}
+}
+
+func Test_NewPasswordHasherServerWithRespStore(t *testing.T) {
+	buf := &bytes.Buffer{}
+	server := newFakeRespServer(t, "")
+	hasher := NewPasswordHasherServer(log.New(buf, "", 0), WithRespStore(RespConfig{Addr: server.addr(), Prefix: "test:"}),
+		WithDelay(DelayConfig{}), WithIdStrategy(SequentialIds, 0))
+	defer hasher.phStore.close()
+	hasher.phStore.storePassword("hash", hasher.idGen.nextId(), 0, 0)
+	hasher.phStore.waitPendingStores()
+	if hash, _ := hasher.phStore.retrievePassword("1"); hash != "hash" {
+		t.Errorf("Expected hash to be kept in the server, got %s", hash)
+	}
+	if sent := server.sent(); len(sent) == 0 || sent[0] != "SET test:hash:1 hash NX" {
+		t.Errorf("Expected keys to have the prefix, got %v", sent)
+	}
+}
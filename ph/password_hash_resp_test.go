@@ -0,0 +1,270 @@
+package ph
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRespServer is a minimal Redis-compatible server, knowing just the commands the store sends.
+type fakeRespServer struct {
+	listener net.Listener
+	password string
+
+	lock     sync.Mutex
+	values   map[string]string
+	expires  map[string]time.Time
+	commands []string
+	failures int
+	conns    map[net.Conn]bool
+	serving  sync.WaitGroup
+}
+
+// newFakeRespServer starts a fake server on a loopback port, requiring the password if any.
+func newFakeRespServer(t *testing.T, password string) *fakeRespServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeRespServer{
+		listener: listener,
+		password: password,
+		values:   make(map[string]string),
+		expires:  make(map[string]time.Time),
+		conns:    make(map[net.Conn]bool),
+	}
+	server.serving.Add(1)
+	go func() {
+		defer server.serving.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.lock.Lock()
+			server.conns[conn] = true
+			server.lock.Unlock()
+			server.serving.Add(1)
+			go server.serve(conn)
+		}
+	}()
+	t.Cleanup(server.close)
+	return server
+}
+
+// addr returns the address the fake server listens at.
+func (server *fakeRespServer) addr() string {
+	return server.listener.Addr().String()
+}
+
+// serve runs the commands read from the connection until it is closed.
+func (server *fakeRespServer) serve(conn net.Conn) {
+	defer server.serving.Done()
+	defer conn.Close()
+	reader, writer := bufio.NewReader(conn), bufio.NewWriter(conn)
+	authed := server.password == ""
+	for {
+		command, err := readRespValue(reader)
+		if err != nil {
+			return
+		}
+		args := make([]string, len(command.items))
+		for i, item := range command.items {
+			args[i] = item.str
+		}
+		writer.WriteString(server.execute(args, &authed))
+		if reader.Buffered() == 0 {
+			writer.Flush()
+		}
+	}
+}
+
+// execute runs a command, returning its reply.
+func (server *fakeRespServer) execute(args []string, authed *bool) string {
+	defer server.lock.Unlock()
+	server.lock.Lock()
+	server.commands = append(server.commands, strings.Join(args, " "))
+	name := strings.ToUpper(args[0])
+	if name == "AUTH" {
+		if len(args) != 2 || args[1] != server.password {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		*authed = true
+		return "+OK\r\n"
+	}
+	if !*authed {
+		return "-NOAUTH Authentication required.\r\n"
+	}
+	if server.failures > 0 {
+		server.failures--
+		return "-ERR injected failure\r\n"
+	}
+	for key, at := range server.expires {
+		if !time.Now().Before(at) {
+			delete(server.values, key)
+			delete(server.expires, key)
+		}
+	}
+	switch {
+	case name == "SET" && len(args) >= 3:
+		return server.set(args[1], args[2], args[3:])
+	case name == "GET" && len(args) == 2:
+		if value, ok := server.values[args[1]]; ok {
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+		}
+		return "$-1\r\n"
+	case (name == "DEL" || name == "EXISTS") && len(args) == 2:
+		_, ok := server.values[args[1]]
+		if name == "DEL" {
+			delete(server.values, args[1])
+			delete(server.expires, args[1])
+		}
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+}
+
+// set runs SET with its NX and PX options, returning its reply. Must be called with the lock held.
+func (server *fakeRespServer) set(key string, value string, options []string) string {
+	nx, expires := false, time.Time{}
+	for i := 0; i < len(options); i++ {
+		switch strings.ToUpper(options[i]) {
+		case "NX":
+			nx = true
+		case "PX":
+			if i++; i == len(options) {
+				return "-ERR syntax error\r\n"
+			}
+			ms, err := strconv.ParseInt(options[i], 10, 64)
+			if err != nil || ms <= 0 {
+				return "-ERR invalid expire time in 'set' command\r\n"
+			}
+			expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		default:
+			return "-ERR syntax error\r\n"
+		}
+	}
+	if _, ok := server.values[key]; ok && nx {
+		return "$-1\r\n"
+	}
+	server.values[key] = value
+	delete(server.expires, key)
+	if !expires.IsZero() {
+		server.expires[key] = expires
+	}
+	return "+OK\r\n"
+}
+
+// dropConnections closes every connection made so far, as a restarting server would.
+func (server *fakeRespServer) dropConnections() {
+	defer server.lock.Unlock()
+	server.lock.Lock()
+	for conn := range server.conns {
+		conn.Close()
+		delete(server.conns, conn)
+	}
+}
+
+// failNext makes the given number of commands run next fail.
+func (server *fakeRespServer) failNext(failures int) {
+	defer server.lock.Unlock()
+	server.lock.Lock()
+	server.failures = failures
+}
+
+// sent returns every command run so far.
+func (server *fakeRespServer) sent() []string {
+	defer server.lock.Unlock()
+	server.lock.Lock()
+	return append([]string{}, server.commands...)
+}
+
+// close stops the fake server.
+func (server *fakeRespServer) close() {
+	server.listener.Close()
+	server.dropConnections()
+	server.serving.Wait()
+}
+
+func Test_readRespValue(t *testing.T) {
+	input := "+OK\r\n-ERR nope\r\n:42\r\n$5\r\nhello\r\n$-1\r\n*2\r\n$3\r\nGET\r\n:7\r\n$0\r\n\r\n"
+	reader := bufio.NewReader(strings.NewReader(input))
+	expected := []respValue{
+		{kind: '+', str: "OK"},
+		{kind: '-', str: "ERR nope"},
+		{kind: ':', num: 42},
+		{kind: '$', str: "hello"},
+		{kind: '$', null: true},
+		{kind: '*', items: []respValue{{kind: '$', str: "GET"}, {kind: ':', num: 7}}},
+		{kind: '$', str: ""},
+	}
+	for _, want := range expected {
+		value, err := readRespValue(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(value) != fmt.Sprint(want) {
+			t.Errorf("Expected %v, got %v", want, value)
+		}
+	}
+	if err := expected[1].err(); err == nil || err.Error() != "resp: ERR nope" {
+		t.Errorf("Expected error reply to be an error, got %v", err)
+	}
+
+	for _, malformed := range []string{"?\r\n", "+OK\n", ":x\r\n", "$3\r\nabcd\r\n", "$-2\r\n", "\r\n"} {
+		if _, err := readRespValue(bufio.NewReader(strings.NewReader(malformed))); err != errRespProtocol {
+			t.Errorf("Expected %q to be refused, got %v", malformed, err)
+		}
+	}
+}
+
+func Test_writeRespCommand(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writer := bufio.NewWriter(buf)
+	if err := writeRespCommand(writer, []string{"SET", "key", "two words"}); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	if buf.String() != "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$9\r\ntwo words\r\n" {
+		t.Errorf("Unexpected command: %q", buf.String())
+	}
+}
+
+func Test_respClient(t *testing.T) {
+	server := newFakeRespServer(t, "secret")
+	client := newRespClient(RespConfig{Addr: server.addr(), Password: "secret"})
+	defer client.close()
+	if _, err := client.do("SET", "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	replies, err := client.pipeline([][]string{{"GET", "key"}, {"GET", "missing"}, {"BOGUS"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replies[0].str != "value" || !replies[1].null || replies[2].err() == nil {
+		t.Errorf("Unexpected replies: %v", replies)
+	}
+
+	// the client connects again once disconnected
+	server.dropConnections()
+	if _, err := client.do("GET", "key"); err == nil {
+		t.Error("Expected command on a dropped connection to fail")
+	}
+	if reply, err := client.do("GET", "key"); err != nil || reply.str != "value" {
+		t.Errorf("Expected client to reconnect, got %v %v", reply, err)
+	}
+
+	unauthorized := newRespClient(RespConfig{Addr: server.addr(), Password: "wrong"})
+	if _, err := unauthorized.do("GET", "key"); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("Expected wrong password to fail, got %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package ph
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// defaultCommitters is how many goroutines store hashes once their delay is over.
+const defaultCommitters = 4
+
+// pendingStore is a hash waiting out its delay, until it is due.
+type pendingStore struct {
+	hashed string
+	id     string
+	ttl    time.Duration
+	due    time.Time
+}
+
+// pendingQueue is a min-heap of pending hashes by when they are due.
+type pendingQueue []pendingStore
+
+func (queue pendingQueue) Len() int            { return len(queue) }
+func (queue pendingQueue) Less(i, j int) bool  { return queue[i].due.Before(queue[j].due) }
+func (queue pendingQueue) Swap(i, j int)       { queue[i], queue[j] = queue[j], queue[i] }
+func (queue *pendingQueue) Push(x interface{}) { *queue = append(*queue, x.(pendingStore)) }
+func (queue *pendingQueue) Pop() interface{} {
+	old := *queue
+	last := old[len(old)-1]
+	old[len(old)-1] = pendingStore{}
+	*queue = old[:len(old)-1]
+	return last
+}
+
+// delayScheduler holds pending hashes in a single queue, handing each to a few committers once due,
+// rather than parking a goroutine (and its stack) per hash. Its goroutines only run while anything is pending.
+type delayScheduler struct {
+	lock       sync.Mutex
+	queue      pendingQueue
+	running    bool
+	wake       chan bool
+	commit     func(pending pendingStore)
+	committers int
+}
+
+// newDelayScheduler creates a scheduler calling the given function for each hash once due.
+func newDelayScheduler(commit func(pending pendingStore)) *delayScheduler {
+	return &delayScheduler{
+		wake:       make(chan bool, 1),
+		commit:     commit,
+		committers: defaultCommitters,
+	}
+}
+
+// schedule queues a pending hash, waking the scheduler if it is due before any other.
+func (scheduler *delayScheduler) schedule(pending pendingStore) {
+	defer scheduler.lock.Unlock()
+	scheduler.lock.Lock()
+	heap.Push(&scheduler.queue, pending)
+	if !scheduler.running {
+		scheduler.running = true
+		go scheduler.run()
+	} else if scheduler.queue[0].due.Equal(pending.due) {
+		select {
+		case scheduler.wake <- true:
+		default: // already woken
+		}
+	}
+}
+
+// run waits for the earliest pending hash to be due, handing it to the committers, until none is left.
+func (scheduler *delayScheduler) run() {
+	due := make(chan pendingStore, scheduler.committers)
+	defer close(due)
+	for i := 0; i < scheduler.committers; i++ {
+		go func() {
+			for pending := range due {
+				scheduler.commit(pending)
+			}
+		}()
+	}
+
+	for {
+		scheduler.lock.Lock()
+		if len(scheduler.queue) == 0 {
+			scheduler.running = false
+			scheduler.lock.Unlock()
+			return
+		}
+		wait := time.Until(scheduler.queue[0].due)
+		if wait <= 0 {
+			pending := heap.Pop(&scheduler.queue).(pendingStore)
+			scheduler.lock.Unlock()
+			due <- pending
+			continue
+		}
+		scheduler.lock.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-scheduler.wake:
+			timer.Stop()
+		}
+	}
+}
+
+// drain takes every queued hash off the scheduler, in the order they would have been due.
+// Hashes already handed to the committers are not included.
+func (scheduler *delayScheduler) drain() []pendingStore {
+	defer scheduler.lock.Unlock()
+	scheduler.lock.Lock()
+	drained := make([]pendingStore, 0, len(scheduler.queue))
+	for len(scheduler.queue) > 0 {
+		drained = append(drained, heap.Pop(&scheduler.queue).(pendingStore))
+	}
+	if scheduler.running {
+		select {
+		case scheduler.wake <- true:
+		default: // already woken
+		}
+	}
+	return drained
+}
+
+// pendingCount returns how many hashes are waiting out their delay.
+func (scheduler *delayScheduler) pendingCount() int {
+	defer scheduler.lock.Unlock()
+	scheduler.lock.Lock()
+	return len(scheduler.queue)
+}
@@ -0,0 +1,103 @@
+package ph
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func Test_delayScheduler(t *testing.T) {
+	committed := make(chan string, 3)
+	scheduler := newDelayScheduler(func(pending pendingStore) {
+		committed <- pending.id
+	})
+	scheduler.committers = 1
+	now := time.Now()
+	scheduler.schedule(pendingStore{id: "3", due: now.Add(30 * time.Millisecond)})
+	scheduler.schedule(pendingStore{id: "1", due: now.Add(10 * time.Millisecond)})
+	scheduler.schedule(pendingStore{id: "2", due: now.Add(20 * time.Millisecond)})
+	if count := scheduler.pendingCount(); count != 3 {
+		t.Errorf("Expected 3 pending, got %d", count)
+	}
+
+	for _, expected := range []string{"1", "2", "3"} {
+		if id := <-committed; id != expected {
+			t.Errorf("Expected %s to be committed next, got %s", expected, id)
+		}
+		if time.Since(now) < 10*time.Millisecond {
+			t.Error("Expected commit to wait until due")
+		}
+	}
+}
+
+func Test_delaySchedulerWakes(t *testing.T) {
+	committed := make(chan string, 2)
+	scheduler := newDelayScheduler(func(pending pendingStore) {
+		committed <- pending.id
+	})
+	scheduler.schedule(pendingStore{id: "later", due: time.Now().Add(time.Hour)})
+	forceGoroutineScheduler()
+
+	// an earlier hash must not wait behind the later one
+	scheduler.schedule(pendingStore{id: "sooner", due: time.Now()})
+	select {
+	case id := <-committed:
+		if id != "sooner" {
+			t.Errorf("Expected sooner to be committed, got %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected scheduler to wake up for an earlier hash")
+	}
+	if count := scheduler.pendingCount(); count != 1 {
+		t.Errorf("Expected later to still be pending, got %d", count)
+	}
+}
+
+func Test_delaySchedulerIdle(t *testing.T) {
+	before := runtime.NumGoroutine()
+	store := newPasswordHashStore(log.New(ioutil.Discard, "", 0))
+	for i := 0; i < 100; i++ {
+		store.storePassword("test", fmt.Sprint(i), 0, time.Millisecond)
+	}
+	if running := runtime.NumGoroutine() - before; running > defaultCommitters+1 {
+		t.Errorf("Expected a fixed number of goroutines, got %d", running)
+	}
+	store.waitPendingStores()
+	if store.hashes.count() != 100 {
+		t.Errorf("Expected all hashes to be stored, got %d", store.hashes.count())
+	}
+
+	// the scheduler stops once nothing is pending
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		forceGoroutineScheduler()
+	}
+	if running := runtime.NumGoroutine() - before; running > 0 {
+		t.Errorf("Expected no goroutines left when idle, got %d", running)
+	}
+}
+
+// BenchmarkSchedule1MPending reports the goroutines and heap used per hash pending in the store.
+func BenchmarkSchedule1MPending(b *testing.B) {
+	const pending = 1000000
+	for n := 0; n < b.N; n++ {
+		runtime.GC()
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		goroutines := runtime.NumGoroutine()
+
+		store := newPasswordHashStore(log.New(ioutil.Discard, "", 0))
+		for i := 0; i < pending; i++ {
+			store.storePassword("very-hashed", fmt.Sprint(i), 0, time.Hour)
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(runtime.NumGoroutine()-goroutines), "goroutines")
+		b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/pending, "heap-B/pending")
+		runtime.KeepAlive(store)
+	}
+}
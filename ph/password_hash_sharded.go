@@ -0,0 +1,284 @@
+package ph
+
+import (
+	"hash/fnv"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// shardedPasswordHashStore partitions hashes by id across independently locked stores, so reads and writes of
+// different ids rarely contend on the same lock. Each shard has a share of the capacity, rounded down, and the
+// shards are expired by a single janitor.
+type shardedPasswordHashStore struct {
+	shards []*passwordHashStore
+	logger *log.Logger
+
+	// expiry janitor shared by all shards
+	interval    time.Duration
+	janitor     sync.WaitGroup
+	janitorStop chan bool
+}
+
+// newShardedPasswordHashStore creates a store of the given number of shards.
+func newShardedPasswordHashStore(logger *log.Logger, shards int) *shardedPasswordHashStore {
+	if shards < 1 {
+		shards = 1
+	}
+	store := &shardedPasswordHashStore{logger: logger}
+	committers := (defaultCommitters + shards - 1) / shards
+	for i := 0; i < shards; i++ {
+		shard := newPasswordHashStore(logger)
+		shard.scheduler.committers = committers
+		store.shards = append(store.shards, shard)
+	}
+	return store
+}
+
+// shard returns the shard holding the given id.
+func (store *shardedPasswordHashStore) shard(id string) *passwordHashStore {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(id))
+	return store.shards[hash.Sum32()%uint32(len(store.shards))]
+}
+
+// setExpiry enables expiry on every shard. It must be called before any password is stored.
+func (store *shardedPasswordHashStore) setExpiry(config ExpiryConfig) {
+	for _, shard := range store.shards {
+		shard.setExpiry(config)
+	}
+	store.interval = store.shards[0].expiry.Interval
+}
+
+// setCapacity bounds every shard to its share of the capacity, rounded down so the shards never hold more than
+// the bounds together. Bounds too small to give every shard room for a hash keep only as many shards as they
+// have room for. It must be called before any password is stored.
+func (store *shardedPasswordHashStore) setCapacity(config CapacityConfig) {
+	n := int64(len(store.shards))
+	if config.MaxRecords > 0 && config.MaxRecords < n {
+		n = config.MaxRecords
+	}
+	if config.MaxBytes > 0 && config.MaxBytes/hashRecordOverhead < n {
+		n = config.MaxBytes / hashRecordOverhead
+		if n < 1 {
+			n = 1
+		}
+	}
+	if n < int64(len(store.shards)) {
+		store.logger.Printf("Capacity only has room for %d shards", n)
+		store.shards = store.shards[:n]
+	}
+	config.MaxRecords /= n
+	config.MaxBytes /= n
+	for _, shard := range store.shards {
+		shard.setCapacity(config)
+	}
+}
+
+// setTombstoneWindow changes how long every shard remembers deleted ids.
+func (store *shardedPasswordHashStore) setTombstoneWindow(window time.Duration) {
+	for _, shard := range store.shards {
+		shard.setTombstoneWindow(window)
+	}
+}
+
+// setCompactDigests keeps the hashes of every shard in an arena-based table. It must be called before any
+// password is stored.
+func (store *shardedPasswordHashStore) setCompactDigests() {
+	for _, shard := range store.shards {
+		shard.setCompactDigests()
+	}
+}
+
+// holdPending holds back the pending hashes every shard schedules from now on.
+func (store *shardedPasswordHashStore) holdPending() {
+	for _, shard := range store.shards {
+		shard.holdPending()
+	}
+}
+
+// resumePending schedules the pending hashes every shard held back.
+func (store *shardedPasswordHashStore) resumePending() {
+	for _, shard := range store.shards {
+		shard.resumePending()
+	}
+}
+
+// storePassword stores the hash in the shard of its id.
+func (store *shardedPasswordHashStore) storePassword(hashed string, id string, ttl time.Duration, delay time.Duration) error {
+	return store.shard(id).storePassword(hashed, id, ttl, delay)
+}
+
+// retrievePassword gets the hash from the shard of its id.
+func (store *shardedPasswordHashStore) retrievePassword(id string) (string, hashState) {
+	return store.shard(id).retrievePassword(id)
+}
+
+// deletePassword deletes the hash from the shard of its id.
+func (store *shardedPasswordHashStore) deletePassword(id string) hashState {
+	return store.shard(id).deletePassword(id)
+}
+
+// onStored registers a listener for hashes stored in any shard. It must be called before any password is stored.
+func (store *shardedPasswordHashStore) onStored(listener storeListener) {
+	for _, shard := range store.shards {
+		shard.onStored(listener)
+	}
+}
+
+// waitPendingStores waits for the pending stores of every shard.
+func (store *shardedPasswordHashStore) waitPendingStores() {
+	for _, shard := range store.shards {
+		shard.pending.Wait()
+	}
+	store.logger.Print("No more pending stores")
+}
+
+// startExpiring runs the janitor over every shard in the background, if expiry is enabled.
+func (store *shardedPasswordHashStore) startExpiring() {
+	if store.interval <= 0 {
+		return
+	}
+	store.janitorStop = make(chan bool)
+	store.janitor.Add(1)
+	go store.runJanitor(store.janitorStop)
+}
+
+// runJanitor periodically expires hashes in each shard in turn until stopped.
+func (store *shardedPasswordHashStore) runJanitor(stop chan bool) {
+	defer store.janitor.Done()
+	store.logger.Print("Expiring hashes...")
+	ticker := time.NewTicker(store.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			expired := 0
+			for _, shard := range store.shards {
+				expired += shard.expireHashes(shard.now())
+			}
+			if expired > 0 {
+				store.logger.Printf("%d hashes expired", expired)
+			}
+		case <-stop:
+			store.logger.Print("Done expiring hashes")
+			return
+		}
+	}
+}
+
+// stopExpiring interrupts the janitor, waiting for it to finish its current run.
+func (store *shardedPasswordHashStore) stopExpiring() {
+	if store.janitorStop == nil {
+		return
+	}
+	close(store.janitorStop)
+	store.janitor.Wait()
+	store.janitorStop = nil
+}
+
+// collectStats adds up the stats of every shard.
+func (store *shardedPasswordHashStore) collectStats(stats *serverStats) {
+	stats.Store = &storeStats{}
+	for _, shard := range store.shards {
+		shardStats := shard.storeStats()
+		stats.Store.Records += shardStats.Records
+		stats.Store.Pending += shardStats.Pending
+		if expiry := shard.expiryStats(); expiry != nil {
+			if stats.Expiry == nil {
+				stats.Expiry = &expiryStats{}
+			}
+			stats.Expiry.Expired += expiry.Expired
+			stats.Expiry.Remembered += expiry.Remembered
+		}
+		if capacity := shard.capacityStats(); capacity != nil {
+			if stats.Capacity == nil {
+				stats.Capacity = &capacityStats{}
+			}
+			stats.Capacity.Records += capacity.Records
+			stats.Capacity.Bytes += capacity.Bytes
+			stats.Capacity.Evicted += capacity.Evicted
+			stats.Capacity.Rejected += capacity.Rejected
+		}
+	}
+}
+
+// drainPending drains every shard at once, adding up what each did. Spooling gathers the hashes of every shard
+// in the one spool file, as written by a store which is not sharded.
+func (store *shardedPasswordHashStore) drainPending(config ShutdownConfig) (shutdownReport, error) {
+	reports := make([]shutdownReport, len(store.shards))
+	errs := make([]error, len(store.shards))
+	var spooled []pendingStore
+	var spooling sync.Mutex
+	var drained sync.WaitGroup
+	for i, shard := range store.shards {
+		drain := shard.pendingDrain()
+		if config.Mode == ShutdownSpool {
+			drain.keep = func(config ShutdownConfig, dropped []pendingStore) error {
+				defer spooling.Unlock()
+				spooling.Lock()
+				spooled = append(spooled, dropped...)
+				return nil
+			}
+		}
+		drained.Add(1)
+		go func(i int, drain pendingDrain) {
+			defer drained.Done()
+			reports[i], errs[i] = drain.run(config)
+		}(i, drain)
+	}
+	drained.Wait()
+
+	report := shutdownReport{Mode: reports[0].Mode}
+	var err error
+	for i := range reports {
+		report.Waited += reports[i].Waited
+		report.Flushed += reports[i].Flushed
+		report.Abandoned += reports[i].Abandoned
+		report.Spooled += reports[i].Spooled
+		if errs[i] != nil && err == nil {
+			err = errs[i]
+		}
+	}
+	if config.Mode == ShutdownSpool && err == nil {
+		if err := writeSpool(config.SpoolFile, spooled); err != nil {
+			return report, err
+		}
+		if len(spooled) > 0 {
+			store.logger.Printf("%d pending hashes spooled to %s", len(spooled), config.SpoolFile)
+		}
+	}
+	return report, err
+}
+
+// loadSpool reloads each spooled hash into the shard now holding its id, whatever the number of shards of the
+// store which spooled it, if sharded at all, then removes the spool file.
+func (store *shardedPasswordHashStore) loadSpool(path string) error {
+	spooled, err := readSpool(path)
+	if err != nil || spooled == nil {
+		return err
+	}
+	reloaded := 0
+	for _, hash := range spooled {
+		if store.shard(hash.Id).reloadSpooled(hash) {
+			reloaded++
+		}
+	}
+	store.logger.Printf("Reloaded %d pending hashes from %s", reloaded, path)
+	return os.Remove(path)
+}
+
+// rewriteHashes rewrites the stored hashes of each shard in turn.
+func (store *shardedPasswordHashStore) rewriteHashes(rewrite func(id string, hashed string) (string, bool)) int {
+	rewritten := 0
+	for _, shard := range store.shards {
+		rewritten += shard.rewriteHashes(rewrite)
+	}
+	return rewritten
+}
+
+// close releases anything held by the store, which has nothing to release while in memory only.
+func (store *shardedPasswordHashStore) close() error {
+	return nil
+}
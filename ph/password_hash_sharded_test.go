@@ -0,0 +1,217 @@
+package ph
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_shardedPasswordHashStore(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newShardedPasswordHashStore(log.New(buf, "", 0), 4)
+	var stored int64
+	store.onStored(func(id string, hashed string) {
+		atomic.AddInt64(&stored, 1)
+	})
+	for i := 0; i < 100; i++ {
+		if err := store.storePassword("hash-"+fmt.Sprint(i), fmt.Sprint(i), 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.waitPendingStores()
+
+	for i, shard := range store.shards {
+		if shard.hashes.count() == 0 || shard.hashes.count() == 100 {
+			t.Errorf("Expected hashes to be spread across shards, got %d in shard %d", shard.hashes.count(), i)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if hash, state := store.retrievePassword(fmt.Sprint(i)); hash != "hash-"+fmt.Sprint(i) || state != hashAvailable {
+			t.Errorf("Unexpected hash for %d: %s %d", i, hash, state)
+		}
+	}
+	if stored != 100 {
+		t.Errorf("Expected listener to be called for every shard, got %d", stored)
+	}
+	if state := store.deletePassword("7"); state != hashAvailable {
+		t.Errorf("Expected hash to be deleted, got %d", state)
+	}
+	if _, state := store.retrievePassword("7"); state != hashDeleted {
+		t.Errorf("Expected tombstone, got %d", state)
+	}
+	if strings.Count(buf.String(), "No more pending stores\n") != 1 {
+		t.Errorf("Expected a single log for all shards: %s", buf.String())
+	}
+}
+
+func Test_shardedCollectStats(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newShardedPasswordHashStore(log.New(buf, "", 0), 4)
+	store.setCapacity(CapacityConfig{MaxRecords: 10, Policy: RejectPolicy})
+	store.setExpiry(ExpiryConfig{})
+	for _, shard := range store.shards {
+		if shard.capacity.MaxRecords != 2 {
+			t.Errorf("Expected each shard to get its share of the capacity, got %d", shard.capacity.MaxRecords)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		store.storePassword("test", fmt.Sprint(i), 0, 0)
+	}
+	store.waitPendingStores()
+
+	stats := &serverStats{}
+	store.collectStats(stats)
+	if stats.Capacity == nil || stats.Capacity.Records != 5 || stats.Expiry == nil {
+		t.Errorf("Unexpected stats: %+v %+v", stats.Capacity, stats.Expiry)
+	}
+}
+
+func Test_shardedCapacity(t *testing.T) {
+	for _, config := range []CapacityConfig{
+		{MaxRecords: 10},
+		{MaxRecords: 10, Policy: RejectPolicy},
+		{MaxRecords: 3},
+		{MaxBytes: 10 * hashRecordSize("00", "test")},
+	} {
+		store := newShardedPasswordHashStore(log.New(&bytes.Buffer{}, "", 0), 4)
+		store.setCapacity(config)
+		if config.MaxRecords == 3 && len(store.shards) != 3 {
+			t.Errorf("Expected a shard per record of room, got %d", len(store.shards))
+		}
+		for i := 0; i < 100; i++ {
+			store.storePassword("test", fmt.Sprintf("%02d", i), 0, 0)
+		}
+		store.waitPendingStores()
+
+		stats := &serverStats{}
+		store.collectStats(stats)
+		if stats.Capacity.Records == 0 || (config.MaxRecords > 0 && stats.Capacity.Records > config.MaxRecords) ||
+			(config.MaxBytes > 0 && stats.Capacity.Bytes > config.MaxBytes) {
+			t.Errorf("Expected shards to hold no more than %+v together, got %+v", config, stats.Capacity)
+		}
+	}
+}
+
+func Test_shardedExpiry(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newShardedPasswordHashStore(log.New(buf, "", 0), 4)
+	store.setExpiry(ExpiryConfig{TTL: time.Millisecond, Interval: time.Second / 100})
+	for i := 0; i < 20; i++ {
+		store.storePassword("test", fmt.Sprint(i), 0, 0)
+	}
+	store.waitPendingStores()
+	store.startExpiring()
+	time.Sleep(time.Second / 10)
+	store.stopExpiring()
+
+	for i, shard := range store.shards {
+		if shard.hashes.count() != 0 {
+			t.Errorf("Expected shard %d to be expired, got %d", i, shard.hashes.count())
+		}
+	}
+	if strings.Count(buf.String(), "Expiring hashes...\n") != 1 || !strings.Contains(buf.String(), "20 hashes expired\n") {
+		t.Errorf("Expected a single janitor for all shards: %s", buf.String())
+	}
+}
+
+func Test_shardedSpool(t *testing.T) {
+	buf := &bytes.Buffer{}
+	path := filepath.Join(t.TempDir(), "pending.spool")
+	store := newShardedPasswordHashStore(log.New(buf, "", 0), 4)
+	for i := 0; i < 20; i++ {
+		store.storePassword("test", fmt.Sprint(i), 0, time.Hour)
+	}
+	report, err := store.drainPending(ShutdownConfig{Mode: ShutdownSpool, SpoolFile: path})
+	if err != nil || report != (shutdownReport{Mode: ShutdownSpool, Spooled: 20}) {
+		t.Errorf("Unexpected report: %+v %v", report, err)
+	}
+
+	if !strings.Contains(buf.String(), "20 pending hashes spooled to "+path+"\n") {
+		t.Errorf("Expected a single spool file: %s", buf.String())
+	}
+
+	// a store of fewer shards reloads them all
+	reloaded := newShardedPasswordHashStore(log.New(buf, "", 0), 2)
+	if err := reloaded.loadSpool(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if _, state := reloaded.retrievePassword(fmt.Sprint(i)); state != hashPending {
+			t.Errorf("Expected %d to be pending again, got %d", i, state)
+		}
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected spool file to be removed: %v", err)
+	}
+
+	// so does a store which is not sharded, and the other way around
+	if _, err := reloaded.drainPending(ShutdownConfig{Mode: ShutdownSpool, SpoolFile: path}); err != nil {
+		t.Fatal(err)
+	}
+	unsharded := newPasswordHashStore(log.New(buf, "", 0))
+	if err := unsharded.loadSpool(path); err != nil {
+		t.Fatal(err)
+	}
+	if state := unsharded.deletePassword("7"); state != hashPending || unsharded.pendingCount() != 19 {
+		t.Errorf("Expected every hash to be pending again, got %d %d", state, unsharded.pendingCount())
+	}
+	if _, err := unsharded.drainPending(ShutdownConfig{Mode: ShutdownSpool, SpoolFile: path}); err != nil {
+		t.Fatal(err)
+	}
+	reloaded = newShardedPasswordHashStore(log.New(buf, "", 0), 4)
+	if err := reloaded.loadSpool(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		expected := hashPending
+		if i == 7 {
+			expected = hashUnknown
+		}
+		if _, state := reloaded.retrievePassword(fmt.Sprint(i)); state != expected {
+			t.Errorf("Expected %d to be reloaded as %d, got %d", i, expected, state)
+		}
+	}
+}
+
+// benchmarkMixed retrieves existing hashes from many goroutines, storing a new one every tenth operation.
+func benchmarkMixed(b *testing.B, store passwordHashStorer) {
+	const existing = 10000
+	for i := 0; i < existing; i++ {
+		store.storePassword("very-hashed", fmt.Sprint(i), 0, 0)
+	}
+	store.waitPendingStores()
+	var next int64 = existing
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if i%10 == 0 {
+				store.storePassword("very-hashed", fmt.Sprint(atomic.AddInt64(&next, 1)), 0, 0)
+			} else {
+				store.retrievePassword(fmt.Sprint(i * 7919 % existing))
+			}
+			i++
+		}
+	})
+	b.StopTimer()
+	store.waitPendingStores()
+}
+
+func BenchmarkMixedPasswordHashStore(b *testing.B) {
+	benchmarkMixed(b, newPasswordHashStore(log.New(ioutil.Discard, "", 0)))
+}
+
+func BenchmarkMixedShardedPasswordHashStore(b *testing.B) {
+	for _, shards := range []int{4, 16, 64} {
+		b.Run(fmt.Sprint(shards, "-shards"), func(b *testing.B) {
+			benchmarkMixed(b, newShardedPasswordHashStore(log.New(ioutil.Discard, "", 0), shards))
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package ph
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// ShutdownMode selects what happens to hashes still waiting out their delay when the server shuts down.
+type ShutdownMode string
+
+const (
+	// ShutdownWait waits out every remaining delay, storing every pending hash. This is the default.
+	ShutdownWait ShutdownMode = "wait"
+	// ShutdownFlush stores every pending hash right away, without waiting for its delay.
+	ShutdownFlush ShutdownMode = "flush"
+	// ShutdownAbandon waits up to the deadline, then drops whatever is still pending.
+	ShutdownAbandon ShutdownMode = "abandon"
+	// ShutdownSpool writes pending hashes to the spool file, to be pending again on the next start.
+	ShutdownSpool ShutdownMode = "spool"
+)
+
+// ParseShutdownMode validates the name of a shutdown mode.
+func ParseShutdownMode(name string) (ShutdownMode, error) {
+	switch mode := ShutdownMode(name); mode {
+	case ShutdownWait, ShutdownFlush, ShutdownAbandon, ShutdownSpool:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown shutdown mode %q", name)
+}
+
+// ShutdownConfig configures what happens to pending hashes on shutdown. The deadline only applies to
+// ShutdownAbandon, while a spool file left by ShutdownSpool is reloaded on start whatever the mode.
+// Hashes abandoned while a hash log is kept come back pending on restart, as the log still holds them.
+type ShutdownConfig struct {
+	Mode      ShutdownMode
+	Deadline  time.Duration
+	SpoolFile string
+}
+
+// shutdownReport tells how many pending stores each shutdown path affected, as returned by the shutdown endpoint.
+type shutdownReport struct {
+	Mode      ShutdownMode `json:"mode"`
+	Waited    int          `json:"waited"`
+	Flushed   int          `json:"flushed"`
+	Abandoned int          `json:"abandoned"`
+	Spooled   int          `json:"spooled"`
+}
+
+// spooledHash is a pending hash as written to the spool file, one JSON object per line.
+type spooledHash struct {
+	Id     string        `json:"id"`
+	Hashed string        `json:"hashed"`
+	TTL    time.Duration `json:"ttl,omitempty"`
+	Due    time.Time     `json:"due"`
+}
+
+// pendingDrain deals with the hashes a store holds in its scheduler on shutdown, according to the shutdown mode,
+// leaving to the store what it does with each of them.
+type pendingDrain struct {
+	logger    *log.Logger
+	scheduler *delayScheduler
+	pending   *sync.WaitGroup
+	// count returns how many hashes are pending, leaving out cancelled ones
+	count func() int
+	// flush stores the hashes taken off the scheduler right away, returning how many were
+	flush func(drained []pendingStore) (int, error)
+	// drop gives up on a hash taken off the scheduler, marking it done, and tells whether it was still wanted
+	drop func(pending pendingStore) bool
+	// keep deals with the hashes given up on, if set; otherwise they are logged as abandoned, or spooled
+	keep func(config ShutdownConfig, dropped []pendingStore) error
+}
+
+// run drains the pending hashes, so none is left afterwards.
+func (drain pendingDrain) run(config ShutdownConfig) (shutdownReport, error) {
+	report := shutdownReport{Mode: config.Mode}
+	switch config.Mode {
+	case ShutdownFlush:
+		flushed, err := drain.flush(drain.scheduler.drain())
+		report.Flushed = flushed
+		if err != nil {
+			return report, err
+		}
+		drain.pending.Wait()
+	case ShutdownAbandon, ShutdownSpool:
+		before := drain.count()
+		if config.Mode == ShutdownAbandon && waitUntil(drain.pending, time.Now().Add(config.Deadline)) {
+			report.Waited = before
+			break
+		}
+		var dropped []pendingStore
+		for _, pending := range drain.scheduler.drain() {
+			if drain.drop(pending) {
+				dropped = append(dropped, pending)
+			}
+		}
+		drain.pending.Wait()
+		if config.Mode == ShutdownAbandon {
+			report.Abandoned = len(dropped)
+			report.Waited = before - report.Abandoned
+		} else {
+			report.Spooled = len(dropped)
+		}
+		if drain.keep != nil {
+			return report, drain.keep(config, dropped)
+		}
+		if config.Mode == ShutdownAbandon {
+			for _, pending := range dropped {
+				drain.logger.Printf("%s abandoned", pending.id)
+			}
+			break
+		}
+		if err := writeSpool(config.SpoolFile, dropped); err != nil {
+			return report, err
+		}
+		if len(dropped) > 0 {
+			drain.logger.Printf("%d pending hashes spooled to %s", len(dropped), config.SpoolFile)
+		}
+	default:
+		report.Mode = ShutdownWait
+		report.Waited = drain.count()
+		drain.pending.Wait()
+	}
+	return report, nil
+}
+
+// waitUntil waits for the group up to the given deadline, telling whether it completed.
+func waitUntil(group *sync.WaitGroup, deadline time.Time) bool {
+	done := make(chan bool)
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// drainPending deals with the hashes still pending according to the shutdown mode, so none is left afterwards.
+func (store *passwordHashStore) drainPending(config ShutdownConfig) (shutdownReport, error) {
+	return store.pendingDrain().run(config)
+}
+
+// pendingDrain is how the store drains its pending hashes, which spools them to the spool file unless told
+// to keep them otherwise.
+func (store *passwordHashStore) pendingDrain() pendingDrain {
+	return pendingDrain{
+		logger:    store.logger,
+		scheduler: store.scheduler,
+		pending:   &store.pending,
+		count:     store.pendingCount,
+		flush: func(drained []pendingStore) (int, error) {
+			for _, pending := range drained {
+				store.commitPending(pending)
+			}
+			return len(drained), nil
+		},
+		drop: store.dropPending,
+	}
+}
+
+// pendingCount returns how many hashes are waiting out their delay, or being stored, leaving out cancelled ones.
+func (store *passwordHashStore) pendingCount() int {
+	defer store.lock.RUnlock()
+	store.lock.RLock()
+	return len(store.pendingHashes) - len(store.cancelled)
+}
+
+// dropPending gives up on a pending hash taken off the scheduler, telling whether it was still wanted.
+func (store *passwordHashStore) dropPending(pending pendingStore) bool {
+	defer store.pending.Done()
+	defer store.lock.Unlock()
+	store.lock.Lock()
+	delete(store.pendingHashes, pending.id)
+	store.releaseCapacity(pending.id, pending.hashed)
+	if store.cancelled[pending.id] {
+		delete(store.cancelled, pending.id)
+		return false
+	}
+	return true
+}
+
+// writeSpool writes the given pending hashes to the spool file, replacing it atomically.
+func writeSpool(path string, spooled []pendingStore) error {
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	for _, pending := range spooled {
+		if err := encoder.Encode(spooledHash{Id: pending.id, Hashed: pending.hashed, TTL: pending.ttl, Due: pending.due}); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomically(path, buf.Bytes())
+}
+
+// loadSpool makes the hashes in the spool file pending again for whatever remained of their delay, then
+// removes the file. Ids already known to the store, such as those restored from a hash log, are skipped.
+func (store *passwordHashStore) loadSpool(path string) error {
+	spooled, err := readSpool(path)
+	if err != nil || spooled == nil {
+		return err
+	}
+	reloaded := 0
+	for _, hash := range spooled {
+		if store.reloadSpooled(hash) {
+			reloaded++
+		}
+	}
+	store.logger.Printf("Reloaded %d pending hashes from %s", reloaded, path)
+	return os.Remove(path)
+}
+
+// readSpool reads the hashes in the spool file, if any.
+func readSpool(path string) ([]spooledHash, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	spooled := []spooledHash{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, maxLogRecord)
+	for line := 1; scanner.Scan(); line++ {
+		var hash spooledHash
+		if err := json.Unmarshal(scanner.Bytes(), &hash); err != nil || hash.Id == "" {
+			return nil, fmt.Errorf("spool line %d: malformed hash", line)
+		}
+		spooled = append(spooled, hash)
+	}
+	return spooled, scanner.Err()
+}
+
+// reloadSpooled makes a spooled hash pending again, unless its id is already known or there is no room for it.
+func (store *passwordHashStore) reloadSpooled(hash spooledHash) bool {
+	if store.knows(hash.Id) {
+		return false
+	}
+	if err := store.reserveCapacity(hash.Id, hash.Hashed); err != nil {
+		store.logger.Printf("No room to reload %s", hash.Id)
+		return false
+	}
+	delay := time.Until(hash.Due)
+	if delay < 0 {
+		delay = 0
+	}
+	store.schedulePending(hash.Hashed, hash.Id, hash.TTL, delay)
+	return true
+}
+
+// knows tells whether the id is stored, pending or remembered as gone.
+func (store *passwordHashStore) knows(id string) bool {
+	defer store.lock.RUnlock()
+	store.lock.RLock()
+	return store.knowsLocked(id)
+}
+
+// knowsLocked is knows for callers already holding the lock.
+func (store *passwordHashStore) knowsLocked(id string) bool {
+	_, stored := store.hashes.get(id)
+	_, gone := store.gone[id]
+	_, pending := store.pendingHashes[id]
+	return stored || gone || pending
+}
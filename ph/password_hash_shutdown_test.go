@@ -0,0 +1,137 @@
+package ph
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ParseShutdownMode(t *testing.T) {
+	for _, name := range []string{"wait", "flush", "abandon", "spool"} {
+		if mode, err := ParseShutdownMode(name); err != nil || string(mode) != name {
+			t.Errorf("Expected %s to be valid: %v", name, err)
+		}
+	}
+	if _, err := ParseShutdownMode("bogus"); err == nil {
+		t.Error("Expected unknown mode to be rejected")
+	}
+}
+
+func Test_drainPendingWait(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	store.storePassword("test", "1", 0, time.Second/100)
+	report, err := store.drainPending(ShutdownConfig{})
+	if err != nil || report != (shutdownReport{Mode: ShutdownWait, Waited: 1}) {
+		t.Errorf("Unexpected report: %+v %v", report, err)
+	}
+	if hash, _ := store.retrievePassword("1"); hash != "test" {
+		t.Error("Expected hash to be stored after waiting")
+	}
+}
+
+func Test_drainPendingFlush(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	var stored []string
+	store.onStored(func(id string, hashed string) {
+		stored = append(stored, id)
+	})
+	store.storePassword("test", "1", 0, time.Hour)
+	store.storePassword("test", "2", 0, time.Hour)
+	start := time.Now()
+	report, err := store.drainPending(ShutdownConfig{Mode: ShutdownFlush})
+	if err != nil || report != (shutdownReport{Mode: ShutdownFlush, Flushed: 2}) {
+		t.Errorf("Unexpected report: %+v %v", report, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Expected flush to not wait for the delay")
+	}
+	if store.hashes.count() != 2 || len(stored) != 2 {
+		t.Errorf("Expected hashes to be stored, and listeners called: %v", stored)
+	}
+}
+
+func Test_drainPendingAbandon(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	store.setCapacity(CapacityConfig{MaxRecords: 2, Policy: RejectPolicy})
+	store.storePassword("test", "1", 0, time.Hour)
+	store.storePassword("test", "2", 0, time.Hour)
+	store.deletePassword("2")
+	report, err := store.drainPending(ShutdownConfig{Mode: ShutdownAbandon, Deadline: time.Second / 100})
+	if err != nil || report != (shutdownReport{Mode: ShutdownAbandon, Waited: 0, Abandoned: 1}) {
+		t.Errorf("Unexpected report: %+v %v", report, err)
+	}
+	if _, state := store.retrievePassword("1"); state != hashUnknown {
+		t.Errorf("Expected abandoned hash to be unknown, got %d", state)
+	}
+	if store.reservedRecords != 0 {
+		t.Errorf("Expected capacity to be released, got %d", store.reservedRecords)
+	}
+	if !strings.Contains(buf.String(), "1 abandoned\n") {
+		t.Errorf("Expected log indicating abandon: %s", buf.String())
+	}
+
+	// nothing is abandoned if everything completes within the deadline
+	store = newPasswordHashStore(log.New(buf, "", 0))
+	store.storePassword("test", "1", 0, time.Second/100)
+	report, _ = store.drainPending(ShutdownConfig{Mode: ShutdownAbandon, Deadline: time.Second})
+	if report != (shutdownReport{Mode: ShutdownAbandon, Waited: 1}) {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+}
+
+func Test_drainPendingSpool(t *testing.T) {
+	buf := &bytes.Buffer{}
+	path := filepath.Join(t.TempDir(), "pending.spool")
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	store.storePassword("test-1", "1", time.Minute, time.Hour)
+	store.storePassword("test-2", "2", 0, time.Hour)
+	report, err := store.drainPending(ShutdownConfig{Mode: ShutdownSpool, SpoolFile: path})
+	if err != nil || report != (shutdownReport{Mode: ShutdownSpool, Spooled: 2}) {
+		t.Errorf("Unexpected report: %+v %v", report, err)
+	}
+	if data, _ := ioutil.ReadFile(path); strings.Count(string(data), "\n") != 2 {
+		t.Errorf("Unexpected spool: %s", data)
+	}
+
+	// the next store gets them pending again for the rest of their delay, skipping known ids
+	reloaded := newPasswordHashStore(log.New(buf, "", 0))
+	reloaded.storePassword("known", "2", 0, 0)
+	reloaded.waitPendingStores()
+	if err := reloaded.loadSpool(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, state := reloaded.retrievePassword("1"); state != hashPending {
+		t.Errorf("Expected spooled hash to be pending, got %d", state)
+	}
+	if hash, _ := reloaded.retrievePassword("2"); hash != "known" {
+		t.Errorf("Expected known id to be kept, got %s", hash)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected spool to be removed: %v", err)
+	}
+	if !strings.Contains(buf.String(), "2 pending hashes spooled to "+path+"\n") ||
+		!strings.Contains(buf.String(), "Reloaded 1 pending hashes from "+path+"\n") {
+		t.Errorf("Expected log indicating spooling: %s", buf.String())
+	}
+	reloaded.drainPending(ShutdownConfig{Mode: ShutdownFlush})
+	if hash, _ := reloaded.hashes.get("1"); hash != "test-1" || reloaded.expiresAt["1"].IsZero() {
+		t.Error("Expected spooled hash to keep its time-to-live")
+	}
+
+	// a missing spool is nothing to reload, while a corrupt one fails
+	if err := reloaded.loadSpool(path); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	ioutil.WriteFile(path, []byte("bogus\n"), 0600)
+	if err := reloaded.loadSpool(path); err == nil {
+		t.Error("Expected corrupt spool to fail")
+	}
+}
@@ -0,0 +1,199 @@
+package ph
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// snapshotMagic starts every snapshot, telling its format apart from anything else.
+	snapshotMagic = "phsnap01"
+
+	logSnapshotSuffix = ".snapshot"
+)
+
+// errCorruptSnapshot is returned when a snapshot fails its checksum or does not decode.
+var errCorruptSnapshot = errors.New("corrupt snapshot")
+
+// snapshotEntryKind tells what a snapshot entry stands for.
+type snapshotEntryKind byte
+
+const (
+	// snapshotStored is a stored hash, along with when it expires, if ever.
+	snapshotStored snapshotEntryKind = iota + 1
+	// snapshotPending is a hash waiting out its delay, as it was submitted.
+	snapshotPending
+	// snapshotGone is an expired or deleted id, along with when it is forgotten.
+	snapshotGone
+)
+
+// storeSnapshot is the full state of a store at some point of its log, which it replaces up to the given segment.
+type storeSnapshot struct {
+	taken   time.Time
+	segment uint64
+	stored  []snapshotHash
+	pending []logRecord
+	gone    []snapshotGoneId
+}
+
+// snapshotHash is a stored hash, where a zero expiry means it never expires.
+type snapshotHash struct {
+	id      string
+	hashed  string
+	expires time.Time
+}
+
+// snapshotGoneId is an expired or deleted id remembered until some time.
+type snapshotGoneId struct {
+	id    string
+	state hashState
+	until time.Time
+}
+
+// logStats are the snapshot and log sizes reported by the stats endpoint.
+// The age of the latest snapshot, in seconds, is left out until one is taken.
+type logStats struct {
+	SnapshotAge *int64 `json:"snapshot_age,omitempty"`
+	Segments    int    `json:"segments"`
+	Bytes       int64  `json:"bytes"`
+}
+
+// encodeSnapshot writes the snapshot in a compact binary form, followed by the CRC-32C of everything before it.
+func encodeSnapshot(snapshot *storeSnapshot) []byte {
+	data := []byte(snapshotMagic)
+	data = appendInt64(data, snapshot.taken.UnixNano())
+	data = appendInt64(data, int64(snapshot.segment))
+	for _, hash := range snapshot.stored {
+		data = append(data, byte(snapshotStored))
+		data = appendString(data, hash.id)
+		data = appendString(data, hash.hashed)
+		data = appendInt64(data, unixNanoOrZero(hash.expires))
+	}
+	for _, record := range snapshot.pending {
+		data = append(data, byte(snapshotPending))
+		data = appendString(data, record.id)
+		data = appendString(data, record.hashed)
+		data = appendInt64(data, int64(record.ttl))
+		data = appendInt64(data, record.available.UnixNano())
+	}
+	for _, gone := range snapshot.gone {
+		data = append(data, byte(snapshotGone))
+		data = appendString(data, gone.id)
+		data = append(data, byte(gone.state))
+		data = appendInt64(data, gone.until.UnixNano())
+	}
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.Checksum(data, logCRCTable))
+	return append(data, checksum[:]...)
+}
+
+// decodeSnapshot verifies and parses a snapshot written by encodeSnapshot.
+func decodeSnapshot(data []byte) (*storeSnapshot, error) {
+	if len(data) < len(snapshotMagic)+4 || !bytes.HasPrefix(data, []byte(snapshotMagic)) {
+		return nil, errCorruptSnapshot
+	}
+	body, checksum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.Checksum(body, logCRCTable) != binary.BigEndian.Uint32(checksum) {
+		return nil, errCorruptSnapshot
+	}
+
+	decoder := &logDecoder{data: body[len(snapshotMagic):]}
+	snapshot := &storeSnapshot{taken: time.Unix(0, decoder.int64()), segment: uint64(decoder.int64())}
+	for len(decoder.data) > 0 && !decoder.failed {
+		switch snapshotEntryKind(decoder.byte()) {
+		case snapshotStored:
+			hash := snapshotHash{id: decoder.string(), hashed: decoder.string()}
+			if expires := decoder.int64(); expires != 0 {
+				hash.expires = time.Unix(0, expires)
+			}
+			snapshot.stored = append(snapshot.stored, hash)
+		case snapshotPending:
+			record := logRecord{kind: logSubmitted, id: decoder.string(), hashed: decoder.string()}
+			record.ttl = time.Duration(decoder.int64())
+			record.available = time.Unix(0, decoder.int64())
+			snapshot.pending = append(snapshot.pending, record)
+		case snapshotGone:
+			gone := snapshotGoneId{id: decoder.string(), state: hashState(decoder.byte())}
+			gone.until = time.Unix(0, decoder.int64())
+			snapshot.gone = append(snapshot.gone, gone)
+		default:
+			return nil, errCorruptSnapshot
+		}
+	}
+	if decoder.failed {
+		return nil, errCorruptSnapshot
+	}
+	return snapshot, nil
+}
+
+// unixNanoOrZero is the time in Unix nanoseconds, keeping the zero time as zero.
+func unixNanoOrZero(at time.Time) int64 {
+	if at.IsZero() {
+		return 0
+	}
+	return at.UnixNano()
+}
+
+// snapshotPath is where the snapshot replacing the segments before the given one is kept.
+func (hashLog *HashLog) snapshotPath(segment uint64) string {
+	return filepath.Join(hashLog.config.Dir, fmt.Sprintf("%016d%s", segment, logSnapshotSuffix))
+}
+
+// loadSnapshot reads the latest valid snapshot, if any, returning the first segment it does not cover.
+// Invalid snapshots are skipped, falling back to older ones, but kept for inspection; replay fails if the
+// segments the snapshot falls back to were already compacted.
+func (hashLog *HashLog) loadSnapshot() (uint64, error) {
+	snapshots, err := hashLog.listFiles(logSnapshotSuffix)
+	if err != nil {
+		return 0, err
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		data, err := ioutil.ReadFile(hashLog.snapshotPath(snapshots[i]))
+		if err != nil {
+			return 0, err
+		}
+		snapshot, err := decodeSnapshot(data)
+		if err != nil || snapshot.segment != snapshots[i] {
+			hashLog.invalidSnapshots++
+			continue
+		}
+		hashLog.snapshot, hashLog.snapshotTaken = snapshot, snapshot.taken
+		return snapshot.segment, nil
+	}
+	return 1, nil
+}
+
+// writeSnapshot saves the snapshot under a temporary name, renaming it once flushed, so a crash never leaves
+// a partial snapshot behind. Older snapshots are removed afterwards.
+func (hashLog *HashLog) writeSnapshot(snapshot *storeSnapshot) error {
+	path := hashLog.snapshotPath(snapshot.segment)
+	if err := writeFileAtomically(path, encodeSnapshot(snapshot)); err != nil {
+		return err
+	}
+	if err := syncDir(hashLog.config.Dir); err != nil {
+		return err
+	}
+
+	hashLog.lock.Lock()
+	hashLog.snapshotTaken = snapshot.taken
+	hashLog.lock.Unlock()
+	snapshots, err := hashLog.listFiles(logSnapshotSuffix)
+	if err != nil {
+		return err
+	}
+	for _, older := range snapshots {
+		if older < snapshot.segment {
+			if err := os.Remove(hashLog.snapshotPath(older)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package ph
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_encodeSnapshot(t *testing.T) {
+	snapshot := &storeSnapshot{
+		taken:   time.Unix(1000, 0),
+		segment: 7,
+		stored:  []snapshotHash{{"1", "hash-1", time.Time{}}, {"2", "hash-2", time.Unix(2000, 0)}},
+		pending: []logRecord{{kind: logSubmitted, id: "3", hashed: "hash-3", ttl: time.Minute, available: time.Unix(1005, 0)}},
+		gone:    []snapshotGoneId{{"4", hashDeleted, time.Unix(3000, 0)}},
+	}
+	data := encodeSnapshot(snapshot)
+	decoded, err := decodeSnapshot(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !decoded.taken.Equal(snapshot.taken) || decoded.segment != 7 {
+		t.Errorf("Unexpected header: %v %d", decoded.taken, decoded.segment)
+	}
+	if len(decoded.stored) != 2 || !decoded.stored[0].expires.IsZero() || !decoded.stored[1].expires.Equal(time.Unix(2000, 0)) {
+		t.Errorf("Unexpected stored hashes: %+v", decoded.stored)
+	}
+	if len(decoded.pending) != 1 || decoded.pending[0].hashed != "hash-3" || decoded.pending[0].ttl != time.Minute {
+		t.Errorf("Unexpected pending hashes: %+v", decoded.pending)
+	}
+	if len(decoded.gone) != 1 || decoded.gone[0].state != hashDeleted || !decoded.gone[0].until.Equal(time.Unix(3000, 0)) {
+		t.Errorf("Unexpected gone ids: %+v", decoded.gone)
+	}
+
+	for _, bogus := range [][]byte{nil, []byte("bogus"), data[:len(data)-1], append([]byte("x"), data[1:]...)} {
+		if _, err := decodeSnapshot(bogus); err != errCorruptSnapshot {
+			t.Errorf("Expected %q to be rejected: %v", bogus, err)
+		}
+	}
+}
+
+func Test_logPasswordHashStoreSnapshot(t *testing.T) {
+	buf := &bytes.Buffer{}
+	dir := t.TempDir()
+	now := time.Unix(1000, 0)
+	store := newLoggedStore(t, buf, dir, now)
+	store.storePassword("hash-1", "1", 0, 0)
+	store.storePassword("hash-2", "2", 0, 0)
+	forceGoroutineScheduler()
+	store.waitPendingStores()
+	store.deletePassword("2")
+	store.storePassword("hash-3", "3", 0, time.Hour)
+
+	snapshot, err := store.snapshot()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(snapshot.stored) != 1 || len(snapshot.pending) != 1 || len(snapshot.gone) != 1 {
+		t.Errorf("Unexpected snapshot: %+v", snapshot)
+	}
+	if _, err := os.Stat(store.hashLog.segmentPath(1)); !os.IsNotExist(err) {
+		t.Errorf("Expected segment covered by the snapshot to be dropped: %v", err)
+	}
+	if !strings.Contains(buf.String(), "Snapshot of 1 hashes, 1 pending, taken\n") {
+		t.Errorf("Expected log indicating snapshot: %s", buf.String())
+	}
+
+	// changes after the snapshot are in the log tail
+	store.storePassword("hash-4", "4", 0, 0)
+	for i := 0; i < 100; i++ {
+		if _, state := store.retrievePassword("4"); state == hashAvailable {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// crash while 3 is still pending
+	store.hashLog.Close()
+
+	buf.Reset()
+	store = newLoggedStore(t, buf, dir, now.Add(time.Hour))
+	defer store.close()
+	for id, expected := range map[string]hashState{"1": hashAvailable, "2": hashDeleted, "4": hashAvailable} {
+		if _, state := store.retrievePassword(id); state != expected {
+			t.Errorf("Expected %s to be restored as %d, got %d", id, expected, state)
+		}
+	}
+	forceGoroutineScheduler()
+	store.waitPendingStores()
+	if hash, state := store.retrievePassword("3"); hash != "hash-3" || state != hashAvailable {
+		t.Errorf("Expected pending hash to be stored after restart, got %s %d", hash, state)
+	}
+	if !strings.Contains(buf.String(), "Restored 2 hashes, 1 pending, from snapshot and 2 log records\n") {
+		t.Errorf("Expected log indicating restoration: %s", buf.String())
+	}
+}
+
+func Test_logPasswordHashStoreInvalidSnapshot(t *testing.T) {
+	buf := &bytes.Buffer{}
+	dir := t.TempDir()
+	store := newLoggedStore(t, buf, dir, time.Unix(1000, 0))
+	store.storePassword("hash-1", "1", 0, 0)
+	forceGoroutineScheduler()
+	store.waitPendingStores()
+	store.close()
+	if err := ioutil.WriteFile(store.hashLog.snapshotPath(99), []byte("bogus"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	store = newLoggedStore(t, buf, dir, time.Unix(1000, 0))
+	defer store.close()
+	if hash, _ := store.retrievePassword("1"); hash != "hash-1" {
+		t.Error("Expected to fall back to the previous snapshot")
+	}
+	if !strings.HasPrefix(buf.String(), "Skipped 1 invalid snapshots\n") {
+		t.Errorf("Expected log indicating invalid snapshot: %s", buf.String())
+	}
+}
+
+func Test_OpenHashLogCorruptSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	store := newLoggedStore(t, &bytes.Buffer{}, dir, time.Unix(1000, 0))
+	store.storePassword("hash-1", "1", 0, 0)
+	forceGoroutineScheduler()
+	store.waitPendingStores()
+	// closing takes a snapshot, compacting the segments it covers
+	store.close()
+	snapshots, err := store.hashLog.listFiles(logSnapshotSuffix)
+	if err != nil || len(snapshots) != 1 || snapshots[0] == 1 {
+		t.Fatalf("Expected a single snapshot after compaction, got %v %v", snapshots, err)
+	}
+	if err := ioutil.WriteFile(store.hashLog.snapshotPath(snapshots[0]), []byte("bogus"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenHashLog(LogConfig{Dir: dir}); !errors.Is(err, errCorruptSnapshot) {
+		t.Errorf("Expected log to fail opening rather than lose hashes, got %v", err)
+	}
+}
+
+func Test_logPasswordHashStoreSnapshotPeriodically(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	hashLog, err := OpenHashLog(LogConfig{Dir: t.TempDir(), SnapshotInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	logStore := newLogPasswordHashStore(store, hashLog)
+	for i := 0; i < 100; i++ {
+		hashLog.lock.Lock()
+		taken := hashLog.snapshotTaken
+		hashLog.lock.Unlock()
+		if !taken.IsZero() {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := logStore.close(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if hashLog.snapshotTaken.IsZero() {
+		t.Error("Expected a snapshot to be taken periodically")
+	}
+}
+
+func Test_logPasswordHashStoreCollectStats(t *testing.T) {
+	buf := &bytes.Buffer{}
+	now := time.Unix(1000, 0)
+	store := newLoggedStore(t, buf, t.TempDir(), now)
+	defer store.close()
+	stats := &serverStats{}
+	store.collectStats(stats)
+	if stats.Log == nil || stats.Log.SnapshotAge != nil || stats.Log.Segments != 1 || stats.Log.Bytes != 0 {
+		t.Errorf("Unexpected stats before any snapshot: %+v", stats.Log)
+	}
+
+	store.storePassword("hash-1", "1", 0, 0)
+	forceGoroutineScheduler()
+	store.waitPendingStores()
+	store.snapshot()
+	store.now = func() time.Time {
+		return now.Add(time.Minute)
+	}
+	store.collectStats(stats)
+	if stats.Log.SnapshotAge == nil || *stats.Log.SnapshotAge != 60 || stats.Log.Segments != 1 {
+		t.Errorf("Unexpected stats after snapshot: %+v", stats.Log)
+	}
+}
@@ -0,0 +1,194 @@
+package ph
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSQLTable           = "password_hashes"
+	defaultSQLMigrationsTable = "password_hash_migrations"
+	defaultSQLTimeout         = 5 * time.Second
+)
+
+// sqlMigrations are the versioned changes to the schema, version 1 first, applied in order to bring any database
+// up to date. Their {hashes} placeholder stands for the table of hashes. Times are Unix milliseconds, so they
+// compare the same in any database. Released migrations must never change: add new ones instead.
+var sqlMigrations = []string{
+	`CREATE TABLE {hashes} (id VARCHAR(64) NOT NULL PRIMARY KEY, hash VARCHAR(512) NOT NULL, ` +
+		`available_at BIGINT NOT NULL, expires_at BIGINT, deleted_at BIGINT)`,
+	`CREATE INDEX {hashes}_available_at ON {hashes} (available_at)`,
+}
+
+// validSQLTable matches the table names accepted, which are written into statements as they are.
+var validSQLTable = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,62}$`)
+
+// SQLConfig configures a store kept in a SQL database: the tables of hashes ("password_hashes" by default) and
+// of the migrations applied to it ("password_hash_migrations" for the default table, or the table of hashes
+// followed by "_migrations" otherwise, as every table of hashes needs its own), whether the driver takes numbered
+// parameters ($1, $2...) rather than question marks, and how long to wait for each statement (5 seconds by
+// default).
+type SQLConfig struct {
+	Table           string
+	MigrationsTable string
+	NumberedParams  bool
+	Timeout         time.Duration
+}
+
+// HashDB is a SQL database holding hashes, with its schema up to date and its statements prepared.
+type HashDB struct {
+	db      *sql.DB
+	config  SQLConfig
+	version int
+
+	insert  *sql.Stmt
+	get     *sql.Stmt
+	remove  *sql.Stmt
+	flush   *sql.Stmt
+	pending *sql.Stmt
+	purge   *sql.Stmt
+}
+
+// OpenHashDB brings the schema of the database up to date, applying any migration not applied yet, then
+// prepares every statement the store runs. The database is closed along with the store.
+func OpenHashDB(db *sql.DB, config SQLConfig) (*HashDB, error) {
+	if config.Table == "" {
+		config.Table = defaultSQLTable
+	}
+	if config.MigrationsTable == "" {
+		config.MigrationsTable = defaultSQLMigrationsTable
+		if config.Table != defaultSQLTable {
+			config.MigrationsTable = config.Table + "_migrations"
+		}
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultSQLTimeout
+	}
+	for _, table := range []string{config.Table, config.MigrationsTable} {
+		if !validSQLTable.MatchString(table) {
+			return nil, fmt.Errorf("invalid table name %q", table)
+		}
+	}
+	hashDB := &HashDB{db: db, config: config}
+	if err := hashDB.migrate(); err != nil {
+		return nil, err
+	}
+	if err := hashDB.prepare(); err != nil {
+		hashDB.closeStatements()
+		return nil, err
+	}
+	return hashDB, nil
+}
+
+// statement writes the table names and parameters of a statement for the database.
+func (hashDB *HashDB) statement(query string) string {
+	query = strings.NewReplacer("{hashes}", hashDB.config.Table, "{migrations}", hashDB.config.MigrationsTable).Replace(query)
+	if !hashDB.config.NumberedParams {
+		return query
+	}
+	numbered := &strings.Builder{}
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			numbered.WriteString("$" + strconv.Itoa(n))
+		} else {
+			numbered.WriteRune(r)
+		}
+	}
+	return numbered.String()
+}
+
+// context returns a context bounding a statement to the configured timeout, and to the given one.
+func (hashDB *HashDB) context(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, hashDB.config.Timeout)
+}
+
+// migrate applies, in order, every migration newer than the latest one applied, each in a transaction of its
+// own along with the record of its version.
+func (hashDB *HashDB) migrate() error {
+	ctx, cancel := hashDB.context(context.Background())
+	defer cancel()
+	create := hashDB.statement(`CREATE TABLE IF NOT EXISTS {migrations} (version INTEGER NOT NULL PRIMARY KEY, applied_at BIGINT NOT NULL)`)
+	if _, err := hashDB.db.ExecContext(ctx, create); err != nil {
+		return fmt.Errorf("migrations table: %w", err)
+	}
+	var latest sql.NullInt64
+	if err := hashDB.db.QueryRowContext(ctx, hashDB.statement(`SELECT MAX(version) FROM {migrations}`)).Scan(&latest); err != nil {
+		return fmt.Errorf("migrations table: %w", err)
+	}
+	hashDB.version = int(latest.Int64)
+	if hashDB.version > len(sqlMigrations) {
+		return fmt.Errorf("schema version %d is newer than this service knows (%d)", hashDB.version, len(sqlMigrations))
+	}
+	for version := hashDB.version + 1; version <= len(sqlMigrations); version++ {
+		if err := hashDB.apply(ctx, version); err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		hashDB.version = version
+	}
+	return nil
+}
+
+// apply applies a single migration, recording its version in the same transaction.
+func (hashDB *HashDB) apply(ctx context.Context, version int) error {
+	tx, err := hashDB.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, hashDB.statement(sqlMigrations[version-1])); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	record := hashDB.statement(`INSERT INTO {migrations} (version, applied_at) VALUES (?, ?)`)
+	if _, err := tx.ExecContext(ctx, record, version, millis(time.Now())); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// prepare prepares every statement the store runs.
+func (hashDB *HashDB) prepare() error {
+	ctx, cancel := hashDB.context(context.Background())
+	defer cancel()
+	statements := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&hashDB.insert, `INSERT INTO {hashes} (id, hash, available_at, expires_at) VALUES (?, ?, ?, ?)`},
+		{&hashDB.get, `SELECT hash, available_at, expires_at, deleted_at FROM {hashes} WHERE id = ?`},
+		{&hashDB.remove, `UPDATE {hashes} SET hash = '', deleted_at = ? WHERE id = ? AND deleted_at IS NULL`},
+		{&hashDB.flush, `UPDATE {hashes} SET available_at = ? WHERE available_at > ? AND deleted_at IS NULL`},
+		{&hashDB.pending, `SELECT id, hash, available_at, expires_at FROM {hashes} WHERE available_at > ? AND deleted_at IS NULL`},
+		{&hashDB.purge, `DELETE FROM {hashes} WHERE expires_at <= ? OR deleted_at <= ?`},
+	}
+	for _, statement := range statements {
+		stmt, err := hashDB.db.PrepareContext(ctx, hashDB.statement(statement.query))
+		if err != nil {
+			return err
+		}
+		*statement.stmt = stmt
+	}
+	return nil
+}
+
+// closeStatements closes every statement prepared.
+func (hashDB *HashDB) closeStatements() {
+	for _, stmt := range []*sql.Stmt{hashDB.insert, hashDB.get, hashDB.remove, hashDB.flush, hashDB.pending, hashDB.purge} {
+		if stmt != nil {
+			_ = stmt.Close()
+		}
+	}
+}
+
+// close closes the statements, then the database.
+func (hashDB *HashDB) close() error {
+	hashDB.closeStatements()
+	return hashDB.db.Close()
+}
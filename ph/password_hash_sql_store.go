@@ -0,0 +1,372 @@
+package ph
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sqlStats are the counts of a store kept in a SQL database, as reported by the stats endpoint.
+type sqlStats struct {
+	Version int   `json:"version"`
+	Pending int   `json:"pending"`
+	Purged  int64 `json:"purged"`
+	Errors  int64 `json:"errors"`
+}
+
+// sqlPasswordHashStore keeps hashes in a SQL database as soon as they are submitted, each row telling when it
+// becomes available, so pending hashes survive a restart. Reads simply compare that time with the current one,
+// while the delay scheduler only tells listeners once hashes become available. Deleted hashes keep their row,
+// without the hash, until the tombstone window is over, and expired ones until the expiry retention is over,
+// when the janitor purges them.
+type sqlPasswordHashStore struct {
+	db              *HashDB
+	logger          *log.Logger
+	expiry          *ExpiryConfig
+	tombstoneWindow time.Duration
+	now             func() time.Time
+
+	scheduler *delayScheduler
+	pending   sync.WaitGroup
+	listeners []storeListener
+
+	janitor     sync.WaitGroup
+	janitorStop chan bool
+
+	purgedCount int64
+	errorCount  int64
+}
+
+// newSQLPasswordHashStore creates a store kept in the given database.
+func newSQLPasswordHashStore(logger *log.Logger, db *HashDB) *sqlPasswordHashStore {
+	store := &sqlPasswordHashStore{
+		db:              db,
+		logger:          logger,
+		tombstoneWindow: defaultTombstoneWindow,
+		now:             time.Now,
+	}
+	store.scheduler = newDelayScheduler(store.commitPending)
+	return store
+}
+
+// setExpiry enables expiry of hashes. It must be called before any password is stored.
+func (store *sqlPasswordHashStore) setExpiry(config ExpiryConfig) {
+	if config.Interval <= 0 {
+		config.Interval = defaultExpiryInterval
+	}
+	if config.Retention <= 0 {
+		config.Retention = defaultExpiryRetention
+	}
+	store.expiry = &config
+}
+
+// setTombstoneWindow changes how long deleted ids are remembered as such.
+func (store *sqlPasswordHashStore) setTombstoneWindow(window time.Duration) {
+	store.tombstoneWindow = window
+}
+
+// millis converts a time to the Unix milliseconds kept in the database.
+func millis(at time.Time) int64 {
+	return at.UnixNano() / int64(time.Millisecond)
+}
+
+// fromMillis converts Unix milliseconds kept in the database back to a time.
+func fromMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// storePassword records the hash right away, available once the given delay is over. It fails without storing
+// anything if the database fails.
+func (store *sqlPasswordHashStore) storePassword(hashed string, id string, ttl time.Duration, delay time.Duration) error {
+	return store.storePasswordContext(context.Background(), hashed, id, ttl, delay)
+}
+
+// storePasswordContext records the hash, bounding the statement to the given context as well.
+func (store *sqlPasswordHashStore) storePasswordContext(ctx context.Context, hashed string, id string, ttl time.Duration, delay time.Duration) error {
+	if ttl <= 0 && store.expiry != nil {
+		ttl = store.expiry.TTL
+	}
+	due := store.now().Add(delay)
+	var expires sql.NullInt64
+	if ttl > 0 {
+		expires = sql.NullInt64{Int64: millis(due.Add(ttl)), Valid: true}
+	}
+	ctx, cancel := store.db.context(ctx)
+	defer cancel()
+	if _, err := store.db.insert.ExecContext(ctx, id, hashed, millis(due), expires); err != nil {
+		store.failed("store", id, err)
+		return err
+	}
+	store.schedulePending(pendingStore{hashed: hashed, id: id, ttl: ttl, due: due})
+	return nil
+}
+
+// schedulePending tells listeners of the hash once due.
+func (store *sqlPasswordHashStore) schedulePending(pending pendingStore) {
+	store.pending.Add(1)
+	store.logger.Printf("Storing for %s...", pending.id)
+	store.scheduler.schedule(pending)
+}
+
+// commitPending tells listeners the hash became available, unless deleted meanwhile.
+func (store *sqlPasswordHashStore) commitPending(pending pendingStore) {
+	defer store.pending.Done()
+	if _, state := store.lookupHash(context.Background(), pending.id); state != hashAvailable {
+		store.logger.Printf("%s cancelled", pending.id)
+		return
+	}
+	for _, listener := range store.listeners {
+		listener(pending.id, pending.hashed)
+	}
+	store.logger.Printf("%s stored", pending.id)
+}
+
+// failed logs and counts a failed statement.
+func (store *sqlPasswordHashStore) failed(action string, id string, err error) {
+	atomic.AddInt64(&store.errorCount, 1)
+	store.logger.Printf("ERROR: Failed to %s %s: %v", action, id, err)
+}
+
+// retrievePassword gets the hash once available, or tells it is pending, expired or deleted.
+func (store *sqlPasswordHashStore) retrievePassword(id string) (string, hashState) {
+	return store.retrievePasswordContext(context.Background(), id)
+}
+
+// retrievePasswordContext gets the hash, bounding the statement to the given context as well.
+func (store *sqlPasswordHashStore) retrievePasswordContext(ctx context.Context, id string) (string, hashState) {
+	store.logger.Printf("Getting for %s", id)
+	return store.lookupHash(ctx, id)
+}
+
+// lookupHash reads the row of the id, telling what state its hash is in as of now.
+func (store *sqlPasswordHashStore) lookupHash(ctx context.Context, id string) (string, hashState) {
+	ctx, cancel := store.db.context(ctx)
+	defer cancel()
+	var hashed string
+	var available int64
+	var expires, deleted sql.NullInt64
+	err := store.db.get.QueryRowContext(ctx, id).Scan(&hashed, &available, &expires, &deleted)
+	if err == sql.ErrNoRows {
+		return "", hashUnknown
+	}
+	if err != nil {
+		store.failed("get", id, err)
+		return "", hashFailed
+	}
+	now := millis(store.now())
+	switch {
+	case deleted.Valid:
+		return "", hashDeleted
+	case available > now:
+		return "", hashPending
+	case expires.Valid && expires.Int64 <= now:
+		return "", hashExpired
+	}
+	return hashed, hashAvailable
+}
+
+// deletePassword removes the hash, whether available or pending, keeping its row to remember the id as deleted.
+// It returns what the store knew about the id beforehand.
+func (store *sqlPasswordHashStore) deletePassword(id string) hashState {
+	return store.deletePasswordContext(context.Background(), id)
+}
+
+// deletePasswordContext removes the hash, bounding the statements to the given context as well.
+func (store *sqlPasswordHashStore) deletePasswordContext(ctx context.Context, id string) hashState {
+	_, state := store.lookupHash(ctx, id)
+	if state != hashAvailable && state != hashPending {
+		return state
+	}
+	ctx, cancel := store.db.context(ctx)
+	defer cancel()
+	result, err := store.db.remove.ExecContext(ctx, millis(store.now()), id)
+	if err == nil {
+		var removed int64
+		if removed, err = result.RowsAffected(); err == nil && removed == 0 {
+			// deleted meanwhile
+			return hashDeleted
+		}
+	}
+	if err != nil {
+		store.failed("delete", id, err)
+		return hashFailed
+	}
+	return state
+}
+
+// waitPendingStores blocks until listeners were told of every pending hash.
+func (store *sqlPasswordHashStore) waitPendingStores() {
+	store.pending.Wait()
+}
+
+// onStored registers a listener for stored hashes. It must be called before any password is stored.
+func (store *sqlPasswordHashStore) onStored(listener storeListener) {
+	store.listeners = append(store.listeners, listener)
+}
+
+// startExpiring starts the janitor, purging rows of expired and deleted ids once they are to be forgotten.
+// Deleted ids are purged even if expiry is not enabled.
+func (store *sqlPasswordHashStore) startExpiring() {
+	interval := defaultExpiryInterval
+	if store.expiry != nil {
+		interval = store.expiry.Interval
+	}
+	store.janitorStop = make(chan bool)
+	store.janitor.Add(1)
+	go func() {
+		defer store.janitor.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				store.purge()
+			case <-store.janitorStop:
+				return
+			}
+		}
+	}()
+}
+
+// stopExpiring stops the janitor, waiting for it to finish.
+func (store *sqlPasswordHashStore) stopExpiring() {
+	if store.janitorStop == nil {
+		return
+	}
+	close(store.janitorStop)
+	store.janitor.Wait()
+	store.janitorStop = nil
+}
+
+// purge deletes the rows of ids past the expiry retention or the tombstone window.
+func (store *sqlPasswordHashStore) purge() {
+	now := store.now()
+	expired := int64(-1 << 63)
+	if store.expiry != nil {
+		expired = millis(now.Add(-store.expiry.Retention))
+	}
+	ctx, cancel := store.db.context(context.Background())
+	defer cancel()
+	result, err := store.db.purge.ExecContext(ctx, expired, millis(now.Add(-store.tombstoneWindow)))
+	var purged int64
+	if err == nil {
+		purged, err = result.RowsAffected()
+	}
+	if err != nil {
+		store.failed("purge", "forgotten ids", err)
+		return
+	}
+	if purged > 0 {
+		atomic.AddInt64(&store.purgedCount, purged)
+		store.logger.Printf("Purged %d forgotten ids", purged)
+	}
+}
+
+// collectStats reports the schema version, the hashes pending and the rows purged, as well as failed statements.
+func (store *sqlPasswordHashStore) collectStats(stats *serverStats) {
+	stats.SQL = &sqlStats{
+		Version: store.db.version,
+		Pending: store.scheduler.pendingCount(),
+		Purged:  atomic.LoadInt64(&store.purgedCount),
+		Errors:  atomic.LoadInt64(&store.errorCount),
+	}
+}
+
+// drainPending deals with the hashes still pending according to the shutdown mode. Their rows are kept,
+// so those abandoned or spooled are pending again on the next start, while flushed ones are made
+// available right away.
+func (store *sqlPasswordHashStore) drainPending(config ShutdownConfig) (shutdownReport, error) {
+	return pendingDrain{
+		logger:    store.logger,
+		scheduler: store.scheduler,
+		pending:   &store.pending,
+		count:     store.scheduler.pendingCount,
+		flush: func(drained []pendingStore) (int, error) {
+			ctx, cancel := store.db.context(context.Background())
+			defer cancel()
+			now := millis(store.now())
+			if _, err := store.db.flush.ExecContext(ctx, now, now); err != nil {
+				store.failed("flush", "pending hashes", err)
+				for range drained {
+					store.pending.Done()
+				}
+				return 0, err
+			}
+			for _, pending := range drained {
+				store.commitPending(pending)
+			}
+			return len(drained), nil
+		},
+		drop: func(pending pendingStore) bool {
+			store.pending.Done()
+			return true
+		},
+		keep: func(config ShutdownConfig, left []pendingStore) error {
+			if len(left) > 0 {
+				store.logger.Printf("%d pending hashes left in the database", len(left))
+			}
+			return nil
+		},
+	}.run(config)
+}
+
+// loadPending schedules the hashes recorded as pending, such as those left by a previous run, so listeners
+// are told once they become available.
+func (store *sqlPasswordHashStore) loadPending() error {
+	ctx, cancel := store.db.context(context.Background())
+	defer cancel()
+	rows, err := store.db.pending.QueryContext(ctx, millis(store.now()))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var reloaded []pendingStore
+	for rows.Next() {
+		var pending pendingStore
+		var available int64
+		var expires sql.NullInt64
+		if err := rows.Scan(&pending.id, &pending.hashed, &available, &expires); err != nil {
+			return err
+		}
+		pending.due = fromMillis(available)
+		reloaded = append(reloaded, pending)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, pending := range reloaded {
+		store.schedulePending(pending)
+	}
+	if len(reloaded) > 0 {
+		store.logger.Printf("Reloaded %d pending hashes from the database", len(reloaded))
+	}
+	return nil
+}
+
+// eachId calls the given function with the id of every row, deleted and expired ones included, such as to move
+// an id generator past every id issued by a previous run.
+func (store *sqlPasswordHashStore) eachId(fn func(id string)) error {
+	ctx, cancel := store.db.context(context.Background())
+	defer cancel()
+	rows, err := store.db.db.QueryContext(ctx, store.db.statement(`SELECT id FROM {hashes}`))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		fn(id)
+	}
+	return rows.Err()
+}
+
+// close closes the database.
+func (store *sqlPasswordHashStore) close() error {
+	return store.db.close()
+}
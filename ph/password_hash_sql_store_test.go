@@ -0,0 +1,223 @@
+package ph
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFakeSQLStore creates a store kept in the fake database of the given name, without any delay.
+func newFakeSQLStore(t *testing.T, buf *bytes.Buffer, name string) (*sqlPasswordHashStore, *fakeSQLDatabase) {
+	db, database := openFakeSQL(t, name)
+	hashDB, err := OpenHashDB(db, SQLConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newSQLPasswordHashStore(log.New(buf, "", 0), hashDB)
+	t.Cleanup(func() { store.close() })
+	return store, database
+}
+
+func Test_sqlPasswordHashStore(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store, database := newFakeSQLStore(t, buf, t.Name())
+	store.setExpiry(ExpiryConfig{TTL: time.Hour})
+	stored := map[string]string{}
+	store.onStored(func(id string, hashed string) { stored[id] = hashed })
+	prepared := len(database.statements())
+
+	store.storePassword("hash-1", "1", 0, 0)
+	store.storePassword("hash-2", "2", 90*time.Second, 0)
+	store.waitPendingStores()
+	if hash, state := store.retrievePassword("1"); hash != "hash-1" || state != hashAvailable {
+		t.Errorf("Expected hash to be stored, got %s %d", hash, state)
+	}
+	if stored["2"] != "hash-2" {
+		t.Errorf("Expected listener to be told of stored hashes, got %v", stored)
+	}
+	row, _ := database.row("password_hashes", "2")
+	if row.expires != row.available+90000 {
+		t.Errorf("Expected hash to expire after its ttl, got %+v", row)
+	}
+
+	if state := store.deletePassword("1"); state != hashAvailable {
+		t.Errorf("Expected stored hash to be deleted, got %d", state)
+	}
+	if _, state := store.retrievePassword("1"); state != hashDeleted {
+		t.Errorf("Expected deleted id to be remembered, got %d", state)
+	}
+	if row, _ := database.row("password_hashes", "1"); row.hash != "" || row.deleted == nil {
+		t.Errorf("Expected deleted row to lose its hash, got %+v", row)
+	}
+	if state := store.deletePassword("1"); state != hashDeleted {
+		t.Errorf("Expected deleting again to tell it is gone, got %d", state)
+	}
+	if state := store.deletePassword("3"); state != hashUnknown {
+		t.Errorf("Expected unknown id, got %d", state)
+	}
+	if _, state := store.retrievePassword("3"); state != hashUnknown {
+		t.Errorf("Expected unknown id, got %d", state)
+	}
+	if err := store.storePassword("hash-2", "2", 0, 0); err == nil {
+		t.Error("Expected storing an id twice to fail")
+	}
+	if len(database.statements()) != prepared {
+		t.Errorf("Expected prepared statements to be reused, got %v", database.statements()[prepared:])
+	}
+
+	stats := &serverStats{}
+	store.collectStats(stats)
+	if stats.SQL == nil || stats.SQL.Version != len(sqlMigrations) || stats.SQL.Pending != 0 || stats.SQL.Errors != 1 {
+		t.Errorf("Unexpected stats: %v", stats.SQL)
+	}
+}
+
+func Test_sqlPasswordHashStoreExpiry(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store, database := newFakeSQLStore(t, buf, t.Name())
+	store.setExpiry(ExpiryConfig{TTL: time.Minute, Retention: time.Hour})
+	store.setTombstoneWindow(time.Minute)
+	store.storePassword("hash-1", "1", 0, 0)
+	store.storePassword("hash-2", "2", 0, 0)
+	store.waitPendingStores()
+	store.deletePassword("2")
+
+	start := time.Now()
+	store.now = func() time.Time { return start.Add(2 * time.Minute) }
+	if _, state := store.retrievePassword("1"); state != hashExpired {
+		t.Errorf("Expected hash to expire, got %d", state)
+	}
+	store.purge()
+	if _, ok := database.row("password_hashes", "1"); !ok {
+		t.Error("Expected expired id to be kept until the retention is over")
+	}
+	if _, ok := database.row("password_hashes", "2"); ok {
+		t.Error("Expected deleted id to be purged after the tombstone window")
+	}
+	store.now = func() time.Time { return start.Add(2 * time.Hour) }
+	store.purge()
+	if _, state := store.retrievePassword("1"); state != hashUnknown {
+		t.Errorf("Expected expired id to be forgotten, got %d", state)
+	}
+	stats := &serverStats{}
+	store.collectStats(stats)
+	if stats.SQL.Purged != 2 {
+		t.Errorf("Unexpected stats: %v", stats.SQL)
+	}
+}
+
+func Test_sqlPasswordHashStorePending(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store, database := newFakeSQLStore(t, buf, t.Name())
+	store.storePassword("hash-1", "1", 0, time.Hour)
+	store.storePassword("hash-2", "2", 0, time.Hour)
+	store.storePassword("hash-3", "3", 0, time.Hour)
+	if _, state := store.retrievePassword("1"); state != hashPending {
+		t.Errorf("Expected hash to be pending, got %d", state)
+	}
+	if state := store.deletePassword("1"); state != hashPending {
+		t.Errorf("Expected pending hash to be cancelled, got %d", state)
+	}
+
+	// pending hashes are left in the database for the next start
+	report, err := store.drainPending(ShutdownConfig{Mode: ShutdownSpool})
+	if err != nil || report.Spooled != 3 {
+		t.Errorf("Expected pending hashes to be left, got %v %v", report, err)
+	}
+	store.close()
+	store, _ = newFakeSQLStore(t, buf, t.Name())
+	stored := map[string]string{}
+	store.onStored(func(id string, hashed string) { stored[id] = hashed })
+	if err := store.loadPending(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Reloaded 2 pending hashes from the database") {
+		t.Errorf("Expected log indicating the reload: %s", buf.String())
+	}
+	if _, state := store.retrievePassword("2"); state != hashPending {
+		t.Errorf("Expected reloaded hash to be pending, got %d", state)
+	}
+	if _, state := store.retrievePassword("1"); state != hashDeleted {
+		t.Errorf("Expected cancelled id to be remembered, got %d", state)
+	}
+
+	report, err = store.drainPending(ShutdownConfig{Mode: ShutdownFlush})
+	if err != nil || report.Flushed != 2 {
+		t.Errorf("Expected reloaded hashes to be flushed, got %v %v", report, err)
+	}
+	if hash, state := store.retrievePassword("3"); hash != "hash-3" || state != hashAvailable {
+		t.Errorf("Expected flushed hash to be available, got %s %d", hash, state)
+	}
+	if stored["2"] != "hash-2" || stored["3"] != "hash-3" || len(stored) != 2 {
+		t.Errorf("Expected listener to be told of flushed hashes, got %v", stored)
+	}
+	if row, _ := database.row("password_hashes", "1"); row.deleted == nil {
+		t.Errorf("Expected cancelled hash to stay deleted, got %+v", row)
+	}
+}
+
+func Test_sqlPasswordHashStoreUnavailable(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store, database := newFakeSQLStore(t, buf, t.Name())
+	database.fail(true)
+	if err := store.storePassword("hash", "1", 0, 0); err == nil {
+		t.Error("Expected store to fail")
+	}
+	if _, state := store.retrievePassword("1"); state != hashFailed {
+		t.Errorf("Expected the store to fail, got %d", state)
+	}
+	if state := store.deletePassword("1"); state != hashFailed {
+		t.Errorf("Expected the store to fail deleting, got %d", state)
+	}
+	if !strings.Contains(buf.String(), "ERROR: Failed to store 1: ") || !strings.Contains(buf.String(), "ERROR: Failed to get 1: ") {
+		t.Errorf("Expected log indicating the failures: %s", buf.String())
+	}
+	w := httptest.NewRecorder()
+	withStore(&PasswordHasherServer{idGen: newSequentialIdGenerator(), phStore: store, logger: log.New(buf, "", 0)}).
+		getHash(w, &http.Request{Method: http.MethodGet, URL: &url.URL{Path: "/hash/1"}})
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected a failing store to be a server error, got %d", w.Code)
+	}
+	stats := &serverStats{}
+	store.collectStats(stats)
+	if stats.SQL.Errors != 4 {
+		t.Errorf("Unexpected stats: %v", stats.SQL)
+	}
+}
+
+func Test_NewPasswordHasherServerWithHashDB(t *testing.T) {
+	buf := &bytes.Buffer{}
+	db, database := openFakeSQL(t, t.Name())
+	hashDB, err := OpenHashDB(db, SQLConfig{Table: "hashes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasher := NewPasswordHasherServer(log.New(buf, "", 0), WithHashDB(hashDB), WithDelay(DelayConfig{}),
+		WithIdStrategy(SequentialIds, 0))
+	defer func() { hasher.phStore.close() }()
+	hasher.phStore.storePassword("hash", hasher.idGen.nextId(), 0, 0)
+	hasher.phStore.waitPendingStores()
+	if hash, _ := hasher.phStore.retrievePassword("1"); hash != "hash" {
+		t.Errorf("Expected hash to be kept in the database, got %s", hash)
+	}
+	if row, ok := database.row("hashes", "1"); !ok || row.hash != "hash" {
+		t.Errorf("Expected hash to be kept in the configured table, got %+v", row)
+	}
+	hasher.phStore.close()
+
+	// ids kept in the database are never issued again after a restart
+	db, _ = openFakeSQL(t, t.Name())
+	hashDB, err = OpenHashDB(db, SQLConfig{Table: "hashes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasher = NewPasswordHasherServer(log.New(buf, "", 0), WithHashDB(hashDB), WithIdStrategy(SequentialIds, 0))
+	if id := hasher.idGen.nextId(); id != "2" {
+		t.Errorf("Expected ids stored to never be issued again, got %s", id)
+	}
+}
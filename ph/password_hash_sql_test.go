@@ -0,0 +1,415 @@
+package ph
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSQLDatabases are the databases of the fake driver, by data source name, kept across connections so a
+// store can be opened again on the same data.
+var fakeSQLDatabases = struct {
+	sync.Mutex
+	byName map[string]*fakeSQLDatabase
+}{byName: make(map[string]*fakeSQLDatabase)}
+
+func init() {
+	sql.Register("phfake", fakeSQLDriver{})
+}
+
+// fakeSQLDriver is a database/sql driver knowing just the statements the store runs, with placeholders of
+// either style, keeping its tables in memory.
+type fakeSQLDriver struct{}
+
+// Open connects to the database of the given name, created empty on first use.
+func (fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	defer fakeSQLDatabases.Unlock()
+	fakeSQLDatabases.Lock()
+	database, ok := fakeSQLDatabases.byName[name]
+	if !ok {
+		database = &fakeSQLDatabase{tables: make(map[string]map[string]*fakeSQLRow)}
+		fakeSQLDatabases.byName[name] = database
+	}
+	return &fakeSQLConn{database: database}, nil
+}
+
+// fakeSQLRow is a row of the fake database, holding either a hash, or a migration in its available column.
+type fakeSQLRow struct {
+	hash      string
+	available int64
+	expires   driver.Value
+	deleted   driver.Value
+}
+
+// fakeSQLDatabase is the state of a fake database, along with every statement prepared on it.
+type fakeSQLDatabase struct {
+	lock     sync.Mutex
+	tables   map[string]map[string]*fakeSQLRow
+	indexes  []string
+	prepared []string
+	failing  bool
+}
+
+// openFakeSQL opens the fake database of the given name, failing the test if it cannot. The database is
+// dropped once the test is over, so running the test again starts from an empty one.
+func openFakeSQL(t *testing.T, name string) (*sql.DB, *fakeSQLDatabase) {
+	db, err := sql.Open("phfake", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		defer fakeSQLDatabases.Unlock()
+		fakeSQLDatabases.Lock()
+		delete(fakeSQLDatabases.byName, name)
+	})
+	defer fakeSQLDatabases.Unlock()
+	fakeSQLDatabases.Lock()
+	return db, fakeSQLDatabases.byName[name]
+}
+
+// fail makes every statement fail from now on, or no longer.
+func (database *fakeSQLDatabase) fail(failing bool) {
+	defer database.lock.Unlock()
+	database.lock.Lock()
+	database.failing = failing
+}
+
+// statements returns every statement prepared so far.
+func (database *fakeSQLDatabase) statements() []string {
+	defer database.lock.Unlock()
+	database.lock.Lock()
+	return append([]string{}, database.prepared...)
+}
+
+// row returns a copy of the row of the id in the given table, if any.
+func (database *fakeSQLDatabase) row(table string, id string) (fakeSQLRow, bool) {
+	defer database.lock.Unlock()
+	database.lock.Lock()
+	row, ok := database.tables[table][id]
+	if !ok {
+		return fakeSQLRow{}, false
+	}
+	return *row, true
+}
+
+// fakeSQLStatements are the statements the fake database knows, {p} standing for a placeholder of either style.
+var fakeSQLStatements = func() map[string]*regexp.Regexp {
+	statements := map[string]string{
+		"create migrations": `CREATE TABLE IF NOT EXISTS (\w+) \(version INTEGER NOT NULL PRIMARY KEY, applied_at BIGINT NOT NULL\)`,
+		"latest migration":  `SELECT MAX\(version\) FROM (\w+)`,
+		"record migration":  `INSERT INTO (\w+) \(version, applied_at\) VALUES \({p}, {p}\)`,
+		"create hashes":     `CREATE TABLE (\w+) \(id VARCHAR\(64\) NOT NULL PRIMARY KEY, hash VARCHAR\(512\) NOT NULL, available_at BIGINT NOT NULL, expires_at BIGINT, deleted_at BIGINT\)`,
+		"create index":      `CREATE INDEX (\w+)_available_at ON (\w+) \(available_at\)`,
+		"insert":            `INSERT INTO (\w+) \(id, hash, available_at, expires_at\) VALUES \({p}, {p}, {p}, {p}\)`,
+		"get":               `SELECT hash, available_at, expires_at, deleted_at FROM (\w+) WHERE id = {p}`,
+		"remove":            `UPDATE (\w+) SET hash = '', deleted_at = {p} WHERE id = {p} AND deleted_at IS NULL`,
+		"flush":             `UPDATE (\w+) SET available_at = {p} WHERE available_at > {p} AND deleted_at IS NULL`,
+		"pending":           `SELECT id, hash, available_at, expires_at FROM (\w+) WHERE available_at > {p} AND deleted_at IS NULL`,
+		"purge":             `DELETE FROM (\w+) WHERE expires_at <= {p} OR deleted_at <= {p}`,
+		"ids":               `SELECT id FROM (\w+)`,
+	}
+	compiled := make(map[string]*regexp.Regexp)
+	for name, statement := range statements {
+		compiled[name] = regexp.MustCompile("^" + strings.Replace(statement, "{p}", `(?:\?|\$\d+)`, -1) + "$")
+	}
+	return compiled
+}()
+
+// fakeSQLConn is a connection to a fake database.
+type fakeSQLConn struct {
+	database *fakeSQLDatabase
+}
+
+// Prepare recognizes the statement, refusing any the store does not run.
+func (conn *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	for name, statement := range fakeSQLStatements {
+		if match := statement.FindStringSubmatch(query); match != nil {
+			conn.database.lock.Lock()
+			conn.database.prepared = append(conn.database.prepared, query)
+			conn.database.lock.Unlock()
+			return &fakeSQLStmt{database: conn.database, name: name, table: match[len(match)-1]}, nil
+		}
+	}
+	return nil, fmt.Errorf("fake: unknown statement %q", query)
+}
+
+// Close does nothing, the database being kept for the next connection.
+func (conn *fakeSQLConn) Close() error {
+	return nil
+}
+
+// Begin starts a transaction, which does not isolate anything, but runs statements all the same.
+func (conn *fakeSQLConn) Begin() (driver.Tx, error) {
+	return fakeSQLTx{}, nil
+}
+
+// fakeSQLTx is a transaction of a fake database.
+type fakeSQLTx struct{}
+
+func (fakeSQLTx) Commit() error   { return nil }
+func (fakeSQLTx) Rollback() error { return nil }
+
+// fakeSQLStmt is a statement of a fake database, running on the table it names last.
+type fakeSQLStmt struct {
+	database *fakeSQLDatabase
+	name     string
+	table    string
+}
+
+func (stmt *fakeSQLStmt) Close() error  { return nil }
+func (stmt *fakeSQLStmt) NumInput() int { return -1 }
+
+// Exec runs a statement changing the database, returning how many rows it affected.
+func (stmt *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	defer stmt.database.lock.Unlock()
+	stmt.database.lock.Lock()
+	if stmt.database.failing {
+		return nil, errors.New("fake: database unavailable")
+	}
+	table, exists := stmt.database.tables[stmt.table]
+	if !exists && !strings.HasPrefix(stmt.name, "create") {
+		return nil, fmt.Errorf("fake: no table %s", stmt.table)
+	}
+	affected := int64(0)
+	switch stmt.name {
+	case "create migrations":
+		if !exists {
+			stmt.database.tables[stmt.table] = make(map[string]*fakeSQLRow)
+		}
+	case "create hashes":
+		if exists {
+			return nil, fmt.Errorf("fake: table %s exists", stmt.table)
+		}
+		stmt.database.tables[stmt.table] = make(map[string]*fakeSQLRow)
+	case "create index":
+		if !exists {
+			return nil, fmt.Errorf("fake: no table %s", stmt.table)
+		}
+		stmt.database.indexes = append(stmt.database.indexes, stmt.table+"_available_at")
+	case "record migration", "insert":
+		id := fmt.Sprint(args[0])
+		if _, ok := table[id]; ok {
+			return nil, fmt.Errorf("fake: duplicate key %s", id)
+		}
+		if stmt.name == "insert" {
+			table[id] = &fakeSQLRow{hash: args[1].(string), available: args[2].(int64), expires: args[3]}
+		} else {
+			table[id] = &fakeSQLRow{available: args[1].(int64)}
+		}
+		affected = 1
+	case "remove":
+		if row, ok := table[args[1].(string)]; ok && row.deleted == nil {
+			row.hash, row.deleted = "", args[0]
+			affected = 1
+		}
+	case "flush":
+		for _, row := range table {
+			if row.available > args[1].(int64) && row.deleted == nil {
+				row.available = args[0].(int64)
+				affected++
+			}
+		}
+	case "purge":
+		for id, row := range table {
+			if row.expires != nil && row.expires.(int64) <= args[0].(int64) ||
+				row.deleted != nil && row.deleted.(int64) <= args[1].(int64) {
+				delete(table, id)
+				affected++
+			}
+		}
+	default:
+		return nil, fmt.Errorf("fake: %s is a query", stmt.name)
+	}
+	return driver.RowsAffected(affected), nil
+}
+
+// Query runs a statement reading the database, returning the rows read.
+func (stmt *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	defer stmt.database.lock.Unlock()
+	stmt.database.lock.Lock()
+	if stmt.database.failing {
+		return nil, errors.New("fake: database unavailable")
+	}
+	table, exists := stmt.database.tables[stmt.table]
+	if !exists {
+		return nil, fmt.Errorf("fake: no table %s", stmt.table)
+	}
+	rows := &fakeSQLRows{}
+	switch stmt.name {
+	case "latest migration":
+		var latest driver.Value
+		for version := range table {
+			var v int64
+			fmt.Sscan(version, &v)
+			if latest == nil || v > latest.(int64) {
+				latest = v
+			}
+		}
+		rows.values = [][]driver.Value{{latest}}
+	case "get":
+		if row, ok := table[args[0].(string)]; ok {
+			rows.values = [][]driver.Value{{row.hash, row.available, row.expires, row.deleted}}
+		}
+	case "pending":
+		for id, row := range table {
+			if row.available > args[0].(int64) && row.deleted == nil {
+				rows.values = append(rows.values, []driver.Value{id, row.hash, row.available, row.expires})
+			}
+		}
+	case "ids":
+		for id := range table {
+			rows.values = append(rows.values, []driver.Value{id})
+		}
+	default:
+		return nil, fmt.Errorf("fake: %s is not a query", stmt.name)
+	}
+	return rows, nil
+}
+
+// fakeSQLRows are the rows read by a query.
+type fakeSQLRows struct {
+	values [][]driver.Value
+}
+
+func (rows *fakeSQLRows) Columns() []string {
+	if len(rows.values) == 0 {
+		return nil
+	}
+	return make([]string, len(rows.values[0]))
+}
+
+func (rows *fakeSQLRows) Close() error { return nil }
+
+func (rows *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(rows.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, rows.values[0])
+	rows.values = rows.values[1:]
+	return nil
+}
+
+func Test_OpenHashDB(t *testing.T) {
+	db, database := openFakeSQL(t, t.Name())
+	hashDB, err := OpenHashDB(db, SQLConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashDB.version != len(sqlMigrations) {
+		t.Errorf("Expected schema version %d, got %d", len(sqlMigrations), hashDB.version)
+	}
+	for version := 1; version <= len(sqlMigrations); version++ {
+		if _, ok := database.row("password_hash_migrations", fmt.Sprint(version)); !ok {
+			t.Errorf("Expected migration %d to be recorded", version)
+		}
+	}
+	if len(database.indexes) != 1 || database.indexes[0] != "password_hashes_available_at" {
+		t.Errorf("Unexpected indexes: %v", database.indexes)
+	}
+	hashDB.close()
+
+	// opening again applies nothing, the schema being up to date
+	db, database = openFakeSQL(t, t.Name())
+	prepared := len(database.statements())
+	hashDB, err = OpenHashDB(db, SQLConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashDB.close()
+	for _, statement := range database.statements()[prepared:] {
+		if strings.HasPrefix(statement, "CREATE TABLE password_hashes") || strings.HasPrefix(statement, "CREATE INDEX") {
+			t.Errorf("Expected migrations not to be applied again, got %q", statement)
+		}
+	}
+	if hashDB.version != len(sqlMigrations) {
+		t.Errorf("Expected schema version %d, got %d", len(sqlMigrations), hashDB.version)
+	}
+}
+
+func Test_OpenHashDB_config(t *testing.T) {
+	db, database := openFakeSQL(t, t.Name())
+	hashDB, err := OpenHashDB(db, SQLConfig{Table: "hashes", MigrationsTable: "hash_versions", NumberedParams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashDB.close()
+	if _, ok := database.row("hash_versions", "1"); !ok {
+		t.Error("Expected migrations to be recorded in the configured table")
+	}
+	numbered := false
+	for _, statement := range database.statements() {
+		if strings.Contains(statement, "password_hash") {
+			t.Errorf("Expected configured tables only, got %q", statement)
+		}
+		if strings.Contains(statement, "?") {
+			t.Errorf("Expected numbered parameters, got %q", statement)
+		}
+		numbered = numbered || strings.Contains(statement, "VALUES ($1, $2, $3, $4)")
+	}
+	if !numbered {
+		t.Errorf("Expected numbered parameters in %v", database.statements())
+	}
+
+	for _, table := range []string{"hashes; DROP TABLE users", "1hashes", ""} {
+		config := SQLConfig{Table: "hashes", MigrationsTable: table}
+		if table == "" {
+			config = SQLConfig{Table: strings.Repeat("h", 64)}
+		}
+		if _, err := OpenHashDB(db, config); err == nil || !strings.Contains(err.Error(), "invalid table name") {
+			t.Errorf("Expected %+v to be refused, got %v", config, err)
+		}
+	}
+}
+
+func Test_OpenHashDB_tables(t *testing.T) {
+	db, database := openFakeSQL(t, t.Name())
+	for _, table := range []string{"", "hashes"} {
+		hashDB, err := OpenHashDB(db, SQLConfig{Table: table})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hashDB.version != len(sqlMigrations) {
+			t.Errorf("Expected schema version %d, got %d", len(sqlMigrations), hashDB.version)
+		}
+		hashDB.closeStatements()
+	}
+	// each table of hashes has its migrations recorded apart
+	if _, ok := database.row("hashes_migrations", "1"); !ok {
+		t.Error("Expected migrations of another table to be recorded apart")
+	}
+	database.lock.Lock()
+	_, created := database.tables["hashes"]
+	database.lock.Unlock()
+	if !created {
+		t.Errorf("Expected another table of hashes to be created, got %v", database.statements())
+	}
+}
+
+func Test_OpenHashDB_newer(t *testing.T) {
+	db, database := openFakeSQL(t, t.Name())
+	hashDB, err := OpenHashDB(db, SQLConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.lock.Lock()
+	database.tables["password_hash_migrations"]["99"] = &fakeSQLRow{}
+	database.lock.Unlock()
+	if _, err := OpenHashDB(db, SQLConfig{}); err == nil || !strings.Contains(err.Error(), "schema version 99") {
+		t.Errorf("Expected newer schema to be refused, got %v", err)
+	}
+	database.fail(true)
+	if _, err := OpenHashDB(db, SQLConfig{}); err == nil {
+		t.Error("Expected failing database to be refused")
+	}
+	hashDB.close()
+}
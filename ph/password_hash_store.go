@@ -1,6 +1,7 @@
 package ph
 
 import (
+	"container/list"
 	"log"
 	"sync"
 	"time"
@@ -8,71 +9,308 @@ import (
 
 // passwordHashStorer is the minimal interface for storing hashes.
 type passwordHashStorer interface {
-	storePassword(hashed string, id int64)
-	retrievePassword(id int64) string
+	storePassword(hashed string, id string, ttl time.Duration, delay time.Duration) error
+	retrievePassword(id string) (string, hashState)
+	deletePassword(id string) hashState
 	waitPendingStores()
+	onStored(listener storeListener)
+	startExpiring()
+	stopExpiring()
+	collectStats(stats *serverStats)
+	drainPending(config ShutdownConfig) (shutdownReport, error)
+	close() error
 }
 
-var hashDelay = 5 * time.Second
+// configurableStore is an in-memory store, which the server configures before storing anything.
+type configurableStore interface {
+	passwordHashStorer
+	setExpiry(config ExpiryConfig)
+	setCapacity(config CapacityConfig)
+	setTombstoneWindow(window time.Duration)
+	setCompactDigests()
+	loadSpool(path string) error
+	holdPending()
+	resumePending()
+}
+
+// hashState tells what a store knows about an id.
+type hashState int
+
+const (
+	// hashUnknown means the id was never stored, or is still pending.
+	hashUnknown hashState = iota
+	// hashAvailable means the hash is stored.
+	hashAvailable
+	// hashExpired means the hash was stored, but its time-to-live has passed.
+	hashExpired
+	// hashPending means the hash is waiting out its delay before being stored.
+	hashPending
+	// hashDeleted means the hash was deleted, whether it was stored or still pending.
+	hashDeleted
+	// hashFailed means the store could not tell, its backend failing.
+	hashFailed
+)
+
+// storeListener is called once a password hash becomes available by its id.
+type storeListener func(id string, hashed string)
 
-// passwordHashStore is an in-memory delayed storage of hashed passwords.
-// FIXME: There's currently no strategy to rotate or purge the password hashes.
-//        Not only this is an issue due to the amount of memory used, but sequential IDs are easily guessable. The hash
-//        even though "secure" (no known issues with SHA-512), length extension and table matching are still possible.
+// removalListener is called once a stored hash is removed other than by its deletion, as of the given time:
+// either evicted from a full store, its id then unknown, or expired after its time-to-live.
+type removalListener func(id string, state hashState, at time.Time)
+
+// removedHash is a hash removed while the write lock was held, until the removal listeners are told about it.
+type removedHash struct {
+	id    string
+	state hashState
+	at    time.Time
+}
+
+// passwordHashStore is an in-memory delayed storage of hashed passwords, which may expire after a time-to-live.
+// FIXME: Without a time-to-live, the password hashes are kept forever, which is an issue due to the amount of memory
+// used. The hash even though "secure" (no known issues with SHA-512), length extension and table matching are
+// still possible.
 type passwordHashStore struct {
-	hashes  map[int64]string
-	lock    sync.RWMutex
-	pending sync.WaitGroup
-	logger  *log.Logger
-	delay   time.Duration
+	expiredCount  int64
+	evictedCount  int64
+	rejectedCount int64
+	hashes        hashTable
+	lock          sync.RWMutex
+	pending       sync.WaitGroup
+	listeners     []storeListener
+	logger        *log.Logger
+	now           func() time.Time
+	scheduler     *delayScheduler
+
+	// evicted and expired hashes, buffered while the write lock is held, for listeners only
+	removalListeners []removalListener
+	removed          []removedHash
+
+	// pending hashes, so they can be cancelled before being stored
+	pendingHashes map[string]pendingStore
+	cancelled     map[string]bool
+	// pending hashes restored while wiring the store, held back until every listener is registered
+	held    []pendingStore
+	holding bool
+
+	// expiry of hashes, only tracked for those with a time-to-live
+	expiry      *ExpiryConfig
+	expiresAt   map[string]time.Time
+	expiring    expiryQueue
+	janitor     sync.WaitGroup
+	janitorStop chan bool
+
+	// expired and deleted ids, remembered as such until forgotten
+	gone            map[string]hashState
+	forgetting      expiryQueue
+	expiredIds      int64
+	tombstones      int64
+	tombstoneWindow time.Duration
+
+	// capacity bounds, only tracked if any, evicting from the back of the LRU list
+	capacity        *CapacityConfig
+	usedBytes       int64
+	reservedRecords int64
+	reservedBytes   int64
+	lru             *list.List
+	lruIndex        map[string]*list.Element
+	lruLock         sync.Mutex
 }
 
 // newPasswordHashStore creates a new store.
-func newPasswordHashStore(logger *log.Logger, delay time.Duration) *passwordHashStore {
-	return &passwordHashStore{
-		hashes: make(map[int64]string),
-		logger: logger,
-		delay:  delay,
+func newPasswordHashStore(logger *log.Logger) *passwordHashStore {
+	store := &passwordHashStore{
+		hashes:          newMapHashTable(),
+		logger:          logger,
+		now:             time.Now,
+		pendingHashes:   make(map[string]pendingStore),
+		cancelled:       make(map[string]bool),
+		expiresAt:       make(map[string]time.Time),
+		gone:            make(map[string]hashState),
+		tombstoneWindow: defaultTombstoneWindow,
 	}
+	store.scheduler = newDelayScheduler(store.commitPending)
+	return store
 }
 
-// delayStore actually stores the password hash tied to its id after a 5-second delay.
-func (store *passwordHashStore) delayStore(hashed string, id int64) {
-	store.logger.Printf("Storing for %d...", id)
-
-	// mark storage as pending and impose delay
-	store.pending.Add(1)
-	time.Sleep(store.delay)
+// commitPending actually stores the password hash tied to its id once its delay is over, unless deleted meanwhile.
+// The hash expires after the given time-to-live, or the store's default if zero.
+func (store *passwordHashStore) commitPending(pending pendingStore) {
+	id, hashed := pending.id, pending.hashed
 
 	// block for concurrent writes
-	defer store.lock.Unlock()
 	store.lock.Lock()
-	store.hashes[id] = hashed
+	delete(store.pendingHashes, id)
+	if store.cancelled[id] {
+		delete(store.cancelled, id)
+		store.releaseCapacity(id, hashed)
+		store.lock.Unlock()
+		store.pending.Done()
+		store.logger.Printf("%s cancelled", id)
+		return
+	}
+	store.hashes.set(id, hashed)
+	store.scheduleExpiry(id, store.now(), pending.ttl)
+	store.trackCapacity(id, hashed)
+	store.lock.Unlock()
+	store.notifyRemoved()
+
+	// listeners run before completion, so waiting for pending stores also waits for them
+	for _, listener := range store.listeners {
+		listener(id, hashed)
+	}
 
 	// mark storage as completed
 	store.pending.Done()
-	store.logger.Printf("%d stored", id)
+	store.logger.Printf("%s stored", id)
+}
+
+// storePassword imposes the given delay, making the given password hash available by its id after that.
+// It fails without storing anything if the store is bounded, full, and not allowed to evict, or if the id is
+// already known.
+func (store *passwordHashStore) storePassword(hashed string, id string, ttl time.Duration, delay time.Duration) error {
+	if err := store.refuseKnown(id); err != nil {
+		return err
+	}
+	if err := store.reserveCapacity(id, hashed); err != nil {
+		store.logger.Printf("No room to store for %s", id)
+		return err
+	}
+	store.schedulePending(hashed, id, ttl, delay)
+	return nil
+}
+
+// refuseKnown fails with ErrExists for an id stored, pending, expired or deleted, so whatever the store holds
+// for it is never overwritten by another hash issued the same id.
+func (store *passwordHashStore) refuseKnown(id string) error {
+	if store.knows(id) {
+		store.logger.Printf("ERROR: Id %s already known", id)
+		return ErrExists
+	}
+	return nil
 }
 
-// storePassword imposes a 5-second delay, making the given password hash available by its id after that.
-// FIXME: This implementation relies on the goroutine callstack as storage for the hash and id.
-//        If this feels too implied, maybe use a channel instead?
-func (store *passwordHashStore) storePassword(hashed string, id int64) {
-	go store.delayStore(hashed, id)
+// schedulePending marks the id as pending and stores its hash once the delay is over.
+func (store *passwordHashStore) schedulePending(hashed string, id string, ttl time.Duration, delay time.Duration) {
+	store.schedulePendingAt(hashed, id, ttl, time.Now().Add(delay))
 }
 
-// retrievePassword will attempt to find a stored password hash, returning empty if not found.
-func (store *passwordHashStore) retrievePassword(id int64) string {
-	store.logger.Printf("Getting for %d", id)
+// schedulePendingAt marks the id as pending and stores its hash once due.
+func (store *passwordHashStore) schedulePendingAt(hashed string, id string, ttl time.Duration, due time.Time) {
+	pending := pendingStore{hashed: hashed, id: id, ttl: ttl, due: due}
+	store.lock.Lock()
+	store.pendingHashes[id] = pending
+	holding := store.holding
+	if holding {
+		store.held = append(store.held, pending)
+	}
+	store.lock.Unlock()
 
+	// mark storage as pending and impose delay
+	store.pending.Add(1)
+	store.logger.Printf("Storing for %s...", id)
+	if !holding {
+		store.scheduler.schedule(pending)
+	}
+}
+
+// holdPending holds back the pending hashes scheduled from now on, such as those restored from a log or spool,
+// so none is stored, even if overdue, before every listener is registered.
+func (store *passwordHashStore) holdPending() {
+	defer store.lock.Unlock()
+	store.lock.Lock()
+	store.holding = true
+}
+
+// resumePending schedules the pending hashes held back, and those scheduled from now on.
+func (store *passwordHashStore) resumePending() {
+	store.lock.Lock()
+	held := store.held
+	store.held, store.holding = nil, false
+	store.lock.Unlock()
+	for _, pending := range held {
+		store.scheduler.schedule(pending)
+	}
+}
+
+// retrievePassword will attempt to find a stored password hash, returning empty if not found, expired or deleted.
+// Hashes past their time-to-live are reported as expired even before the janitor gets to remove them.
+func (store *passwordHashStore) retrievePassword(id string) (string, hashState) {
+	store.logger.Printf("Getting for %s", id)
+	password, state := store.lookupHash(id)
+	switch state {
+	case hashExpired:
+		store.logger.Printf("Password hash for %s expired", id)
+	case hashDeleted:
+		store.logger.Printf("Password hash for %s deleted", id)
+	case hashPending:
+		store.logger.Printf("Password hash for %s pending", id)
+	case hashUnknown:
+		store.logger.Printf("No password hash for %s", id)
+	}
+	return password, state
+}
+
+// lookupHash finds the stored password hash, or what is known about its id otherwise, without logging
+// so the read lock is held as briefly as possible.
+func (store *passwordHashStore) lookupHash(id string) (string, hashState) {
 	// blocks if storage is being writen to, but fast(er) for concurrent reads
 	defer store.lock.RUnlock()
 	store.lock.RLock()
-	if password, ok := store.hashes[id]; ok {
-		return password
+	if password, ok := store.hashes.get(id); ok {
+		if at, expiring := store.expiresAt[id]; !expiring || store.now().Before(at) {
+			store.touchHash(id)
+			return password, hashAvailable
+		}
+		return "", hashExpired
+	} else if gone, ok := store.gone[id]; ok {
+		return "", gone
+	} else if _, pending := store.pendingHashes[id]; pending && !store.cancelled[id] {
+		return "", hashPending
+	}
+	return "", hashUnknown
+}
+
+// removeHash forgets a stored hash and everything tracked about it. Must be called with the write lock held.
+func (store *passwordHashStore) removeHash(id string) {
+	if hashed, ok := store.hashes.get(id); ok {
+		store.untrackCapacity(id, hashed)
+		store.hashes.remove(id)
+		delete(store.expiresAt, id)
+	}
+}
+
+// onStored registers a listener for stored hashes. It must be called before any password is stored.
+func (store *passwordHashStore) onStored(listener storeListener) {
+	store.listeners = append(store.listeners, listener)
+}
+
+// onRemoved registers a listener for evicted and expired hashes. It must be called before any password is stored.
+func (store *passwordHashStore) onRemoved(listener removalListener) {
+	store.removalListeners = append(store.removalListeners, listener)
+}
+
+// noteRemoved buffers an evicted or expired hash for the removal listeners, if any.
+// Must be called with the write lock held.
+func (store *passwordHashStore) noteRemoved(id string, state hashState, at time.Time) {
+	if len(store.removalListeners) > 0 {
+		store.removed = append(store.removed, removedHash{id, state, at})
+	}
+}
+
+// notifyRemoved passes the hashes removed meanwhile to the removal listeners, once the write lock is released.
+func (store *passwordHashStore) notifyRemoved() {
+	if len(store.removalListeners) == 0 {
+		return
+	}
+	store.lock.Lock()
+	removed := store.removed
+	store.removed = nil
+	store.lock.Unlock()
+	for _, hash := range removed {
+		for _, listener := range store.removalListeners {
+			listener(hash.id, hash.state, hash.at)
+		}
 	}
-	store.logger.Printf("No password hash for %d", id)
-	return ""
 }
 
 // waitPendingStores should be called from a consumer of this store to ensure no pending writes exist.
@@ -80,3 +318,31 @@ func (store *passwordHashStore) waitPendingStores() {
 	store.pending.Wait()
 	store.logger.Print("No more pending stores")
 }
+
+// close releases anything held by the store, which has nothing to release while in memory only.
+func (store *passwordHashStore) close() error {
+	return nil
+}
+
+// storeStats are the hashes held by an in-memory store, as reported by the stats endpoint.
+type storeStats struct {
+	Records int64 `json:"records"`
+	Pending int64 `json:"pending"`
+}
+
+// storeStats returns how many hashes are stored, and how many are still waiting out their delay.
+func (store *passwordHashStore) storeStats() *storeStats {
+	defer store.lock.RUnlock()
+	store.lock.RLock()
+	return &storeStats{
+		Records: int64(store.hashes.count()),
+		Pending: int64(len(store.pendingHashes) - len(store.cancelled)),
+	}
+}
+
+// collectStats adds the store's own stats to the given ones.
+func (store *passwordHashStore) collectStats(stats *serverStats) {
+	stats.Store = store.storeStats()
+	stats.Expiry = store.expiryStats()
+	stats.Capacity = store.capacityStats()
+}
@@ -0,0 +1,340 @@
+package ph
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Errors returned by a Store for ids it has no hash to return for.
+var (
+	// ErrNotFound is returned for ids never stored, or forgotten since.
+	ErrNotFound = errors.New("hash not found")
+	// ErrPending is returned for hashes still waiting out their delay.
+	ErrPending = errors.New("hash pending")
+	// ErrExpired is returned for hashes past their time-to-live.
+	ErrExpired = errors.New("hash expired")
+	// ErrDeleted is returned for hashes deleted, by stores remembering deleted ids.
+	ErrDeleted = errors.New("hash deleted")
+	// ErrExists is returned by Put for ids already known, whose hash is never overwritten.
+	ErrExists = errors.New("hash id already exists")
+)
+
+// externalRecheckDelay is how long to wait before checking again whether a Store made a hash available.
+const externalRecheckDelay = 10 * time.Millisecond
+
+// errStoreFailed is returned for ids a store of the service could not tell anything about, its backend failing.
+var errStoreFailed = errors.New("store failed")
+
+// PutOptions tell how long a hash waits before becoming available, and how long it is kept once available,
+// or the store's default, if any, when zero.
+type PutOptions struct {
+	Delay time.Duration
+	TTL   time.Duration
+}
+
+// Store keeps password hashes by id, as the service does in memory or in any backend given WithStore.
+// Every method may be called concurrently, and fails with the error of the context if done.
+//
+// Put stores a hash, which becomes available once its delay is over, and until its time-to-live is over.
+// It fails with ErrExists for an id the store already knows, rather than overwriting what it holds.
+// Get returns an available hash, or fails with ErrPending, ErrExpired, ErrDeleted or ErrNotFound, which
+// stores not remembering deleted or expired ids may return instead of ErrDeleted and ErrExpired.
+// Delete removes a hash, whether available or pending, or fails like Get for any other id.
+// Close releases the store, after which no other method is called. Other errors tell the backend failed.
+type Store interface {
+	Put(ctx context.Context, id string, hashed string, options PutOptions) error
+	Get(ctx context.Context, id string) (string, error)
+	Delete(ctx context.Context, id string) error
+	Close() error
+}
+
+// storeError returns the error a Store fails with for an id in the given state, if any.
+func storeError(state hashState) error {
+	switch state {
+	case hashAvailable:
+		return nil
+	case hashPending:
+		return ErrPending
+	case hashExpired:
+		return ErrExpired
+	case hashDeleted:
+		return ErrDeleted
+	case hashFailed:
+		return errStoreFailed
+	}
+	return ErrNotFound
+}
+
+// storeState returns the state of an id a Store failed with the given error for, telling whether it is one.
+func storeState(err error) (hashState, bool) {
+	switch {
+	case err == nil:
+		return hashAvailable, true
+	case errors.Is(err, ErrPending):
+		return hashPending, true
+	case errors.Is(err, ErrExpired):
+		return hashExpired, true
+	case errors.Is(err, ErrDeleted):
+		return hashDeleted, true
+	case errors.Is(err, ErrNotFound):
+		return hashUnknown, true
+	}
+	return hashFailed, false
+}
+
+// contextStorer is a store whose backend takes the context of each request, so requests cancelled or past
+// their deadline stop waiting on it.
+type contextStorer interface {
+	storePasswordContext(ctx context.Context, hashed string, id string, ttl time.Duration, delay time.Duration) error
+	retrievePasswordContext(ctx context.Context, id string) (string, hashState)
+	deletePasswordContext(ctx context.Context, id string) hashState
+}
+
+// storeWithContext stores the hash, handing the context to the store if it takes one.
+func storeWithContext(ctx context.Context, storer passwordHashStorer, hashed string, id string, ttl time.Duration, delay time.Duration) error {
+	if storer, ok := storer.(contextStorer); ok {
+		return storer.storePasswordContext(ctx, hashed, id, ttl, delay)
+	}
+	return storer.storePassword(hashed, id, ttl, delay)
+}
+
+// retrieveWithContext gets the hash, handing the context to the store if it takes one.
+func retrieveWithContext(ctx context.Context, storer passwordHashStorer, id string) (string, hashState) {
+	if storer, ok := storer.(contextStorer); ok {
+		return storer.retrievePasswordContext(ctx, id)
+	}
+	return storer.retrievePassword(id)
+}
+
+// deleteWithContext removes the hash, handing the context to the store if it takes one.
+func deleteWithContext(ctx context.Context, storer passwordHashStorer, id string) hashState {
+	if storer, ok := storer.(contextStorer); ok {
+		return storer.deletePasswordContext(ctx, id)
+	}
+	return storer.deletePassword(id)
+}
+
+// storeAdapter exposes a store of the service as a Store, storing hashes with the delay given as is.
+// The context is handed to stores taking one, and failures once it is done are reported as its error.
+type storeAdapter struct {
+	storer passwordHashStorer
+}
+
+// Put stores the hash, unless the context is done.
+func (adapter storeAdapter) Put(ctx context.Context, id string, hashed string, options PutOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := storeWithContext(ctx, adapter.storer, hashed, id, options.TTL, options.Delay)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Get returns the hash, unless the context is done.
+func (adapter storeAdapter) Get(ctx context.Context, id string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	hashed, state := retrieveWithContext(ctx, adapter.storer, id)
+	if state == hashFailed && ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	return hashed, storeError(state)
+}
+
+// Delete removes the hash, unless the context is done.
+func (adapter storeAdapter) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	switch state := deleteWithContext(ctx, adapter.storer, id); state {
+	case hashAvailable, hashPending:
+		return nil
+	case hashFailed:
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return storeError(state)
+	default:
+		return storeError(state)
+	}
+}
+
+// Close closes the store.
+func (adapter storeAdapter) Close() error {
+	return adapter.storer.close()
+}
+
+// memoryStore is the in-memory store of the service as a Store, expiring hashes until closed.
+type memoryStore struct {
+	storeAdapter
+	store *passwordHashStore
+}
+
+// NewMemoryStore creates a Store keeping hashes in memory, as the service does by default. Deleted ids are
+// remembered for a day, and expired ones until the janitor removes them, every minute.
+func NewMemoryStore(logger *log.Logger) Store {
+	store := newPasswordHashStore(logger)
+	store.setExpiry(ExpiryConfig{})
+	store.startExpiring()
+	return memoryStore{storeAdapter{store}, store}
+}
+
+// Close stops expiring hashes, then closes the store.
+func (store memoryStore) Close() error {
+	store.store.stopExpiring()
+	return store.storeAdapter.Close()
+}
+
+// externalStats are the counts of a store given WithStore, as reported by the stats endpoint.
+type externalStats struct {
+	Pending int   `json:"pending"`
+	Errors  int64 `json:"errors"`
+}
+
+// externalPasswordHashStore keeps hashes in a Store given WithStore, handing it the delay chosen for each hash,
+// and telling listeners of hashes once their delay is over. The Store expires hashes and remembers deleted ids
+// on its own, if at all, and gets the context of the request it serves, if any.
+type externalPasswordHashStore struct {
+	store      Store
+	logger     *log.Logger
+	scheduler  *delayScheduler
+	pending    sync.WaitGroup
+	listeners  []storeListener
+	errorCount int64
+}
+
+// newExternalPasswordHashStore creates a store kept in the given Store.
+func newExternalPasswordHashStore(logger *log.Logger, store Store) *externalPasswordHashStore {
+	external := &externalPasswordHashStore{store: store, logger: logger}
+	external.scheduler = newDelayScheduler(external.commitPending)
+	return external
+}
+
+// storePassword hands the hash to the Store along with its delay.
+func (store *externalPasswordHashStore) storePassword(hashed string, id string, ttl time.Duration, delay time.Duration) error {
+	return store.storePasswordContext(context.Background(), hashed, id, ttl, delay)
+}
+
+// storePasswordContext hands the hash to the Store with the given context.
+func (store *externalPasswordHashStore) storePasswordContext(ctx context.Context, hashed string, id string, ttl time.Duration, delay time.Duration) error {
+	if err := store.store.Put(ctx, id, hashed, PutOptions{Delay: delay, TTL: ttl}); err != nil {
+		store.failed("store", id, err)
+		return err
+	}
+	store.pending.Add(1)
+	store.logger.Printf("Storing for %s...", id)
+	store.scheduler.schedule(pendingStore{hashed: hashed, id: id, ttl: ttl, due: time.Now().Add(delay)})
+	return nil
+}
+
+// commitPending tells listeners the hash became available, unless deleted meanwhile. Hashes the Store has
+// not made available yet, its own clock running behind, are checked again shortly after.
+func (store *externalPasswordHashStore) commitPending(pending pendingStore) {
+	_, state := store.retrievePassword(pending.id)
+	if state == hashPending {
+		pending.due = time.Now().Add(externalRecheckDelay)
+		store.scheduler.schedule(pending)
+		return
+	}
+	defer store.pending.Done()
+	if state != hashAvailable {
+		store.logger.Printf("%s cancelled", pending.id)
+		return
+	}
+	for _, listener := range store.listeners {
+		listener(pending.id, pending.hashed)
+	}
+	store.logger.Printf("%s stored", pending.id)
+}
+
+// failed logs and counts a failure of the Store.
+func (store *externalPasswordHashStore) failed(action string, id string, err error) {
+	atomic.AddInt64(&store.errorCount, 1)
+	store.logger.Printf("ERROR: Failed to %s %s: %v", action, id, err)
+}
+
+// retrievePassword gets the hash from the Store, or tells it failed.
+func (store *externalPasswordHashStore) retrievePassword(id string) (string, hashState) {
+	return store.retrievePasswordContext(context.Background(), id)
+}
+
+// retrievePasswordContext gets the hash from the Store with the given context.
+func (store *externalPasswordHashStore) retrievePasswordContext(ctx context.Context, id string) (string, hashState) {
+	hashed, err := store.store.Get(ctx, id)
+	state, ok := storeState(err)
+	if !ok {
+		store.failed("get", id, err)
+	}
+	if state != hashAvailable {
+		return "", state
+	}
+	return hashed, state
+}
+
+// deletePassword removes the hash from the Store, reporting it as available beforehand if removed, as the
+// Store does not tell whether it was still pending, or tells it failed.
+func (store *externalPasswordHashStore) deletePassword(id string) hashState {
+	return store.deletePasswordContext(context.Background(), id)
+}
+
+// deletePasswordContext removes the hash from the Store with the given context.
+func (store *externalPasswordHashStore) deletePasswordContext(ctx context.Context, id string) hashState {
+	err := store.store.Delete(ctx, id)
+	state, ok := storeState(err)
+	if !ok {
+		store.failed("delete", id, err)
+	}
+	return state
+}
+
+// waitPendingStores blocks until listeners were told of every pending hash.
+func (store *externalPasswordHashStore) waitPendingStores() {
+	store.pending.Wait()
+}
+
+// onStored registers a listener for stored hashes. It must be called before any password is stored.
+func (store *externalPasswordHashStore) onStored(listener storeListener) {
+	store.listeners = append(store.listeners, listener)
+}
+
+// startExpiring does nothing, the Store expiring hashes on its own.
+func (store *externalPasswordHashStore) startExpiring() {}
+
+// stopExpiring does nothing, the Store expiring hashes on its own.
+func (store *externalPasswordHashStore) stopExpiring() {}
+
+// collectStats reports the hashes listeners are still to be told of, and the failures of the Store.
+func (store *externalPasswordHashStore) collectStats(stats *serverStats) {
+	stats.External = &externalStats{
+		Pending: store.scheduler.pendingCount(),
+		Errors:  atomic.LoadInt64(&store.errorCount),
+	}
+}
+
+// drainPending waits for listeners to be told of pending hashes, which the Store keeps whatever the shutdown
+// mode, unless abandoning them, when listeners are no longer told of them.
+func (store *externalPasswordHashStore) drainPending(config ShutdownConfig) (shutdownReport, error) {
+	report := shutdownReport{Mode: config.Mode}
+	if config.Mode == ShutdownAbandon {
+		left := store.scheduler.drain()
+		for range left {
+			store.pending.Done()
+		}
+		report.Abandoned = len(left)
+	}
+	report.Waited = store.scheduler.pendingCount()
+	store.pending.Wait()
+	return report, nil
+}
+
+// close closes the Store.
+func (store *externalPasswordHashStore) close() error {
+	return store.store.Close()
+}
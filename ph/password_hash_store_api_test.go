@@ -0,0 +1,264 @@
+package ph
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingStore is a Store whose backend is unavailable.
+type failingStore struct {
+	closed bool
+}
+
+var errBackendDown = errors.New("backend down")
+
+func (store *failingStore) Put(ctx context.Context, id string, hashed string, options PutOptions) error {
+	return errBackendDown
+}
+
+func (store *failingStore) Get(ctx context.Context, id string) (string, error) {
+	return "", errBackendDown
+}
+
+func (store *failingStore) Delete(ctx context.Context, id string) error {
+	return errBackendDown
+}
+
+func (store *failingStore) Close() error {
+	store.closed = true
+	return nil
+}
+
+func Test_storeAdapter(t *testing.T) {
+	for state, expected := range map[hashState]error{
+		hashAvailable: nil,
+		hashPending:   ErrPending,
+		hashExpired:   ErrExpired,
+		hashDeleted:   ErrDeleted,
+		hashUnknown:   ErrNotFound,
+	} {
+		store := storeAdapter{&MockStore{id: "42", hash: "", state: state, t: t}}
+		if _, err := store.Get(context.Background(), "42"); err != expected {
+			t.Errorf("Expected %v for state %d, got %v", expected, state, err)
+		}
+		if got, ok := storeState(expected); got != state || !ok {
+			t.Errorf("Expected %v to tell state %d, got %d", expected, state, got)
+		}
+	}
+	if state, ok := storeState(errBackendDown); state != hashFailed || ok {
+		t.Error("Expected other errors to tell the store failed")
+	}
+
+	mock := &MockStore{id: "42", expected: "hash", delay: time.Minute, ttl: time.Hour, t: t}
+	store := storeAdapter{mock}
+	if err := store.Put(context.Background(), "42", "hash", PutOptions{Delay: time.Minute, TTL: time.Hour}); err != nil {
+		t.Errorf("Expected hash to be stored with the delay given, got %v", err)
+	}
+	mock.state = hashPending
+	if err := store.Delete(context.Background(), "42"); err != nil || !mock.deleted {
+		t.Errorf("Expected pending hash to be deleted, got %v", err)
+	}
+	if err := store.Close(); err != nil || !mock.closed {
+		t.Errorf("Expected store to be closed, got %v", err)
+	}
+}
+
+func Test_externalPasswordHashStore(t *testing.T) {
+	buf := &bytes.Buffer{}
+	backend := NewMemoryStore(log.New(&bytes.Buffer{}, "", 0))
+	store := newExternalPasswordHashStore(log.New(buf, "", 0), backend)
+	stored := map[string]string{}
+	store.onStored(func(id string, hashed string) { stored[id] = hashed })
+
+	if err := store.storePassword("hash-1", "1", 0, 50*time.Millisecond); err != nil {
+		t.Errorf("Expected hash to be stored with its delay, got %v", err)
+	}
+	store.storePassword("hash-2", "2", 0, 100*time.Millisecond)
+	if _, state := store.retrievePassword("1"); state != hashPending {
+		t.Errorf("Expected hash to be pending, got %d", state)
+	}
+	if state := store.deletePassword("2"); state != hashAvailable {
+		t.Errorf("Expected pending hash to be deleted, got %d", state)
+	}
+	report, _ := store.drainPending(ShutdownConfig{Mode: ShutdownWait})
+	if report.Waited != 2 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	if hash, state := store.retrievePassword("1"); hash != "hash-1" || state != hashAvailable {
+		t.Errorf("Expected hash to be available, got %s %d", hash, state)
+	}
+	if stored["1"] != "hash-1" || len(stored) != 1 {
+		t.Errorf("Expected listener to be told of available hashes only, got %v", stored)
+	}
+	if !strings.Contains(buf.String(), "2 cancelled") {
+		t.Errorf("Expected log indicating the cancellation: %s", buf.String())
+	}
+
+	failing := &failingStore{}
+	store = newExternalPasswordHashStore(log.New(buf, "", 0), failing)
+	if err := store.storePassword("hash", "1", 0, 0); err != errBackendDown {
+		t.Errorf("Expected store to fail, got %v", err)
+	}
+	if _, state := store.retrievePassword("1"); state != hashFailed {
+		t.Errorf("Expected store to fail, got %d", state)
+	}
+	if !strings.Contains(buf.String(), "ERROR: Failed to store 1: backend down") {
+		t.Errorf("Expected log indicating the failure: %s", buf.String())
+	}
+	stats := &serverStats{}
+	store.collectStats(stats)
+	if stats.External == nil || stats.External.Errors != 2 {
+		t.Errorf("Unexpected stats: %v", stats.External)
+	}
+	if store.close(); !failing.closed {
+		t.Error("Expected Store to be closed")
+	}
+}
+
+func Test_NewPasswordHasherServerWithStore(t *testing.T) {
+	buf := &bytes.Buffer{}
+	backend := NewMemoryStore(log.New(&bytes.Buffer{}, "", 0))
+	server := NewPasswordHasherServer(log.New(buf, "", 0), WithStore(backend), WithDelay(DelayConfig{}),
+		WithIdStrategy(SequentialIds, 0), WithAdminToken("admin-secret"))
+	defer server.phStore.close()
+	server.phStats.startAccumulating()
+	defer server.phStats.stopAccumulating()
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodPost, "/hash", strings.NewReader("password=angryMonkey"))
+	if err != nil {
+		panic(err)
+	}
+	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	server.http.Handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "1" {
+		t.Fatalf("Unexpected response, got %d %s", w.Code, w.Body.String())
+	}
+	server.phStore.waitPendingStores()
+	if hashed, err := backend.Get(context.Background(), "1"); hashed == "" || err != nil {
+		t.Errorf("Expected hash to be kept in the Store, got %q %v", hashed, err)
+	}
+
+	r, err = http.NewRequest(http.MethodDelete, "/hash/1", nil)
+	if err != nil {
+		panic(err)
+	}
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	w = httptest.NewRecorder()
+	server.http.Handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected hash to be deleted, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	r, err = http.NewRequest(http.MethodGet, "/hash/1", nil)
+	if err != nil {
+		panic(err)
+	}
+	server.http.Handler.ServeHTTP(w, r)
+	if w.Code != http.StatusGone || w.Body.String() != "Deleted" {
+		t.Errorf("Expected deleted id to be gone, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func Test_getHashStoreFailure(t *testing.T) {
+	server := NewPasswordHasherServer(log.New(&bytes.Buffer{}, "", 0), WithStore(&errorStore{}), WithIdStrategy(SequentialIds, 0))
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodGet, "/hash/1", nil)
+	if err != nil {
+		panic(err)
+	}
+	server.http.Handler.ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError || w.Body.String() != "Internal Error" {
+		t.Errorf("Expected failing Store to be an internal error, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+// errorStore is a Store whose Get fails as a backend timing out would.
+type errorStore struct {
+	failingStore
+}
+
+func (store *errorStore) Get(ctx context.Context, id string) (string, error) {
+	return "", context.DeadlineExceeded
+}
+
+// contextKey tags the contexts handed to a Store.
+type contextKey struct{}
+
+// contextStore is a Store failing with the error of the context once done, recording the tag of the contexts
+// it gets. Getting the "slow" id waits for the context to be done.
+type contextStore struct {
+	failingStore
+	lock sync.Mutex
+	tags []interface{}
+}
+
+func (store *contextStore) record(ctx context.Context) error {
+	defer store.lock.Unlock()
+	store.lock.Lock()
+	store.tags = append(store.tags, ctx.Value(contextKey{}))
+	return ctx.Err()
+}
+
+func (store *contextStore) Put(ctx context.Context, id string, hashed string, options PutOptions) error {
+	return store.record(ctx)
+}
+
+func (store *contextStore) Get(ctx context.Context, id string) (string, error) {
+	if id == "slow" {
+		<-ctx.Done()
+	}
+	if err := store.record(ctx); err != nil {
+		return "", err
+	}
+	return "", ErrNotFound
+}
+
+func (store *contextStore) Delete(ctx context.Context, id string) error {
+	if err := store.record(ctx); err != nil {
+		return err
+	}
+	return ErrNotFound
+}
+
+func Test_storeAdapterContext(t *testing.T) {
+	backend := &contextStore{}
+	server := NewPasswordHasherServer(log.New(&bytes.Buffer{}, "", 0), WithStore(backend), WithDelay(DelayConfig{}),
+		WithEncryption(openTestKeyRing(t, filepath.Join(t.TempDir(), "data.keys"))))
+	defer server.phStore.close()
+
+	ctx := context.WithValue(context.Background(), contextKey{}, "request")
+	if err := server.store.Put(ctx, "1", "hash", PutOptions{}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := server.store.Get(ctx, "1"); err != ErrNotFound {
+		t.Errorf("Expected hash not to be found, got %v", err)
+	}
+	if err := server.store.Delete(ctx, "1"); err != ErrNotFound {
+		t.Errorf("Expected hash not to be found, got %v", err)
+	}
+	server.phStore.waitPendingStores()
+	backend.lock.Lock()
+	for i, tag := range backend.tags[:3] {
+		if tag != "request" {
+			t.Errorf("Expected call %d to get the context of the request, got %v", i, tag)
+		}
+	}
+	backend.lock.Unlock()
+
+	// requests past their deadline while the Store works fail with the error of their context
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := server.store.Get(ctx, "slow"); err != context.DeadlineExceeded {
+		t.Errorf("Expected the error of the context, got %v", err)
+	}
+}
@@ -9,7 +9,7 @@ import (
 )
 
 func Test_newPasswordHashStore(t *testing.T) {
-	store := newPasswordHashStore(nil, 0)
+	store := newPasswordHashStore(nil)
 	if store.hashes == nil {
 		t.Error("Hashes expected to not be nil")
 	}
@@ -17,8 +17,8 @@ func Test_newPasswordHashStore(t *testing.T) {
 
 func Test_retrievePasswordEmpty(t *testing.T) {
 	buf := &bytes.Buffer{}
-	store := newPasswordHashStore(log.New(buf, "", 0), 0)
-	if store.retrievePassword(0) != "" {
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	if hash, state := store.retrievePassword("0"); hash != "" || state != hashUnknown {
 		t.Error("Expected an empty store to return no hashes")
 	}
 	if buf.String() != "Getting for 0\nNo password hash for 0\n" {
@@ -26,37 +26,36 @@ func Test_retrievePasswordEmpty(t *testing.T) {
 	}
 }
 
-func Test_delayStore(t *testing.T) {
+func Test_storePasswordWithoutDelay(t *testing.T) {
 	// test with no delay
 	buf := &bytes.Buffer{}
-	store := newPasswordHashStore(log.New(buf, "", 0), 0)
-	store.delayStore("test", 0)
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	store.storePassword("test", "0", 0, 0)
+	store.waitPendingStores()
 
-	if len(store.hashes) != 1 {
+	if store.hashes.count() != 1 {
 		t.Error("Expected one hash")
-	} else if hash, ok := store.hashes[0]; !ok {
+	} else if hash, ok := store.hashes.get("0"); !ok {
 		t.Error("Expected hash with id 0")
 	} else if hash != "test" {
 		t.Errorf("Expected correct value, got %s", hash)
 	}
 
-	if buf.String() != "Storing for 0...\n0 stored\n" {
+	if buf.String() != "Storing for 0...\n0 stored\nNo more pending stores\n" {
 		t.Errorf("Expected log indicating ongoing work: %s", buf.String())
 	}
-
-	// shouldn't block
-	store.waitPendingStores()
 }
 
 func Test_retrievePassword(t *testing.T) {
 	// test with no delay
 	buf := &bytes.Buffer{}
-	store := newPasswordHashStore(log.New(buf, "", 0), 0)
-	store.delayStore("test", 0)
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	store.storePassword("test", "0", 0, 0)
+	store.waitPendingStores()
 	buf.Reset()
 
-	hash := store.retrievePassword(0)
-	if hash != "test" {
+	hash, state := store.retrievePassword("0")
+	if hash != "test" || state != hashAvailable {
 		t.Errorf("Expected to return correct hash, got %s", hash)
 	}
 	if buf.String() != "Getting for 0\n" {
@@ -69,16 +68,16 @@ func Test_storePassword(t *testing.T) {
 	delay := time.Second / 100
 
 	buf := &bytes.Buffer{}
-	store := newPasswordHashStore(log.New(buf, "", 0), delay)
-	store.storePassword("test", 0)
-	if store.retrievePassword(0) != "" {
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	store.storePassword("test", "0", 0, delay)
+	if hash, _ := store.retrievePassword("0"); hash != "" {
 		t.Error("Expected to have no hashes before the delay")
 	}
 	forceGoroutineScheduler()
 	buf.Reset()
 
 	store.waitPendingStores()
-	if store.retrievePassword(0) != "test" {
+	if hash, _ := store.retrievePassword("0"); hash != "test" {
 		t.Error("Expected to have correct hash before the delay")
 	}
 
@@ -86,3 +85,18 @@ func Test_storePassword(t *testing.T) {
 		t.Errorf("Expected log indicating no more pending: %s", buf.String())
 	}
 }
+
+func Test_onStored(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	var gotId, gotHash string
+	store.onStored(func(id string, hashed string) {
+		gotId, gotHash = id, hashed
+	})
+	store.storePassword("test", "7", 0, 0)
+	store.waitPendingStores()
+
+	if gotId != "7" || gotHash != "test" {
+		t.Errorf("Expected listener to be called with the stored hash, got %s %s", gotId, gotHash)
+	}
+}
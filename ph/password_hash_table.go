@@ -0,0 +1,291 @@
+package ph
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"math"
+)
+
+// hashTable holds the stored password hashes by id. Callers provide the locking.
+type hashTable interface {
+	get(id string) (string, bool)
+	set(id string, hashed string)
+	remove(id string)
+	count() int
+	each(visit func(id string, hashed string))
+}
+
+// setCompactDigests keeps hashes in an arena-based table rather than a map. It must be called before any
+// password is stored.
+func (store *passwordHashStore) setCompactDigests() {
+	store.hashes = newArenaHashTable()
+}
+
+// mapHashTable keeps hashes in a map, as given.
+type mapHashTable map[string]string
+
+// newMapHashTable creates an empty map-based table.
+func newMapHashTable() mapHashTable {
+	return make(mapHashTable)
+}
+
+func (table mapHashTable) get(id string) (string, bool) {
+	hashed, ok := table[id]
+	return hashed, ok
+}
+
+func (table mapHashTable) set(id string, hashed string) {
+	table[id] = hashed
+}
+
+func (table mapHashTable) remove(id string) {
+	delete(table, id)
+}
+
+func (table mapHashTable) count() int {
+	return len(table)
+}
+
+func (table mapHashTable) each(visit func(id string, hashed string)) {
+	for id, hashed := range table {
+		visit(id, hashed)
+	}
+}
+
+const (
+	// minArenaChunk and arenaChunkSize bound the size of the arenas entries are appended to,
+	// which double in size as the table grows, so small tables stay small.
+	minArenaChunk  = 64 << 10
+	arenaChunkSize = 4 << 20
+	// minArenaSlots is the initial size of the open-addressing table, a power of two.
+	minArenaSlots = 1024
+
+	// emptyRef and deletedRef mark slots which never held an entry, or whose entry was removed.
+	emptyRef   = 0
+	deletedRef = math.MaxUint64
+
+	// entryDigest is an entry holding a raw SHA-512 digest, base64-encoded on read.
+	entryDigest = 0
+	// entryRaw is an entry holding the hash as given, such as when sealed.
+	entryRaw = 1
+)
+
+// strictBase64 only decodes canonical base64, so a digest re-encodes to the exact hash it was stored as.
+var strictBase64 = base64.StdEncoding.Strict()
+
+// arenaSlot is a slot of the open-addressing table: the hash of an id, and where its entry is in the arenas.
+type arenaSlot struct {
+	hash uint64
+	ref  uint64
+}
+
+// arenaHashTable keeps hashes in large preallocated byte arenas, indexed by an open-addressing table with
+// linear probing. Base64-encoded SHA-512 digests are kept raw, taking 64 bytes instead of 88, and are only
+// encoded again on read. Neither the arenas nor the table hold pointers, so the garbage collector does not
+// scan them. Entries are laid out as a kind byte, the id and value lengths as uvarints, then the id and value.
+// Removed entries are left in place as garbage until there is more garbage than live entries.
+type arenaHashTable struct {
+	slots   []arenaSlot
+	used    int
+	deleted int
+	chunks  [][]byte
+	live    int64
+	garbage int64
+}
+
+// newArenaHashTable creates an empty arena-based table.
+func newArenaHashTable() *arenaHashTable {
+	return &arenaHashTable{slots: make([]arenaSlot, minArenaSlots)}
+}
+
+// hashId hashes an id for the table with FNV-1a, never to zero so empty slots stand out.
+func hashId(id string) uint64 {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(id); i++ {
+		hash ^= uint64(id[i])
+		hash *= 1099511628211
+	}
+	if hash != 0 {
+		return hash
+	}
+	return 1
+}
+
+// find returns the slot holding the id, or -1 along with the first slot it could be inserted at.
+func (table *arenaHashTable) find(id string, hash uint64) (int, int) {
+	mask := uint64(len(table.slots) - 1)
+	insert := -1
+	for i := hash & mask; ; i = (i + 1) & mask {
+		slot := table.slots[i]
+		switch {
+		case slot.ref == emptyRef:
+			if insert < 0 {
+				insert = int(i)
+			}
+			return -1, insert
+		case slot.ref == deletedRef:
+			if insert < 0 {
+				insert = int(i)
+			}
+		case slot.hash == hash:
+			if table.entryHasId(slot.ref, id) {
+				return int(i), insert
+			}
+		}
+	}
+}
+
+// entry decodes the entry at the given reference, returning its id, value and size in the arena.
+func (table *arenaHashTable) entry(ref uint64) (string, string, int64) {
+	ref--
+	chunk := table.chunks[ref>>32][uint32(ref):]
+	idLen, n := binary.Uvarint(chunk[1:])
+	valueLen, m := binary.Uvarint(chunk[1+n:])
+	start := 1 + n + m
+	id := string(chunk[start : start+int(idLen)])
+	value := chunk[start+int(idLen) : start+int(idLen)+int(valueLen)]
+	size := int64(start) + int64(idLen) + int64(valueLen)
+	if chunk[0] == entryDigest {
+		return id, base64.StdEncoding.EncodeToString(value), size
+	}
+	return id, string(value), size
+}
+
+// entryHasId tells whether the entry at the given reference is that of the id, without decoding the rest.
+func (table *arenaHashTable) entryHasId(ref uint64, id string) bool {
+	ref--
+	chunk := table.chunks[ref>>32][uint32(ref):]
+	idLen, n := binary.Uvarint(chunk[1:])
+	_, m := binary.Uvarint(chunk[1+n:])
+	start := 1 + n + m
+	return int(idLen) == len(id) && string(chunk[start:start+len(id)]) == id
+}
+
+// entrySize decodes only the size in the arena of the entry at the given reference.
+func (table *arenaHashTable) entrySize(ref uint64) int64 {
+	ref--
+	chunk := table.chunks[ref>>32][uint32(ref):]
+	idLen, n := binary.Uvarint(chunk[1:])
+	valueLen, m := binary.Uvarint(chunk[1+n:])
+	return int64(1+n+m) + int64(idLen) + int64(valueLen)
+}
+
+// append writes a new entry to the arenas, returning its reference.
+func (table *arenaHashTable) append(id string, hashed string) uint64 {
+	kind, value := byte(entryRaw), []byte(hashed)
+	if len(hashed) == base64.StdEncoding.EncodedLen(sha512.Size) {
+		if digest, err := strictBase64.DecodeString(hashed); err == nil && len(digest) == sha512.Size {
+			kind, value = entryDigest, digest
+		}
+	}
+	var lengths [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lengths[:], uint64(len(id)))
+	n += binary.PutUvarint(lengths[n:], uint64(len(value)))
+	size := 1 + n + len(id) + len(value)
+
+	last := len(table.chunks) - 1
+	if last < 0 || cap(table.chunks[last])-len(table.chunks[last]) < size {
+		chunkSize := minArenaChunk
+		if last >= 0 {
+			chunkSize = 2 * cap(table.chunks[last])
+		}
+		if chunkSize > arenaChunkSize {
+			chunkSize = arenaChunkSize
+		}
+		if size > chunkSize {
+			chunkSize = size
+		}
+		table.chunks = append(table.chunks, make([]byte, 0, chunkSize))
+		last++
+	}
+	chunk := table.chunks[last]
+	offset := len(chunk)
+	chunk = append(chunk, kind)
+	chunk = append(chunk, lengths[:n]...)
+	chunk = append(chunk, id...)
+	chunk = append(chunk, value...)
+	table.chunks[last] = chunk
+	table.live += int64(size)
+	return (uint64(last)<<32 | uint64(offset)) + 1
+}
+
+func (table *arenaHashTable) get(id string) (string, bool) {
+	i, _ := table.find(id, hashId(id))
+	if i < 0 {
+		return "", false
+	}
+	_, hashed, _ := table.entry(table.slots[i].ref)
+	return hashed, true
+}
+
+func (table *arenaHashTable) set(id string, hashed string) {
+	hash := hashId(id)
+	i, insert := table.find(id, hash)
+	if i >= 0 {
+		table.discard(table.slots[i].ref)
+		table.slots[i].ref = table.append(id, hashed)
+		table.compactIfWasteful()
+		return
+	}
+	if table.slots[insert].ref == deletedRef {
+		table.deleted--
+	}
+	table.slots[insert] = arenaSlot{hash: hash, ref: table.append(id, hashed)}
+	table.used++
+	if 4*(table.used+table.deleted) > 3*len(table.slots) {
+		table.rebuild()
+	}
+}
+
+func (table *arenaHashTable) remove(id string) {
+	i, _ := table.find(id, hashId(id))
+	if i < 0 {
+		return
+	}
+	table.discard(table.slots[i].ref)
+	table.slots[i] = arenaSlot{ref: deletedRef}
+	table.used--
+	table.deleted++
+	table.compactIfWasteful()
+}
+
+// discard accounts for an entry no longer referenced as garbage.
+func (table *arenaHashTable) discard(ref uint64) {
+	size := table.entrySize(ref)
+	table.live -= size
+	table.garbage += size
+}
+
+// compactIfWasteful rebuilds the table once removed entries take more room than live ones.
+func (table *arenaHashTable) compactIfWasteful() {
+	if table.garbage > arenaChunkSize && table.garbage > table.live {
+		table.rebuild()
+	}
+}
+
+// rebuild copies the live entries into fresh arenas and a table sized for them, dropping garbage and tombstones.
+func (table *arenaHashTable) rebuild() {
+	slots := minArenaSlots
+	for 2*table.used >= slots {
+		slots *= 2
+	}
+	fresh := &arenaHashTable{slots: make([]arenaSlot, slots)}
+	table.each(func(id string, hashed string) {
+		fresh.set(id, hashed)
+	})
+	*table = *fresh
+}
+
+func (table *arenaHashTable) count() int {
+	return table.used
+}
+
+func (table *arenaHashTable) each(visit func(id string, hashed string)) {
+	for _, slot := range table.slots {
+		if slot.ref != emptyRef && slot.ref != deletedRef {
+			id, hashed, _ := table.entry(slot.ref)
+			visit(id, hashed)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package ph
+
+import (
+	"bytes"
+	"log"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_arenaHashTable(t *testing.T) {
+	table := newArenaHashTable()
+	digest := newSHA512PasswordHasher().hashPassword("angryMonkey")
+	table.set("1", digest)
+	table.set("2", "k1.sealed")
+	if hash, ok := table.get("1"); !ok || hash != digest {
+		t.Errorf("Expected digest to read back as stored, got %s %v", hash, ok)
+	}
+	if hash, ok := table.get("2"); !ok || hash != "k1.sealed" {
+		t.Errorf("Expected raw hash to read back as stored, got %s %v", hash, ok)
+	}
+	if _, ok := table.get("3"); ok {
+		t.Error("Expected unknown id to be missing")
+	}
+
+	table.set("2", "k2.resealed")
+	if hash, _ := table.get("2"); hash != "k2.resealed" || table.count() != 2 {
+		t.Errorf("Expected hash to be overwritten, got %s with %d hashes", hash, table.count())
+	}
+	table.remove("1")
+	table.remove("3")
+	if _, ok := table.get("1"); ok || table.count() != 1 {
+		t.Errorf("Expected hash to be removed, got %d hashes", table.count())
+	}
+}
+
+func Test_arenaHashTableDigests(t *testing.T) {
+	table := newArenaHashTable()
+	digest := newSHA512PasswordHasher().hashPassword("angryMonkey")
+	table.set("1", digest)
+	if table.live != 1+2+1+64 {
+		t.Errorf("Expected digest to be kept raw, got %d bytes", table.live)
+	}
+
+	// not canonical base64, so it must be kept as is to read back the same
+	noncanonical := digest[:len(digest)-3] + "R=="
+	table.set("2", noncanonical)
+	if hash, _ := table.get("2"); hash != noncanonical {
+		t.Errorf("Expected non-canonical hash to read back as stored, got %s", hash)
+	}
+	if table.live != 2*(1+2+1)+64+88 {
+		t.Errorf("Expected non-canonical hash to be kept as is, got %d bytes", table.live)
+	}
+}
+
+func Test_arenaHashTableGrowth(t *testing.T) {
+	table := newArenaHashTable()
+	for i := 0; i < 10000; i++ {
+		table.set(strconv.Itoa(i), "hash-"+strconv.Itoa(i))
+	}
+	for i := 0; i < 10000; i += 2 {
+		table.remove(strconv.Itoa(i))
+	}
+	if table.count() != 5000 || len(table.slots) <= 2*table.count() {
+		t.Errorf("Expected table to grow with its hashes, got %d slots for %d", len(table.slots), table.count())
+	}
+	for i := 0; i < 10000; i++ {
+		hash, ok := table.get(strconv.Itoa(i))
+		if ok != (i%2 == 1) || (ok && hash != "hash-"+strconv.Itoa(i)) {
+			t.Errorf("Unexpected hash for %d: %s %v", i, hash, ok)
+		}
+	}
+	visited := 0
+	table.each(func(id string, hashed string) {
+		if hashed != "hash-"+id {
+			t.Errorf("Unexpected hash for %s: %s", id, hashed)
+		}
+		visited++
+	})
+	if visited != 5000 {
+		t.Errorf("Expected every hash to be visited, got %d", visited)
+	}
+}
+
+func Test_arenaHashTableCompaction(t *testing.T) {
+	table := newArenaHashTable()
+	table.set("small", "hash")
+	large := strings.Repeat("x", 1<<20)
+	for i := 0; i < 5; i++ {
+		table.set("large", large+strconv.Itoa(i))
+	}
+	if table.garbage != 0 {
+		t.Errorf("Expected overwritten hashes to be compacted, got %d bytes of garbage", table.garbage)
+	}
+	if hash, _ := table.get("large"); hash != large+"4" {
+		t.Error("Expected latest hash to survive compaction")
+	}
+	if hash, _ := table.get("small"); hash != "hash" {
+		t.Errorf("Expected other hash to survive compaction, got %s", hash)
+	}
+}
+
+func Test_compactDigestsStore(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := newPasswordHashStore(log.New(buf, "", 0))
+	store.setCompactDigests()
+	digest := newSHA512PasswordHasher().hashPassword("angryMonkey")
+	store.storePassword(digest, "1", 0, 0)
+	store.waitPendingStores()
+	if hash, state := store.retrievePassword("1"); hash != digest || state != hashAvailable {
+		t.Errorf("Unexpected hash: %s %d", hash, state)
+	}
+	if state := store.deletePassword("1"); state != hashAvailable || store.hashes.count() != 0 {
+		t.Errorf("Expected hash to be deleted, got %d", state)
+	}
+}
+
+// benchmarkTable10M reports the heap used per hash and the time taken by a forced garbage collection
+// with 10 million hashes stored in the table.
+func benchmarkTable10M(b *testing.B, newTable func() hashTable) {
+	const records = 10000000
+	hasher := newSHA512PasswordHasher()
+	for n := 0; n < b.N; n++ {
+		runtime.GC()
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		table := newTable()
+		for i := 0; i < records; i++ {
+			id := strconv.Itoa(i)
+			table.set(id, hasher.hashPassword(id))
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		start := time.Now()
+		runtime.GC()
+		gc := time.Since(start)
+		var collected runtime.MemStats
+		runtime.ReadMemStats(&collected)
+		b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/records, "heap-B/record")
+		b.ReportMetric(float64(gc.Nanoseconds()), "gc-ns")
+		b.ReportMetric(float64(collected.PauseTotalNs-after.PauseTotalNs), "gc-pause-ns")
+		runtime.KeepAlive(table)
+	}
+}
+
+func BenchmarkHashTable10M(b *testing.B) {
+	b.Run("map", func(b *testing.B) {
+		benchmarkTable10M(b, func() hashTable { return newMapHashTable() })
+	})
+	b.Run("arena", func(b *testing.B) {
+		benchmarkTable10M(b, func() hashTable { return newArenaHashTable() })
+	})
+}
+
+func BenchmarkHashTableGet(b *testing.B) {
+	tables := map[string]hashTable{"map": newMapHashTable(), "arena": newArenaHashTable()}
+	for _, name := range []string{"map", "arena"} {
+		table := tables[name]
+		for i := 0; i < 100000; i++ {
+			table.set(strconv.Itoa(i), "very-hashed")
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				table.get(strconv.Itoa(i % 100000))
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package ph
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retrievalTokenIssuer is the minimal interface for binding ids to signed retrieval tokens.
+type retrievalTokenIssuer interface {
+	issueToken(id string) string
+	verifyToken(id string, token string) error
+}
+
+var (
+	errInvalidToken = errors.New("invalid retrieval token")
+	errExpiredToken = errors.New("expired retrieval token")
+)
+
+// TokenKey is a single HMAC key used to sign retrieval tokens, named by an id embedded in each token.
+type TokenKey struct {
+	Id     string
+	Secret []byte
+}
+
+// TokenConfig configures retrieval tokens. The first key signs new tokens, while all of them verify tokens,
+// so a key can be rotated by putting a new one first and keeping the old one until its tokens expire.
+type TokenConfig struct {
+	Keys []TokenKey
+	TTL  time.Duration
+}
+
+const (
+	defaultTokenTTL = 24 * time.Hour
+
+	// retrievalTokenHeader carries the token returned by the hash endpoint.
+	retrievalTokenHeader = "X-Retrieval-Token"
+)
+
+// ParseTokenKeys reads one key per line as "<key id> <secret>", ignoring blank lines and # comments.
+func ParseTokenKeys(data []byte) ([]TokenKey, error) {
+	var keys []TokenKey
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 || strings.Contains(fields[0], ".") {
+			return nil, fmt.Errorf("invalid token key on line %d", line)
+		}
+		keys = append(keys, TokenKey{Id: fields[0], Secret: []byte(fields[1])})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no token keys")
+	}
+	return keys, nil
+}
+
+// hmacTokenIssuer issues "<key id>.<expiry>.<signature>" tokens, where the signature is the HMAC-SHA256
+// of the key id, hash id and expiry (in Unix seconds). Tokens are only valid for the id they were issued for.
+type hmacTokenIssuer struct {
+	signing TokenKey
+	keys    map[string][]byte
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+// newHMACTokenIssuer creates a new issuer, which requires at least one key.
+func newHMACTokenIssuer(config TokenConfig) *hmacTokenIssuer {
+	if len(config.Keys) == 0 {
+		panic("retrieval tokens require at least one key")
+	}
+	if config.TTL <= 0 {
+		config.TTL = defaultTokenTTL
+	}
+	keys := make(map[string][]byte, len(config.Keys))
+	for _, key := range config.Keys {
+		keys[key.Id] = key.Secret
+	}
+	return &hmacTokenIssuer{
+		signing: config.Keys[0],
+		keys:    keys,
+		ttl:     config.TTL,
+		now:     time.Now,
+	}
+}
+
+// issueToken signs a new token for the id with the current key.
+func (issuer *hmacTokenIssuer) issueToken(id string) string {
+	expiry := strconv.FormatInt(issuer.now().Add(issuer.ttl).Unix(), 10)
+	return issuer.signing.Id + "." + expiry + "." + signToken(issuer.signing.Secret, issuer.signing.Id, id, expiry)
+}
+
+// verifyToken checks the token was signed by a known key for this very id, and that it has not expired yet.
+func (issuer *hmacTokenIssuer) verifyToken(id string, token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errInvalidToken
+	}
+	secret, ok := issuer.keys[parts[0]]
+	if !ok {
+		return errInvalidToken
+	}
+	expected := signToken(secret, parts[0], id, parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		return errInvalidToken
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return errInvalidToken
+	}
+	if issuer.now().Unix() >= expiry {
+		return errExpiredToken
+	}
+	return nil
+}
+
+// signToken computes the unpadded base64url HMAC-SHA256 of the token fields.
+func signToken(secret []byte, keyId, id, expiry string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(keyId + "\n" + id + "\n" + expiry))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
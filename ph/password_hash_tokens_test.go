@@ -0,0 +1,84 @@
+package ph
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ParseTokenKeys(t *testing.T) {
+	keys, err := ParseTokenKeys([]byte("# current first\nk2 new-secret\n\nk1   old-secret\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(keys) != 2 || keys[0].Id != "k2" || string(keys[0].Secret) != "new-secret" || keys[1].Id != "k1" {
+		t.Errorf("Unexpected keys: %+v", keys)
+	}
+
+	for _, data := range []string{"", "# nothing\n", "k1\n", "k1 a b\n", "k.1 secret\n"} {
+		if _, err := ParseTokenKeys([]byte(data)); err == nil {
+			t.Errorf("Expected %q to fail", data)
+		}
+	}
+}
+
+func Test_newHMACTokenIssuer(t *testing.T) {
+	issuer := newHMACTokenIssuer(TokenConfig{Keys: []TokenKey{{"k1", []byte("secret")}}})
+	if issuer.ttl != defaultTokenTTL {
+		t.Errorf("Unexpected default TTL: %v", issuer.ttl)
+	}
+	if issuer.signing.Id != "k1" {
+		t.Errorf("Unexpected signing key: %s", issuer.signing.Id)
+	}
+}
+
+func Test_verifyToken(t *testing.T) {
+	now := time.Unix(1000, 0)
+	issuer := newHMACTokenIssuer(TokenConfig{Keys: []TokenKey{{"k1", []byte("secret")}}, TTL: time.Minute})
+	issuer.now = func() time.Time {
+		return now
+	}
+
+	token := issuer.issueToken("42")
+	if !strings.HasPrefix(token, "k1.1060.") {
+		t.Errorf("Unexpected token: %s", token)
+	}
+	if err := issuer.verifyToken("42", token); err != nil {
+		t.Errorf("Expected valid token: %v", err)
+	}
+	if err := issuer.verifyToken("43", token); err != errInvalidToken {
+		t.Errorf("Expected token to be bound to its id: %v", err)
+	}
+	tampered := strings.Replace(token, ".1060.", ".9999.", 1)
+	if err := issuer.verifyToken("42", tampered); err != errInvalidToken {
+		t.Errorf("Expected tampered expiry to be rejected: %v", err)
+	}
+	for _, bogus := range []string{"", "bogus", "k9.1060.abc", "k1.1060.abc", "k1.x.y.z"} {
+		if err := issuer.verifyToken("42", bogus); err != errInvalidToken {
+			t.Errorf("Expected %q to be rejected: %v", bogus, err)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	if err := issuer.verifyToken("42", token); err != errExpiredToken {
+		t.Errorf("Expected expired token: %v", err)
+	}
+}
+
+func Test_verifyTokenKeyRotation(t *testing.T) {
+	old := newHMACTokenIssuer(TokenConfig{Keys: []TokenKey{{"k1", []byte("old")}}})
+	token := old.issueToken("42")
+
+	rotated := newHMACTokenIssuer(TokenConfig{Keys: []TokenKey{{"k2", []byte("new")}, {"k1", []byte("old")}}})
+	if err := rotated.verifyToken("42", token); err != nil {
+		t.Errorf("Expected old token to survive rotation: %v", err)
+	}
+	if !strings.HasPrefix(rotated.issueToken("42"), "k2.") {
+		t.Error("Expected new tokens to be signed with the new key")
+	}
+
+	retired := newHMACTokenIssuer(TokenConfig{Keys: []TokenKey{{"k2", []byte("new")}}})
+	if err := retired.verifyToken("42", token); err != errInvalidToken {
+		t.Errorf("Expected token of a retired key to be rejected: %v", err)
+	}
+}
@@ -3,28 +3,23 @@ package ph
 import (
 	"crypto/sha512"
 	"encoding/base64"
-	"sync/atomic"
 )
 
 // passwordHasher is the minimal interface for hashing passwords.
 type passwordHasher interface {
-	hashPassword(password string) (string, int64)
+	hashPassword(password string) string
 }
 
-// sha512PasswordHasher ensures that each password hashed is tied to a unique ID.
-type sha512PasswordHasher struct {
-	uniqueId int64
-}
+// sha512PasswordHasher hashes passwords with SHA512. The ids they are stored by come from an idGenerator.
+type sha512PasswordHasher struct{}
 
 // newSHA512PasswordHasher creates a new hasher.
 func newSHA512PasswordHasher() *sha512PasswordHasher {
 	return &sha512PasswordHasher{}
 }
 
-// hashPassword actually hashes the given plain-text password using SHA512, returns its ID and a base64-encoded hash.
-func (pwHasher *sha512PasswordHasher) hashPassword(password string) (string, int64) {
-	id := atomic.AddInt64(&pwHasher.uniqueId, 1)
+// hashPassword actually hashes the given plain-text password using SHA512, returning a base64-encoded hash.
+func (pwHasher *sha512PasswordHasher) hashPassword(password string) string {
 	hashed := sha512.Sum512([]byte(password))
-	encoded := base64.StdEncoding.EncodeToString(hashed[:])
-	return encoded, id
+	return base64.StdEncoding.EncodeToString(hashed[:])
 }
@@ -0,0 +1,116 @@
+package ph
+
+import (
+	"math"
+	"math/bits"
+)
+
+const (
+	// histogramSubBucketBits sets the precision of the histogram: values are counted in buckets no wider than
+	// 1/2^(histogramSubBucketBits-1) of them, so percentiles are within 1/128 (0.79%) of the actual timing.
+	histogramSubBucketBits  = 8
+	histogramSubBucketCount = 1 << histogramSubBucketBits
+	histogramSubBucketHalf  = histogramSubBucketCount / 2
+
+	// histogramMaxBits bounds the timings counted precisely to 2^42µs (about 50 days); longer ones are counted
+	// in the last bucket, while the max stays exact.
+	histogramMaxBits = 42
+	histogramBuckets = histogramSubBucketCount + (histogramMaxBits-histogramSubBucketBits)*histogramSubBucketHalf
+)
+
+// latencyPercentiles are the percentiles of the timings in microseconds, as reported by the stats endpoint.
+type latencyPercentiles struct {
+	P50  int64 `json:"p50"`
+	P90  int64 `json:"p90"`
+	P99  int64 `json:"p99"`
+	P999 int64 `json:"p999"`
+	Max  int64 `json:"max"`
+}
+
+// latencyHistogram counts timings in log-linear buckets, as an HDR histogram does with 2 significant digits:
+// timings below 256µs each get their own bucket, then every power of 2 is split in 128 buckets. It takes the same
+// memory whatever the timings, and histograms merge by adding their counts.
+type latencyHistogram struct {
+	counts [histogramBuckets]int64
+	count  int64
+	max    microseconds
+}
+
+// histogramIndex returns the bucket counting the given timing.
+func histogramIndex(ms microseconds) int {
+	if ms < 0 {
+		ms = 0
+	}
+	value := uint64(ms)
+	if value < histogramSubBucketCount {
+		return int(value)
+	}
+	if bits.Len64(value) > histogramMaxBits {
+		return histogramBuckets - 1
+	}
+	shift := bits.Len64(value) - histogramSubBucketBits
+	return histogramSubBucketCount + (shift-1)*histogramSubBucketHalf + int(value>>uint(shift)) - histogramSubBucketHalf
+}
+
+// histogramHighest returns the highest timing counted by the given bucket.
+func histogramHighest(index int) microseconds {
+	if index < histogramSubBucketCount {
+		return microseconds(index)
+	}
+	shift := (index-histogramSubBucketCount)/histogramSubBucketHalf + 1
+	sub := (index-histogramSubBucketCount)%histogramSubBucketHalf + histogramSubBucketHalf
+	return microseconds((uint64(sub)+1)<<uint(shift) - 1)
+}
+
+// record counts a single timing.
+func (histogram *latencyHistogram) record(ms microseconds) {
+	histogram.counts[histogramIndex(ms)]++
+	histogram.count++
+	if ms > histogram.max {
+		histogram.max = ms
+	}
+}
+
+// merge adds the counts of another histogram, as if its timings were recorded in this one.
+func (histogram *latencyHistogram) merge(other *latencyHistogram) {
+	for i, count := range other.counts {
+		histogram.counts[i] += count
+	}
+	histogram.count += other.count
+	if other.max > histogram.max {
+		histogram.max = other.max
+	}
+}
+
+// percentile returns the timing at the given quantile (0 to 1): the highest timing counted by its bucket, so it
+// is never below the actual one and within 1/128 of it, and never above the max. It is 0 without any timing.
+func (histogram *latencyHistogram) percentile(quantile float64) microseconds {
+	if histogram.count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(quantile * float64(histogram.count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, count := range histogram.counts {
+		if seen += count; seen >= rank {
+			if highest := histogramHighest(i); highest < histogram.max {
+				return highest
+			}
+			break
+		}
+	}
+	return histogram.max
+}
+
+// percentiles returns the p50, p90, p99, p99.9 and max of the timings.
+func (histogram *latencyHistogram) percentiles() *latencyPercentiles {
+	return &latencyPercentiles{
+		P50:  int64(histogram.percentile(0.5)),
+		P90:  int64(histogram.percentile(0.9)),
+		P99:  int64(histogram.percentile(0.99)),
+		P999: int64(histogram.percentile(0.999)),
+		Max:  int64(histogram.max),
+	}
+}
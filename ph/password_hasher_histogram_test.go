@@ -0,0 +1,89 @@
+package ph
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func Test_histogramIndex(t *testing.T) {
+	previous := -1
+	for _, ms := range []microseconds{0, 1, 255, 256, 257, 258, 511, 512, 1000, 1 << 20, 1<<histogramMaxBits - 1} {
+		index := histogramIndex(ms)
+		if index < previous {
+			t.Errorf("Expected %d to be counted after the previous timings, got %d", ms, index)
+		}
+		if highest := histogramHighest(index); highest < ms || float64(highest-ms) > float64(ms)/128 {
+			t.Errorf("Expected bucket of %d to count up to 1/128 more, got %d", ms, highest)
+		}
+		previous = index
+	}
+	if index := histogramIndex(1 << 50); index != histogramBuckets-1 {
+		t.Errorf("Expected longer timings in the last bucket, got %d", index)
+	}
+	if index := histogramIndex(-1); index != 0 {
+		t.Errorf("Expected negative timings in the first bucket, got %d", index)
+	}
+}
+
+func Test_latencyHistogram(t *testing.T) {
+	histogram := &latencyHistogram{}
+	if percentiles := histogram.percentiles(); *percentiles != (latencyPercentiles{}) {
+		t.Errorf("Unexpected percentiles without timings: %+v", percentiles)
+	}
+	for ms := microseconds(1); ms <= 100; ms++ {
+		histogram.record(ms)
+	}
+	// timings below 256µs are exact
+	if percentiles := histogram.percentiles(); *percentiles != (latencyPercentiles{P50: 50, P90: 90, P99: 99, P999: 100, Max: 100}) {
+		t.Errorf("Unexpected percentiles: %+v", percentiles)
+	}
+
+	// percentiles never exceed the max
+	histogram.record(1001)
+	if p := histogram.percentile(1); p != 1001 {
+		t.Errorf("Expected highest percentile to be the max, got %d", p)
+	}
+}
+
+func Test_latencyHistogramMerge(t *testing.T) {
+	histogram, other, all := &latencyHistogram{}, &latencyHistogram{}, &latencyHistogram{}
+	for ms := microseconds(0); ms < 10000; ms += 7 {
+		histogram.record(ms)
+		all.record(ms)
+		other.record(ms * 3)
+		all.record(ms * 3)
+	}
+	histogram.merge(other)
+	if *histogram != *all {
+		t.Error("Expected merged histogram to count the timings of both")
+	}
+}
+
+// Test_latencyHistogramAccuracy checks the documented bound: percentiles are never below the actual timing, and
+// within 1/128 of it, whatever the distribution.
+func Test_latencyHistogramAccuracy(t *testing.T) {
+	random := rand.New(rand.NewSource(42))
+	distributions := map[string]func() microseconds{
+		"uniform":     func() microseconds { return microseconds(random.Int63n(1000000)) },
+		"exponential": func() microseconds { return microseconds(random.ExpFloat64() * 5000) },
+		"lognormal":   func() microseconds { return microseconds(math.Exp(random.NormFloat64()*2 + 8)) },
+	}
+	for name, next := range distributions {
+		histogram := &latencyHistogram{}
+		timings := make([]microseconds, 100000)
+		for i := range timings {
+			timings[i] = next()
+			histogram.record(timings[i])
+		}
+		sort.Slice(timings, func(i, j int) bool { return timings[i] < timings[j] })
+		for _, quantile := range []float64{0.5, 0.9, 0.99, 0.999, 1} {
+			actual := timings[int(math.Ceil(quantile*float64(len(timings))))-1]
+			got := histogram.percentile(quantile)
+			if got < actual || float64(got-actual) > float64(actual)/128 {
+				t.Errorf("Expected %s p%v within 1/128 of %d, got %d", name, quantile*100, actual, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package ph
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metricsContentType is the Prometheus text exposition format served by the metrics endpoint.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metricKind is the Prometheus type of a metric family.
+type metricKind string
+
+const (
+	counterMetric   metricKind = "counter"
+	gaugeMetric     metricKind = "gauge"
+	histogramMetric metricKind = "histogram"
+)
+
+// metricLabel is a label of a sample.
+type metricLabel struct {
+	name  string
+	value string
+}
+
+// metricSample is a single value of a metric family, whose name may have a suffix, as histograms' do.
+type metricSample struct {
+	suffix string
+	labels []metricLabel
+	value  float64
+}
+
+// metricFamily is a named metric with its help and type, and the samples collected for it.
+type metricFamily struct {
+	name    string
+	help    string
+	kind    metricKind
+	samples []metricSample
+}
+
+// metricCollector collects the current metric families of a component, each time metrics are scraped.
+type metricCollector func() []metricFamily
+
+// metricRegistry gathers the metrics of every component registered into it, written in the Prometheus text
+// format. Families are written sorted by name, and those collected by several components under the same name
+// are written as a single one, with the help and type given first.
+type metricRegistry struct {
+	lock       sync.Mutex
+	collectors []metricCollector
+}
+
+// newMetricRegistry creates a registry without any component.
+func newMetricRegistry() *metricRegistry {
+	return &metricRegistry{}
+}
+
+// register adds a component's collector, called each time metrics are scraped.
+func (registry *metricRegistry) register(collector metricCollector) {
+	defer registry.lock.Unlock()
+	registry.lock.Lock()
+	registry.collectors = append(registry.collectors, collector)
+}
+
+// gather collects the families of every component, merging those of the same name.
+func (registry *metricRegistry) gather() []metricFamily {
+	registry.lock.Lock()
+	collectors := append([]metricCollector(nil), registry.collectors...)
+	registry.lock.Unlock()
+
+	var families []metricFamily
+	byName := make(map[string]int)
+	for _, collect := range collectors {
+		for _, family := range collect() {
+			if i, ok := byName[family.name]; ok {
+				families[i].samples = append(families[i].samples, family.samples...)
+				continue
+			}
+			byName[family.name] = len(families)
+			families = append(families, family)
+		}
+	}
+	sort.SliceStable(families, func(i, j int) bool { return families[i].name < families[j].name })
+	return families
+}
+
+// write writes every family with samples in the Prometheus text format.
+func (registry *metricRegistry) write(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	for _, family := range registry.gather() {
+		if len(family.samples) == 0 {
+			continue
+		}
+		out.WriteString("# HELP " + family.name + " " + escapeMetricHelp(family.help) + "\n")
+		out.WriteString("# TYPE " + family.name + " " + string(family.kind) + "\n")
+		for _, sample := range family.samples {
+			out.WriteString(family.name + sample.suffix)
+			if len(sample.labels) > 0 {
+				out.WriteString("{")
+				for i, label := range sample.labels {
+					if i > 0 {
+						out.WriteString(",")
+					}
+					out.WriteString(label.name + `="` + escapeMetricLabel(label.value) + `"`)
+				}
+				out.WriteString("}")
+			}
+			out.WriteString(" " + formatMetricValue(sample.value) + "\n")
+		}
+	}
+	return out.Flush()
+}
+
+// escapeMetricHelp escapes backslashes and line feeds, as help texts must be.
+func escapeMetricHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// escapeMetricLabel escapes backslashes, double quotes and line feeds, as label values must be.
+func escapeMetricLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatMetricValue writes a value as Go would parse it, with infinities and NaN as Prometheus spells them.
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// singleMetric returns a family of a single sample without labels.
+func singleMetric(name string, help string, kind metricKind, value float64) metricFamily {
+	return metricFamily{name: name, help: help, kind: kind, samples: []metricSample{{value: value}}}
+}
+
+// latencyBuckets are the upper bounds in seconds of the latency histograms exposed, as Prometheus clients
+// default to, with finer ones below a millisecond, as hashing takes less than that.
+var latencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogramMetricFamily returns the family of a latency histogram, its buckets counting the timings up to each
+// bound of latencyBuckets, within the precision of the histogram, given the sum of the timings in microseconds.
+func histogramMetricFamily(name string, help string, histogram *latencyHistogram, sum microseconds) metricFamily {
+	family := metricFamily{name: name, help: help, kind: histogramMetric}
+	var seen int64
+	i := 0
+	for _, bound := range latencyBuckets {
+		limit := microseconds(bound * 1e6)
+		for ; i < histogramBuckets && histogramHighest(i) <= limit; i++ {
+			seen += histogram.counts[i]
+		}
+		family.samples = append(family.samples, metricSample{
+			suffix: "_bucket",
+			labels: []metricLabel{{"le", formatMetricValue(bound)}},
+			value:  float64(seen),
+		})
+	}
+	family.samples = append(family.samples,
+		metricSample{suffix: "_bucket", labels: []metricLabel{{"le", "+Inf"}}, value: float64(histogram.count)},
+		metricSample{suffix: "_sum", value: float64(sum) / 1e6},
+		metricSample{suffix: "_count", value: float64(histogram.count)},
+	)
+	return family
+}
+
+// storeMetrics collects the size of the store and its pending hashes, as well as what it expired, evicted or
+// failed to do, from whichever stats the store reports.
+func storeMetrics(store passwordHashStorer) metricCollector {
+	return func() []metricFamily {
+		stats := &serverStats{}
+		store.collectStats(stats)
+		var families []metricFamily
+		pending := func(count int64) {
+			families = append(families, singleMetric("password_hasher_store_pending",
+				"Hashes waiting out their delay.", gaugeMetric, float64(count)))
+		}
+		errors := func(count int64) {
+			families = append(families, singleMetric("password_hasher_store_errors_total",
+				"Failed operations of the store backend.", counterMetric, float64(count)))
+		}
+		if stats.Store != nil {
+			families = append(families, singleMetric("password_hasher_store_records",
+				"Hashes held by the store.", gaugeMetric, float64(stats.Store.Records)))
+			pending(stats.Store.Pending)
+		}
+		if stats.Expiry != nil {
+			families = append(families, singleMetric("password_hasher_store_expired_total",
+				"Hashes expired after their time-to-live.", counterMetric, float64(stats.Expiry.Expired)))
+		}
+		if stats.Capacity != nil {
+			families = append(families,
+				singleMetric("password_hasher_store_bytes", "Estimated bytes held by the store.",
+					gaugeMetric, float64(stats.Capacity.Bytes)),
+				singleMetric("password_hasher_store_evicted_total", "Hashes evicted from a full store.",
+					counterMetric, float64(stats.Capacity.Evicted)),
+				singleMetric("password_hasher_store_rejected_total", "Hashes rejected by a full store.",
+					counterMetric, float64(stats.Capacity.Rejected)))
+		}
+		if stats.SQL != nil {
+			pending(int64(stats.SQL.Pending))
+			errors(stats.SQL.Errors)
+		}
+		if stats.External != nil {
+			pending(int64(stats.External.Pending))
+			errors(stats.External.Errors)
+		}
+		if stats.Resp != nil {
+			errors(stats.Resp.Errors)
+		}
+		return families
+	}
+}
+
+// runtimeMetrics collects the Go runtime stats, named as Prometheus clients do.
+func runtimeMetrics() []metricFamily {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	return []metricFamily{
+		singleMetric("go_goroutines", "Number of goroutines that currently exist.",
+			gaugeMetric, float64(runtime.NumGoroutine())),
+		{name: "go_info", help: "Information about the Go environment.", kind: gaugeMetric,
+			samples: []metricSample{{labels: []metricLabel{{"version", runtime.Version()}}, value: 1}}},
+		singleMetric("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.",
+			gaugeMetric, float64(memStats.Alloc)),
+		singleMetric("go_memstats_sys_bytes", "Number of bytes obtained from system.",
+			gaugeMetric, float64(memStats.Sys)),
+		singleMetric("go_memstats_heap_objects", "Number of allocated objects.",
+			gaugeMetric, float64(memStats.HeapObjects)),
+		singleMetric("go_memstats_mallocs_total", "Total number of mallocs.",
+			counterMetric, float64(memStats.Mallocs)),
+		singleMetric("go_memstats_frees_total", "Total number of frees.",
+			counterMetric, float64(memStats.Frees)),
+		singleMetric("go_memstats_next_gc_bytes", "Number of heap bytes when next garbage collection will take place.",
+			gaugeMetric, float64(memStats.NextGC)),
+		singleMetric("go_gc_cycles_total", "Number of completed garbage collection cycles.",
+			counterMetric, float64(memStats.NumGC)),
+	}
+}
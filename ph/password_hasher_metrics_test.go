@@ -0,0 +1,160 @@
+package ph
+
+import (
+	"bytes"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_metricRegistry(t *testing.T) {
+	registry := newMetricRegistry()
+	registry.register(func() []metricFamily {
+		return []metricFamily{
+			singleMetric("b_total", "Second.", counterMetric, 3),
+			{name: "a_info", help: "First, with \\ and\nlines.", kind: gaugeMetric,
+				samples: []metricSample{{labels: []metricLabel{{"version", `say "hi"`}, {"os", "linux"}}, value: 1}}},
+			{name: "c_empty", help: "Nothing collected.", kind: gaugeMetric},
+		}
+	})
+	registry.register(func() []metricFamily {
+		return []metricFamily{{name: "a_info", help: "Ignored.", kind: gaugeMetric,
+			samples: []metricSample{{labels: []metricLabel{{"version", "other"}}, value: 0.5}}}}
+	})
+	buf := &bytes.Buffer{}
+	if err := registry.write(buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP a_info First, with \\ and\nlines.
+# TYPE a_info gauge
+a_info{version="say \"hi\"",os="linux"} 1
+a_info{version="other"} 0.5
+# HELP b_total Second.
+# TYPE b_total counter
+b_total 3
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected metrics:\n%s", buf.String())
+	}
+}
+
+func Test_formatMetricValue(t *testing.T) {
+	for value, expected := range map[float64]string{
+		0: "0", 42: "42", 0.25: "0.25", 1e21: "1e+21", math.Inf(1): "+Inf", math.Inf(-1): "-Inf",
+	} {
+		if got := formatMetricValue(value); got != expected {
+			t.Errorf("Expected %v to be written as %s, got %s", value, expected, got)
+		}
+	}
+	if got := formatMetricValue(math.NaN()); got != "NaN" {
+		t.Errorf("Expected NaN, got %s", got)
+	}
+}
+
+func Test_histogramMetricFamily(t *testing.T) {
+	histogram := &latencyHistogram{}
+	for _, ms := range []microseconds{50, 100, 900, 3000, 20000000} {
+		histogram.record(ms)
+	}
+	family := histogramMetricFamily("h", "Help.", histogram, 20004050)
+	buckets := map[string]float64{}
+	for _, sample := range family.samples {
+		if sample.suffix == "_bucket" {
+			buckets[sample.labels[0].value] = sample.value
+		}
+	}
+	for bound, expected := range map[string]float64{"0.0001": 2, "0.00025": 2, "0.001": 3, "0.0025": 3, "0.005": 4, "10": 4, "+Inf": 5} {
+		if buckets[bound] != expected {
+			t.Errorf("Expected %v timings up to %s, got %v", expected, bound, buckets[bound])
+		}
+	}
+	last := family.samples[len(family.samples)-2:]
+	if last[0].suffix != "_sum" || last[0].value != 20.00405 || last[1].suffix != "_count" || last[1].value != 5 {
+		t.Errorf("Unexpected sum and count: %+v", last)
+	}
+}
+
+func Test_storeMetrics(t *testing.T) {
+	store := newPasswordHashStore(log.New(&bytes.Buffer{}, "", 0))
+	store.setCapacity(CapacityConfig{MaxRecords: 10})
+	store.storePassword("hash-1", "1", 0, 0)
+	store.storePassword("hash-2", "2", 0, time.Hour)
+	store.storePassword("hash-3", "3", 0, time.Hour)
+	store.deletePassword("3")
+	for i := 0; i < 100; i++ {
+		if _, state := store.retrievePassword("1"); state == hashAvailable {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	registry := newMetricRegistry()
+	registry.register(storeMetrics(store))
+	buf := &bytes.Buffer{}
+	registry.write(buf)
+	for _, line := range []string{"password_hasher_store_records 1\n", "password_hasher_store_pending 1\n",
+		"password_hasher_store_rejected_total 0\n", "# TYPE password_hasher_store_bytes gauge\n"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("Expected %q in metrics:\n%s", line, buf.String())
+		}
+	}
+	store.drainPending(ShutdownConfig{Mode: ShutdownAbandon})
+}
+
+func Test_getMetrics(t *testing.T) {
+	server := NewPasswordHasherServer(log.New(&bytes.Buffer{}, "", 0), WithDelay(DelayConfig{}),
+		WithIdStrategy(SequentialIds, 0), WithIdempotency(IdempotencyConfig{}))
+	defer server.phStore.close()
+	server.phStats.startAccumulating()
+
+	for _, form := range []string{"password=angryMonkey", "password=angryMonkey", "password=angryMonkey&ttl=never"} {
+		r, err := http.NewRequest(http.MethodPost, "/hash", strings.NewReader(form))
+		if err != nil {
+			panic(err)
+		}
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		server.http.Handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	server.phStore.waitPendingStores()
+	server.phStats.stopAccumulating()
+
+	r, err := http.NewRequest(http.MethodGet, "/metrics", nil)
+	if err != nil {
+		panic(err)
+	}
+	w := httptest.NewRecorder()
+	server.http.Handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != metricsContentType {
+		t.Fatalf("Unexpected response, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	for _, line := range []string{
+		"# TYPE password_hasher_requests_total counter\n",
+		"password_hasher_requests_total{code=\"200\"} 2\n",
+		"password_hasher_requests_total{code=\"400\"} 1\n",
+		"# TYPE password_hasher_hash_duration_seconds histogram\n",
+		"password_hasher_hash_duration_seconds_bucket{le=\"+Inf\"} 2\n",
+		"password_hasher_hash_duration_seconds_count 2\n",
+		"password_hasher_store_records 2\n",
+		"password_hasher_store_pending 0\n",
+		"password_hasher_idempotency_keys 0\n",
+		"# TYPE go_goroutines gauge\n",
+		"go_info{version=\"",
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("Expected %q in metrics:\n%s", line, w.Body.String())
+		}
+	}
+
+	r, err = http.NewRequest(http.MethodPost, "/metrics", nil)
+	if err != nil {
+		panic(err)
+	}
+	w = httptest.NewRecorder()
+	server.http.Handler.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected only GET to be allowed, got %d", w.Code)
+	}
+}
@@ -2,48 +2,216 @@ package ph
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 // PasswordHasherServer is an HTTP service that hashes passwords using the SHA512 algorithm, but which
-// imposes a 5-second delay between the hash request and the available hash for... reasons :)
+// imposes a delay (5 seconds by default) between the hash request and the available hash for... reasons :)
 // The service also provides endpoints for stats and graceful shutdown.
 type PasswordHasherServer struct {
-	http     *http.Server
-	stopping bool
-	done     chan bool
-	pwHasher passwordHasher
-	phStore  passwordHashStorer
-	phStats  passwordHasherStater
-	logger   *log.Logger
+	http        *http.Server
+	stopping    int32 // accessed atomically, set once shutting down
+	done        chan bool
+	pwHasher    passwordHasher
+	idGen       idGenerator
+	phStore     passwordHashStorer
+	store       Store
+	external    Store
+	phStats     passwordHasherStater
+	notifier    passwordHashNotifier
+	tokens      retrievalTokenIssuer
+	idempotency *idempotencyCache
+	metrics     *metricRegistry
+	expiry      *ExpiryConfig
+	capacity    *CapacityConfig
+	tombstones  *time.Duration
+	hashLog     *HashLog
+	keys        *KeyRing
+	snapshots   snapshotter
+	rotator     keyRotator
+	dumps       dumpableStore
+	journal     *replicationJournal
+	following   *FollowerConfig
+	follower    *followerPasswordHashStore
+	resp        *RespConfig
+	hashDB      *HashDB
+	cluster     *Cluster
+	drain       ShutdownConfig
+	delays      *DelayConfig
+	hashDelays  delayPolicy
+	shards      int
+	compact     bool
+	admin       string
+	logger      *log.Logger
 }
 
-// NewPasswordHasherServer creates a new hasher server ready to use.
-func NewPasswordHasherServer(logger *log.Logger) *PasswordHasherServer {
+// NewPasswordHasherServer creates a new hasher server ready to use, customized by any given options.
+func NewPasswordHasherServer(logger *log.Logger, options ...ServerOption) *PasswordHasherServer {
 	mux := http.NewServeMux()
 	server := &PasswordHasherServer{
 		http: &http.Server{
 			Addr:    ":8090", // TODO: make it configurable?
 			Handler: mux,
 		},
-		stopping: false,
 		done:     make(chan bool, 1),
 		pwHasher: newSHA512PasswordHasher(),
-		phStore:  newPasswordHashStore(logger, hashDelay),
+		idGen:    newRandomIdGenerator(),
 		phStats:  newPasswordHasherStats(logger),
 		logger:   logger,
 	}
+	for _, option := range options {
+		option(server)
+	}
+	if server.cluster != nil {
+		if _, inOrder := server.idGen.(idAdvancer); inOrder {
+			panic("cluster mode requires random or uuidv7 ids")
+		}
+		server.idGen = newClusterIdGenerator(server.idGen, server.cluster)
+	}
+	server.hashDelays = fixedDelayPolicy(defaultHashDelay)
+	if server.delays != nil {
+		server.hashDelays = newDelayPolicy(*server.delays)
+	}
+	// pending hashes restored from a log or spool are only stored once every listener is registered
+	var restoring configurableStore
+	switch {
+	case server.external != nil:
+		server.phStore = newExternalPasswordHashStore(logger, server.external)
+	case server.resp != nil:
+		server.phStore = server.newRespStore()
+	case server.hashDB != nil:
+		server.phStore = server.newSQLStore()
+	case server.following != nil:
+		store := server.newConfiguredStore()
+		newReplica := func() replicaStore { return server.newConfiguredStore().(replicaStore) }
+		server.follower = newFollowerPasswordHashStore(logger, *server.following, server.admin, store.(replicaStore), newReplica)
+		server.phStore = server.follower
+	default:
+		store := server.newConfiguredStore()
+		store.holdPending()
+		restoring = store
+		server.phStore = store
+		if server.hashLog != nil {
+			logStore := newLogPasswordHashStore(store.(*passwordHashStore), server.hashLog)
+			server.phStore, server.snapshots = logStore, logStore
+		}
+		if server.drain.SpoolFile != "" {
+			if err := store.loadSpool(server.drain.SpoolFile); err != nil {
+				logger.Printf("ERROR: Failed to reload spool: %v", err)
+			}
+		}
+		// ids issued in order must not be issued again after a restart
+		if dumps, ok := server.phStore.(dumpableStore); ok {
+			server.advanceIds(dumps.dumpHashes())
+		}
+		if server.journal != nil {
+			server.phStore = newReplicatingPasswordHashStore(server.phStore, server.journal)
+		}
+	}
+	if server.keys != nil {
+		encrypting := newEncryptingPasswordHashStore(logger, server.phStore, server.keys)
+		server.phStore, server.rotator = encrypting, encrypting
+	}
+	if server.notifier != nil {
+		server.phStore.onStored(server.notifier.hashStored)
+	}
+	server.dumps, _ = server.phStore.(dumpableStore)
+	server.store = storeAdapter{server.phStore}
+	server.metrics = newMetricRegistry()
+	server.phStats.registerMetrics(server.metrics)
+	server.metrics.register(storeMetrics(server.phStore))
+	server.metrics.register(server.collectMetrics)
+	server.metrics.register(runtimeMetrics)
 	mux.HandleFunc("/shutdown", server.shutdownServer)
 	mux.HandleFunc("/stats", server.getStats)
-	mux.HandleFunc("/hash", server.hash)
-	mux.HandleFunc("/hash/", server.getHash)
+	mux.HandleFunc("/metrics", server.getMetrics)
+	mux.HandleFunc("/hash", server.windowed(server.hash))
+	mux.HandleFunc("/hash/", server.hashById)
+	mux.HandleFunc("/admin/snapshot", server.takeSnapshot)
+	mux.HandleFunc("/admin/rotate-key", server.rotateKey)
+	mux.HandleFunc("/admin/dump", server.dumpStore)
+	mux.HandleFunc("/admin/restore", server.restoreStore)
+	mux.HandleFunc("/admin/replicate", server.replicate)
+	mux.HandleFunc("/admin/reload-peers", server.reloadPeers)
+	if restoring != nil {
+		restoring.resumePending()
+	}
 	return server
 }
 
+// newConfiguredStore creates the in-memory store, configured by the options given to the server.
+func (server *PasswordHasherServer) newConfiguredStore() configurableStore {
+	store := server.newStore()
+	if server.expiry != nil {
+		store.setExpiry(*server.expiry)
+	}
+	if server.capacity != nil {
+		store.setCapacity(*server.capacity)
+	}
+	if server.tombstones != nil {
+		store.setTombstoneWindow(*server.tombstones)
+	}
+	if server.compact {
+		store.setCompactDigests()
+	}
+	return store
+}
+
+// newRespStore creates a store kept in a Redis-compatible server, configured by the options which apply to it.
+func (server *PasswordHasherServer) newRespStore() *respPasswordHashStore {
+	store := newRespPasswordHashStore(server.logger, *server.resp)
+	if server.expiry != nil {
+		store.setExpiry(*server.expiry)
+	}
+	if server.tombstones != nil {
+		store.setTombstoneWindow(*server.tombstones)
+	}
+	if server.drain.SpoolFile != "" {
+		if err := store.loadSpool(server.drain.SpoolFile); err != nil {
+			server.logger.Printf("ERROR: Failed to reload spool: %v", err)
+		}
+	}
+	return store
+}
+
+// newSQLStore creates a store kept in a SQL database, configured by the options which apply to it, and
+// reloads the hashes left pending by a previous run, past whose ids those issued in order then start.
+func (server *PasswordHasherServer) newSQLStore() *sqlPasswordHashStore {
+	store := newSQLPasswordHashStore(server.logger, server.hashDB)
+	if server.expiry != nil {
+		store.setExpiry(*server.expiry)
+	}
+	if server.tombstones != nil {
+		store.setTombstoneWindow(*server.tombstones)
+	}
+	if err := store.loadPending(); err != nil {
+		server.logger.Printf("ERROR: Failed to reload pending hashes: %v", err)
+	}
+	// ids issued in order must not be issued again after a restart
+	if advancer, ok := server.idGen.(idAdvancer); ok {
+		if err := store.eachId(advancer.advancePast); err != nil {
+			server.logger.Printf("ERROR: Failed to read the ids stored: %v", err)
+		}
+	}
+	return store
+}
+
+// newStore creates the in-memory store, sharded if asked for and not kept durable by a hash log.
+func (server *PasswordHasherServer) newStore() configurableStore {
+	if server.shards > 1 && (server.hashLog == nil || server.following != nil) {
+		return newShardedPasswordHashStore(server.logger, server.shards)
+	}
+	return newPasswordHashStore(server.logger)
+}
+
 // Run will start the service and wait indefinitely for a call to the shutdown endpoint.
 func (server *PasswordHasherServer) Run() {
 	go server.start()
@@ -56,6 +224,10 @@ func (server *PasswordHasherServer) Run() {
 func (server *PasswordHasherServer) start() {
 	server.logger.Print("Start server...")
 	server.phStats.startAccumulating()
+	server.phStore.startExpiring()
+	if server.follower != nil {
+		server.follower.start()
+	}
 	if err := server.http.ListenAndServe(); err != http.ErrServerClosed {
 		panic(err)
 	}
@@ -66,8 +238,15 @@ type StoppedFunc func()
 
 // stop will halt listening for HTTP traffic, cease accumulating stats, and wait until all password stores are completed.
 func (server *PasswordHasherServer) stop() StoppedFunc {
-	server.phStats.stopAccumulating()
 	server.logger.Print("Stopping server...")
+	server.phStats.stopAccumulating()
+	server.phStore.stopExpiring()
+	if server.follower != nil {
+		server.follower.stop()
+	}
+	if server.journal != nil {
+		server.journal.close()
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	if err := server.http.Shutdown(ctx); err != nil {
 		panic(err)
@@ -75,6 +254,12 @@ func (server *PasswordHasherServer) stop() StoppedFunc {
 	server.logger.Print("Done")
 	return func() {
 		server.phStore.waitPendingStores()
+		if server.notifier != nil {
+			server.notifier.waitPendingDeliveries()
+		}
+		if err := server.phStore.close(); err != nil {
+			server.logger.Printf("ERROR: %v", err)
+		}
 		server.logger.Print("Server Stopped")
 		cancel()
 	}
@@ -87,14 +272,29 @@ func (server *PasswordHasherServer) shutdown() {
 
 // waitShutdown blocks until the respective signal is received.
 func (server *PasswordHasherServer) waitShutdown() {
-	server.stopping = <-server.done
+	if <-server.done {
+		atomic.StoreInt32(&server.stopping, 1)
+	}
+}
+
+// isStopping tells whether the server is shutting down, as handlers check from any goroutine.
+func (server *PasswordHasherServer) isStopping() bool {
+	return atomic.LoadInt32(&server.stopping) != 0
 }
 
 // hash handles the password hashing and its delayed storage, accumulating the time elapsed to complete.
-// The password is expected as a POST'ed form with a field called "password".
+// The password is expected as a POST'ed form, or JSON object, with a field called "password".
+// An optional "callback_url" field asks for the hash to be POST'ed there once stored, if callbacks are enabled.
+// If retrieval tokens are enabled, the token needed to get the hash later is returned in a header.
+// If expiry is enabled, an optional "ttl" field overrides how long the hash is kept, up to the configured maximum.
+// If allowed, an optional "delay" field asks for how long the hash waits, while the tenant it is submitted for is
+// given by a header. The delay chosen is returned in a header.
+// A bounded store that rejects new hashes when full makes this fail with 507.
+// If idempotency is enabled, retrying a request with the same Idempotency-Key header returns the original
+// response, while reusing the key for another request fails with 422, or 409 if still served.
 func (server *PasswordHasherServer) hash(w http.ResponseWriter, req *http.Request) {
 	startTime := time.Now()
-	if server.stopping {
+	if server.isStopping() {
 		stopErrorResponse(server.logger, w)
 		return
 	}
@@ -102,29 +302,148 @@ func (server *PasswordHasherServer) hash(w http.ResponseWriter, req *http.Reques
 		methodErrorResponse(server.logger, w)
 		return
 	}
-	if err := req.ParseForm(); err != nil {
+	if server.follower != nil {
+		readOnlyErrorResponse(server.logger, w)
+		return
+	}
+	if err := parseHashForm(req); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		_, errW := fmt.Fprintf(w, "Bad Form")
 		logWriteError(server.logger, errW)
 		return
 	}
 	password := req.FormValue("password")
+	callbackURL := req.FormValue("callback_url")
+	if callbackURL != "" && (server.notifier == nil || !server.notifier.allowCallback(callbackURL)) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, errW := fmt.Fprintf(w, "Callback Not Allowed")
+		logWriteError(server.logger, errW)
+		return
+	}
+	var ttl time.Duration
+	if value := req.FormValue("ttl"); value != "" {
+		var err error
+		ttl, err = parseDuration(value)
+		if err != nil || ttl <= 0 || server.expiry == nil || (server.expiry.MaxTTL > 0 && ttl > server.expiry.MaxTTL) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, errW := fmt.Fprintf(w, "Invalid TTL")
+			logWriteError(server.logger, errW)
+			return
+		}
+	}
+	delay := delayRequest{tenant: req.Header.Get(tenantHeader)}
+	if value := req.FormValue("delay"); value != "" {
+		var err error
+		delay.delay, err = parseDuration(value)
+		if err != nil || delay.delay < 0 {
+			invalidDelayResponse(server.logger, w)
+			return
+		}
+		delay.requested = true
+	}
+	idempotent := ""
+	if key := req.Header.Get(idempotencyKeyHeader); key != "" && server.idempotency != nil {
+		if len(key) > maxIdempotencyKeyLength {
+			w.WriteHeader(http.StatusBadRequest)
+			_, errW := fmt.Fprintf(w, "Invalid Idempotency Key")
+			logWriteError(server.logger, errW)
+			return
+		}
+		idempotent = scopedIdempotencyKey(req, key)
+		response, outcome := server.idempotency.begin(idempotent, server.idempotency.fingerprint(req))
+		switch outcome {
+		case idempotencyReplay:
+			w.Header().Set(idempotentReplayedHeader, "true")
+			server.hashResponse(w, *response)
+			server.phStats.accumulateTiming(time.Since(startTime))
+			return
+		case idempotencyMismatch:
+			idempotencyMismatchResponse(server.logger, w)
+			return
+		case idempotencyInFlight:
+			idempotencyConflictResponse(server.logger, w)
+			return
+		}
+	}
 
 	// Hash the password and store it.
 	// Note that the plain-text password (hopefully) dies with this callstack.
 	// TODO: Maybe protect the memory around the plain-text password?
-	hashed, id := server.pwHasher.hashPassword(password)
-	server.phStore.storePassword(hashed, id)
+	hashed := server.pwHasher.hashPassword(password)
+	id := server.idGen.nextId()
+	if callbackURL != "" {
+		server.notifier.registerCallback(id, callbackURL)
+	}
+	chosen, err := server.hashDelays.delayFor(delay)
+	if err == nil {
+		err = server.store.Put(req.Context(), id, hashed, PutOptions{Delay: chosen, TTL: ttl})
+	} else {
+		server.logger.Printf("Refused delay of %v for %s", delay.delay, id)
+	}
+	if err != nil {
+		if callbackURL != "" {
+			server.notifier.forgetCallback(id)
+		}
+		if idempotent != "" {
+			server.idempotency.abandon(idempotent)
+		}
+		if errors.Is(err, errStoreFull) {
+			storeFullErrorResponse(server.logger, w)
+		} else if errors.Is(err, errInvalidDelay) {
+			invalidDelayResponse(server.logger, w)
+		} else {
+			internalErrorResponse(server.logger, w)
+		}
+		return
+	}
 
-	_, errW := fmt.Fprintf(w, "%d", id)
-	logWriteError(server.logger, errW)
+	response := idempotentResponse{id: id, delay: chosen}
+	if server.tokens != nil {
+		response.token = server.tokens.issueToken(id)
+	}
+	if idempotent != "" {
+		server.idempotency.complete(idempotent, response)
+	}
+	server.hashResponse(w, response)
 	finishTime := time.Now()
 	server.phStats.accumulateTiming(finishTime.Sub(startTime))
 }
 
-// getHash obtains the password hash for a given id in the URL path.
+// windowed counts every request served by the handler in the recent windows, as failed if it answered with a
+// server error.
+func (server *PasswordHasherServer) windowed(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		startTime := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(recorder, req)
+		server.phStats.accumulateRequest(time.Since(startTime), recorder.status)
+	}
+}
+
+// hashResponse returns the id of a hash, along with its retrieval token, if any, and the delay chosen for it.
+func (server *PasswordHasherServer) hashResponse(w http.ResponseWriter, response idempotentResponse) {
+	if response.token != "" {
+		w.Header().Set(retrievalTokenHeader, response.token)
+	}
+	w.Header().Set(hashDelayHeader, response.delay.String())
+	_, errW := fmt.Fprintf(w, "%s", response.id)
+	logWriteError(server.logger, errW)
+}
+
+// hashById dispatches requests for a given id to either get or delete its hash.
+func (server *PasswordHasherServer) hashById(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "DELETE" {
+		server.deleteHash(w, req)
+	} else {
+		server.getHash(w, req)
+	}
+}
+
+// getHash obtains the password hash for a given id in the URL path, or 410 if it has expired or was deleted.
+// If retrieval tokens are enabled, the token issued along with the id is required as a bearer token.
+// In a cluster, requests for ids owned by another node are forwarded to it.
 func (server *PasswordHasherServer) getHash(w http.ResponseWriter, req *http.Request) {
-	if server.stopping {
+	if server.isStopping() {
 		stopErrorResponse(server.logger, w)
 		return
 	}
@@ -132,27 +451,368 @@ func (server *PasswordHasherServer) getHash(w http.ResponseWriter, req *http.Req
 		methodErrorResponse(server.logger, w)
 		return
 	}
-	value := req.URL.Path[len("/hash/"):]
-	id, err := strconv.ParseInt(value, 10, 64)
-	if err != nil {
+	id := req.URL.Path[len("/hash/"):]
+	if !server.idGen.validId(id) {
 		w.WriteHeader(http.StatusBadRequest)
 		_, errW := fmt.Fprintf(w, "Invalid ID")
 		logWriteError(server.logger, errW)
 		return
 	}
-	password := server.phStore.retrievePassword(id)
-	if password == "" {
+	if server.forwardToOwner(w, req, id) {
+		return
+	}
+	if server.tokens != nil {
+		switch err := server.tokens.verifyToken(id, requestToken(req)); err {
+		case nil:
+		case errExpiredToken:
+			goneErrorResponse(server.logger, w, "Token Expired")
+			return
+		default:
+			forbiddenErrorResponse(server.logger, w)
+			return
+		}
+	}
+	password, err := server.store.Get(req.Context(), id)
+	switch {
+	case err == nil:
+		_, errW := fmt.Fprintf(w, "%s", password)
+		logWriteError(server.logger, errW)
+	case errors.Is(err, ErrExpired):
+		goneErrorResponse(server.logger, w, "Expired")
+	case errors.Is(err, ErrDeleted):
+		goneErrorResponse(server.logger, w, "Deleted")
+	case errors.Is(err, ErrPending), errors.Is(err, ErrNotFound):
 		_, errW := fmt.Fprintf(w, "")
 		logWriteError(server.logger, errW)
+	default:
+		internalErrorResponse(server.logger, w)
+	}
+}
+
+// deleteHash removes the password hash for a given id in the URL path, cancelling it if still pending.
+// Callers must present either the admin token or the retrieval token issued along with the id,
+// and each deletion is logged with who asked for it. In a cluster, it is forwarded to the node owning the id.
+func (server *PasswordHasherServer) deleteHash(w http.ResponseWriter, req *http.Request) {
+	if server.isStopping() {
+		stopErrorResponse(server.logger, w)
+		return
+	}
+	if req.Method != "DELETE" {
+		methodErrorResponse(server.logger, w)
+		return
+	}
+	if server.follower != nil {
+		readOnlyErrorResponse(server.logger, w)
+		return
+	}
+	id := req.URL.Path[len("/hash/"):]
+	if !server.idGen.validId(id) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, errW := fmt.Fprintf(w, "Invalid ID")
+		logWriteError(server.logger, errW)
+		return
+	}
+	if server.forwardToOwner(w, req, id) {
+		return
+	}
+	caller, ok := server.authorizeDelete(req, id)
+	if !ok {
+		server.logger.Printf("Refused to delete %s for %s", id, req.RemoteAddr)
+		forbiddenErrorResponse(server.logger, w)
+		return
+	}
+
+	switch err := server.store.Delete(req.Context(), id); {
+	case err == nil:
+		if server.notifier != nil {
+			server.notifier.forgetCallback(id)
+		}
+		server.logger.Printf("Deleted %s for %s", id, caller)
+		_, errW := fmt.Fprintf(w, "Deleted")
+		logWriteError(server.logger, errW)
+	case errors.Is(err, ErrDeleted):
+		goneErrorResponse(server.logger, w, "Deleted")
+	case errors.Is(err, ErrExpired):
+		goneErrorResponse(server.logger, w, "Expired")
+	case errors.Is(err, ErrNotFound):
+		notFoundErrorResponse(server.logger, w)
+	default:
+		internalErrorResponse(server.logger, w)
+	}
+}
+
+// forwardToOwner forwards the request to the node owning the id, if in a cluster and another node owns it,
+// answering 502 if that node cannot be reached. Requests already forwarded by another node are served
+// here, in case their rings disagree while the peers are reloaded. It tells whether the request was handled.
+func (server *PasswordHasherServer) forwardToOwner(w http.ResponseWriter, req *http.Request, id string) bool {
+	if server.cluster == nil || req.Header.Get(clusterForwardedHeader) != "" {
+		return false
+	}
+	owner, self := server.cluster.owner(id)
+	if self {
+		return false
+	}
+	if !server.cluster.forward(server.logger, w, req, owner) {
+		badGatewayErrorResponse(server.logger, w)
+	}
+	return true
+}
+
+// authorizeDelete tells whether the request may delete the id, and who the caller is.
+func (server *PasswordHasherServer) authorizeDelete(req *http.Request, id string) (string, bool) {
+	if server.authorizeAdmin(req) {
+		return "admin at " + req.RemoteAddr, true
+	}
+	if server.tokens != nil {
+		token := requestToken(req)
+		if server.tokens.verifyToken(id, token) == nil {
+			return "token " + token[:strings.Index(token, ".")] + " holder at " + req.RemoteAddr, true
+		}
+	}
+	return "", false
+}
+
+// authorizeAdmin tells whether the request carries the admin token, if one is configured.
+func (server *PasswordHasherServer) authorizeAdmin(req *http.Request) bool {
+	if server.admin == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(requestToken(req)), []byte(server.admin)) == 1
+}
+
+// takeSnapshot has a durable store take a snapshot of itself right away, compacting its log.
+// It requires the admin token, and is not found unless the store is durable.
+func (server *PasswordHasherServer) takeSnapshot(w http.ResponseWriter, req *http.Request) {
+	if server.isStopping() {
+		stopErrorResponse(server.logger, w)
+		return
+	}
+	if req.Method != "POST" {
+		methodErrorResponse(server.logger, w)
+		return
+	}
+	if !server.authorizeAdmin(req) {
+		server.logger.Printf("Refused to take snapshot for %s", req.RemoteAddr)
+		forbiddenErrorResponse(server.logger, w)
+		return
+	}
+	if server.snapshots == nil {
+		notFoundErrorResponse(server.logger, w)
+		return
+	}
+
+	if _, err := server.snapshots.snapshot(); err != nil {
+		server.logger.Printf("ERROR: Failed to take snapshot: %v", err)
+		internalErrorResponse(server.logger, w)
+		return
+	}
+	server.logger.Printf("Snapshot taken for admin at %s", req.RemoteAddr)
+	_, errW := fmt.Fprintf(w, "Snapshot Taken")
+	logWriteError(server.logger, errW)
+}
+
+// rotateKey has an encrypting store switch to a new data key, re-encrypting stored hashes in the background.
+// It requires the admin token, and is not found unless the store is encrypted.
+func (server *PasswordHasherServer) rotateKey(w http.ResponseWriter, req *http.Request) {
+	if server.isStopping() {
+		stopErrorResponse(server.logger, w)
+		return
+	}
+	if req.Method != "POST" {
+		methodErrorResponse(server.logger, w)
+		return
+	}
+	if !server.authorizeAdmin(req) {
+		server.logger.Printf("Refused to rotate key for %s", req.RemoteAddr)
+		forbiddenErrorResponse(server.logger, w)
+		return
+	}
+	if server.rotator == nil {
+		notFoundErrorResponse(server.logger, w)
+		return
+	}
+
+	kid, err := server.rotator.rotateKey()
+	if err != nil {
+		server.logger.Printf("ERROR: Failed to rotate key: %v", err)
+		internalErrorResponse(server.logger, w)
+		return
+	}
+	server.logger.Printf("Key rotated for admin at %s", req.RemoteAddr)
+	_, errW := fmt.Fprintf(w, "%s", kid)
+	logWriteError(server.logger, errW)
+}
+
+// dumpStore returns every record of the store as of now as JSON Lines: stored and pending hashes, as well as
+// expired and deleted ids, along with when each expires, is due or is forgotten. It requires the admin token.
+func (server *PasswordHasherServer) dumpStore(w http.ResponseWriter, req *http.Request) {
+	if server.isStopping() {
+		stopErrorResponse(server.logger, w)
+		return
+	}
+	if req.Method != "GET" {
+		methodErrorResponse(server.logger, w)
+		return
+	}
+	if !server.authorizeAdmin(req) {
+		server.logger.Printf("Refused to dump store for %s", req.RemoteAddr)
+		forbiddenErrorResponse(server.logger, w)
+		return
+	}
+	if server.dumps == nil {
+		notFoundErrorResponse(server.logger, w)
+		return
+	}
+
+	dumped := server.dumps.dumpHashes()
+	w.Header().Set("Content-Type", dumpContentType)
+	if err := writeDump(w, dumped); err != nil {
+		server.logger.Printf("ERROR: Failed to write dump: %v", err)
+		return
+	}
+	server.logger.Printf("Dumped %d records for admin at %s", len(dumped), req.RemoteAddr)
+}
+
+// restoreStore puts back the records of a dump POST'ed as JSON Lines, returning how many were restored as JSON.
+// Every record is validated before any is restored, while ids already known are skipped, so restoring the same
+// dump again changes nothing. Ids are never issued again afterwards. It requires the admin token.
+func (server *PasswordHasherServer) restoreStore(w http.ResponseWriter, req *http.Request) {
+	if server.isStopping() {
+		stopErrorResponse(server.logger, w)
+		return
+	}
+	if req.Method != "POST" {
+		methodErrorResponse(server.logger, w)
+		return
+	}
+	if !server.authorizeAdmin(req) {
+		server.logger.Printf("Refused to restore store for %s", req.RemoteAddr)
+		forbiddenErrorResponse(server.logger, w)
+		return
+	}
+	if server.dumps == nil {
+		notFoundErrorResponse(server.logger, w)
+		return
+	}
+
+	hashes, err := readDump(req.Body, server.idGen.validId)
+	if err != nil {
+		invalidDumpResponse(server.logger, w, err)
+		return
+	}
+	report, err := server.dumps.restoreHashes(hashes)
+	if errors.Is(err, errInvalidDump) {
+		invalidDumpResponse(server.logger, w, err)
+		return
+	} else if errors.Is(err, errReadOnly) {
+		readOnlyErrorResponse(server.logger, w)
+		return
+	} else if err != nil {
+		server.logger.Printf("ERROR: Failed to restore: %v", err)
+		internalErrorResponse(server.logger, w)
+		return
+	}
+	server.advanceIds(hashes)
+	server.logger.Printf("Restored %d records, skipped %d, rejected %d, for admin at %s",
+		report.Restored, report.Skipped, report.Rejected, req.RemoteAddr)
+	data, err := json.Marshal(report)
+	if err != nil {
+		server.logger.Printf("ERROR: %v", err)
+		internalErrorResponse(server.logger, w)
+		return
+	}
+	_, errW := w.Write(data)
+	logWriteError(server.logger, errW)
+}
+
+// advanceIds moves the id generator past every restored id, if it issues ids in order.
+func (server *PasswordHasherServer) advanceIds(hashes []dumpedHash) {
+	if advancer, ok := server.idGen.(idAdvancer); ok {
+		for _, hash := range hashes {
+			advancer.advancePast(hash.Id)
+		}
+	}
+}
+
+// replicate streams the mutations of the store to a follower as JSON Lines, from after the epoch and sequence number
+// given as query parameters, until either side disconnects. Followers too far behind get a snapshot first.
+// It requires the admin token, and is not found unless the server is a primary.
+func (server *PasswordHasherServer) replicate(w http.ResponseWriter, req *http.Request) {
+	if server.isStopping() {
+		stopErrorResponse(server.logger, w)
+		return
+	}
+	if req.Method != "GET" {
+		methodErrorResponse(server.logger, w)
+		return
+	}
+	if !server.authorizeAdmin(req) {
+		server.logger.Printf("Refused to replicate for %s", req.RemoteAddr)
+		forbiddenErrorResponse(server.logger, w)
+		return
+	}
+	if server.journal == nil || server.dumps == nil {
+		notFoundErrorResponse(server.logger, w)
+		return
+	}
+
+	epoch, after := parseReplicationPosition(req)
+	w.Header().Set("Content-Type", dumpContentType)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	server.logger.Printf("Replicating after %s/%d for admin at %s", epoch, after, req.RemoteAddr)
+	err := server.journal.stream(req.Context(), epoch, after, server.dumps, func(event replicationEvent) error {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	server.logger.Printf("Stopped replicating for admin at %s: %v", req.RemoteAddr, err)
+}
+
+// reloadPeers has a cluster node read its peers file again, rebuilding the ring of which node owns which ids.
+// It requires the admin token, and is not found unless in a cluster.
+func (server *PasswordHasherServer) reloadPeers(w http.ResponseWriter, req *http.Request) {
+	if server.isStopping() {
+		stopErrorResponse(server.logger, w)
+		return
+	}
+	if req.Method != "POST" {
+		methodErrorResponse(server.logger, w)
+		return
+	}
+	if !server.authorizeAdmin(req) {
+		server.logger.Printf("Refused to reload peers for %s", req.RemoteAddr)
+		forbiddenErrorResponse(server.logger, w)
+		return
+	}
+	if server.cluster == nil {
+		notFoundErrorResponse(server.logger, w)
+		return
+	}
+
+	if err := server.cluster.Reload(); err != nil {
+		server.logger.Printf("ERROR: Failed to reload peers: %v", err)
+		internalErrorResponse(server.logger, w)
 		return
 	}
-	_, errW := fmt.Fprintf(w, "%s", password)
+	peers := server.cluster.peerCount()
+	server.logger.Printf("Reloaded %d peers for admin at %s", peers, req.RemoteAddr)
+	_, errW := fmt.Fprintf(w, "%d", peers)
 	logWriteError(server.logger, errW)
 }
 
-// getStats returns the current server stats (`total` passwords and `average` hashing time) as JSON.
+// getStats returns the current server stats (`total` passwords and `average` hashing time) as JSON, along with
+// the `latency` percentiles, the `timing` count, sum, min, max, mean and variance, and the rates and timings over
+// the last 1, 5 and 15 minutes under `windows`.
+// The in-memory `store` size is included, as are callback delivery results under `callbacks` when callbacks are
+// enabled, `expiry` counts, `capacity` usage, the `log` size, `encryption` keys, `replication` lag and `cluster`
+// forwarding.
 func (server *PasswordHasherServer) getStats(w http.ResponseWriter, req *http.Request) {
-	if server.stopping {
+	if server.isStopping() {
 		stopErrorResponse(server.logger, w)
 		return
 	}
@@ -161,8 +821,22 @@ func (server *PasswordHasherServer) getStats(w http.ResponseWriter, req *http.Re
 		return
 	}
 
-	total, avg := server.phStats.generateStats()
-	if data, ok := statsToJson(server.logger, total, avg); ok {
+	stats := &serverStats{}
+	stats.Total, stats.Average = server.phStats.generateStats()
+	stats.Latency = server.phStats.latencyPercentiles()
+	stats.Timing = server.phStats.timingStats()
+	stats.Windows = server.phStats.windowStats()
+	if server.notifier != nil {
+		stats.Callbacks = server.notifier.callbackStats()
+	}
+	server.phStore.collectStats(stats)
+	if server.cluster != nil {
+		stats.Cluster = server.cluster.stats()
+	}
+	if server.idempotency != nil {
+		stats.Idempotency = server.idempotency.stats()
+	}
+	if data, ok := statsToJson(server.logger, stats); ok {
 		_, errW := w.Write(data)
 		logWriteError(server.logger, errW)
 	} else {
@@ -172,11 +846,61 @@ func (server *PasswordHasherServer) getStats(w http.ResponseWriter, req *http.Re
 	}
 }
 
+// getMetrics returns the metrics of the hasher, its store and stats, and the Go runtime, in the Prometheus text
+// format, for monitoring systems to scrape.
+func (server *PasswordHasherServer) getMetrics(w http.ResponseWriter, req *http.Request) {
+	if server.isStopping() {
+		stopErrorResponse(server.logger, w)
+		return
+	}
+	if req.Method != "GET" {
+		methodErrorResponse(server.logger, w)
+		return
+	}
+	if server.metrics == nil {
+		notFoundErrorResponse(server.logger, w)
+		return
+	}
+	w.Header().Set("Content-Type", metricsContentType)
+	logWriteError(server.logger, server.metrics.write(w))
+}
+
+// collectMetrics returns the metrics of the hasher itself: its callback deliveries and idempotency keys, when
+// enabled.
+func (server *PasswordHasherServer) collectMetrics() []metricFamily {
+	var families []metricFamily
+	if server.notifier != nil {
+		stats := server.notifier.callbackStats()
+		deliveries := metricFamily{name: "password_hasher_callbacks_total", help: "Callback deliveries by result.", kind: counterMetric}
+		for _, result := range []struct {
+			name  string
+			count int64
+		}{{"delivered", stats.Delivered}, {"retried", stats.Retried}, {"failed", stats.Failed}} {
+			deliveries.samples = append(deliveries.samples, metricSample{
+				labels: []metricLabel{{"result", result.name}},
+				value:  float64(result.count),
+			})
+		}
+		families = append(families, deliveries, singleMetric("password_hasher_callbacks_pending",
+			"Callbacks waiting to be delivered.", gaugeMetric, float64(stats.Pending)))
+	}
+	if server.idempotency != nil {
+		stats := server.idempotency.stats()
+		families = append(families,
+			singleMetric("password_hasher_idempotency_keys", "Idempotency keys remembered.",
+				gaugeMetric, float64(stats.Keys)),
+			singleMetric("password_hasher_idempotent_replays_total", "Hash requests replayed for their idempotency key.",
+				counterMetric, float64(stats.Replayed)))
+	}
+	return families
+}
+
 // shutdown initiates the server graceful shutdown, after this all endpoints will stop to respond.
-// The process may take up to 5 seconds to complete due to pending hash operations.
+// Pending hashes are dealt with according to the shutdown mode first, which by default waits out their delay
+// for up to 5 seconds. How many pending stores each path affected is returned as JSON.
 // FIXME: Anyone reaching this service can shut it down. Don't we want to protect this a bit more?
 func (server *PasswordHasherServer) shutdownServer(w http.ResponseWriter, req *http.Request) {
-	if server.stopping {
+	if server.isStopping() {
 		stopErrorResponse(server.logger, w)
 		return
 	}
@@ -184,5 +908,24 @@ func (server *PasswordHasherServer) shutdownServer(w http.ResponseWriter, req *h
 		methodErrorResponse(server.logger, w)
 		return
 	}
-	server.shutdown()
+	if !atomic.CompareAndSwapInt32(&server.stopping, 0, 1) {
+		stopErrorResponse(server.logger, w)
+		return
+	}
+	defer server.shutdown()
+
+	report, err := server.phStore.drainPending(server.drain)
+	if err != nil {
+		server.logger.Printf("ERROR: Failed to drain pending stores: %v", err)
+		internalErrorResponse(server.logger, w)
+		return
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		server.logger.Printf("ERROR: %v", err)
+		internalErrorResponse(server.logger, w)
+		return
+	}
+	_, errW := w.Write(data)
+	logWriteError(server.logger, errW)
 }
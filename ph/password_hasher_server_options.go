@@ -0,0 +1,162 @@
+package ph
+
+import (
+	"time"
+)
+
+// ServerOption customizes a PasswordHasherServer when passed to NewPasswordHasherServer.
+type ServerOption func(server *PasswordHasherServer)
+
+// WithCallbacks enables webhook callbacks for hashes submitted with a `callback_url`.
+func WithCallbacks(config CallbackConfig) ServerOption {
+	return func(server *PasswordHasherServer) {
+		server.notifier = newWebhookNotifier(server.logger, config)
+	}
+}
+
+// WithIdStrategy selects how ids are issued. The node id (0-1023) is only used by SnowflakeIds, and must be
+// checked with ValidateIdNode beforehand, as one out of that range panics.
+func WithIdStrategy(strategy IdStrategy, node int64) ServerOption {
+	return func(server *PasswordHasherServer) {
+		server.idGen = newIdGenerator(strategy, node)
+	}
+}
+
+// WithRetrievalTokens requires the signed token returned along with each id to get its hash.
+func WithRetrievalTokens(config TokenConfig) ServerOption {
+	return func(server *PasswordHasherServer) {
+		server.tokens = newHMACTokenIssuer(config)
+	}
+}
+
+// WithExpiry removes stored hashes once their time-to-live has passed, and accepts a `ttl` per hash.
+func WithExpiry(config ExpiryConfig) ServerOption {
+	return func(server *PasswordHasherServer) {
+		server.expiry = &config
+	}
+}
+
+// WithCapacity bounds how many hashes, and how many bytes of them, the store may hold.
+func WithCapacity(config CapacityConfig) ServerOption {
+	return func(server *PasswordHasherServer) {
+		server.capacity = &config
+	}
+}
+
+// WithTombstoneWindow changes how long deleted ids are remembered as such (24 hours by default).
+func WithTombstoneWindow(window time.Duration) ServerOption {
+	return func(server *PasswordHasherServer) {
+		server.tombstones = &window
+	}
+}
+
+// WithAdminToken sets the bearer token that authorizes administrative requests, such as deleting any hash.
+func WithAdminToken(token string) ServerOption {
+	return func(server *PasswordHasherServer) {
+		server.admin = token
+	}
+}
+
+// WithHashLog makes stored hashes durable by logging them, and rebuilds the store from whatever the log holds.
+// The log is closed when the server stops.
+func WithHashLog(hashLog *HashLog) ServerOption {
+	return func(server *PasswordHasherServer) {
+		server.hashLog = hashLog
+	}
+}
+
+// WithEncryption seals stored hashes with data keys from the given ring, so they are encrypted at rest.
+func WithEncryption(keys *KeyRing) ServerOption {
+	return func(server *PasswordHasherServer) {
+		server.keys = keys
+	}
+}
+
+// WithShutdown selects what happens to pending hashes on shutdown, instead of waiting out their delay.
+func WithShutdown(config ShutdownConfig) ServerOption {
+	return func(server *PasswordHasherServer) {
+		server.drain = config
+	}
+}
+
+// WithDelay changes how long hashes wait before becoming available, possibly per tenant or per hash.
+func WithDelay(config DelayConfig) ServerOption {
+	return func(server *PasswordHasherServer) {
+		server.delays = &config
+	}
+}
+
+// WithShards partitions the store across the given number of independently locked shards, so concurrent
+// requests for different ids rarely wait on each other. It does not apply to a store kept durable WithHashLog.
+func WithShards(shards int) ServerOption {
+	return func(server *PasswordHasherServer) {
+		server.shards = shards
+	}
+}
+
+// WithCompactStore keeps stored hashes in large preallocated arenas rather than a map, as raw digests where
+// possible, which takes less memory and leaves the garbage collector little to scan with many hashes stored.
+func WithCompactStore() ServerOption {
+	return func(server *PasswordHasherServer) {
+		server.compact = true
+	}
+}
+
+// WithReplicationJournal makes the server a primary, journaling the given number of latest mutations of its store
+// (100000 by default) so followers can catch up from where they left off.
+func WithReplicationJournal(size int) ServerOption {
+	return func(server *PasswordHasherServer) {
+		server.journal = newReplicationJournal(size)
+	}
+}
+
+// WithFollower makes the server a read-only follower of the given primary, mirroring its store.
+// The follower authenticates WithAdminToken, and is neither durable nor spools pending hashes.
+func WithFollower(config FollowerConfig) ServerOption {
+	return func(server *PasswordHasherServer) {
+		server.following = &config
+	}
+}
+
+// WithCluster makes the server a node of the given cluster, issuing only ids it owns, and forwarding requests
+// for other ids to the nodes owning them. Ids must not be issued in order, as checked by ValidateClusterIds,
+// since the server panics otherwise.
+func WithCluster(cluster *Cluster) ServerOption {
+	return func(server *PasswordHasherServer) {
+		server.cluster = cluster
+	}
+}
+
+// WithRespStore keeps stored hashes in a Redis-compatible server rather than in memory. Delays, expiry and
+// tombstones apply, while capacity bounds, sharding, compact storage, hash logs and replication do not.
+func WithRespStore(config RespConfig) ServerOption {
+	return func(server *PasswordHasherServer) {
+		server.resp = &config
+	}
+}
+
+// WithHashDB keeps stored hashes in the given SQL database rather than in memory, pending ones included, so
+// they survive a restart. Delays, expiry and tombstones apply, while capacity bounds, sharding, compact storage,
+// hash logs, spooling and replication do not.
+func WithHashDB(hashDB *HashDB) ServerOption {
+	return func(server *PasswordHasherServer) {
+		server.hashDB = hashDB
+	}
+}
+
+// WithStore keeps stored hashes in the given Store rather than in memory, handing it the delay chosen for each
+// hash. Encryption and callbacks apply, while expiry and tombstones are up to the Store, and capacity bounds,
+// sharding, compact storage, hash logs, spooling and replication do not apply.
+func WithStore(store Store) ServerOption {
+	return func(server *PasswordHasherServer) {
+		server.external = store
+	}
+}
+
+// WithIdempotency honors the Idempotency-Key header of hash requests: retrying a request with the same key
+// within the window returns the id of the original one, while reusing the key for another request fails.
+func WithIdempotency(config IdempotencyConfig) ServerOption {
+	return func(server *PasswordHasherServer) {
+		server.idempotency = newIdempotencyCache(config)
+	}
+}
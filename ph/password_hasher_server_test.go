@@ -6,6 +6,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -15,13 +18,16 @@ func Test_NewPasswordHasherServer(t *testing.T) {
 	if server.pwHasher == nil {
 		t.Error("Expected hasher to not be nil")
 	}
+	if _, ok := server.idGen.(*randomIdGenerator); !ok {
+		t.Error("Expected random ids by default")
+	}
 	if server.phStore == nil {
 		t.Error("Expected store to not be nil")
 	}
 	if server.phStats == nil {
 		t.Error("Expected stats to not be nil")
 	}
-	if server.stopping == true {
+	if server.isStopping() {
 		t.Error("Expected to not be stopping")
 	}
 
@@ -40,7 +46,7 @@ func Test_NewPasswordHasherServer(t *testing.T) {
 }
 
 func Test_stoppingResponse(t *testing.T) {
-	server := &PasswordHasherServer{stopping: true}
+	server := &PasswordHasherServer{stopping: 1}
 
 	w := httptest.NewRecorder()
 	server.hash(w, &http.Request{})
@@ -57,6 +63,18 @@ func Test_stoppingResponse(t *testing.T) {
 	w = httptest.NewRecorder()
 	server.shutdownServer(w, &http.Request{})
 	Test_stopErrorResponse(t)
+
+	w = httptest.NewRecorder()
+	server.deleteHash(w, &http.Request{})
+	Test_stopErrorResponse(t)
+
+	w = httptest.NewRecorder()
+	server.takeSnapshot(w, &http.Request{})
+	Test_stopErrorResponse(t)
+
+	w = httptest.NewRecorder()
+	server.rotateKey(w, &http.Request{})
+	Test_stopErrorResponse(t)
 }
 
 func Test_methodResponse(t *testing.T) {
@@ -77,6 +95,18 @@ func Test_methodResponse(t *testing.T) {
 	w = httptest.NewRecorder()
 	server.shutdownServer(w, &http.Request{Method: http.MethodPost})
 	Test_methodErrorResponse(t)
+
+	w = httptest.NewRecorder()
+	server.deleteHash(w, &http.Request{Method: http.MethodGet})
+	Test_methodErrorResponse(t)
+
+	w = httptest.NewRecorder()
+	server.takeSnapshot(w, &http.Request{Method: http.MethodGet})
+	Test_methodErrorResponse(t)
+
+	w = httptest.NewRecorder()
+	server.rotateKey(w, &http.Request{Method: http.MethodGet})
+	Test_methodErrorResponse(t)
 }
 
 func Test_hashBadForm(t *testing.T) {
@@ -94,7 +124,7 @@ func Test_hashBadForm(t *testing.T) {
 }
 
 func Test_getHashInvalidId(t *testing.T) {
-	server := &PasswordHasherServer{}
+	server := &PasswordHasherServer{idGen: newSequentialIdGenerator()}
 
 	w := httptest.NewRecorder()
 	server.getHash(w, &http.Request{Method: http.MethodGet, URL: &url.URL{Path: "/hash/bogus"}})
@@ -108,21 +138,22 @@ func Test_getHashInvalidId(t *testing.T) {
 }
 
 func Test_hash(t *testing.T) {
-	server := &PasswordHasherServer{
+	server := withStore(&PasswordHasherServer{
 		pwHasher: &MockHasher{
 			expected: "test",
 			t:        t,
 		},
+		idGen: &MockIdGenerator{id: "42"},
 		phStore: &MockStore{
 			hash:     "test",
 			expected: "very-hashed",
-			id:       42,
+			id:       "42",
 			t:        t,
 		},
 		phStats: &MockStats{
 			t: t,
 		},
-	}
+	})
 
 	w := httptest.NewRecorder()
 	buf := bytes.NewReader([]byte("password=test"))
@@ -141,14 +172,794 @@ func Test_hash(t *testing.T) {
 	}
 }
 
-func Test_getHashNone(t *testing.T) {
+func Test_hashCallbackNotAllowed(t *testing.T) {
 	server := &PasswordHasherServer{
+		notifier: newWebhookNotifier(nil, CallbackConfig{Allowlist: []string{"hooks.example.com"}}),
+	}
+
+	for _, notifier := range []passwordHashNotifier{nil, server.notifier} {
+		server.notifier = notifier
+		w := httptest.NewRecorder()
+		buf := bytes.NewReader([]byte("password=test&callback_url=http%3A%2F%2Fevil.example.com%2F"))
+		r, err := http.NewRequest(http.MethodPost, "", buf)
+		if err != nil {
+			panic(err)
+		}
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		server.hash(w, r)
+
+		if w.Body.String() != "Callback Not Allowed" {
+			t.Errorf("Unexpected body, got %s", w.Body.String())
+		}
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Unexpected code, got %d", w.Code)
+		}
+	}
+}
+
+func Test_hashCallback(t *testing.T) {
+	notifier := &MockNotifier{}
+	server := withStore(&PasswordHasherServer{
+		pwHasher: &MockHasher{
+			expected: "test",
+			t:        t,
+		},
+		idGen: &MockIdGenerator{id: "42"},
 		phStore: &MockStore{
-			hash: "",
-			id:   42,
+			expected: "very-hashed",
+			id:       "42",
+			t:        t,
+		},
+		phStats:  &MockStats{t: t},
+		notifier: notifier,
+	})
+
+	w := httptest.NewRecorder()
+	buf := bytes.NewReader([]byte("password=test&callback_url=https%3A%2F%2Fhooks.example.com%2Fdone"))
+	r, err := http.NewRequest(http.MethodPost, "", buf)
+	if err != nil {
+		panic(err)
+	}
+	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	server.hash(w, r)
+
+	if w.Body.String() != "42" {
+		t.Errorf("Unexpected body, got %s", w.Body.String())
+	}
+	if notifier.registered["42"] != "https://hooks.example.com/done" {
+		t.Errorf("Expected callback to be registered, got %v", notifier.registered)
+	}
+}
+
+func Test_getStatsCallbacks(t *testing.T) {
+	server := withStore(&PasswordHasherServer{
+		phStats:  &MockStats{total: 1, avg: 2},
+		phStore:  &MockStore{},
+		notifier: &MockNotifier{stats: callbackStats{Delivered: 3, Retried: 2, Failed: 1}},
+	})
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodGet, "", nil)
+	if err != nil {
+		panic(err)
+	}
+	server.getStats(w, r)
+
+	if w.Body.String() != `{"total":1,"average":2,"callbacks":{"delivered":3,"retried":2,"failed":1,"pending":0}}` {
+		t.Errorf("Unexpected body, got %s", w.Body.String())
+	}
+}
+
+func Test_NewPasswordHasherServerWithIdStrategy(t *testing.T) {
+	server := NewPasswordHasherServer(nil, WithIdStrategy(SequentialIds, 0))
+	if _, ok := server.idGen.(*sequentialIdGenerator); !ok {
+		t.Error("Expected sequential ids")
+	}
+}
+
+func Test_getStatsExpiry(t *testing.T) {
+	server := withStore(&PasswordHasherServer{
+		phStats: &MockStats{total: 1, avg: 2},
+		phStore: &MockStore{expiry: &expiryStats{Expired: 5, Remembered: 3}},
+	})
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodGet, "", nil)
+	if err != nil {
+		panic(err)
+	}
+	server.getStats(w, r)
+
+	if w.Body.String() != `{"total":1,"average":2,"expiry":{"expired":5,"remembered":3}}` {
+		t.Errorf("Unexpected body, got %s", w.Body.String())
+	}
+}
+
+func Test_NewPasswordHasherServerWithExpiry(t *testing.T) {
+	server := NewPasswordHasherServer(nil, WithExpiry(ExpiryConfig{TTL: time.Hour}))
+	store := server.phStore.(*passwordHashStore)
+	if store.expiry == nil || store.expiry.TTL != time.Hour {
+		t.Error("Expected store to expire hashes")
+	}
+}
+
+func Test_getStatsCapacity(t *testing.T) {
+	server := withStore(&PasswordHasherServer{
+		phStats: &MockStats{total: 1, avg: 2},
+		phStore: &MockStore{capacity: &capacityStats{Records: 4, Bytes: 1024, Evicted: 2, Rejected: 1}},
+	})
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodGet, "", nil)
+	if err != nil {
+		panic(err)
+	}
+	server.getStats(w, r)
+
+	if w.Body.String() != `{"total":1,"average":2,"capacity":{"records":4,"bytes":1024,"evicted":2,"rejected":1}}` {
+		t.Errorf("Unexpected body, got %s", w.Body.String())
+	}
+}
+
+func Test_NewPasswordHasherServerWithCapacity(t *testing.T) {
+	server := NewPasswordHasherServer(nil, WithCapacity(CapacityConfig{MaxRecords: 10}))
+	store := server.phStore.(*passwordHashStore)
+	if store.capacity == nil || store.capacity.MaxRecords != 10 || store.capacity.Policy != EvictPolicy {
+		t.Error("Expected store to be bounded")
+	}
+}
+
+func Test_NewPasswordHasherServerWithTombstoneWindow(t *testing.T) {
+	server := NewPasswordHasherServer(nil, WithTombstoneWindow(time.Minute), WithAdminToken("secret"))
+	if store := server.phStore.(*passwordHashStore); store.tombstoneWindow != time.Minute {
+		t.Errorf("Unexpected tombstone window: %v", store.tombstoneWindow)
+	}
+	if server.admin != "secret" {
+		t.Errorf("Unexpected admin token: %s", server.admin)
+	}
+}
+
+func Test_NewPasswordHasherServerWithCallbacks(t *testing.T) {
+	server := NewPasswordHasherServer(nil, WithCallbacks(CallbackConfig{Allowlist: []string{"localhost"}}))
+	if server.notifier == nil {
+		t.Error("Expected notifier to not be nil")
+	}
+	if len(server.phStore.(*passwordHashStore).listeners) != 1 {
+		t.Error("Expected notifier to listen to stored hashes")
+	}
+}
+
+func Test_hashRetrievalToken(t *testing.T) {
+	server := withStore(&PasswordHasherServer{
+		pwHasher: &MockHasher{
+			expected: "test",
+			t:        t,
+		},
+		idGen: &MockIdGenerator{id: "42"},
+		phStore: &MockStore{
+			expected: "very-hashed",
+			id:       "42",
+			t:        t,
+		},
+		phStats: &MockStats{untimed: true},
+		tokens:  newHMACTokenIssuer(TokenConfig{Keys: []TokenKey{{"k1", []byte("secret")}}}),
+	})
+
+	w := httptest.NewRecorder()
+	buf := bytes.NewReader([]byte("password=test"))
+	r, err := http.NewRequest(http.MethodPost, "", buf)
+	if err != nil {
+		panic(err)
+	}
+	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	server.hash(w, r)
+
+	token := w.Header().Get(retrievalTokenHeader)
+	if server.tokens.verifyToken("42", token) != nil {
+		t.Errorf("Expected a valid token, got %s", token)
+	}
+}
+
+func Test_getHashRetrievalToken(t *testing.T) {
+	issuer := newHMACTokenIssuer(TokenConfig{Keys: []TokenKey{{"k1", []byte("secret")}}, TTL: time.Minute})
+	server := withStore(&PasswordHasherServer{
+		idGen: &MockIdGenerator{id: "42"},
+		phStore: &MockStore{
+			hash: "test",
+			id:   "42",
 			t:    t,
 		},
+		tokens: issuer,
+	})
+	token := issuer.issueToken("42")
+
+	cases := []struct {
+		path   string
+		auth   string
+		code   int
+		body   string
+		offset time.Duration
+	}{
+		{"/hash/42", "Bearer " + token, http.StatusOK, "test", 0},
+		{"/hash/42?token=" + token, "", http.StatusOK, "test", 0},
+		{"/hash/42", "", http.StatusForbidden, "Forbidden", 0},
+		{"/hash/42", "Bearer bogus", http.StatusForbidden, "Forbidden", 0},
+		{"/hash/42", "Bearer " + token, http.StatusGone, "Token Expired", time.Hour},
+	}
+	for _, c := range cases {
+		issuer.now = func() time.Time {
+			return time.Now().Add(c.offset)
+		}
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodGet, c.path, nil)
+		if err != nil {
+			panic(err)
+		}
+		if c.auth != "" {
+			r.Header.Set("Authorization", c.auth)
+		}
+		server.getHash(w, r)
+
+		if w.Body.String() != c.body {
+			t.Errorf("Unexpected body for %s, got %s", c.path, w.Body.String())
+		}
+		if w.Code != c.code {
+			t.Errorf("Unexpected code for %s, got %d", c.path, w.Code)
+		}
+	}
+}
+
+func Test_hashTTL(t *testing.T) {
+	server := withStore(&PasswordHasherServer{
+		pwHasher: &MockHasher{
+			expected: "test",
+			t:        t,
+		},
+		idGen: &MockIdGenerator{id: "42"},
+		phStore: &MockStore{
+			expected: "very-hashed",
+			id:       "42",
+			ttl:      90 * time.Second,
+			t:        t,
+		},
+		phStats: &MockStats{t: t},
+		expiry:  &ExpiryConfig{MaxTTL: time.Hour},
+	})
+
+	for body, code := range map[string]int{
+		"password=test&ttl=90":    http.StatusOK,
+		"password=test&ttl=1m30s": http.StatusOK,
+		"password=test&ttl=0":     http.StatusBadRequest,
+		"password=test&ttl=-90":   http.StatusBadRequest,
+		"password=test&ttl=2h":    http.StatusBadRequest,
+		"password=test&ttl=bogus": http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodPost, "", bytes.NewReader([]byte(body)))
+		if err != nil {
+			panic(err)
+		}
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		server.hash(w, r)
+
+		if w.Code != code {
+			t.Errorf("Unexpected code for %s, got %d", body, w.Code)
+		}
+		if code != http.StatusOK && w.Body.String() != "Invalid TTL" {
+			t.Errorf("Unexpected body for %s, got %s", body, w.Body.String())
+		}
+	}
+
+	// no per-hash TTLs unless expiry is enabled
+	server.expiry = nil
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodPost, "", bytes.NewReader([]byte("password=test&ttl=90")))
+	if err != nil {
+		panic(err)
+	}
+	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	server.hash(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected code, got %d", w.Code)
+	}
+}
+
+func Test_hashDelay(t *testing.T) {
+	logs := &bytes.Buffer{}
+	store := &MockStore{
+		expected: "very-hashed",
+		id:       "42",
+		delay:    90 * time.Second,
+		t:        t,
+	}
+	server := withStore(&PasswordHasherServer{
+		pwHasher: &MockHasher{
+			expected: "test",
+			t:        t,
+		},
+		idGen:      &MockIdGenerator{id: "42"},
+		phStore:    store,
+		phStats:    &MockStats{untimed: true},
+		hashDelays: newDelayPolicy(DelayConfig{Tenants: map[string]time.Duration{"acme": time.Hour}, MaxRequestDelay: 2 * time.Minute}),
+		logger:     log.New(logs, "", 0),
+	})
+
+	for body, code := range map[string]int{
+		"password=test&delay=90":              http.StatusOK,
+		"password=test&delay=1m30s":           http.StatusOK,
+		"password=test&delay=-90":             http.StatusBadRequest,
+		"password=test&delay=bogus":           http.StatusBadRequest,
+		`{"password":"test","delay":90}`:      http.StatusOK,
+		`{"password":"test","delay":"1m30s"}`: http.StatusOK,
+		`{"password":"test","delay":-90}`:     http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodPost, "", bytes.NewReader([]byte(body)))
+		if err != nil {
+			panic(err)
+		}
+		if strings.HasPrefix(body, "{") {
+			r.Header.Add("Content-Type", "application/json; charset=utf-8")
+		} else {
+			r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		}
+		r.Header.Add(tenantHeader, "acme")
+		server.hash(w, r)
+
+		if w.Code != code {
+			t.Errorf("Unexpected code for %s, got %d", body, w.Code)
+		}
+		if code != http.StatusOK && w.Body.String() != "Invalid Delay" {
+			t.Errorf("Unexpected body for %s, got %s", body, w.Body.String())
+		}
+		if code == http.StatusOK && w.Header().Get(hashDelayHeader) != "1m30s" {
+			t.Errorf("Expected chosen delay to be returned, got %s", w.Header().Get(hashDelayHeader))
+		}
+	}
+
+	// a delay refused by the policy is a bad request too
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodPost, "", bytes.NewReader([]byte("password=test&delay=3m")))
+	if err != nil {
+		panic(err)
+	}
+	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Add(tenantHeader, "acme")
+	server.hash(w, r)
+	if w.Code != http.StatusBadRequest || w.Body.String() != "Invalid Delay" {
+		t.Errorf("Unexpected response, got %d %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(logs.String(), "Refused delay of 3m0s for 42\n") {
+		t.Errorf("Expected log indicating refusal: %s", logs.String())
+	}
+
+	for _, body := range []string{`{"password":"test"`, `{"password":"test","delay":[90]}`} {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodPost, "", bytes.NewReader([]byte(body)))
+		if err != nil {
+			panic(err)
+		}
+		r.Header.Add("Content-Type", "application/json")
+		server.hash(w, r)
+		if w.Code != http.StatusBadRequest || w.Body.String() != "Bad Form" {
+			t.Errorf("Expected %s to be refused, got %d %s", body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func Test_NewPasswordHasherServerWithDelay(t *testing.T) {
+	server := NewPasswordHasherServer(log.New(&bytes.Buffer{}, "", 0), WithDelay(DelayConfig{Delay: time.Second, MaxRequestDelay: time.Minute}))
+	delay, err := server.hashDelays.delayFor(delayRequest{delay: 2 * time.Second, requested: true})
+	if delay != 2*time.Second || err != nil {
+		t.Errorf("Expected delay to be allowed per request, got %v %v", delay, err)
+	}
+	if delay, _ := server.hashDelays.delayFor(delayRequest{}); delay != time.Second {
+		t.Errorf("Expected configured delay, got %v", delay)
+	}
+}
+
+func Test_NewPasswordHasherServerWithShards(t *testing.T) {
+	server := NewPasswordHasherServer(log.New(&bytes.Buffer{}, "", 0), WithShards(8), WithCapacity(CapacityConfig{MaxRecords: 80}))
+	store, ok := server.phStore.(*shardedPasswordHashStore)
+	if !ok || len(store.shards) != 8 || store.shards[0].capacity.MaxRecords != 10 {
+		t.Fatal("Expected store to be sharded")
+	}
+
+	// a durable store is not sharded
+	server = NewPasswordHasherServer(log.New(&bytes.Buffer{}, "", 0), WithShards(8), WithHashLog(openTestLog(t, t.TempDir())))
+	if _, ok := server.phStore.(*logPasswordHashStore); !ok {
+		t.Error("Expected store to be logged")
+	}
+	server.phStore.close()
+}
+
+func Test_NewPasswordHasherServerWithCompactStore(t *testing.T) {
+	server := NewPasswordHasherServer(log.New(&bytes.Buffer{}, "", 0), WithCompactStore())
+	store, ok := server.phStore.(*passwordHashStore)
+	if !ok {
+		t.Fatal("Expected an in-memory store")
+	}
+	if _, ok := store.hashes.(*arenaHashTable); !ok {
+		t.Error("Expected hashes to be kept in arenas")
+	}
+}
+
+func Test_hashStoreFull(t *testing.T) {
+	notifier := &MockNotifier{}
+	server := withStore(&PasswordHasherServer{
+		pwHasher: &MockHasher{
+			expected: "test",
+			t:        t,
+		},
+		idGen: &MockIdGenerator{id: "42"},
+		phStore: &MockStore{
+			expected: "very-hashed",
+			id:       "42",
+			err:      errStoreFull,
+			t:        t,
+		},
+		phStats:  &MockStats{t: t},
+		notifier: notifier,
+	})
+
+	w := httptest.NewRecorder()
+	buf := bytes.NewReader([]byte("password=test&callback_url=https%3A%2F%2Fhooks.example.com%2Fdone"))
+	r, err := http.NewRequest(http.MethodPost, "", buf)
+	if err != nil {
+		panic(err)
+	}
+	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	server.hash(w, r)
+
+	if w.Body.String() != "Store Full" {
+		t.Errorf("Unexpected body, got %s", w.Body.String())
+	}
+	if w.Code != http.StatusInsufficientStorage {
+		t.Errorf("Unexpected code, got %d", w.Code)
+	}
+	if len(notifier.registered) != 0 {
+		t.Error("Expected callback to be forgotten")
+	}
+}
+
+func Test_hashStoreFailed(t *testing.T) {
+	server := withStore(&PasswordHasherServer{
+		pwHasher: &MockHasher{
+			expected: "test",
+			t:        t,
+		},
+		idGen: &MockIdGenerator{id: "42"},
+		phStore: &MockStore{
+			expected: "very-hashed",
+			id:       "42",
+			err:      os.ErrClosed,
+			t:        t,
+		},
+		phStats: &MockStats{t: t},
+	})
+
+	w := httptest.NewRecorder()
+	buf := bytes.NewReader([]byte("password=test"))
+	r, err := http.NewRequest(http.MethodPost, "", buf)
+	if err != nil {
+		panic(err)
+	}
+	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	server.hash(w, r)
+
+	if w.Body.String() != "Internal Error" {
+		t.Errorf("Unexpected body, got %s", w.Body.String())
+	}
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Unexpected code, got %d", w.Code)
+	}
+}
+
+func Test_NewPasswordHasherServerWithHashLog(t *testing.T) {
+	hashLog := openTestLog(t, t.TempDir())
+	server := NewPasswordHasherServer(log.New(&bytes.Buffer{}, "", 0), WithHashLog(hashLog))
+	store, ok := server.phStore.(*logPasswordHashStore)
+	if !ok || store.hashLog != hashLog {
+		t.Fatal("Expected store to be logged")
+	}
+	if err := store.close(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func Test_NewPasswordHasherServerRestartOverdue(t *testing.T) {
+	dir := t.TempDir()
+	server := NewPasswordHasherServer(log.New(&bytes.Buffer{}, "", 0), WithHashLog(openTestLog(t, dir)),
+		WithDelay(DelayConfig{Delay: time.Millisecond}), WithIdStrategy(SequentialIds, 0))
+	if err := server.phStore.storePassword("hash-1", "1", 0, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	// crash while the hash is pending, restarting once its delay is over
+	server.phStore.(*logPasswordHashStore).hashLog.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	buf := &bytes.Buffer{}
+	server = NewPasswordHasherServer(log.New(buf, "", 0), WithHashLog(openTestLog(t, dir)),
+		WithDelay(DelayConfig{Delay: time.Millisecond}), WithIdStrategy(SequentialIds, 0), WithReplicationJournal(10))
+	server.phStore.waitPendingStores()
+	if hash, state := server.phStore.retrievePassword("1"); hash != "hash-1" || state != hashAvailable {
+		t.Errorf("Expected overdue hash to be stored, got %s %d", hash, state)
+	}
+	epoch, _ := server.journal.position()
+	if events, ok, _ := server.journal.since(epoch, 0); !ok || len(events) != 1 || events[0].Op != replicationStored {
+		t.Errorf("Expected overdue hash to be journaled, got %+v", events)
+	}
+	server.phStore.close()
+
+	// the stored record was logged too
+	buf.Reset()
+	server = NewPasswordHasherServer(log.New(buf, "", 0), WithHashLog(openTestLog(t, dir)))
+	defer server.phStore.close()
+	if !strings.Contains(buf.String(), "Restored 1 hashes, 0 pending") {
+		t.Errorf("Expected overdue hash to be restored as stored: %s", buf.String())
+	}
+}
+
+func Test_NewPasswordHasherServerRestartIds(t *testing.T) {
+	dir := t.TempDir()
+	server := NewPasswordHasherServer(log.New(&bytes.Buffer{}, "", 0), WithHashLog(openTestLog(t, dir)),
+		WithDelay(DelayConfig{}), WithIdStrategy(SequentialIds, 0))
+	server.phStats.startAccumulating()
+	for _, form := range []string{"password=angryMonkey", "password=angryMonkey"} {
+		r, err := http.NewRequest(http.MethodPost, "/hash", strings.NewReader(form))
+		if err != nil {
+			panic(err)
+		}
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		server.http.Handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	server.phStats.stopAccumulating()
+	server.phStore.waitPendingStores()
+	server.phStore.deletePassword("2")
+	server.phStore.close()
+
+	// the counter starts after every id restored, deleted ones included
+	server = NewPasswordHasherServer(log.New(&bytes.Buffer{}, "", 0), WithHashLog(openTestLog(t, dir)),
+		WithIdStrategy(SequentialIds, 0))
+	defer server.phStore.close()
+	if id := server.idGen.nextId(); id != "3" {
+		t.Errorf("Expected ids restored to never be issued again, got %s", id)
+	}
+	if err := server.phStore.storePassword("other", "1", 0, 0); err != ErrExists {
+		t.Errorf("Expected a known id to be refused, got %v", err)
+	}
+	if hash, _ := server.phStore.retrievePassword("1"); hash == "other" {
+		t.Error("Expected the restored hash to be kept")
+	}
+}
+
+func Test_getHashExpired(t *testing.T) {
+	server := withStore(&PasswordHasherServer{
+		idGen: &MockIdGenerator{id: "42"},
+		phStore: &MockStore{
+			state: hashExpired,
+			id:    "42",
+			t:     t,
+		},
+	})
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodGet, "/hash/42", nil)
+	if err != nil {
+		panic(err)
+	}
+	server.getHash(w, r)
+
+	if w.Body.String() != "Expired" {
+		t.Errorf("Unexpected body, got %s", w.Body.String())
+	}
+	if w.Code != http.StatusGone {
+		t.Errorf("Unexpected code, got %d", w.Code)
+	}
+}
+
+func Test_getHashDeleted(t *testing.T) {
+	server := withStore(&PasswordHasherServer{
+		idGen: &MockIdGenerator{id: "42"},
+		phStore: &MockStore{
+			state: hashDeleted,
+			id:    "42",
+			t:     t,
+		},
+	})
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodGet, "/hash/42", nil)
+	if err != nil {
+		panic(err)
+	}
+	server.getHash(w, r)
+
+	if w.Body.String() != "Deleted" {
+		t.Errorf("Unexpected body, got %s", w.Body.String())
+	}
+	if w.Code != http.StatusGone {
+		t.Errorf("Unexpected code, got %d", w.Code)
+	}
+}
+
+func Test_deleteHash(t *testing.T) {
+	issuer := newHMACTokenIssuer(TokenConfig{Keys: []TokenKey{{"k1", []byte("secret")}}})
+	cases := []struct {
+		auth  string
+		state hashState
+		code  int
+		body  string
+		log   string
+	}{
+		{"Bearer admin-secret", hashAvailable, http.StatusOK, "Deleted", "Deleted 42 for admin at 10.0.0.1:1234\n"},
+		{"Bearer " + issuer.issueToken("42"), hashPending, http.StatusOK, "Deleted", "Deleted 42 for token k1 holder at 10.0.0.1:1234\n"},
+		{"Bearer admin-secret", hashDeleted, http.StatusGone, "Deleted", ""},
+		{"Bearer admin-secret", hashExpired, http.StatusGone, "Expired", ""},
+		{"Bearer admin-secret", hashUnknown, http.StatusNotFound, "Not Found", ""},
+		{"Bearer " + issuer.issueToken("43"), hashAvailable, http.StatusForbidden, "Forbidden", "Refused to delete 42 for 10.0.0.1:1234\n"},
+		{"", hashAvailable, http.StatusForbidden, "Forbidden", "Refused to delete 42 for 10.0.0.1:1234\n"},
+	}
+	for _, c := range cases {
+		buf := &bytes.Buffer{}
+		notifier := &MockNotifier{registered: map[string]string{"42": "https://hooks.example.com/"}}
+		store := &MockStore{state: c.state, id: "42", t: t}
+		server := withStore(&PasswordHasherServer{
+			idGen:    &MockIdGenerator{id: "42"},
+			phStore:  store,
+			notifier: notifier,
+			tokens:   issuer,
+			admin:    "admin-secret",
+			logger:   log.New(buf, "", 0),
+		})
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodDelete, "/hash/42", nil)
+		if err != nil {
+			panic(err)
+		}
+		r.RemoteAddr = "10.0.0.1:1234"
+		if c.auth != "" {
+			r.Header.Set("Authorization", c.auth)
+		}
+		server.hashById(w, r)
+
+		if w.Body.String() != c.body {
+			t.Errorf("Unexpected body, got %s", w.Body.String())
+		}
+		if w.Code != c.code {
+			t.Errorf("Unexpected code, got %d", w.Code)
+		}
+		if buf.String() != c.log {
+			t.Errorf("Unexpected log, got %s", buf.String())
+		}
+		if store.deleted != (c.code != http.StatusForbidden) {
+			t.Errorf("Unexpected deletion for %s", c.auth)
+		}
+		if (len(notifier.registered) == 0) != (c.code == http.StatusOK) {
+			t.Error("Expected callback to be forgotten once deleted")
+		}
+	}
+}
+
+func Test_takeSnapshot(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := log.New(buf, "", 0)
+	store := newLogPasswordHashStore(newPasswordHashStore(logger), openTestLog(t, t.TempDir()))
+	defer store.close()
+	cases := []struct {
+		auth  string
+		store snapshotter
+		code  int
+		body  string
+		log   string
+	}{
+		{"Bearer admin-secret", store, http.StatusOK, "Snapshot Taken", "Snapshot of 0 hashes, 0 pending, taken\nSnapshot taken for admin at 10.0.0.1:1234\n"},
+		{"Bearer bogus", store, http.StatusForbidden, "Forbidden", "Refused to take snapshot for 10.0.0.1:1234\n"},
+		{"Bearer admin-secret", nil, http.StatusNotFound, "Not Found", ""},
+	}
+	for _, c := range cases {
+		buf.Reset()
+		server := &PasswordHasherServer{snapshots: c.store, admin: "admin-secret", logger: logger}
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodPost, "/admin/snapshot", nil)
+		if err != nil {
+			panic(err)
+		}
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("Authorization", c.auth)
+		server.takeSnapshot(w, r)
+
+		if w.Body.String() != c.body {
+			t.Errorf("Unexpected body, got %s", w.Body.String())
+		}
+		if w.Code != c.code {
+			t.Errorf("Unexpected code, got %d", w.Code)
+		}
+		if buf.String() != c.log {
+			t.Errorf("Unexpected log, got %s", buf.String())
+		}
+	}
+}
+
+func Test_rotateKey(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := log.New(buf, "", 0)
+	store := newEncryptedStore(t, buf, newPasswordHashStore(logger))
+	defer store.close()
+	cases := []struct {
+		auth    string
+		rotator keyRotator
+		code    int
+		body    string
+		log     string
+	}{
+		{"Bearer admin-secret", store, http.StatusOK, "k2", "Rotated to data key k2\nKey rotated for admin at 10.0.0.1:1234\n"},
+		{"Bearer bogus", store, http.StatusForbidden, "Forbidden", "Refused to rotate key for 10.0.0.1:1234\n"},
+		{"Bearer admin-secret", nil, http.StatusNotFound, "Not Found", ""},
+	}
+	for _, c := range cases {
+		store.reencryption.Wait()
+		buf.Reset()
+		server := &PasswordHasherServer{rotator: c.rotator, admin: "admin-secret", logger: logger}
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(http.MethodPost, "/admin/rotate-key", nil)
+		if err != nil {
+			panic(err)
+		}
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("Authorization", c.auth)
+		server.rotateKey(w, r)
+		store.reencryption.Wait()
+
+		if w.Body.String() != c.body {
+			t.Errorf("Unexpected body, got %s", w.Body.String())
+		}
+		if w.Code != c.code {
+			t.Errorf("Unexpected code, got %d", w.Code)
+		}
+		if !strings.HasPrefix(buf.String(), c.log) {
+			t.Errorf("Unexpected log, got %s", buf.String())
+		}
+	}
+}
+
+func Test_deleteHashNoAuthorization(t *testing.T) {
+	buf := &bytes.Buffer{}
+	server := withStore(&PasswordHasherServer{
+		idGen:   &MockIdGenerator{id: "42"},
+		phStore: &MockStore{id: "42", t: t},
+		logger:  log.New(buf, "", 0),
+	})
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest(http.MethodDelete, "/hash/42", nil)
+	if err != nil {
+		panic(err)
+	}
+	r.Header.Set("Authorization", "Bearer ")
+	server.deleteHash(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected deletes to be forbidden without any token configured, got %d", w.Code)
+	}
+}
+
+func Test_deleteHashInvalidId(t *testing.T) {
+	server := &PasswordHasherServer{idGen: newSequentialIdGenerator()}
+
+	w := httptest.NewRecorder()
+	server.deleteHash(w, &http.Request{Method: http.MethodDelete, URL: &url.URL{Path: "/hash/bogus"}})
+
+	if w.Body.String() != "Invalid ID" {
+		t.Errorf("Unexpected body, got %s", w.Body.String())
+	}
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected code, got %d", w.Code)
 	}
+}
+
+func Test_getHashNone(t *testing.T) {
+	server := withStore(&PasswordHasherServer{
+		idGen: &MockIdGenerator{id: "42"},
+		phStore: &MockStore{
+			hash: "",
+			id:   "42",
+			t:    t,
+		},
+	})
 	w := httptest.NewRecorder()
 	r, err := http.NewRequest(http.MethodGet, "/hash/42", nil)
 	if err != nil {
@@ -165,13 +976,14 @@ func Test_getHashNone(t *testing.T) {
 }
 
 func Test_getHash(t *testing.T) {
-	server := &PasswordHasherServer{
+	server := withStore(&PasswordHasherServer{
+		idGen: &MockIdGenerator{id: "42"},
 		phStore: &MockStore{
 			hash: "test",
-			id:   42,
+			id:   "42",
 			t:    t,
 		},
-	}
+	})
 	w := httptest.NewRecorder()
 	r, err := http.NewRequest(http.MethodGet, "/hash/42", nil)
 	if err != nil {
@@ -188,12 +1000,13 @@ func Test_getHash(t *testing.T) {
 }
 
 func Test_getStats(t *testing.T) {
-	server := &PasswordHasherServer{
+	server := withStore(&PasswordHasherServer{
 		phStats: &MockStats{
 			total: 10,
 			avg:   33,
 		},
-	}
+		phStore: &MockStore{},
+	})
 	w := httptest.NewRecorder()
 	r, err := http.NewRequest(http.MethodGet, "", nil)
 	if err != nil {
@@ -217,7 +1030,7 @@ func Test_shutdownServer(t *testing.T) {
 		panic(err)
 	}
 	server.shutdownServer(w, r)
-	if w.Body.String() != "" {
+	if w.Body.String() != `{"mode":"wait","waited":0,"flushed":0,"abandoned":0,"spooled":0}` {
 		t.Errorf("Unexpected body, got %s", w.Body.String())
 	}
 	if w.Code != http.StatusOK {
@@ -227,18 +1040,76 @@ func Test_shutdownServer(t *testing.T) {
 	server.waitShutdown()
 }
 
+func Test_shutdownServerModes(t *testing.T) {
+	buf := &bytes.Buffer{}
+	store := &MockStore{t: t}
+	server := withStore(&PasswordHasherServer{
+		done:    make(chan bool, 1),
+		phStore: store,
+		drain:   ShutdownConfig{Mode: ShutdownFlush},
+		logger:  log.New(buf, "", 0),
+	})
+	w := httptest.NewRecorder()
+	server.shutdownServer(w, &http.Request{Method: http.MethodGet})
+	if w.Body.String() != `{"mode":"flush","waited":0,"flushed":2,"abandoned":0,"spooled":0}` {
+		t.Errorf("Unexpected body, got %s", w.Body.String())
+	}
+	if !store.pending || !server.isStopping() {
+		t.Error("Expected pending stores to be drained while stopping")
+	}
+	server.waitShutdown()
+
+	// a failure to drain still shuts down
+	store.err = os.ErrPermission
+	server.stopping = 0
+	w = httptest.NewRecorder()
+	server.shutdownServer(w, &http.Request{Method: http.MethodGet})
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Unexpected code, got %d", w.Code)
+	}
+	if !strings.Contains(buf.String(), "ERROR: Failed to drain pending stores: permission denied\n") {
+		t.Errorf("Expected log indicating failure: %s", buf.String())
+	}
+	server.waitShutdown()
+}
+
+func Test_NewPasswordHasherServerWithSpool(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pending.spool")
+	store := newPasswordHashStore(log.New(&bytes.Buffer{}, "", 0))
+	store.storePassword("very-hashed", "1", 0, time.Hour)
+	if _, err := store.drainPending(ShutdownConfig{Mode: ShutdownSpool, SpoolFile: path}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	server := NewPasswordHasherServer(log.New(buf, "", 0), WithShutdown(ShutdownConfig{Mode: ShutdownFlush, SpoolFile: path}))
+	if _, state := server.phStore.retrievePassword("1"); state != hashPending {
+		t.Errorf("Expected spooled hash to be pending again, got %d", state)
+	}
+	if !strings.Contains(buf.String(), "Reloaded 1 pending hashes from "+path+"\n") {
+		t.Errorf("Expected log indicating reload: %s", buf.String())
+	}
+	report, _ := server.phStore.drainPending(server.drain)
+	if report.Flushed != 1 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+}
+
 func Test_NewPasswordHasherServerHandler(t *testing.T) {
 	server := NewPasswordHasherServer(nil)
 	server.pwHasher = &MockHasher{
 		expected: "test",
 		t:        t,
 	}
+	server.idGen = &MockIdGenerator{id: "42"}
 	server.phStore = &MockStore{
 		hash:     "test",
 		expected: "very-hashed",
-		id:       42,
+		id:       "42",
+		delay:    defaultHashDelay,
 		t:        t,
 	}
+	server.store = storeAdapter{server.phStore}
 	server.phStats = &MockStats{
 		total: 10,
 		avg:   33,
@@ -294,7 +1165,7 @@ func Test_NewPasswordHasherServerHandler(t *testing.T) {
 	}
 
 	server.http.Handler.ServeHTTP(w, r)
-	if w.Body.String() != "" {
+	if w.Body.String() != `{"mode":"","waited":0,"flushed":2,"abandoned":0,"spooled":0}` {
 		t.Errorf("Unexpected body, got %s", w.Body.String())
 	}
 	if w.Code != http.StatusOK {
@@ -317,56 +1188,165 @@ func Test_Run(t *testing.T) {
 	}
 }
 
+func Test_NewPasswordHasherServerWithEncryption(t *testing.T) {
+	hashLog := openTestLog(t, t.TempDir())
+	keys := openTestKeyRing(t, filepath.Join(t.TempDir(), "data.keys"))
+	server := NewPasswordHasherServer(log.New(&bytes.Buffer{}, "", 0), WithHashLog(hashLog), WithEncryption(keys))
+	store, ok := server.phStore.(*encryptingPasswordHashStore)
+	if !ok || store.keys != keys || server.rotator != store {
+		t.Fatal("Expected store to be encrypted")
+	}
+	if _, ok := store.passwordHashStorer.(*logPasswordHashStore); !ok || server.snapshots == nil {
+		t.Error("Expected the log to be encrypted")
+	}
+	store.close()
+}
+
+func Test_stopClosesStore(t *testing.T) {
+	store := &MockStore{t: t}
+	server := withStore(&PasswordHasherServer{
+		http:    &http.Server{},
+		phStore: store,
+		phStats: &MockStats{t: t},
+		logger:  log.New(&bytes.Buffer{}, "", 0),
+	})
+	stopped := server.stop()
+	if store.closed {
+		t.Error("Expected store to stay open until pending stores are done")
+	}
+	stopped()
+	if !store.pending || !store.closed {
+		t.Error("Expected store to be closed once pending stores are done")
+	}
+}
+
 type MockHasher struct {
 	expected string
 	t        *testing.T
 }
 
-func (m *MockHasher) hashPassword(password string) (string, int64) {
+func (m *MockHasher) hashPassword(password string) string {
 	if m.expected != password {
 		m.t.Errorf("Unexpected password: %s", password)
 	}
-	return "very-hashed", 42
+	return "very-hashed"
+}
+
+type MockIdGenerator struct {
+	id string
+}
+
+func (m *MockIdGenerator) nextId() string {
+	return m.id
+}
+
+func (m *MockIdGenerator) validId(id string) bool {
+	return id == m.id
+}
+
+// withStore completes a server built by a test with what NewPasswordHasherServer derives from its options:
+// the Store its handlers use, and a delay policy without delays unless given one.
+func withStore(server *PasswordHasherServer) *PasswordHasherServer {
+	server.store = storeAdapter{server.phStore}
+	if server.hashDelays == nil {
+		server.hashDelays = fixedDelayPolicy(0)
+	}
+	return server
 }
 
 type MockStore struct {
 	hash     string
 	expected string
-	id       int64
+	id       string
+	ttl      time.Duration
+	delay    time.Duration
+	state    hashState
 	pending  bool
+	listener storeListener
+	expiry   *expiryStats
+	capacity *capacityStats
+	err      error
+	deleted  bool
+	closed   bool
 	t        *testing.T
 }
 
-func (m *MockStore) storePassword(hashed string, id int64) {
+func (m *MockStore) storePassword(hashed string, id string, ttl time.Duration, delay time.Duration) error {
 	if hashed != m.expected {
 		m.t.Errorf("Unexpected hashed: %s", hashed)
 	}
 	if id != m.id {
-		m.t.Errorf("Unexpected id: %d", id)
+		m.t.Errorf("Unexpected id: %s", id)
+	}
+	if ttl != m.ttl {
+		m.t.Errorf("Unexpected ttl: %v", ttl)
+	}
+	if delay != m.delay {
+		m.t.Errorf("Unexpected delay: %v", delay)
+	}
+	return m.err
+}
+
+func (m *MockStore) retrievePassword(id string) (string, hashState) {
+	if id != m.id {
+		m.t.Errorf("Unexpected id: %s", id)
 	}
+	if m.state == hashUnknown && m.hash != "" {
+		return m.hash, hashAvailable
+	}
+	return m.hash, m.state
 }
 
-func (m *MockStore) retrievePassword(id int64) string {
+func (m *MockStore) deletePassword(id string) hashState {
 	if id != m.id {
-		m.t.Errorf("Unexpected id: %d", id)
+		m.t.Errorf("Unexpected id: %s", id)
 	}
-	return m.hash
+	m.deleted = true
+	return m.state
 }
 
 func (m *MockStore) waitPendingStores() {
 	m.pending = true
 }
 
+func (m *MockStore) onStored(listener storeListener) {
+	m.listener = listener
+}
+
+func (m *MockStore) startExpiring() {
+}
+
+func (m *MockStore) stopExpiring() {
+}
+
+func (m *MockStore) drainPending(config ShutdownConfig) (shutdownReport, error) {
+	m.pending = true
+	return shutdownReport{Mode: config.Mode, Flushed: 2}, m.err
+}
+
+func (m *MockStore) close() error {
+	m.closed = true
+	return nil
+}
+
+func (m *MockStore) collectStats(stats *serverStats) {
+	stats.Expiry = m.expiry
+	stats.Capacity = m.capacity
+}
+
+// MockStats fails the test for requests timed over 100µs, unless untimed, as for requests doing real work
+// such as signing a token or choosing a delay.
 type MockStats struct {
-	total int64
-	avg   int64
-	acc   bool
-	t     *testing.T
+	total   int64
+	avg     int64
+	acc     bool
+	untimed bool
+	t       *testing.T
 }
 
 func (m *MockStats) accumulateTiming(elapsed time.Duration) {
 	ms := elapsed.Microseconds()
-	if ms > 100 {
+	if ms > 100 && !m.untimed {
 		m.t.Errorf("Unexpected elapsed time: %dms", ms)
 	}
 }
@@ -375,6 +1355,24 @@ func (m *MockStats) generateStats() (int64, int64) {
 	return m.total, m.avg
 }
 
+func (m *MockStats) timingStats() *timingStats {
+	return nil
+}
+
+func (m *MockStats) latencyPercentiles() *latencyPercentiles {
+	return nil
+}
+
+func (m *MockStats) accumulateRequest(elapsed time.Duration, status int) {
+}
+
+func (m *MockStats) registerMetrics(registry *metricRegistry) {
+}
+
+func (m *MockStats) windowStats() *windowStats {
+	return nil
+}
+
 func (m *MockStats) startAccumulating() {
 	m.acc = true
 }
@@ -382,3 +1380,36 @@ func (m *MockStats) startAccumulating() {
 func (m *MockStats) stopAccumulating() {
 	m.acc = false
 }
+
+type MockNotifier struct {
+	registered map[string]string
+	stats      callbackStats
+	waited     bool
+}
+
+func (m *MockNotifier) allowCallback(callbackURL string) bool {
+	return true
+}
+
+func (m *MockNotifier) registerCallback(id string, callbackURL string) {
+	if m.registered == nil {
+		m.registered = make(map[string]string)
+	}
+	m.registered[id] = callbackURL
+}
+
+func (m *MockNotifier) forgetCallback(id string) {
+	delete(m.registered, id)
+}
+
+func (m *MockNotifier) hashStored(id string, hashed string) {
+}
+
+func (m *MockNotifier) callbackStats() *callbackStats {
+	stats := m.stats
+	return &stats
+}
+
+func (m *MockNotifier) waitPendingDeliveries() {
+	m.waited = true
+}
@@ -3,20 +3,42 @@ package ph
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// statsToJson converts the given total/avg stats into a JSON string.
+// serverStats holds everything reported by the stats endpoint.
+// Optional sections are left out of the JSON when the respective feature is disabled.
+type serverStats struct {
+	Total       int64               `json:"total"`
+	Average     int64               `json:"average"`
+	Latency     *latencyPercentiles `json:"latency,omitempty"`
+	Timing      *timingStats        `json:"timing,omitempty"`
+	Windows     *windowStats        `json:"windows,omitempty"`
+	Store       *storeStats         `json:"store,omitempty"`
+	Callbacks   *callbackStats      `json:"callbacks,omitempty"`
+	Expiry      *expiryStats        `json:"expiry,omitempty"`
+	Capacity    *capacityStats      `json:"capacity,omitempty"`
+	Log         *logStats           `json:"log,omitempty"`
+	Encryption  *encryptionStats    `json:"encryption,omitempty"`
+	Replication *replicationStats   `json:"replication,omitempty"`
+	Cluster     *clusterStats       `json:"cluster,omitempty"`
+	Resp        *respStats          `json:"resp,omitempty"`
+	SQL         *sqlStats           `json:"sql,omitempty"`
+	External    *externalStats      `json:"external,omitempty"`
+	Idempotency *idempotencyStats   `json:"idempotency,omitempty"`
+}
+
+// statsToJson converts the given stats into a JSON string.
 // Return false if the conversion fails (very unlikely).
-func statsToJson(logger *log.Logger, total, avg int64) ([]byte, bool) {
-	type Stats struct {
-		Total   int64 `json:"total"`
-		Average int64 `json:"average"`
-	}
-	data, errJ := json.Marshal(&Stats{
-		total, avg,
-	})
+func statsToJson(logger *log.Logger, stats *serverStats) ([]byte, bool) {
+	data, errJ := json.Marshal(stats)
 	if errJ != nil {
 		logger.Printf("ERROR: %v", errJ)
 		return nil, false
@@ -44,3 +66,148 @@ func stopErrorResponse(logger *log.Logger, w http.ResponseWriter) {
 	_, errW := fmt.Fprintf(w, "Shutting Down")
 	logWriteError(logger, errW)
 }
+
+// forbiddenErrorResponse is a shorthand to return HTTP 403 when the caller is not authorized.
+func forbiddenErrorResponse(logger *log.Logger, w http.ResponseWriter) {
+	w.WriteHeader(http.StatusForbidden)
+	_, errW := fmt.Fprintf(w, "Forbidden")
+	logWriteError(logger, errW)
+}
+
+// goneErrorResponse is a shorthand to return HTTP 410 with the given reason.
+func goneErrorResponse(logger *log.Logger, w http.ResponseWriter, reason string) {
+	w.WriteHeader(http.StatusGone)
+	_, errW := fmt.Fprintf(w, "%s", reason)
+	logWriteError(logger, errW)
+}
+
+// invalidDumpResponse is a shorthand to return HTTP 400 with why a dump cannot be restored.
+func invalidDumpResponse(logger *log.Logger, w http.ResponseWriter, err error) {
+	logger.Printf("Refused to restore: %v", err)
+	w.WriteHeader(http.StatusBadRequest)
+	_, errW := fmt.Fprintf(w, "%v", err)
+	logWriteError(logger, errW)
+}
+
+// requestToken returns the bearer token from the Authorization header, or the "token" query parameter otherwise.
+func requestToken(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	if req.URL != nil {
+		return req.URL.Query().Get("token")
+	}
+	return ""
+}
+
+// maxJSONFormSize bounds the JSON object read as a form, as ParseForm bounds a form.
+const maxJSONFormSize = 10 << 20
+
+// parseHashForm parses the fields of a hash request into its form, either as ParseForm does or, if POST'ed as
+// application/json, from a JSON object whose fields are strings, or numbers as for a delay in seconds.
+// Either way, fields are then read with FormValue, and the form is what an idempotency key is checked against.
+func parseHashForm(req *http.Request) error {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return req.ParseForm()
+	}
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(io.LimitReader(req.Body, maxJSONFormSize))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return err
+	}
+	form := req.URL.Query()
+	for name, value := range fields {
+		switch value := value.(type) {
+		case string:
+			form.Set(name, value)
+		case json.Number:
+			form.Set(name, value.String())
+		case nil:
+		default:
+			return fmt.Errorf("field %s is neither a string nor a number", name)
+		}
+	}
+	req.Form = form
+	return nil
+}
+
+// parseDuration accepts either a Go duration ("90s", "1h30m") or a whole number of seconds.
+func parseDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds > int64(math.MaxInt64/time.Second) || seconds < int64(math.MinInt64/time.Second) {
+			return 0, fmt.Errorf("duration %s out of range", value)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// storeFullErrorResponse is a shorthand to return HTTP 507 when the store has no room for more hashes.
+func storeFullErrorResponse(logger *log.Logger, w http.ResponseWriter) {
+	w.WriteHeader(http.StatusInsufficientStorage)
+	_, errW := fmt.Fprintf(w, "Store Full")
+	logWriteError(logger, errW)
+}
+
+// notFoundErrorResponse is a shorthand to return HTTP 404 when there is nothing to act upon.
+func notFoundErrorResponse(logger *log.Logger, w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	_, errW := fmt.Fprintf(w, "Not Found")
+	logWriteError(logger, errW)
+}
+
+// internalErrorResponse is a shorthand to return HTTP 500 when the server fails a request on its own.
+func internalErrorResponse(logger *log.Logger, w http.ResponseWriter) {
+	w.WriteHeader(http.StatusInternalServerError)
+	_, errW := fmt.Fprintf(w, "Internal Error")
+	logWriteError(logger, errW)
+}
+
+// invalidDelayResponse is a shorthand to return HTTP 400 when the delay asked for is malformed or not allowed.
+func invalidDelayResponse(logger *log.Logger, w http.ResponseWriter) {
+	w.WriteHeader(http.StatusBadRequest)
+	_, errW := fmt.Fprintf(w, "Invalid Delay")
+	logWriteError(logger, errW)
+}
+
+// readOnlyErrorResponse is a shorthand to return HTTP 405 when writing to a follower, which only its primary writes to.
+func readOnlyErrorResponse(logger *log.Logger, w http.ResponseWriter) {
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	_, errW := fmt.Fprintf(w, "Read Only")
+	logWriteError(logger, errW)
+}
+
+// badGatewayErrorResponse is a shorthand to return HTTP 502 when the cluster node owning an id cannot be reached.
+func badGatewayErrorResponse(logger *log.Logger, w http.ResponseWriter) {
+	w.WriteHeader(http.StatusBadGateway)
+	_, errW := fmt.Fprintf(w, "Owner Unavailable")
+	logWriteError(logger, errW)
+}
+
+// idempotencyMismatchResponse is a shorthand to return HTTP 422 when an idempotency key is reused for another request.
+func idempotencyMismatchResponse(logger *log.Logger, w http.ResponseWriter) {
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	_, errW := fmt.Fprintf(w, "Idempotency Key Reused")
+	logWriteError(logger, errW)
+}
+
+// idempotencyConflictResponse is a shorthand to return HTTP 409 when the request of an idempotency key is still served.
+func idempotencyConflictResponse(logger *log.Logger, w http.ResponseWriter) {
+	w.WriteHeader(http.StatusConflict)
+	_, errW := fmt.Fprintf(w, "Request In Progress")
+	logWriteError(logger, errW)
+}
+
+// statusRecorder is a response writer remembering the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader remembers the status code before writing it.
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
@@ -7,18 +7,33 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func Test_statsToJson(t *testing.T) {
 	buf := &bytes.Buffer{}
 	logger := log.New(buf, "", 0)
 
-	json, ok := statsToJson(logger, 10, 33)
+	json, ok := statsToJson(logger, &serverStats{Total: 10, Average: 33})
 	if !ok {
 		t.Error("Expected ok")
 	} else if string(json) != `{"total":10,"average":33}` {
 		t.Errorf("Unexpect JSON: %s", json)
 	}
+
+	json, ok = statsToJson(logger, &serverStats{Total: 1, Average: 2, Callbacks: &callbackStats{Delivered: 1}})
+	if !ok {
+		t.Error("Expected ok")
+	} else if string(json) != `{"total":1,"average":2,"callbacks":{"delivered":1,"retried":0,"failed":0,"pending":0}}` {
+		t.Errorf("Unexpect JSON: %s", json)
+	}
+
+	json, ok = statsToJson(logger, &serverStats{Total: 3, Average: 2, Latency: &latencyPercentiles{P50: 1, P90: 2, P99: 3, P999: 4, Max: 5}})
+	if !ok {
+		t.Error("Expected ok")
+	} else if string(json) != `{"total":3,"average":2,"latency":{"p50":1,"p90":2,"p99":3,"p999":4,"max":5}}` {
+		t.Errorf("Unexpect JSON: %s", json)
+	}
 }
 
 func Test_logWriteError(t *testing.T) {
@@ -63,3 +78,72 @@ func Test_stopErrorResponse(t *testing.T) {
 		t.Errorf("Unexpected code, got %d", w.Code)
 	}
 }
+
+func Test_forbiddenErrorResponse(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := log.New(buf, "", 0)
+	w := httptest.NewRecorder()
+	forbiddenErrorResponse(logger, w)
+
+	if w.Body.String() != "Forbidden" {
+		t.Errorf("Unexpected body, got %s", w.Body.String())
+	}
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Unexpected code, got %d", w.Code)
+	}
+}
+
+func Test_goneErrorResponse(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := log.New(buf, "", 0)
+	w := httptest.NewRecorder()
+	goneErrorResponse(logger, w, "Expired")
+
+	if w.Body.String() != "Expired" {
+		t.Errorf("Unexpected body, got %s", w.Body.String())
+	}
+	if w.Code != http.StatusGone {
+		t.Errorf("Unexpected code, got %d", w.Code)
+	}
+}
+
+func Test_requestToken(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "/hash/1?token=query", nil)
+	if token := requestToken(r); token != "query" {
+		t.Errorf("Expected token from the query, got %s", token)
+	}
+	r.Header.Set("Authorization", "Bearer header")
+	if token := requestToken(r); token != "header" {
+		t.Errorf("Expected token from the header, got %s", token)
+	}
+	if token := requestToken(&http.Request{}); token != "" {
+		t.Errorf("Expected no token, got %s", token)
+	}
+}
+
+func Test_parseDuration(t *testing.T) {
+	for value, expected := range map[string]time.Duration{"90": 90 * time.Second, "1m30s": 90 * time.Second, "-5": -5 * time.Second} {
+		if d, err := parseDuration(value); err != nil || d != expected {
+			t.Errorf("Unexpected duration for %s: %v %v", value, d, err)
+		}
+	}
+	for _, value := range []string{"", "bogus", "99999999999999999"} {
+		if _, err := parseDuration(value); err == nil {
+			t.Errorf("Expected %s to fail", value)
+		}
+	}
+}
+
+func Test_storeFullErrorResponse(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := log.New(buf, "", 0)
+	w := httptest.NewRecorder()
+	storeFullErrorResponse(logger, w)
+
+	if w.Body.String() != "Store Full" {
+		t.Errorf("Unexpected body, got %s", w.Body.String())
+	}
+	if w.Code != http.StatusInsufficientStorage {
+		t.Errorf("Unexpected code, got %d", w.Code)
+	}
+}
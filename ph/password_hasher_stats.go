@@ -2,6 +2,10 @@ package ph
 
 import (
 	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -10,58 +14,169 @@ import (
 type passwordHasherStater interface {
 	accumulateTiming(elapsed time.Duration)
 	generateStats() (total int64, avg int64)
+	timingStats() *timingStats
+	latencyPercentiles() *latencyPercentiles
+	accumulateRequest(elapsed time.Duration, status int)
+	windowStats() *windowStats
+	registerMetrics(registry *metricRegistry)
 	startAccumulating()
 	stopAccumulating()
 }
 
 type microseconds int64
 
+// timingStats summarize the timings of the password hashing operations in microseconds, as reported by the
+// stats endpoint. The variance is that of the population of timings.
+type timingStats struct {
+	Count    int64   `json:"count"`
+	Sum      int64   `json:"sum"`
+	Min      int64   `json:"min"`
+	Max      int64   `json:"max"`
+	Mean     float64 `json:"mean"`
+	Variance float64 `json:"variance"`
+}
+
+// timingAggregates are streaming aggregates of timings, taking the same memory whatever their number.
+// The mean and variance are updated with Welford's method, which stays accurate over many timings.
+type timingAggregates struct {
+	count int64
+	sum   microseconds
+	min   microseconds
+	max   microseconds
+	mean  float64
+	m2    float64 // sum of squared differences from the mean
+}
+
+// add accumulates a single timing.
+func (aggregates *timingAggregates) add(ms microseconds) {
+	aggregates.count++
+	aggregates.sum += ms
+	if aggregates.count == 1 || ms < aggregates.min {
+		aggregates.min = ms
+	}
+	if ms > aggregates.max {
+		aggregates.max = ms
+	}
+	delta := float64(ms) - aggregates.mean
+	aggregates.mean += delta / float64(aggregates.count)
+	aggregates.m2 += delta * (float64(ms) - aggregates.mean)
+}
+
+// variance returns the population variance of the timings, or 0 without any.
+func (aggregates *timingAggregates) variance() float64 {
+	if aggregates.count == 0 {
+		return 0
+	}
+	return math.Max(aggregates.m2/float64(aggregates.count), 0)
+}
+
 // passwordHasherStats accumulates the stats for the password hashing operations.
-// These stats include the total number of operations as well as their individual timings in microseconds.
-// FIXME: There's currently no strategy to rotate or purge the accumulated timings.
-//        This accumulation is a risk and makes the service prone to Denial of Service due to exhausted memory.
+// These stats include the total number of operations as well as aggregates and a histogram of their timings in
+// microseconds, so memory stays constant however many operations there are.
 type passwordHasherStats struct {
-	queue  chan microseconds
-	times  []microseconds
-	lock   sync.RWMutex
-	logger *log.Logger
+	queue     chan microseconds
+	timings   timingAggregates
+	latencies latencyHistogram
+	windows   *requestWindows
+	requests  map[int]int64
+	lock      sync.RWMutex
+	running   sync.WaitGroup
+	logger    *log.Logger
 }
 
 // newPasswordHasherStats returns a new stats controller.
 func newPasswordHasherStats(logger *log.Logger) *passwordHasherStats {
 	return &passwordHasherStats{
-		queue:  make(chan microseconds, 1),
-		times:  make([]microseconds, 0),
-		logger: logger,
+		queue:    make(chan microseconds, 1),
+		windows:  newRequestWindows(time.Now),
+		requests: make(map[int]int64),
+		logger:   logger,
 	}
 }
 
 // accumulateTiming stores the timing of a single password hash operation.
 func (phStats *passwordHasherStats) accumulateTiming(elapsed time.Duration) {
-	// TODO: This shouldn't block, unless storing states gets slow (too many entries?)
-	//       Consider increasing the channel capacity - or make storing faster
+	// TODO: This shouldn't block, unless accumulating gets slow - consider increasing the channel capacity
 	phStats.queue <- microseconds(elapsed.Microseconds())
 }
 
 // generateStats returns the total number of operations and their average timing in microseconds.
 func (phStats *passwordHasherStats) generateStats() (total int64, avg int64) {
-	// Lock ensures that the total won't change during the loop
 	defer phStats.lock.RUnlock()
 	phStats.lock.RLock()
-	if len(phStats.times) == 0 {
+	if phStats.timings.count == 0 {
 		return
 	}
-	var accumulated microseconds
-	for _, ms := range phStats.times {
-		accumulated += ms
+	return phStats.timings.count, int64(phStats.timings.sum) / phStats.timings.count
+}
+
+// timingStats returns the count, sum, min, max, mean and variance of the timings in microseconds.
+func (phStats *passwordHasherStats) timingStats() *timingStats {
+	defer phStats.lock.RUnlock()
+	phStats.lock.RLock()
+	return &timingStats{
+		Count:    phStats.timings.count,
+		Sum:      int64(phStats.timings.sum),
+		Min:      int64(phStats.timings.min),
+		Max:      int64(phStats.timings.max),
+		Mean:     phStats.timings.mean,
+		Variance: phStats.timings.variance(),
+	}
+}
+
+// latencyPercentiles returns the p50, p90, p99, p99.9 and max of the timings in microseconds.
+func (phStats *passwordHasherStats) latencyPercentiles() *latencyPercentiles {
+	defer phStats.lock.RUnlock()
+	phStats.lock.RLock()
+	return phStats.latencies.percentiles()
+}
+
+// accumulateRequest counts a hash request by the status it was answered with, and in the recent windows, as
+// failed if answered with a server error. Unlike timings, requests are counted right away, without going through
+// the queue.
+func (phStats *passwordHasherStats) accumulateRequest(elapsed time.Duration, status int) {
+	phStats.windows.record(elapsed, status >= http.StatusInternalServerError)
+	phStats.lock.Lock()
+	phStats.requests[status]++
+	phStats.lock.Unlock()
+}
+
+// windowStats returns the rates and timings of the hash requests over the last 1, 5 and 15 minutes.
+func (phStats *passwordHasherStats) windowStats() *windowStats {
+	return phStats.windows.stats()
+}
+
+// registerMetrics registers the hash requests by status, and the histogram of the hashing times.
+func (phStats *passwordHasherStats) registerMetrics(registry *metricRegistry) {
+	registry.register(phStats.collectMetrics)
+}
+
+// collectMetrics returns the hash requests by status, and the histogram of the hashing times.
+func (phStats *passwordHasherStats) collectMetrics() []metricFamily {
+	defer phStats.lock.RUnlock()
+	phStats.lock.RLock()
+	requests := metricFamily{name: "password_hasher_requests_total", help: "Hash requests by status code.", kind: counterMetric}
+	statuses := make([]int, 0, len(phStats.requests))
+	for status := range phStats.requests {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		requests.samples = append(requests.samples, metricSample{
+			labels: []metricLabel{{"code", strconv.Itoa(status)}},
+			value:  float64(phStats.requests[status]),
+		})
+	}
+	return []metricFamily{
+		requests,
+		histogramMetricFamily("password_hasher_hash_duration_seconds", "Time taken to hash and store passwords.",
+			&phStats.latencies, phStats.timings.sum),
 	}
-	// coincidentally, len = total, since we never purge timings
-	total = int64(len(phStats.times))
-	return total, int64(accumulated) / total
 }
 
 // accumulateStats actually accumulate timings sent by accumulateTiming.
 func (phStats *passwordHasherStats) accumulateStats() {
+	defer phStats.running.Done()
 	phStats.logger.Print("Collecting stats...")
 	ok := true
 	for ok {
@@ -69,9 +184,10 @@ func (phStats *passwordHasherStats) accumulateStats() {
 		if ms, ok = <-phStats.queue; ok {
 			phStats.logger.Printf("Elapsed time: %dms", ms)
 
-			// block reads while appending/resizing/reallocating
+			// block reads while updating the aggregates together
 			phStats.lock.Lock()
-			phStats.times = append(phStats.times, ms)
+			phStats.timings.add(ms)
+			phStats.latencies.record(ms)
 			phStats.lock.Unlock()
 		}
 	}
@@ -80,10 +196,12 @@ func (phStats *passwordHasherStats) accumulateStats() {
 
 // startAccumulating begins to accumulate timings.
 func (phStats *passwordHasherStats) startAccumulating() {
+	phStats.running.Add(1)
 	go phStats.accumulateStats()
 }
 
-// stopAccumulating interrupts the accumulation of timings.
+// stopAccumulating interrupts the accumulation of timings, waiting for the ones already queued.
 func (phStats *passwordHasherStats) stopAccumulating() {
 	close(phStats.queue)
+	phStats.running.Wait()
 }
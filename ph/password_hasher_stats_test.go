@@ -3,6 +3,7 @@ package ph
 import (
 	"bytes"
 	"log"
+	"math"
 	"testing"
 	"time"
 )
@@ -12,8 +13,8 @@ func Test_newPasswordHasherStats(t *testing.T) {
 	if stats.queue == nil {
 		t.Error("Queue expected to not be nil")
 	}
-	if stats.times == nil {
-		t.Error("Times expected to not be nil")
+	if stats.timings.count != 0 {
+		t.Error("Timings expected to be empty")
 	}
 
 	// Enforce channel len 1
@@ -74,9 +75,9 @@ func Test_accumulateTiming(t *testing.T) {
 	stats.accumulateTiming(time.Microsecond * 3)
 	forceGoroutineScheduler()
 
-	if len(stats.times) != 1 {
+	if stats.timings.count != 1 {
 		t.Error("Expected one timing accumulated")
-	} else if stats.times[0] != 3 {
+	} else if stats.timings.sum != 3 {
 		t.Error("Expected accumulated timing to be 3 ms")
 	} else if buf.String() != "Elapsed time: 3ms\n" {
 		t.Errorf("Expected logged timing to be 3 ms: %s", buf.String())
@@ -110,5 +111,38 @@ func Test_generateStats(t *testing.T) {
 	} else if avg != 5 {
 		t.Error("Expected average timing to be 5 ms")
 	}
+	if percentiles := stats.latencyPercentiles(); percentiles.P50 != 3 || percentiles.Max != 7 {
+		t.Errorf("Unexpected percentiles: %+v", percentiles)
+	}
 	stats.stopAccumulating()
 }
+
+func Test_timingStats(t *testing.T) {
+	stats := newPasswordHasherStats(nil)
+	if timing := stats.timingStats(); *timing != (timingStats{}) {
+		t.Errorf("Unexpected values for blank stats: %+v", timing)
+	}
+	for _, ms := range []microseconds{2, 4, 4, 4, 5, 5, 7, 9} {
+		stats.timings.add(ms)
+	}
+	timing := stats.timingStats()
+	if *timing != (timingStats{Count: 8, Sum: 40, Min: 2, Max: 9, Mean: 5, Variance: 4}) {
+		t.Errorf("Unexpected stats: %+v", timing)
+	}
+}
+
+func Test_timingStatsAccuracy(t *testing.T) {
+	// a large offset makes the naive sum of squares lose the variance to rounding
+	stats := newPasswordHasherStats(nil)
+	const offset = 1 << 40
+	for i := 0; i < 1000000; i++ {
+		stats.timings.add(offset + microseconds(i%2))
+	}
+	timing := stats.timingStats()
+	if timing.Mean != offset+0.5 || math.Abs(timing.Variance-0.25) > 1e-6 {
+		t.Errorf("Expected mean and variance to stay accurate, got %v %v", timing.Mean, timing.Variance)
+	}
+	if stats.timings.count != 1000000 || timing.Min != offset || timing.Max != offset+1 {
+		t.Errorf("Unexpected stats: %+v", timing)
+	}
+}
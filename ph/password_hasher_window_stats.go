@@ -0,0 +1,105 @@
+package ph
+
+import (
+	"sync"
+	"time"
+)
+
+// windowSeconds is how many per-second buckets are kept, enough for the longest window.
+const windowSeconds = 15 * 60
+
+// windowSummary is the activity of hash requests over a recent window, as reported by the stats endpoint:
+// how many requests there were per second, which fraction of them failed with a server error, and their average
+// and max timings in microseconds.
+type windowSummary struct {
+	Requests    int64   `json:"requests"`
+	Errors      int64   `json:"errors"`
+	RequestRate float64 `json:"request_rate"`
+	ErrorRate   float64 `json:"error_rate"`
+	Average     int64   `json:"average"`
+	Max         int64   `json:"max"`
+}
+
+// windowStats are the summaries of the last 1, 5 and 15 minutes, as reported by the stats endpoint.
+type windowStats struct {
+	OneMinute      *windowSummary `json:"1m"`
+	FiveMinutes    *windowSummary `json:"5m"`
+	FifteenMinutes *windowSummary `json:"15m"`
+}
+
+// windowBucket counts the requests of a single second.
+type windowBucket struct {
+	second   int64
+	requests int64
+	errors   int64
+	sum      microseconds
+	max      microseconds
+}
+
+// requestWindows keeps a ring of per-second buckets over the last 15 minutes, each reused once the second it
+// counted falls out of the ring, so memory stays constant and summaries take the same time whatever the traffic.
+type requestWindows struct {
+	lock    sync.Mutex
+	buckets [windowSeconds]windowBucket
+	now     func() time.Time
+}
+
+// newRequestWindows creates empty windows, using the given clock.
+func newRequestWindows(now func() time.Time) *requestWindows {
+	return &requestWindows{now: now}
+}
+
+// record counts a request completed now, telling whether it failed.
+func (windows *requestWindows) record(elapsed time.Duration, failed bool) {
+	defer windows.lock.Unlock()
+	windows.lock.Lock()
+	second := windows.now().Unix()
+	bucket := &windows.buckets[second%windowSeconds]
+	if bucket.second != second {
+		*bucket = windowBucket{second: second}
+	}
+	ms := microseconds(elapsed.Microseconds())
+	bucket.requests++
+	if failed {
+		bucket.errors++
+	}
+	bucket.sum += ms
+	if ms > bucket.max {
+		bucket.max = ms
+	}
+}
+
+// summary sums up the requests of the last given seconds, the current one included.
+func (windows *requestWindows) summary(seconds int64) *windowSummary {
+	defer windows.lock.Unlock()
+	windows.lock.Lock()
+	now := windows.now().Unix()
+	summary := &windowSummary{}
+	var sum microseconds
+	for _, bucket := range windows.buckets {
+		if bucket.second > now || now-bucket.second >= seconds {
+			continue
+		}
+		summary.Requests += bucket.requests
+		summary.Errors += bucket.errors
+		sum += bucket.sum
+		if int64(bucket.max) > summary.Max {
+			summary.Max = int64(bucket.max)
+		}
+	}
+	summary.RequestRate = float64(summary.Requests) / float64(seconds)
+	if summary.Requests > 0 {
+		summary.ErrorRate = float64(summary.Errors) / float64(summary.Requests)
+		summary.Average = int64(sum) / summary.Requests
+	}
+	return summary
+}
+
+// stats returns the summaries of the last 1, 5 and 15 minutes.
+func (windows *requestWindows) stats() *windowStats {
+	return &windowStats{
+		OneMinute:      windows.summary(60),
+		FiveMinutes:    windows.summary(5 * 60),
+		FifteenMinutes: windows.summary(15 * 60),
+	}
+}
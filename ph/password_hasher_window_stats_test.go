@@ -0,0 +1,91 @@
+package ph
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_requestWindows(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	windows := newRequestWindows(func() time.Time { return now })
+	if stats := windows.stats(); *stats.OneMinute != (windowSummary{}) || *stats.FifteenMinutes != (windowSummary{}) {
+		t.Errorf("Unexpected stats without requests: %+v", stats)
+	}
+
+	// 10 minutes ago, then 2 minutes ago, then now
+	now = now.Add(-10 * time.Minute)
+	windows.record(900*time.Microsecond, true)
+	now = now.Add(8 * time.Minute)
+	windows.record(100*time.Microsecond, false)
+	windows.record(300*time.Microsecond, true)
+	now = now.Add(2 * time.Minute)
+	for i := 0; i < 6; i++ {
+		windows.record(200*time.Microsecond, i == 0)
+	}
+
+	stats := windows.stats()
+	if *stats.OneMinute != (windowSummary{Requests: 6, Errors: 1, RequestRate: 0.1, ErrorRate: 1.0 / 6, Average: 200, Max: 200}) {
+		t.Errorf("Unexpected 1m stats: %+v", stats.OneMinute)
+	}
+	if *stats.FiveMinutes != (windowSummary{Requests: 8, Errors: 2, RequestRate: 8.0 / 300, ErrorRate: 0.25, Average: 200, Max: 300}) {
+		t.Errorf("Unexpected 5m stats: %+v", stats.FiveMinutes)
+	}
+	if *stats.FifteenMinutes != (windowSummary{Requests: 9, Errors: 3, RequestRate: 0.01, ErrorRate: 3.0 / 9, Average: 277, Max: 900}) {
+		t.Errorf("Unexpected 15m stats: %+v", stats.FifteenMinutes)
+	}
+
+	// buckets are reused once their second falls out of the ring
+	now = now.Add(5 * time.Minute)
+	windows.record(50*time.Microsecond, false)
+	stats = windows.stats()
+	if stats.OneMinute.Requests != 1 || stats.FiveMinutes.Requests != 1 || stats.FifteenMinutes.Requests != 9 {
+		t.Errorf("Unexpected stats once older requests slid out: %+v %+v %+v", stats.OneMinute, stats.FiveMinutes, stats.FifteenMinutes)
+	}
+	now = now.Add(10 * time.Minute)
+	if stats := windows.stats(); stats.FifteenMinutes.Requests != 1 {
+		t.Errorf("Expected only the latest request within 15 minutes, got %+v", stats.FifteenMinutes)
+	}
+	if bucket := windows.buckets[now.Add(-15*time.Minute).Unix()%windowSeconds]; bucket.requests != 6 {
+		t.Errorf("Expected stale bucket to stay until reused, got %+v", bucket)
+	}
+	windows.record(10*time.Microsecond, false)
+	if bucket := windows.buckets[now.Unix()%windowSeconds]; bucket.requests != 1 || bucket.second != now.Unix() {
+		t.Errorf("Expected stale bucket to be reset when reused, got %+v", bucket)
+	}
+}
+
+func Test_hashWindowed(t *testing.T) {
+	server := NewPasswordHasherServer(log.New(&bytes.Buffer{}, "", 0), WithStore(&failingStore{}),
+		WithIdStrategy(SequentialIds, 0))
+	stats := server.phStats.(*passwordHasherStats)
+	now := time.Unix(1600000000, 0)
+	stats.windows.now = func() time.Time { return now }
+
+	for _, form := range []string{"password=angryMonkey", "password=angryMonkey&ttl=never"} {
+		r, err := http.NewRequest(http.MethodPost, "/hash", strings.NewReader(form))
+		if err != nil {
+			panic(err)
+		}
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		server.http.Handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	// a failing store is a server error, an invalid ttl is not
+	if summary := stats.windowStats().OneMinute; summary.Requests != 2 || summary.Errors != 1 {
+		t.Errorf("Unexpected stats: %+v", summary)
+	}
+
+	r, err := http.NewRequest(http.MethodGet, "/stats", nil)
+	if err != nil {
+		panic(err)
+	}
+	w := httptest.NewRecorder()
+	server.http.Handler.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), `"windows":{"1m":{"requests":2,"errors":1,`) {
+		t.Errorf("Unexpected stats: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,187 @@
+// Package storetest checks that a ph.Store behaves as the service expects, for any backend to run in its tests:
+//
+//	func Test_myStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) ph.Store { return newMyStore(t) })
+//	}
+package storetest
+
+import (
+	"context"
+	"errors"
+	"github.com/ricardofandrade/password-hasher/ph"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// availableTimeout bounds how long a hash without delay may take to become available.
+const availableTimeout = 2 * time.Second
+
+// Run runs every check, each against a fresh and empty store created by newStore, and closed once done.
+func Run(t *testing.T, newStore func(t *testing.T) ph.Store) {
+	checks := []struct {
+		name  string
+		check func(t *testing.T, store ph.Store)
+	}{
+		{"PutGet", checkPutGet},
+		{"NotFound", checkNotFound},
+		{"Pending", checkPending},
+		{"Delete", checkDelete},
+		{"DeletePending", checkDeletePending},
+		{"Expiry", checkExpiry},
+		{"Context", checkContext},
+		{"Concurrent", checkConcurrent},
+	}
+	for _, c := range checks {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			store := newStore(t)
+			c.check(t, store)
+			if err := store.Close(); err != nil {
+				t.Errorf("Expected store to close, got %v", err)
+			}
+		})
+	}
+}
+
+// put stores a hash, failing the test if it cannot.
+func put(t *testing.T, store ph.Store, id string, hashed string, options ph.PutOptions) {
+	t.Helper()
+	if err := store.Put(context.Background(), id, hashed, options); err != nil {
+		t.Fatalf("Expected %s to be stored, got %v", id, err)
+	}
+}
+
+// waitAvailable gets a hash once no longer pending, failing the test if it takes too long.
+func waitAvailable(t *testing.T, store ph.Store, id string) (string, error) {
+	t.Helper()
+	deadline := time.Now().Add(availableTimeout)
+	for {
+		hashed, err := store.Get(context.Background(), id)
+		if !errors.Is(err, ph.ErrPending) {
+			return hashed, err
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s to become available within %v", id, availableTimeout)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// expectGone checks that the id is deleted, or unknown for stores not remembering deleted ids.
+func expectGone(t *testing.T, err error, id string) {
+	t.Helper()
+	if !errors.Is(err, ph.ErrDeleted) && !errors.Is(err, ph.ErrNotFound) {
+		t.Errorf("Expected %s to be deleted, got %v", id, err)
+	}
+}
+
+func checkPutGet(t *testing.T, store ph.Store) {
+	put(t, store, "1", "hash-1", ph.PutOptions{})
+	put(t, store, "2", "hash-2", ph.PutOptions{TTL: time.Hour})
+	for id, expected := range map[string]string{"1": "hash-1", "2": "hash-2"} {
+		if hashed, err := waitAvailable(t, store, id); hashed != expected || err != nil {
+			t.Errorf("Expected %s to be %s, got %q %v", id, expected, hashed, err)
+		}
+	}
+}
+
+func checkNotFound(t *testing.T, store ph.Store) {
+	if _, err := store.Get(context.Background(), "1"); !errors.Is(err, ph.ErrNotFound) {
+		t.Errorf("Expected unknown id not to be found, got %v", err)
+	}
+	if err := store.Delete(context.Background(), "1"); !errors.Is(err, ph.ErrNotFound) {
+		t.Errorf("Expected deleting unknown id not to find it, got %v", err)
+	}
+}
+
+func checkPending(t *testing.T, store ph.Store) {
+	put(t, store, "1", "hash-1", ph.PutOptions{Delay: time.Hour})
+	put(t, store, "2", "hash-2", ph.PutOptions{Delay: 100 * time.Millisecond})
+	for _, id := range []string{"1", "2"} {
+		if hashed, err := store.Get(context.Background(), id); !errors.Is(err, ph.ErrPending) || hashed != "" {
+			t.Errorf("Expected %s to be pending, got %q %v", id, hashed, err)
+		}
+	}
+	if hashed, err := waitAvailable(t, store, "2"); hashed != "hash-2" || err != nil {
+		t.Errorf("Expected hash to become available once its delay is over, got %q %v", hashed, err)
+	}
+	if _, err := store.Get(context.Background(), "1"); !errors.Is(err, ph.ErrPending) {
+		t.Errorf("Expected hash to wait out its whole delay, got %v", err)
+	}
+}
+
+func checkDelete(t *testing.T, store ph.Store) {
+	put(t, store, "1", "hash-1", ph.PutOptions{})
+	waitAvailable(t, store, "1")
+	if err := store.Delete(context.Background(), "1"); err != nil {
+		t.Errorf("Expected hash to be deleted, got %v", err)
+	}
+	hashed, err := store.Get(context.Background(), "1")
+	expectGone(t, err, "1")
+	if hashed != "" {
+		t.Errorf("Expected no hash once deleted, got %q", hashed)
+	}
+	expectGone(t, store.Delete(context.Background(), "1"), "1")
+}
+
+func checkDeletePending(t *testing.T, store ph.Store) {
+	put(t, store, "1", "hash-1", ph.PutOptions{Delay: 50 * time.Millisecond})
+	if err := store.Delete(context.Background(), "1"); err != nil {
+		t.Errorf("Expected pending hash to be deleted, got %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	_, err := store.Get(context.Background(), "1")
+	expectGone(t, err, "1")
+}
+
+func checkExpiry(t *testing.T, store ph.Store) {
+	put(t, store, "1", "hash-1", ph.PutOptions{TTL: 200 * time.Millisecond})
+	waitAvailable(t, store, "1")
+	time.Sleep(250 * time.Millisecond)
+	hashed, err := store.Get(context.Background(), "1")
+	if !errors.Is(err, ph.ErrExpired) && !errors.Is(err, ph.ErrNotFound) {
+		t.Errorf("Expected hash to expire, got %v", err)
+	}
+	if hashed != "" {
+		t.Errorf("Expected no hash once expired, got %q", hashed)
+	}
+}
+
+func checkContext(t *testing.T, store ph.Store) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := store.Put(ctx, "1", "hash-1", ph.PutOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected put to fail with the context, got %v", err)
+	}
+	if _, err := store.Get(ctx, "1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected get to fail with the context, got %v", err)
+	}
+	if err := store.Delete(ctx, "1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected delete to fail with the context, got %v", err)
+	}
+}
+
+func checkConcurrent(t *testing.T, store ph.Store) {
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := store.Put(context.Background(), id, "hash-"+id, ph.PutOptions{}); err != nil {
+				t.Errorf("Expected %s to be stored, got %v", id, err)
+			}
+			if _, err := store.Get(context.Background(), id); err != nil && !errors.Is(err, ph.ErrPending) {
+				t.Errorf("Expected %s to be found, got %v", id, err)
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+	for i := 1; i <= 20; i++ {
+		id := strconv.Itoa(i)
+		if hashed, err := waitAvailable(t, store, id); hashed != "hash-"+id || err != nil {
+			t.Errorf("Expected %s to be stored, got %q %v", id, hashed, err)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package storetest
+
+import (
+	"github.com/ricardofandrade/password-hasher/ph"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func Test_memoryStore(t *testing.T) {
+	Run(t, func(t *testing.T) ph.Store {
+		return ph.NewMemoryStore(log.New(ioutil.Discard, "", 0))
+	})
+}
@@ -3,7 +3,7 @@ export PATH=${PATH}:`go env GOPATH`/bin
 go build && go install
 killall password-hasher
 
-password-hasher &
+password-hasher -id-strategy sequential &
 pid=$!
 
 stats=$(curl --silent 'http://localhost:8090/stats')